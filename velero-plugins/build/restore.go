@@ -1,13 +1,29 @@
 package build
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	buildv1API "github.com/openshift/api/build/v1"
+	buildv1client "github.com/openshift/client-go/build/clientset/versioned/typed/build/v1"
 	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
+// BuildsPerBuildConfigEnvVar is the environment variable setting how many of
+// the most recent builds of each buildconfig are restored, unless the restore
+// sets the openshift.io/restore-builds-per-buildconfig annotation
+const BuildsPerBuildConfigEnvVar = "RESTORE_BUILDS_PER_BUILDCONFIG"
+
 // RestorePlugin is a restore item action plugin for Velero
 type RestorePlugin struct {
 	Log logrus.FieldLogger
@@ -22,9 +38,186 @@ func (p *RestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 
 // Execute action for the restore plugin for the build resource
 func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
-	p.Log.Info("[build-restore] Skipping restore of build to allow buildconfig to recreate it")
-	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	if input.Restore.Annotations[common.RestoreBuildsAnnotation] != "true" {
+		p.Log.Info("[build-restore] Skipping restore of build to allow buildconfig to recreate it")
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	build := buildv1API.Build{}
+	itemMarshal, _ := json.Marshal(input.Item)
+	json.Unmarshal(itemMarshal, &build)
+	backupBuild := buildv1API.Build{}
+	itemMarshal, _ = json.Marshal(input.ItemFromBackup)
+	json.Unmarshal(itemMarshal, &backupBuild)
+
+	// velero drops the owner references of the item it restores
+	if name := owningBuildConfig(backupBuild); len(name) > 0 {
+		client, err := clients.BuildClient()
+		if err != nil {
+			return nil, err
+		}
+		buildConfig, err := restoredBuildConfig(client, common.MappedNamespace(input.Restore, build.Namespace), name)
+		if err != nil {
+			return nil, err
+		}
+		if buildConfig == nil {
+			p.Log.Infof("[build-restore] Skipping restore of build %s, its buildconfig %s is not restored", build.Name, name)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		if limit := buildsPerBuildConfig(input.Restore); limit > 0 && !IsRecentBuild(build, *buildConfig, limit) {
+			p.Log.Infof("[build-restore] Skipping restore of build %s, older than the %d most recent builds of its buildconfig", build.Name, limit)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		build.OwnerReferences = restoredOwnerReferences(backupBuild, *buildConfig)
+	}
+
+	p.Log.Infof("[build-restore] Restoring build %s with its status", build.Name)
+	build.Status = restoredStatus(backupBuild.Status)
+
+	registry, backupRegistry, err := RestoreRegistries(build.ObjectMeta, p.Log)
+	if err != nil {
+		return nil, err
+	}
+	namespaceMapping := input.Restore.Spec.NamespaceMapping
+	build.Spec.CommonSpec, err = updateImageReferences(build.Spec.CommonSpec, registry, backupRegistry, p.Log, namespaceMapping)
+	if err != nil {
+		p.Log.Error("[build-restore] error modifying build: ", err)
+		return nil, err
+	}
+	if output := build.Status.OutputDockerImageReference; len(output) > 0 && len(registry) > 0 && len(backupRegistry) > 0 {
+		if newOutput, err := common.ReplaceImageRefPrefix(output, backupRegistry, registry, namespaceMapping); err == nil {
+			build.Status.OutputDockerImageReference = newOutput
+		}
+	}
+
+	var out map[string]interface{}
+	objrec, _ := json.Marshal(build)
+	json.Unmarshal(objrec, &out)
+
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: out}), nil
+}
+
+// buildsPerBuildConfig returns the number of most recent builds restored per
+// buildconfig. The restore annotation takes precedence over the environment
+// variable, and a value of 0 restores all builds.
+func buildsPerBuildConfig(restore *v1.Restore) int {
+	value, found := restore.Annotations[common.RestoreBuildsPerBuildConfigAnnotation]
+	if !found {
+		value = os.Getenv(BuildsPerBuildConfigEnvVar)
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// owningBuildConfig returns the name of the buildconfig build was started
+// from, or "" if it wasn't started from one
+func owningBuildConfig(build buildv1API.Build) string {
+	for _, owner := range build.OwnerReferences {
+		if owner.Kind == "BuildConfig" {
+			return owner.Name
+		}
+	}
+	if name := build.Labels[buildv1API.BuildConfigLabel]; len(name) > 0 {
+		return name
+	}
+	return build.Annotations[buildv1API.BuildConfigAnnotation]
+}
+
+// restoredBuildConfig returns the buildconfig name of namespace, the namespace
+// the build is restored to, on this cluster, or nil if it doesn't exist.
+// Buildconfigs are restored before builds, so it doesn't exist if the restore
+// doesn't include it.
+func restoredBuildConfig(client buildv1client.BuildConfigsGetter, namespace, name string) (*buildv1API.BuildConfig, error) {
+	buildConfig, err := client.BuildConfigs(namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return buildConfig, err
+}
+
+// restoredOwnerReferences returns the buildconfig owner references of the
+// backed up build pointed at buildConfig, which has a different UID than on
+// the backup cluster, so the garbage collector doesn't delete the build
+func restoredOwnerReferences(backupBuild buildv1API.Build, buildConfig buildv1API.BuildConfig) []metav1.OwnerReference {
+	var owners []metav1.OwnerReference
+	for _, owner := range backupBuild.OwnerReferences {
+		if owner.Kind == "BuildConfig" && owner.Name == buildConfig.Name {
+			owner.UID = buildConfig.UID
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// IsRecentBuild returns false if build is older than the limit most recent
+// builds of buildConfig, going by the last version the restored buildconfig
+// had at backup time. Builds whose number or last version is unknown are
+// restored.
+func IsRecentBuild(build buildv1API.Build, buildConfig buildv1API.BuildConfig, limit int) bool {
+	number, err := strconv.ParseInt(build.Annotations[buildv1API.BuildNumberAnnotation], 10, 64)
+	if err != nil {
+		return true
+	}
+	lastVersion, err := strconv.ParseInt(buildConfig.Annotations[common.BackupLastBuildVersionAnnotation], 10, 64)
+	if err != nil {
+		return true
+	}
+	return recentBuildNumber(number, lastVersion, limit)
+}
 
+// recentBuildNumber returns whether build number is one of the limit most
+// recent builds of a buildconfig whose last build was number lastVersion
+func recentBuildNumber(number, lastVersion int64, limit int) bool {
+	return number > lastVersion-int64(limit)
+}
+
+// RestoreRegistries returns the internal registry hostnames of this cluster and
+// of the backup cluster for a restored build or buildconfig, looking the former
+// up if the common plugin has not annotated the item with it yet
+func RestoreRegistries(meta metav1.ObjectMeta, log logrus.FieldLogger) (string, string, error) {
+	registry := meta.Annotations[common.RestoreRegistryHostname]
+	backupRegistry := meta.Annotations[common.BackupRegistryHostname]
+	if len(registry) == 0 && len(backupRegistry) > 0 {
+		major, minor, err := common.GetServerVersion()
+		if err != nil {
+			return "", "", err
+		}
+		registry, err = common.GetRegistryInfo(major, minor, log)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return registry, backupRegistry, nil
+}
+
+// restoredStatus returns the status a build is restored with: the one it had
+// at backup time, with builds which had not finished marked as cancelled so
+// the build controller doesn't run them again
+func restoredStatus(status buildv1API.BuildStatus) buildv1API.BuildStatus {
+	switch status.Phase {
+	case buildv1API.BuildPhaseComplete, buildv1API.BuildPhaseFailed, buildv1API.BuildPhaseError, buildv1API.BuildPhaseCancelled:
+		return status
+	}
+	if len(status.Phase) > 0 {
+		status.Message = fmt.Sprintf("The build was %s when backed up and was cancelled on restore.", status.Phase)
+	} else {
+		status.Message = "The build was cancelled on restore."
+	}
+	status.Phase = buildv1API.BuildPhaseCancelled
+	status.Cancelled = true
+	return status
+}
+
+// MapNamespace returns ref with the namespace it names, if any, mapped by the
+// namespace mapping of the restore
+func MapNamespace(ref corev1API.ObjectReference, namespaceMapping map[string]string) corev1API.ObjectReference {
+	if newNamespace := namespaceMapping[ref.Namespace]; len(ref.Namespace) > 0 && len(newNamespace) > 0 {
+		ref.Namespace = newNamespace
+	}
+	return ref
 }
 
 func updateDockerReference(
@@ -34,6 +227,9 @@ func updateDockerReference(
 	log logrus.FieldLogger,
 	namespaceMapping map[string]string,
 ) (corev1API.ObjectReference, error) {
+	if fromRef.Kind == "ImageStreamTag" || fromRef.Kind == "ImageStreamImage" {
+		return MapNamespace(fromRef, namespaceMapping), nil
+	}
 	if fromRef.Kind != "DockerImage" {
 		return fromRef, nil
 	}
@@ -50,6 +246,20 @@ func updateDockerReference(
 	return fromRef, nil
 }
 
+// updateGeneratedSecret points a reference to a dockercfg secret generated for a
+// service account of the backed up namespace, e.g. builder-dockercfg-abc12, at
+// the one generated in the target namespace. If there is none, the reference is
+// dropped so the build uses the secrets of the builder service account.
+// References to other secrets are left as they are.
+func updateGeneratedSecret(secretRef *corev1API.LocalObjectReference, secretList *corev1API.SecretList, log logrus.FieldLogger) *corev1API.LocalObjectReference {
+	newSecret, err := common.UpdatePullSecret(secretRef, secretList, log)
+	if err != nil {
+		log.Infof("[build-restore-common] no secret replaces generated secret %s in the target namespace, dropping the reference", secretRef.Name)
+		return nil
+	}
+	return newSecret
+}
+
 // UpdateCommonSpec Updates docker references and secrets using CommonSpec, for both Build and BuildConfig
 func UpdateCommonSpec(
 	spec buildv1API.CommonSpec,
@@ -59,11 +269,30 @@ func UpdateCommonSpec(
 	log logrus.FieldLogger,
 	namespaceMapping map[string]string,
 ) (buildv1API.CommonSpec, error) {
-	newSecret, err := common.UpdatePullSecret(spec.Output.PushSecret, secretList, log)
-	if err != nil {
-		return spec, err
+	spec.Output.PushSecret = updateGeneratedSecret(spec.Output.PushSecret, secretList, log)
+	if spec.Strategy.SourceStrategy != nil {
+		spec.Strategy.SourceStrategy.PullSecret = updateGeneratedSecret(spec.Strategy.SourceStrategy.PullSecret, secretList, log)
+	}
+	if spec.Strategy.DockerStrategy != nil {
+		spec.Strategy.DockerStrategy.PullSecret = updateGeneratedSecret(spec.Strategy.DockerStrategy.PullSecret, secretList, log)
+	}
+	if spec.Strategy.CustomStrategy != nil {
+		spec.Strategy.CustomStrategy.PullSecret = updateGeneratedSecret(spec.Strategy.CustomStrategy.PullSecret, secretList, log)
 	}
-	spec.Output.PushSecret = newSecret
+	for i, imageSource := range spec.Source.Images {
+		spec.Source.Images[i].PullSecret = updateGeneratedSecret(imageSource.PullSecret, secretList, log)
+	}
+	return updateImageReferences(spec, registry, backupRegistry, log, namespaceMapping)
+}
+
+// updateImageReferences Updates docker references using CommonSpec
+func updateImageReferences(
+	spec buildv1API.CommonSpec,
+	registry string,
+	backupRegistry string,
+	log logrus.FieldLogger,
+	namespaceMapping map[string]string,
+) (buildv1API.CommonSpec, error) {
 	if spec.Output.To != nil {
 		newTo, err := updateDockerReference(*spec.Output.To, registry, backupRegistry, log, namespaceMapping)
 		if err != nil {
@@ -73,11 +302,6 @@ func UpdateCommonSpec(
 	}
 
 	if spec.Strategy.SourceStrategy != nil {
-		newSecret, err := common.UpdatePullSecret(spec.Strategy.SourceStrategy.PullSecret, secretList, log)
-		if err != nil {
-			return spec, err
-		}
-		spec.Strategy.SourceStrategy.PullSecret = newSecret
 		newFrom, err := updateDockerReference(spec.Strategy.SourceStrategy.From, registry, backupRegistry, log, namespaceMapping)
 		if err != nil {
 			return spec, err
@@ -85,45 +309,26 @@ func UpdateCommonSpec(
 		spec.Strategy.SourceStrategy.From = newFrom
 
 	}
-	if spec.Strategy.DockerStrategy != nil {
-		newSecret, err := common.UpdatePullSecret(spec.Strategy.DockerStrategy.PullSecret, secretList, log)
+	if spec.Strategy.DockerStrategy != nil && spec.Strategy.DockerStrategy.From != nil {
+		newFrom, err := updateDockerReference(*spec.Strategy.DockerStrategy.From, registry, backupRegistry, log, namespaceMapping)
 		if err != nil {
 			return spec, err
 		}
-		spec.Strategy.DockerStrategy.PullSecret = newSecret
-		if spec.Strategy.DockerStrategy.From != nil {
-			newFrom, err := updateDockerReference(*spec.Strategy.DockerStrategy.From, registry, backupRegistry, log, namespaceMapping)
-			if err != nil {
-				return spec, err
-			}
-			spec.Strategy.DockerStrategy.From = &newFrom
-		}
+		spec.Strategy.DockerStrategy.From = &newFrom
 	}
 	if spec.Strategy.CustomStrategy != nil {
-		newSecret, err := common.UpdatePullSecret(spec.Strategy.CustomStrategy.PullSecret, secretList, log)
-		if err != nil {
-			return spec, err
-		}
-		spec.Strategy.CustomStrategy.PullSecret = newSecret
 		newFrom, err := updateDockerReference(spec.Strategy.CustomStrategy.From, registry, backupRegistry, log, namespaceMapping)
 		if err != nil {
 			return spec, err
 		}
 		spec.Strategy.CustomStrategy.From = newFrom
 	}
-	if spec.Source.Images != nil {
-		for _, imageSource := range spec.Source.Images {
-			newSecret, err := common.UpdatePullSecret(imageSource.PullSecret, secretList, log)
-			if err != nil {
-				return spec, err
-			}
-			imageSource.PullSecret = newSecret
-			newFrom, err := updateDockerReference(imageSource.From, registry, backupRegistry, log, namespaceMapping)
-			if err != nil {
-				return spec, err
-			}
-			imageSource.From = newFrom
+	for i, imageSource := range spec.Source.Images {
+		newFrom, err := updateDockerReference(imageSource.From, registry, backupRegistry, log, namespaceMapping)
+		if err != nil {
+			return spec, err
 		}
+		spec.Source.Images[i].From = newFrom
 	}
-	return spec, err
+	return spec, nil
 }
@@ -1,15 +1,22 @@
 package build
 
 import (
+	"encoding/json"
+	"os"
 	"testing"
 
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
 	buildv1API "github.com/openshift/api/build/v1"
+	buildv1client "github.com/openshift/client-go/build/clientset/versioned/typed/build/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 func TestRestorePluginAppliesTo(t *testing.T) {
@@ -19,6 +26,245 @@ func TestRestorePluginAppliesTo(t *testing.T) {
 	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"builds"}}, actual)
 }
 
+func TestRestorePluginSkipsBuilds(t *testing.T) {
+	item := buildItem(t, buildv1API.Build{Status: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseComplete}})
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+}
+
+func TestRestorePluginRestoresBuilds(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.RestoreBuildsAnnotation: "true"}}}
+	statuses := map[string]struct {
+		backedUp buildv1API.BuildStatus
+		expected buildv1API.BuildStatus
+	}{
+		"complete": {
+			backedUp: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseComplete, OutputDockerImageReference: "registry/ns/app:latest"},
+			expected: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseComplete, OutputDockerImageReference: "registry/ns/app:latest"},
+		},
+		"failed": {
+			backedUp: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseFailed, Reason: buildv1API.StatusReasonGenericBuildFailed},
+			expected: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseFailed, Reason: buildv1API.StatusReasonGenericBuildFailed},
+		},
+		"running": {
+			backedUp: buildv1API.BuildStatus{Phase: buildv1API.BuildPhaseRunning},
+			expected: buildv1API.BuildStatus{
+				Phase:     buildv1API.BuildPhaseCancelled,
+				Cancelled: true,
+				Message:   "The build was Running when backed up and was cancelled on restore.",
+			},
+		},
+	}
+	for name, status := range statuses {
+		backupItem := buildItem(t, buildv1API.Build{ObjectMeta: metav1.ObjectMeta{Name: "app-1"}, Status: status.backedUp})
+		// velero resets the status of the item it restores
+		item := buildItem(t, buildv1API.Build{ObjectMeta: metav1.ObjectMeta{Name: "app-1"}})
+
+		restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: backupItem, Restore: restore})
+		require.NoError(t, err, name)
+		require.False(t, output.SkipRestore, name)
+
+		restored := buildv1API.Build{}
+		data, err := json.Marshal(output.UpdatedItem)
+		require.NoError(t, err, name)
+		require.NoError(t, json.Unmarshal(data, &restored), name)
+		assert.Equal(t, status.expected, restored.Status, name)
+	}
+}
+
+func TestRestorePluginRewritesBuildReferences(t *testing.T) {
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.RestoreBuildsAnnotation: "true"}},
+		Spec:       v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}},
+	}
+	build := buildv1API.Build{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "new-ns",
+			Annotations: map[string]string{
+				common.BackupRegistryHostname:  "docker-registry.default.svc:5000",
+				common.RestoreRegistryHostname: "image-registry.openshift-image-registry.svc:5000",
+			},
+		},
+		Spec: buildv1API.BuildSpec{
+			CommonSpec: buildv1API.CommonSpec{
+				Strategy: buildv1API.BuildStrategy{
+					DockerStrategy: &buildv1API.DockerBuildStrategy{
+						From: &corev1API.ObjectReference{Kind: "DockerImage", Name: "docker-registry.default.svc:5000/ns/base@sha256:1"},
+					},
+				},
+				Output: buildv1API.BuildOutput{
+					To: &corev1API.ObjectReference{Kind: "DockerImage", Name: "docker-registry.default.svc:5000/ns/app:latest"},
+				},
+			},
+		},
+	}
+	item := buildItem(t, build)
+	build.Status = buildv1API.BuildStatus{
+		Phase:                      buildv1API.BuildPhaseComplete,
+		OutputDockerImageReference: "docker-registry.default.svc:5000/ns/app:latest",
+	}
+	backupItem := buildItem(t, build)
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: backupItem, Restore: restore})
+	require.NoError(t, err)
+
+	restored := buildv1API.Build{}
+	data, err := json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/new-ns/base@sha256:1", restored.Spec.Strategy.DockerStrategy.From.Name)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/new-ns/app:latest", restored.Spec.Output.To.Name)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/new-ns/app:latest", restored.Status.OutputDockerImageReference)
+}
+
+func TestBuildsPerBuildConfig(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.RestoreBuildsPerBuildConfigAnnotation: "5"}}}
+	assert.Equal(t, 5, buildsPerBuildConfig(restore))
+	restore.Annotations[common.RestoreBuildsPerBuildConfigAnnotation] = "-1"
+	assert.Equal(t, 0, buildsPerBuildConfig(restore))
+
+	os.Setenv(BuildsPerBuildConfigEnvVar, "3")
+	defer os.Unsetenv(BuildsPerBuildConfigEnvVar)
+	assert.Equal(t, 3, buildsPerBuildConfig(&v1.Restore{}))
+}
+
+func TestRecentBuildNumber(t *testing.T) {
+	assert.True(t, recentBuildNumber(20, 20, 5))
+	assert.True(t, recentBuildNumber(16, 20, 5))
+	assert.False(t, recentBuildNumber(15, 20, 5))
+	assert.True(t, recentBuildNumber(1, 3, 5))
+}
+
+func TestIsRecentBuild(t *testing.T) {
+	buildConfig := buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{common.BackupLastBuildVersionAnnotation: "20"},
+	}}
+	build := func(number string) buildv1API.Build {
+		return buildv1API.Build{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{buildv1API.BuildNumberAnnotation: number}}}
+	}
+	assert.True(t, IsRecentBuild(build("18"), buildConfig, 5))
+	assert.False(t, IsRecentBuild(build("2"), buildConfig, 5))
+	assert.True(t, IsRecentBuild(build(""), buildConfig, 5))
+	assert.True(t, IsRecentBuild(build("2"), buildv1API.BuildConfig{}, 5))
+}
+
+func TestOwningBuildConfig(t *testing.T) {
+	assert.Equal(t, "", owningBuildConfig(buildv1API.Build{}))
+	assert.Equal(t, "app", owningBuildConfig(buildv1API.Build{ObjectMeta: metav1.ObjectMeta{
+		OwnerReferences: []metav1.OwnerReference{{Kind: "BuildConfig", Name: "app"}},
+	}}))
+	assert.Equal(t, "app", owningBuildConfig(buildv1API.Build{ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{buildv1API.BuildConfigLabel: "app"},
+	}}))
+}
+
+func TestRestoredOwnerReferences(t *testing.T) {
+	backupBuild := buildv1API.Build{ObjectMeta: metav1.ObjectMeta{
+		OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "build.openshift.io/v1", Kind: "BuildConfig", Name: "app", UID: "source-uid"},
+			{APIVersion: "v1", Kind: "ConfigMap", Name: "app", UID: "other-uid"},
+		},
+	}}
+	buildConfig := buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{Name: "app", UID: "target-uid"}}
+
+	assert.Equal(t, []metav1.OwnerReference{
+		{APIVersion: "build.openshift.io/v1", Kind: "BuildConfig", Name: "app", UID: "target-uid"},
+	}, restoredOwnerReferences(backupBuild, buildConfig))
+}
+
+// fakeBuildConfigs serves the buildconfigs of namespaces
+type fakeBuildConfigs struct {
+	buildv1client.BuildConfigInterface
+	namespace    string
+	buildConfigs map[string]map[string]*buildv1API.BuildConfig
+}
+
+func (f *fakeBuildConfigs) BuildConfigs(namespace string) buildv1client.BuildConfigInterface {
+	return &fakeBuildConfigs{namespace: namespace, buildConfigs: f.buildConfigs}
+}
+
+func (f *fakeBuildConfigs) Get(name string, options metav1.GetOptions) (*buildv1API.BuildConfig, error) {
+	if buildConfig, found := f.buildConfigs[f.namespace][name]; found {
+		return buildConfig.DeepCopy(), nil
+	}
+	return nil, k8serrors.NewNotFound(buildv1API.Resource("buildconfigs"), name)
+}
+
+func TestRestoredBuildConfigMappedNamespace(t *testing.T) {
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}}}
+	client := &fakeBuildConfigs{buildConfigs: map[string]map[string]*buildv1API.BuildConfig{
+		"ns":     {"app": {ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns", UID: "source-uid"}}},
+		"new-ns": {},
+	}}
+
+	// the buildconfig of the backup namespace isn't the restored one
+	buildConfig, err := restoredBuildConfig(client, common.MappedNamespace(restore, "ns"), "app")
+	require.NoError(t, err)
+	assert.Nil(t, buildConfig)
+
+	client.buildConfigs["new-ns"]["app"] = &buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "new-ns", UID: "target-uid"}}
+	buildConfig, err = restoredBuildConfig(client, common.MappedNamespace(restore, "ns"), "app")
+	require.NoError(t, err)
+	require.NotNil(t, buildConfig)
+	assert.Equal(t, "target-uid", string(buildConfig.UID))
+}
+
+func TestIsRecentBuildMappedNamespace(t *testing.T) {
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}}}
+	buildConfig := func(namespace, lastVersion string) *buildv1API.BuildConfig {
+		return &buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   namespace,
+			Annotations: map[string]string{common.BackupLastBuildVersionAnnotation: lastVersion},
+		}}
+	}
+	client := &fakeBuildConfigs{buildConfigs: map[string]map[string]*buildv1API.BuildConfig{
+		"ns":     {"app": buildConfig("ns", "20")},
+		"new-ns": {"app": buildConfig("new-ns", "6")},
+	}}
+	build := buildv1API.Build{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app-5",
+		Namespace:   "ns",
+		Annotations: map[string]string{buildv1API.BuildNumberAnnotation: "5"},
+	}}
+
+	// the cutoff comes from the restored buildconfig, not the one of the backup namespace
+	restored, err := restoredBuildConfig(client, common.MappedNamespace(restore, build.Namespace), "app")
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	assert.True(t, IsRecentBuild(build, *restored, 2))
+	assert.False(t, IsRecentBuild(build, *client.buildConfigs["ns"]["app"], 2))
+}
+
+func TestRestorePluginRestoresBuildsWithoutBuildConfig(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		common.RestoreBuildsAnnotation:               "true",
+		common.RestoreBuildsPerBuildConfigAnnotation: "1",
+	}}}
+	item := buildItem(t, buildv1API.Build{ObjectMeta: metav1.ObjectMeta{Name: "binary-1"}})
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+	assert.False(t, output.SkipRestore)
+}
+
+// buildItem returns build as an item to restore
+func buildItem(t *testing.T, build buildv1API.Build) *unstructured.Unstructured {
+	build.TypeMeta = metav1.TypeMeta{APIVersion: "build.openshift.io/v1", Kind: "Build"}
+	data, err := json.Marshal(build)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+	return item
+}
+
 func TestRestorePluginExecute(t *testing.T) {
 	t.Run("Test Execute() for build", func(t *testing.T) {
 		secretList := corev1API.SecretList{
@@ -57,4 +303,101 @@ func TestRestorePluginExecute(t *testing.T) {
 		assert.Equal(t, oldCustomSecret, build.Spec.Output.PushSecret)
 		assert.Equal(t, newDockercfgSecret, build.Spec.Strategy.SourceStrategy.PullSecret)
 	})
+
+	t.Run("Test Execute() for build without generated secrets in the target namespace", func(t *testing.T) {
+		secretList := corev1API.SecretList{}
+		oldDockercfgSecret := &corev1API.LocalObjectReference{Name: "builder-dockercfg-old"}
+		oldCustomSecret := &corev1API.LocalObjectReference{Name: "custom-old"}
+
+		spec := buildv1API.CommonSpec{
+			Strategy: buildv1API.BuildStrategy{
+				DockerStrategy: &buildv1API.DockerBuildStrategy{
+					PullSecret: oldCustomSecret,
+				},
+			},
+			Output: buildv1API.BuildOutput{
+				PushSecret: oldDockercfgSecret,
+			},
+		}
+
+		newCommonSpec, err := UpdateCommonSpec(spec, "registry", "backupRegistry", &secretList, test.NewLogger(), map[string]string{})
+		assert.Equal(t, err, nil)
+
+		assert.Nil(t, newCommonSpec.Output.PushSecret)
+		assert.Equal(t, oldCustomSecret, newCommonSpec.Strategy.DockerStrategy.PullSecret)
+	})
+
+	t.Run("Test Execute() for build with image sources", func(t *testing.T) {
+		secretList := corev1API.SecretList{
+			Items: []corev1API.Secret{
+				corev1API.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "default-dockercfg-new",
+					},
+				},
+			},
+		}
+
+		spec := buildv1API.CommonSpec{
+			Source: buildv1API.BuildSource{
+				Images: []buildv1API.ImageSource{
+					{
+						From:       corev1API.ObjectReference{Kind: "DockerImage", Name: "backupRegistry/ns/base:latest"},
+						PullSecret: &corev1API.LocalObjectReference{Name: "default-dockercfg-old"},
+					},
+					{
+						From:       corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "base:latest"},
+						PullSecret: &corev1API.LocalObjectReference{Name: "custom-old"},
+					},
+				},
+			},
+		}
+
+		newCommonSpec, err := UpdateCommonSpec(spec, "registry", "backupRegistry", &secretList, test.NewLogger(), map[string]string{})
+		assert.Equal(t, err, nil)
+
+		assert.Equal(t, &corev1API.LocalObjectReference{Name: "default-dockercfg-new"}, newCommonSpec.Source.Images[0].PullSecret)
+		assert.Equal(t, "registry/ns/base:latest", newCommonSpec.Source.Images[0].From.Name)
+		assert.Equal(t, &corev1API.LocalObjectReference{Name: "custom-old"}, newCommonSpec.Source.Images[1].PullSecret)
+		assert.Equal(t, "base:latest", newCommonSpec.Source.Images[1].From.Name)
+	})
+
+	t.Run("Test Execute() for build with output references", func(t *testing.T) {
+		outputs := map[string]struct {
+			to       *corev1API.ObjectReference
+			expected *corev1API.ObjectReference
+		}{
+			"internal registry": {
+				to:       &corev1API.ObjectReference{Kind: "DockerImage", Name: "docker-registry.default.svc:5000/ns/app:latest"},
+				expected: &corev1API.ObjectReference{Kind: "DockerImage", Name: "image-registry.openshift-image-registry.svc:5000/new-ns/app:latest"},
+			},
+			"external registry": {
+				to:       &corev1API.ObjectReference{Kind: "DockerImage", Name: "quay.io/ns/app:latest"},
+				expected: &corev1API.ObjectReference{Kind: "DockerImage", Name: "quay.io/ns/app:latest"},
+			},
+			"imagestreamtag": {
+				to:       &corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:latest"},
+				expected: &corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:latest"},
+			},
+			"imagestreamtag of a mapped namespace": {
+				to:       &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "ns", Name: "app:latest"},
+				expected: &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "new-ns", Name: "app:latest"},
+			},
+			"imagestreamtag of another namespace": {
+				to:       &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "other", Name: "app:latest"},
+				expected: &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "other", Name: "app:latest"},
+			},
+			"imagestreamimage of a mapped namespace": {
+				to:       &corev1API.ObjectReference{Kind: "ImageStreamImage", Namespace: "ns", Name: "app@sha256:1"},
+				expected: &corev1API.ObjectReference{Kind: "ImageStreamImage", Namespace: "new-ns", Name: "app@sha256:1"},
+			},
+		}
+		for name, output := range outputs {
+			spec := buildv1API.CommonSpec{Output: buildv1API.BuildOutput{To: output.to}}
+			newCommonSpec, err := UpdateCommonSpec(spec, "image-registry.openshift-image-registry.svc:5000", "docker-registry.default.svc:5000",
+				&corev1API.SecretList{}, test.NewLogger(), map[string]string{"ns": "new-ns"})
+			assert.Equal(t, err, nil, name)
+			assert.Equal(t, output.expected, newCommonSpec.Output.To, name)
+		}
+	})
 }
@@ -0,0 +1,81 @@
+package buildconfig
+
+import (
+	"encoding/json"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	buildv1API "github.com/openshift/api/build/v1"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// BackupPlugin is a backup item action plugin for Velero
+type BackupPlugin struct {
+	Log logrus.FieldLogger
+}
+
+// AppliesTo returns a velero.ResourceSelector that applies to buildconfigs
+func (p *BackupPlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"buildconfigs"},
+	}, nil
+}
+
+// Execute adds the secrets the buildconfig references as additional items, so
+// they are backed up even if the backup filters don't include them
+func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.Log.Info("[buildconfig-backup] Entering buildconfig backup plugin")
+
+	buildconfig := buildv1API.BuildConfig{}
+	itemMarshal, _ := json.Marshal(item)
+	json.Unmarshal(itemMarshal, &buildconfig)
+
+	var additionalItems []velero.ResourceIdentifier
+	for _, name := range referencedSecrets(buildconfig) {
+		p.Log.Infof("[buildconfig-backup] Adding secret %s as additional item for buildconfig %s/%s", name, buildconfig.Namespace, buildconfig.Name)
+		additionalItems = append(additionalItems, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{Resource: "secrets"},
+			Namespace:     buildconfig.Namespace,
+			Name:          name,
+		})
+	}
+	return item, additionalItems, nil
+}
+
+// referencedSecrets returns the names of the source, build input, pull and
+// push secrets buildconfig references, except the dockercfg secrets generated
+// for service accounts, which are generated again on the restore cluster
+func referencedSecrets(buildconfig buildv1API.BuildConfig) []string {
+	spec := buildconfig.Spec.CommonSpec
+	refs := []*corev1API.LocalObjectReference{spec.Source.SourceSecret, spec.Output.PushSecret}
+	for _, secret := range spec.Source.Secrets {
+		refs = append(refs, &corev1API.LocalObjectReference{Name: secret.Secret.Name})
+	}
+	for _, image := range spec.Source.Images {
+		refs = append(refs, image.PullSecret)
+	}
+	if spec.Strategy.SourceStrategy != nil {
+		refs = append(refs, spec.Strategy.SourceStrategy.PullSecret)
+	}
+	if spec.Strategy.DockerStrategy != nil {
+		refs = append(refs, spec.Strategy.DockerStrategy.PullSecret)
+	}
+	if spec.Strategy.CustomStrategy != nil {
+		refs = append(refs, spec.Strategy.CustomStrategy.PullSecret)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if ref == nil || len(ref.Name) == 0 || seen[ref.Name] || len(common.GeneratedDockercfgSecretPrefix(ref.Name)) > 0 {
+			continue
+		}
+		seen[ref.Name] = true
+		names = append(names, ref.Name)
+	}
+	return names
+}
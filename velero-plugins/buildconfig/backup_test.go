@@ -0,0 +1,48 @@
+package buildconfig
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	buildv1API "github.com/openshift/api/build/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+)
+
+func TestBackupPluginAppliesTo(t *testing.T) {
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+	actual, err := backupPlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"buildconfigs"}}, actual)
+}
+
+func TestReferencedSecrets(t *testing.T) {
+	buildconfig := buildv1API.BuildConfig{
+		Spec: buildv1API.BuildConfigSpec{CommonSpec: buildv1API.CommonSpec{
+			Source: buildv1API.BuildSource{
+				SourceSecret: &corev1API.LocalObjectReference{Name: "git-clone"},
+				Secrets: []buildv1API.SecretBuildSource{
+					{Secret: corev1API.LocalObjectReference{Name: "settings"}},
+				},
+				Images: []buildv1API.ImageSource{
+					{PullSecret: &corev1API.LocalObjectReference{Name: "default-dockercfg-abc12"}},
+				},
+			},
+			Strategy: buildv1API.BuildStrategy{
+				SourceStrategy: &buildv1API.SourceBuildStrategy{
+					PullSecret: &corev1API.LocalObjectReference{Name: "quay-pull"},
+				},
+			},
+			Output: buildv1API.BuildOutput{
+				PushSecret: &corev1API.LocalObjectReference{Name: "builder-dockercfg-abc12"},
+			},
+		}},
+	}
+
+	assert.Equal(t, []string{"git-clone", "settings", "quay-pull"}, referencedSecrets(buildconfig))
+
+	buildconfig.Spec.Output.PushSecret = &corev1API.LocalObjectReference{Name: "quay-pull"}
+	assert.Equal(t, []string{"git-clone", "quay-pull", "settings"}, referencedSecrets(buildconfig))
+}
@@ -1,7 +1,13 @@
 package buildconfig
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/build"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
@@ -9,10 +15,24 @@ import (
 	buildv1API "github.com/openshift/api/build/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
+const (
+	// webhookSecretKey is the key of secrets referenced by webhook triggers
+	// holding the value webhook invocations are checked against
+	webhookSecretKey = "WebHookSecretKey"
+	// webhookSecretBytes is the number of random bytes of regenerated webhook secrets
+	webhookSecretBytes = 20
+)
+
+// JenkinsPipelineSupportedEnvVar is the environment variable overriding
+// whether the restore cluster supports the JenkinsPipeline build strategy
+const JenkinsPipelineSupportedEnvVar = "JENKINS_PIPELINE_STRATEGY_SUPPORTED"
+
 // RestorePlugin is a restore item action plugin for Velero
 type RestorePlugin struct {
 	Log logrus.FieldLogger
@@ -33,12 +53,56 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	itemMarshal, _ := json.Marshal(input.Item)
 	json.Unmarshal(itemMarshal, &buildconfig)
 
+	if buildconfig.Spec.Strategy.Type == buildv1API.JenkinsPipelineBuildStrategyType &&
+		input.Restore.Annotations[common.RestoreJenkinsPipelinesAnnotation] != "true" {
+		major, minor, err := common.GetServerVersion()
+		if err != nil {
+			return nil, err
+		}
+		if !jenkinsPipelineSupported(major, minor) {
+			p.Log.Warnf("[buildconfig-restore] Skipping restore of buildconfig %s/%s: the JenkinsPipeline build strategy is not supported on this cluster, "+
+				"migrate the pipeline to OpenShift Pipelines (Tekton) or a Jenkinsfile run by Jenkins, or set the %s annotation on the restore to restore it anyway",
+				buildconfig.Namespace, buildconfig.Name, common.RestoreJenkinsPipelinesAnnotation)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+	}
+
+	backupBuildconfig := buildv1API.BuildConfig{}
+	itemMarshal, _ = json.Marshal(input.ItemFromBackup)
+	json.Unmarshal(itemMarshal, &backupBuildconfig)
+	restoreLastVersion(&buildconfig, backupBuildconfig)
+
 	buildconfig, err := p.updateSecretsAndDockerRefs(buildconfig, input.Restore.Spec.NamespaceMapping)
 	if err != nil {
 		p.Log.Error("[buildconfig-restore] error modifying buildconfig: ", err)
 		return nil, err
 	}
 
+	if input.Restore.Annotations[common.PauseBuildTriggersAnnotation] == "true" {
+		buildconfig, err = pauseImageChangeTriggers(buildconfig)
+		if err != nil {
+			p.Log.Error("[buildconfig-restore] error pausing buildconfig triggers: ", err)
+			return nil, err
+		}
+		if triggers, paused := buildconfig.Annotations[common.OriginalBuildTriggersAnnotation]; paused {
+			p.Log.Infof("[buildconfig-restore] removed the ImageChange triggers of buildconfig %s/%s, re-apply them with: "+
+				"oc patch bc/%s -n %s --type=json -p '[{\"op\":\"replace\",\"path\":\"/spec/triggers\",\"value\":%s}]'",
+				buildconfig.Namespace, buildconfig.Name, buildconfig.Name, buildconfig.Namespace, triggers)
+		}
+	}
+
+	if input.Restore.Annotations[common.RegenerateWebhookSecretsAnnotation] == "true" {
+		regenerated, err := regenerateWebhookSecrets(&buildconfig, common.MappedNamespace(input.Restore, buildconfig.Namespace), ensureWebhookSecret)
+		if err != nil {
+			p.Log.Error("[buildconfig-restore] error regenerating buildconfig webhook secrets: ", err)
+			return nil, err
+		}
+		if len(regenerated) > 0 {
+			p.Log.Infof("[buildconfig-restore] regenerated the secrets of the %s webhook triggers of buildconfig %s/%s, update the webhooks calling them",
+				strings.Join(regenerated, ", "), buildconfig.Namespace, buildconfig.Name)
+		}
+	}
+
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(buildconfig)
 	json.Unmarshal(objrec, &out)
@@ -57,13 +121,163 @@ func (p *RestorePlugin) updateSecretsAndDockerRefs(buildconfig buildv1API.BuildC
 		return buildconfig, err
 	}
 
-	registry := buildconfig.Annotations[common.RestoreRegistryHostname]
-	backupRegistry := buildconfig.Annotations[common.BackupRegistryHostname]
+	registry, backupRegistry, err := build.RestoreRegistries(buildconfig.ObjectMeta, p.Log)
+	if err != nil {
+		return buildconfig, err
+	}
 
 	newCommonSpec, err := build.UpdateCommonSpec(buildconfig.Spec.CommonSpec, registry, backupRegistry, secretList, p.Log, namespaceMapping)
 	if err != nil {
 		return buildconfig, err
 	}
 	buildconfig.Spec.CommonSpec = newCommonSpec
+	mapTriggerNamespaces(&buildconfig, namespaceMapping)
 	return buildconfig, nil
 }
+
+// restoreLastVersion sets the last version of buildconfig to the one it had at
+// backup time, which velero resets with the rest of the status, so builds
+// started on this cluster don't reuse the numbers of the backed up builds. It
+// also records it in an annotation for the build restore plugin.
+func restoreLastVersion(buildconfig *buildv1API.BuildConfig, backupBuildconfig buildv1API.BuildConfig) {
+	lastVersion := backupBuildconfig.Status.LastVersion
+	if lastVersion <= 0 {
+		return
+	}
+	buildconfig.Status.LastVersion = lastVersion
+	if buildconfig.Annotations == nil {
+		buildconfig.Annotations = make(map[string]string)
+	}
+	buildconfig.Annotations[common.BackupLastBuildVersionAnnotation] = strconv.FormatInt(lastVersion, 10)
+}
+
+// jenkinsPipelineSupported returns whether the cluster of the given kubernetes
+// version supports the JenkinsPipeline build strategy, which OpenShift 4
+// (kubernetes 1.13 and later) dropped. The environment variable overrides it.
+func jenkinsPipelineSupported(major, minor int) bool {
+	if supported, err := strconv.ParseBool(os.Getenv(JenkinsPipelineSupportedEnvVar)); err == nil {
+		return supported
+	}
+	return major == 1 && minor <= 11
+}
+
+// mapTriggerNamespaces maps the namespaces the ImageChange triggers of
+// buildconfig reference by the namespace mapping of the restore
+func mapTriggerNamespaces(buildconfig *buildv1API.BuildConfig, namespaceMapping map[string]string) {
+	for _, trigger := range buildconfig.Spec.Triggers {
+		if trigger.ImageChange != nil && trigger.ImageChange.From != nil {
+			newFrom := build.MapNamespace(*trigger.ImageChange.From, namespaceMapping)
+			trigger.ImageChange.From = &newFrom
+		}
+	}
+}
+
+// pauseImageChangeTriggers removes the ImageChange triggers of buildconfig, so
+// restored imagestreams getting their tags don't start builds, and records its
+// original triggers in the openshift.io/original-build-triggers annotation
+func pauseImageChangeTriggers(buildconfig buildv1API.BuildConfig) (buildv1API.BuildConfig, error) {
+	var triggers []buildv1API.BuildTriggerPolicy
+	for _, trigger := range buildconfig.Spec.Triggers {
+		if trigger.Type != buildv1API.ImageChangeBuildTriggerType {
+			triggers = append(triggers, trigger)
+		}
+	}
+	if len(triggers) == len(buildconfig.Spec.Triggers) {
+		return buildconfig, nil
+	}
+	original, err := json.Marshal(buildconfig.Spec.Triggers)
+	if err != nil {
+		return buildconfig, err
+	}
+	if buildconfig.Annotations == nil {
+		buildconfig.Annotations = make(map[string]string)
+	}
+	buildconfig.Annotations[common.OriginalBuildTriggersAnnotation] = string(original)
+	buildconfig.Spec.Triggers = triggers
+	return buildconfig, nil
+}
+
+// webhook returns the webhook of trigger, or nil if it isn't a webhook trigger
+func webhook(trigger *buildv1API.BuildTriggerPolicy) *buildv1API.WebHookTrigger {
+	switch {
+	case trigger.GitHubWebHook != nil:
+		return trigger.GitHubWebHook
+	case trigger.GitLabWebHook != nil:
+		return trigger.GitLabWebHook
+	case trigger.BitbucketWebHook != nil:
+		return trigger.BitbucketWebHook
+	default:
+		return trigger.GenericWebHook
+	}
+}
+
+// regenerateWebhookSecrets replaces the inline secrets of the webhook triggers
+// of buildconfig with new random values, and calls ensureSecret with
+// namespace, the namespace buildconfig is restored to, and the name of the
+// secrets other webhook triggers reference, which returns whether it created
+// the secret. It returns the triggers whose secrets
+// were regenerated, e.g. "GitHub" or "Generic (secret hook)".
+func regenerateWebhookSecrets(buildconfig *buildv1API.BuildConfig, namespace string, ensureSecret func(namespace, name string) (bool, error)) ([]string, error) {
+	var regenerated []string
+	for i := range buildconfig.Spec.Triggers {
+		trigger := &buildconfig.Spec.Triggers[i]
+		hook := webhook(trigger)
+		if hook == nil {
+			continue
+		}
+		if hook.SecretReference != nil && len(hook.SecretReference.Name) > 0 {
+			created, err := ensureSecret(namespace, hook.SecretReference.Name)
+			if err != nil {
+				return nil, err
+			}
+			if created {
+				regenerated = append(regenerated, fmt.Sprintf("%s (secret %s)", trigger.Type, hook.SecretReference.Name))
+			}
+		} else if len(hook.Secret) > 0 {
+			secret, err := newWebhookSecret()
+			if err != nil {
+				return nil, err
+			}
+			hook.Secret = secret
+			regenerated = append(regenerated, string(trigger.Type))
+		}
+	}
+	return regenerated, nil
+}
+
+// ensureWebhookSecret creates the webhook secret name in namespace with a new
+// random value if it doesn't exist, returning whether it created it
+func ensureWebhookSecret(namespace, name string) (bool, error) {
+	client, err := clients.CoreClient()
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err == nil || !k8serrors.IsNotFound(err) {
+		return false, err
+	}
+	value, err := newWebhookSecret()
+	if err != nil {
+		return false, err
+	}
+	secret := &corev1API.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		StringData: map[string]string{webhookSecretKey: value},
+	}
+	if _, err := client.Secrets(namespace).Create(secret); err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("creating webhook secret %s/%s: %v", namespace, name, err)
+	}
+	return true, nil
+}
+
+// newWebhookSecret returns a random webhook secret value
+func newWebhookSecret() (string, error) {
+	value := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(value), nil
+}
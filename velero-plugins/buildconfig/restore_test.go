@@ -0,0 +1,171 @@
+package buildconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/build"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	buildv1API "github.com/openshift/api/build/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"buildconfigs"}}, actual)
+}
+
+func TestPauseImageChangeTriggers(t *testing.T) {
+	triggers := []buildv1API.BuildTriggerPolicy{
+		{Type: buildv1API.ConfigChangeBuildTriggerType},
+		{
+			Type: buildv1API.ImageChangeBuildTriggerType,
+			ImageChange: &buildv1API.ImageChangeTrigger{
+				From: &corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "base:latest"},
+			},
+		},
+		{Type: buildv1API.GitHubWebHookBuildTriggerType, GitHubWebHook: &buildv1API.WebHookTrigger{Secret: "secret"}},
+	}
+	buildconfig := buildv1API.BuildConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec:       buildv1API.BuildConfigSpec{Triggers: triggers},
+	}
+
+	paused, err := pauseImageChangeTriggers(buildconfig)
+	require.NoError(t, err)
+	assert.Equal(t, []buildv1API.BuildTriggerPolicy{triggers[0], triggers[2]}, paused.Spec.Triggers)
+	assert.Contains(t, paused.Annotations, common.OriginalBuildTriggersAnnotation)
+
+	// the logged oc patch command puts the annotation back as the triggers value
+	var original []buildv1API.BuildTriggerPolicy
+	require.NoError(t, json.Unmarshal([]byte(paused.Annotations[common.OriginalBuildTriggersAnnotation]), &original))
+	assert.Equal(t, triggers, original)
+}
+
+func TestPauseImageChangeTriggersWithoutImageChangeTriggers(t *testing.T) {
+	buildconfig := buildv1API.BuildConfig{
+		Spec: buildv1API.BuildConfigSpec{Triggers: []buildv1API.BuildTriggerPolicy{{Type: buildv1API.ConfigChangeBuildTriggerType}}},
+	}
+
+	paused, err := pauseImageChangeTriggers(buildconfig)
+	require.NoError(t, err)
+	assert.Equal(t, buildconfig, paused)
+	assert.NotContains(t, paused.Annotations, common.OriginalBuildTriggersAnnotation)
+}
+
+func TestRegenerateWebhookSecrets(t *testing.T) {
+	buildconfig := buildv1API.BuildConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec: buildv1API.BuildConfigSpec{Triggers: []buildv1API.BuildTriggerPolicy{
+			{Type: buildv1API.ConfigChangeBuildTriggerType},
+			{Type: buildv1API.GitHubWebHookBuildTriggerType, GitHubWebHook: &buildv1API.WebHookTrigger{Secret: "old"}},
+			{
+				Type:           buildv1API.GenericWebHookBuildTriggerType,
+				GenericWebHook: &buildv1API.WebHookTrigger{SecretReference: &buildv1API.SecretLocalReference{Name: "missing"}},
+			},
+			{
+				Type:          buildv1API.GitLabWebHookBuildTriggerType,
+				GitLabWebHook: &buildv1API.WebHookTrigger{SecretReference: &buildv1API.SecretLocalReference{Name: "existing"}},
+			},
+		}},
+	}
+	var ensured []string
+	ensureSecret := func(namespace, name string) (bool, error) {
+		ensured = append(ensured, namespace+"/"+name)
+		return name == "missing", nil
+	}
+
+	// the secrets are ensured in the namespace the buildconfig is restored to
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}}}
+	regenerated, err := regenerateWebhookSecrets(&buildconfig, common.MappedNamespace(restore, buildconfig.Namespace), ensureSecret)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GitHub", "Generic (secret missing)"}, regenerated)
+	assert.Equal(t, []string{"new-ns/missing", "new-ns/existing"}, ensured)
+	secret := buildconfig.Spec.Triggers[1].GitHubWebHook.Secret
+	assert.NotEqual(t, "old", secret)
+	assert.Len(t, secret, 2*webhookSecretBytes)
+	assert.Equal(t, "missing", buildconfig.Spec.Triggers[2].GenericWebHook.SecretReference.Name)
+	assert.Empty(t, buildconfig.Spec.Triggers[2].GenericWebHook.Secret)
+}
+
+func TestMapTriggerNamespaces(t *testing.T) {
+	buildconfig := buildv1API.BuildConfig{
+		Spec: buildv1API.BuildConfigSpec{Triggers: []buildv1API.BuildTriggerPolicy{
+			{Type: buildv1API.ImageChangeBuildTriggerType, ImageChange: &buildv1API.ImageChangeTrigger{}},
+			{
+				Type: buildv1API.ImageChangeBuildTriggerType,
+				ImageChange: &buildv1API.ImageChangeTrigger{
+					From: &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "base-images", Name: "base:latest"},
+				},
+			},
+			{
+				Type: buildv1API.ImageChangeBuildTriggerType,
+				ImageChange: &buildv1API.ImageChangeTrigger{
+					From: &corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "other", Name: "tools:latest"},
+				},
+			},
+		}},
+	}
+
+	mapTriggerNamespaces(&buildconfig, map[string]string{"base-images": "new-base-images"})
+	assert.Nil(t, buildconfig.Spec.Triggers[0].ImageChange.From)
+	assert.Equal(t, "new-base-images", buildconfig.Spec.Triggers[1].ImageChange.From.Namespace)
+	assert.Equal(t, "other", buildconfig.Spec.Triggers[2].ImageChange.From.Namespace)
+}
+
+func TestJenkinsPipelineSupported(t *testing.T) {
+	assert.True(t, jenkinsPipelineSupported(1, 11))
+	assert.False(t, jenkinsPipelineSupported(1, 18))
+
+	os.Setenv(JenkinsPipelineSupportedEnvVar, "true")
+	defer os.Unsetenv(JenkinsPipelineSupportedEnvVar)
+	assert.True(t, jenkinsPipelineSupported(1, 18))
+}
+
+func TestRestoreLastVersionNumbersBuildsAfterBackup(t *testing.T) {
+	backupBuildconfig := buildv1API.BuildConfig{Status: buildv1API.BuildConfigStatus{LastVersion: 42}}
+	// velero resets the status of the item it restores
+	buildconfig := buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+	restoreLastVersion(&buildconfig, backupBuildconfig)
+
+	// the build controller numbers the next build of a buildconfig lastVersion+1
+	numbered := func(number int64) buildv1API.Build {
+		return buildv1API.Build{ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("app-%d", number),
+			Annotations: map[string]string{buildv1API.BuildNumberAnnotation: strconv.FormatInt(number, 10)},
+		}}
+	}
+	first := numbered(buildconfig.Status.LastVersion + 1)
+	assert.Equal(t, "app-43", first.Name)
+
+	// the build restore plugin counts the restored builds from the same number
+	assert.True(t, build.IsRecentBuild(first, buildconfig, 1))
+	assert.True(t, build.IsRecentBuild(numbered(42), buildconfig, 1))
+	assert.False(t, build.IsRecentBuild(numbered(41), buildconfig, 1))
+}
+
+func TestRestoreLastVersion(t *testing.T) {
+	backupBuildconfig := buildv1API.BuildConfig{Status: buildv1API.BuildConfigStatus{LastVersion: 42}}
+	// velero resets the status of the item it restores
+	buildconfig := buildv1API.BuildConfig{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+
+	restoreLastVersion(&buildconfig, backupBuildconfig)
+	assert.Equal(t, "42", buildconfig.Annotations[common.BackupLastBuildVersionAnnotation])
+	// the next build is numbered lastVersion+1, after the last build of the backup cluster
+	assert.Equal(t, int64(42), buildconfig.Status.LastVersion)
+
+	neverBuilt := buildv1API.BuildConfig{}
+	restoreLastVersion(&neverBuilt, buildv1API.BuildConfig{})
+	assert.Equal(t, buildv1API.BuildConfig{}, neverBuilt)
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"sync"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/sirupsen/logrus"
+	velero "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// systemPriorityClasses exist on every cluster
+var systemPriorityClasses = map[string]bool{
+	"system-cluster-critical": true,
+	"system-node-critical":    true,
+}
+
+// priorityClassCache caches the priority class mapping of a restore and which
+// priority classes exist, so they are looked up once per restore
+type priorityClassCache struct {
+	sync.Mutex
+	restore types.UID
+	mapping map[string]string
+	exists  map[string]bool
+}
+
+var priorityClasses priorityClassCache
+
+// UpdatePriorityClassName updates the priority class of a restored pod or pod
+// template spec: its name is mapped by the ConfigMap the
+// openshift.io/priorityclass-mapping annotation of the restore names, and
+// removed with a warning if the priority class doesn't exist on this cluster,
+// so the pods aren't rejected. Velero restores priority classes after pods and
+// their controllers, so the name is kept if restore restores priority classes.
+func UpdatePriorityClassName(spec *corev1API.PodSpec, restore *velero.Restore, log logrus.FieldLogger) error {
+	if len(spec.PriorityClassName) == 0 {
+		return nil
+	}
+	priorityClasses.Lock()
+	defer priorityClasses.Unlock()
+	if priorityClasses.restore != restore.UID || priorityClasses.exists == nil {
+		mapping, err := priorityClassMapping(restore)
+		if err != nil {
+			return err
+		}
+		priorityClasses.restore = restore.UID
+		priorityClasses.mapping = mapping
+		priorityClasses.exists = make(map[string]bool)
+	}
+
+	name, found, err := restorePriorityClassName(spec.PriorityClassName, priorityClasses.mapping, func(name string) (bool, error) {
+		if exists, cached := priorityClasses.exists[name]; cached {
+			return exists, nil
+		}
+		exists, err := priorityClassExists(name)
+		if err != nil {
+			return false, err
+		}
+		priorityClasses.exists[name] = exists
+		return exists, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		if RestoresClusterResource(restore, "priorityclasses") {
+			log.Infof("[util] priority class %s doesn't exist on this cluster yet, keeping it since the restore restores priority classes", name)
+		} else {
+			log.Warnf("[util] priority class %s doesn't exist on this cluster, removing it", name)
+			name = ""
+		}
+	}
+	if name == spec.PriorityClassName {
+		return nil
+	}
+	if len(name) > 0 {
+		log.Infof("[util] mapping priority class %s to %s", spec.PriorityClassName, name)
+	}
+	spec.PriorityClassName = name
+	// admission sets the priority of the new class
+	spec.Priority = nil
+	return nil
+}
+
+// restorePriorityClassName returns the name of the priority class name is
+// mapped to, and whether it exists, given by exists
+func restorePriorityClassName(name string, mapping map[string]string, exists func(string) (bool, error)) (string, bool, error) {
+	if newName := mapping[name]; len(newName) > 0 {
+		name = newName
+	}
+	if systemPriorityClasses[name] {
+		return name, true, nil
+	}
+	found, err := exists(name)
+	if err != nil {
+		return "", false, err
+	}
+	return name, found, nil
+}
+
+// priorityClassMapping returns the priority class names of the backup cluster
+// mapped to the ones of this cluster by the ConfigMap in the velero namespace
+// which the openshift.io/priorityclass-mapping annotation of restore names
+func priorityClassMapping(restore *velero.Restore) (map[string]string, error) {
+	name := restore.Annotations[PriorityClassMappingAnnotation]
+	if len(name) == 0 {
+		return nil, nil
+	}
+	client, err := clients.CoreClient()
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := client.ConfigMaps(restore.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return configMap.Data, nil
+}
+
+// priorityClassExists returns whether the priority class exists on this
+// cluster, served by scheduling.k8s.io/v1, or v1beta1 on older clusters
+func priorityClassExists(name string) (bool, error) {
+	client, err := clients.DiscoveryClient()
+	if err != nil {
+		return false, err
+	}
+	for _, version := range []string{"v1", "v1beta1"} {
+		_, err := client.RESTClient().Get().AbsPath("/apis/scheduling.k8s.io", version, "priorityclasses", name).DoRaw()
+		if err == nil {
+			return true, nil
+		}
+		if !k8serrors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velero "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRestorePriorityClassName(t *testing.T) {
+	existing := map[string]bool{"high": true, "batch-low": true}
+	exists := func(name string) (bool, error) {
+		return existing[name], nil
+	}
+	mapping := map[string]string{"critical": "high", "old-low": "missing"}
+
+	tests := []struct {
+		name     string
+		class    string
+		expected string
+		found    bool
+	}{
+		{name: "existing", class: "batch-low", expected: "batch-low", found: true},
+		{name: "missing", class: "medium", expected: "medium", found: false},
+		{name: "mapped", class: "critical", expected: "high", found: true},
+		{name: "mapped to a missing class", class: "old-low", expected: "missing", found: false},
+		{name: "system", class: "system-node-critical", expected: "system-node-critical", found: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, found, err := restorePriorityClassName(test.class, mapping, exists)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+			assert.Equal(t, test.found, found)
+		})
+	}
+
+	_, _, err := restorePriorityClassName("high", nil, func(string) (bool, error) {
+		return false, errors.New("forbidden")
+	})
+	assert.Error(t, err)
+}
+
+func TestUpdatePriorityClassNameRestoredWithPods(t *testing.T) {
+	restore := &velero.Restore{ObjectMeta: metav1.ObjectMeta{UID: "restore-uid"}}
+	// app-high is restored after the pods, so it doesn't exist yet
+	priorityClasses.restore = restore.UID
+	priorityClasses.mapping = nil
+	priorityClasses.exists = map[string]bool{"app-high": false}
+	priority := int32(1000)
+
+	spec := &corev1API.PodSpec{PriorityClassName: "app-high", Priority: &priority}
+	require.NoError(t, UpdatePriorityClassName(spec, restore, test.NewLogger()))
+	assert.Equal(t, "app-high", spec.PriorityClassName)
+	assert.Equal(t, &priority, spec.Priority)
+
+	// the name is removed when the restore doesn't restore priority classes
+	for _, restore := range []*velero.Restore{
+		{ObjectMeta: metav1.ObjectMeta{UID: "restore-uid"}, Spec: velero.RestoreSpec{ExcludedResources: []string{"priorityclasses.scheduling.k8s.io"}}},
+		{ObjectMeta: metav1.ObjectMeta{UID: "restore-uid"}, Spec: velero.RestoreSpec{IncludedNamespaces: []string{"app"}}},
+	} {
+		spec := &corev1API.PodSpec{PriorityClassName: "app-high", Priority: &priority}
+		require.NoError(t, UpdatePriorityClassName(spec, restore, test.NewLogger()))
+		assert.Empty(t, spec.PriorityClassName)
+		assert.Nil(t, spec.Priority)
+	}
+}
+
+func TestRestoresClusterResource(t *testing.T) {
+	include := true
+	exclude := false
+	assert.True(t, RestoresClusterResource(&velero.Restore{}, "priorityclasses"))
+	assert.True(t, RestoresClusterResource(&velero.Restore{Spec: velero.RestoreSpec{IncludedNamespaces: []string{"*"}}}, "priorityclasses"))
+	assert.False(t, RestoresClusterResource(&velero.Restore{Spec: velero.RestoreSpec{IncludedNamespaces: []string{"app"}}}, "priorityclasses"))
+	assert.True(t, RestoresClusterResource(&velero.Restore{Spec: velero.RestoreSpec{IncludedNamespaces: []string{"app"}, IncludeClusterResources: &include}}, "priorityclasses"))
+	assert.False(t, RestoresClusterResource(&velero.Restore{Spec: velero.RestoreSpec{IncludeClusterResources: &exclude}}, "priorityclasses"))
+	assert.False(t, RestoresClusterResource(&velero.Restore{Spec: velero.RestoreSpec{ExcludedResources: []string{"priorityclasses"}}}, "priorityclasses"))
+}
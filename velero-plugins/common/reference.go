@@ -0,0 +1,106 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// ipv6RegistryPlaceholder stands in for bracketed IPv6 registry hosts, which the
+// docker reference parser doesn't accept, while parsing the rest of a reference
+const ipv6RegistryPlaceholder = "ipv6.invalid"
+
+// ImageReference is an image reference split into its parts
+type ImageReference struct {
+	// The registry host, with its port if any; IPv6 hosts are bracketed
+	Registry string
+	// The repository within the registry, e.g. namespace/name
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImageReference parses an image reference such as registry:5000/ns/name:tag
+// or [fd00::1234]:5000/ns/name@sha256:<hex> with the docker reference parser.
+// The first path component is always taken as the registry. Digests are only
+// split off, not validated.
+func ParseImageReference(s string) (*ImageReference, error) {
+	registry := ""
+	toParse := s
+	digest := ""
+	if index := strings.LastIndex(toParse, "@"); index >= 0 {
+		toParse, digest = toParse[:index], toParse[index+1:]
+		if !strings.Contains(digest, ":") {
+			return nil, fmt.Errorf("image reference %s has an invalid digest", s)
+		}
+	}
+	if strings.HasPrefix(toParse, "[") {
+		slash := strings.Index(toParse, "/")
+		if slash < 0 {
+			return nil, fmt.Errorf("image reference %s has no repository", s)
+		}
+		registry = toParse[:slash]
+		if err := validateIPv6Registry(registry); err != nil {
+			return nil, fmt.Errorf("image reference %s: %v", s, err)
+		}
+		toParse = ipv6RegistryPlaceholder + toParse[slash:]
+	}
+	parsed, err := reference.Parse(toParse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %v", s, err)
+	}
+	named, ok := parsed.(reference.Named)
+	if !ok {
+		return nil, fmt.Errorf("image reference %s has no repository", s)
+	}
+	ref := &ImageReference{Registry: reference.Domain(named), Repository: reference.Path(named), Digest: digest}
+	if len(registry) > 0 {
+		ref.Registry = registry
+	}
+	if len(ref.Registry) == 0 {
+		return nil, fmt.Errorf("image reference %s has no registry", s)
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	return ref, nil
+}
+
+// validateIPv6Registry returns an error unless registry is a bracketed IPv6
+// address, optionally followed by a port
+func validateIPv6Registry(registry string) error {
+	end := strings.Index(registry, "]")
+	if end < 0 {
+		return fmt.Errorf("registry %s has no closing bracket", registry)
+	}
+	if ip := net.ParseIP(registry[1:end]); ip == nil || ip.To4() != nil {
+		return fmt.Errorf("registry %s is not a bracketed IPv6 address", registry)
+	}
+	if rest := registry[end+1:]; len(rest) > 0 {
+		port, err := strconv.Atoi(strings.TrimPrefix(rest, ":"))
+		if !strings.HasPrefix(rest, ":") || err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("registry %s has an invalid port", registry)
+		}
+	}
+	return nil
+}
+
+// String returns the reference, e.g. registry:5000/ns/name:tag
+func (r ImageReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if len(r.Tag) > 0 {
+		s += ":" + r.Tag
+	}
+	if len(r.Digest) > 0 {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// RegistryHostPort joins host and port into a registry host, bracketing IPv6 hosts
+func RegistryHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,234 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velero "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      string
+		expected *ImageReference
+	}{
+		{
+			name:     "hostname and port",
+			ref:      "myregistry.local:8443/ns/app:latest",
+			expected: &ImageReference{Registry: "myregistry.local:8443", Repository: "ns/app", Tag: "latest"},
+		},
+		{
+			name:     "IPv6 and port",
+			ref:      "[fd00::1234]:5000/ns/app:v1",
+			expected: &ImageReference{Registry: "[fd00::1234]:5000", Repository: "ns/app", Tag: "v1"},
+		},
+		{
+			name:     "IPv6 without port",
+			ref:      "[fd00::1234]/ns/app",
+			expected: &ImageReference{Registry: "[fd00::1234]", Repository: "ns/app"},
+		},
+		{
+			name:     "hostname without port",
+			ref:      "image-registry.openshift-image-registry.svc/ns/app",
+			expected: &ImageReference{Registry: "image-registry.openshift-image-registry.svc", Repository: "ns/app"},
+		},
+		{
+			name:     "digested",
+			ref:      "172.30.0.1:5000/ns/app@" + testDigest,
+			expected: &ImageReference{Registry: "172.30.0.1:5000", Repository: "ns/app", Digest: testDigest},
+		},
+		{
+			name:     "IPv6 digested",
+			ref:      "[fd00::1234]:5000/ns/app:v1@" + testDigest,
+			expected: &ImageReference{Registry: "[fd00::1234]:5000", Repository: "ns/app", Tag: "v1", Digest: testDigest},
+		},
+		{name: "no registry", ref: "app:latest"},
+		{name: "unclosed IPv6", ref: "[fd00::1234:5000/ns/app"},
+		{name: "IPv4 in brackets", ref: "[172.30.0.1]:5000/ns/app"},
+		{name: "IPv6 with invalid port", ref: "[fd00::1234]:port/ns/app"},
+		{name: "IPv6 without repository", ref: "[fd00::1234]:5000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := ParseImageReference(test.ref)
+			if test.expected == nil {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ref)
+			assert.Equal(t, test.ref, ref.String())
+		})
+	}
+}
+
+func TestRegistryHostPort(t *testing.T) {
+	assert.Equal(t, "172.30.0.1:5000", RegistryHostPort("172.30.0.1", 5000))
+	assert.Equal(t, "[fd00::1234]:5000", RegistryHostPort("fd00::1234", 5000))
+}
+
+func TestReplaceImageRefPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		oldPrefix string
+		newPrefix string
+		expected  string
+	}{
+		{
+			name:      "hostname and port",
+			ref:       "myregistry.local:8443/ns/app:latest",
+			oldPrefix: "myregistry.local:8443",
+			newPrefix: "[fd00::1234]:5000",
+			expected:  "[fd00::1234]:5000/mapped/app:latest",
+		},
+		{
+			name:      "IPv6 and port",
+			ref:       "[fd00::1234]:5000/ns/app@" + testDigest,
+			oldPrefix: "[fd00::1234]:5000",
+			newPrefix: "image-registry.openshift-image-registry.svc:5000",
+			expected:  "image-registry.openshift-image-registry.svc:5000/mapped/app@" + testDigest,
+		},
+		{
+			name:      "openshift namespace drops the digest",
+			ref:       "[fd00::1234]:5000/openshift/app@" + testDigest,
+			oldPrefix: "[fd00::1234]:5000",
+			newPrefix: "registry:5000",
+			expected:  "registry:5000/openshift/app",
+		},
+		{
+			name:      "port is part of the prefix",
+			ref:       "myregistry.local:8443/ns/app:latest",
+			oldPrefix: "myregistry.local",
+		},
+		{
+			name:      "IPv6 prefix must match the whole host",
+			ref:       "[fd00::1234]:5000/ns/app",
+			oldPrefix: "[fd00::12]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := ReplaceImageRefPrefix(test.ref, test.oldPrefix, test.newPrefix, map[string]string{"ns": "mapped"})
+			if len(test.expected) == 0 {
+				assert.Error(t, err)
+				assert.False(t, HasImageRefPrefix(test.ref, test.oldPrefix))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ref)
+			assert.True(t, HasImageRefPrefix(test.ref, test.oldPrefix))
+		})
+	}
+}
+
+func TestParseLocalImageReference(t *testing.T) {
+	ref, err := ParseLocalImageReference("[fd00::1234]:5000/ns/app:v1", "[fd00::1234]:5000")
+	require.NoError(t, err)
+	assert.Equal(t, &LocalImageReference{Registry: "[fd00::1234]:5000", Namespace: "ns", Name: "app", Tag: "v1"}, ref)
+	ref, err = ParseLocalImageReference("registry:5000/ns/app@"+testDigest, "registry:5000")
+	require.NoError(t, err)
+	assert.Equal(t, &LocalImageReference{Registry: "registry:5000", Namespace: "ns", Name: "app", Digest: testDigest}, ref)
+	_, err = ParseLocalImageReference("registry:5000/ns/app", "other:5000")
+	assert.Error(t, err)
+	_, err = ParseLocalImageReference("registry:5000/app", "registry:5000")
+	assert.Error(t, err)
+}
+
+func TestSwapImageTriggerRefs(t *testing.T) {
+	annotations := map[string]string{
+		ImageTriggersAnnotation: `[{"from":{"kind":"ImageStreamTag","name":"app:latest","namespace":"old"},"fieldPath":"spec.template.spec.containers[?(@.name==\"app\")].image"},` +
+			`{"from":{"kind":"ImageStreamTag","name":"base:latest","namespace":"openshift"},"fieldPath":"spec.template.spec.initContainers[?(@.name==\"init\")].image","paused":true},` +
+			`{"from":{"kind":"DockerImage","name":"backup.registry:5000/old/app:v1"},"fieldPath":"spec.template.spec.containers[?(@.name==\"sidecar\")].image"}]`,
+	}
+	err := SwapImageTriggerRefs(annotations, "backup.registry:5000", "restore.registry:5000", logrus.New(), map[string]string{"old": "new"})
+	require.NoError(t, err)
+	assert.Equal(t, `[{"from":{"kind":"ImageStreamTag","name":"app:latest","namespace":"new"},"fieldPath":"spec.template.spec.containers[?(@.name==\"app\")].image"},`+
+		`{"from":{"kind":"ImageStreamTag","name":"base:latest","namespace":"openshift"},"fieldPath":"spec.template.spec.initContainers[?(@.name==\"init\")].image","paused":true},`+
+		`{"from":{"kind":"DockerImage","name":"restore.registry:5000/new/app:v1"},"fieldPath":"spec.template.spec.containers[?(@.name==\"sidecar\")].image"}]`,
+		annotations[ImageTriggersAnnotation])
+
+	assert.NoError(t, SwapImageTriggerRefs(map[string]string{}, "backup.registry:5000", "restore.registry:5000", logrus.New(), nil))
+	assert.Error(t, SwapImageTriggerRefs(map[string]string{ImageTriggersAnnotation: "{"}, "backup.registry:5000", "restore.registry:5000", logrus.New(), nil))
+}
+
+func TestRestoreImageSwap(t *testing.T) {
+	const (
+		backupRegistry    = "docker-registry.default.svc:5000"
+		registry          = "image-registry.openshift-image-registry.svc:5000"
+		migrationRegistry = "migration.example.com"
+	)
+	annotations := map[string]string{MigrationRegistry: migrationRegistry}
+	restore := func(migrationType string) *velero.Restore {
+		return &velero.Restore{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{StageOrFinalMigrationAnnotation: migrationType}},
+			Spec:       velero.RestoreSpec{BackupName: "backup", NamespaceMapping: map[string]string{"ns": "new-ns"}},
+		}
+	}
+
+	swapImage, target := RestoreImageSwap(annotations, restore(StageMigration), backupRegistry, registry)
+	assert.Equal(t, migrationRegistry, target)
+	assert.Equal(t, "migration.example.com/ns/app:latest", swapImage(backupRegistry+"/ns/app:latest"))
+	assert.Equal(t, "quay.io/ns/app:latest", swapImage("quay.io/ns/app:latest"))
+
+	swapImage, target = RestoreImageSwap(annotations, restore(FinalMigration), backupRegistry, registry)
+	assert.Equal(t, registry, target)
+	assert.Equal(t, registry+"/new-ns/app:latest", swapImage(backupRegistry+"/ns/app:latest"))
+	// left in the migration registry by the stage restore of the pod
+	assert.Equal(t, migrationRegistry+"/ns/app:latest", swapImage(migrationRegistry+"/ns/app:latest"))
+	annotations[RestoredImageRegistryAnnotation] = migrationRegistry
+	swapImage, _ = RestoreImageSwap(annotations, restore(FinalMigration), backupRegistry, registry)
+	assert.Equal(t, registry+"/new-ns/app:latest", swapImage(migrationRegistry+"/ns/app:latest"))
+
+	// restores outside of migrations use the internal registry too
+	swapImage, target = RestoreImageSwap(map[string]string{}, &velero.Restore{}, backupRegistry, registry)
+	assert.Equal(t, registry, target)
+	assert.Equal(t, registry+"/ns/app:latest", swapImage(backupRegistry+"/ns/app:latest"))
+	swapImage, _ = RestoreImageSwap(map[string]string{}, &velero.Restore{}, backupRegistry, "")
+	assert.Equal(t, backupRegistry+"/ns/app:latest", swapImage(backupRegistry+"/ns/app:latest"))
+}
+
+func TestSwapRestoredImages(t *testing.T) {
+	spec := corev1API.PodSpec{
+		Containers: []corev1API.Container{
+			{Name: "digest", Image: "backup.registry:5000/old/app@" + testDigest},
+			{Name: "external", Image: "quay.io/old/app:v1"},
+		},
+		InitContainers: []corev1API.Container{
+			{Name: "init", Image: "backup.registry:5000/old/init:latest"},
+		},
+		EphemeralContainers: []corev1API.EphemeralContainer{
+			{EphemeralContainerCommon: corev1API.EphemeralContainerCommon{Name: "debug", Image: "backup.registry:5000/old/debug"}},
+		},
+	}
+	restore := &velero.Restore{Spec: velero.RestoreSpec{NamespaceMapping: map[string]string{"old": "new"}}}
+	annotations := SwapRestoredImages(&spec, nil, restore, "backup.registry:5000", "restore.registry:5000", logrus.New())
+	assert.Equal(t, "restore.registry:5000/new/app@"+testDigest, spec.Containers[0].Image)
+	assert.Equal(t, "quay.io/old/app:v1", spec.Containers[1].Image)
+	assert.Equal(t, "restore.registry:5000/new/init:latest", spec.InitContainers[0].Image)
+	assert.Equal(t, "restore.registry:5000/new/debug", spec.EphemeralContainers[0].Image)
+	assert.Equal(t, map[string]string{RestoredImageRegistryAnnotation: "restore.registry:5000"}, annotations)
+
+	// stage migrations point the pod templates of controllers at the migration registry too
+	spec.Containers[0].Image = "backup.registry:5000/old/app:v1"
+	stage := &velero.Restore{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{StageOrFinalMigrationAnnotation: StageMigration}},
+		Spec:       velero.RestoreSpec{BackupName: "backup"},
+	}
+	annotations = SwapRestoredImages(&spec, map[string]string{MigrationRegistry: "migration.example.com"}, stage, "backup.registry:5000", "restore.registry:5000", logrus.New())
+	assert.Equal(t, "migration.example.com/old/app:v1", spec.Containers[0].Image)
+	assert.Equal(t, "migration.example.com", annotations[RestoredImageRegistryAnnotation])
+
+	// nothing is swapped without a registry, nor recorded
+	spec.Containers[0].Image = "backup.registry:5000/old/app:v1"
+	annotations = SwapRestoredImages(&spec, nil, restore, "backup.registry:5000", "", logrus.New())
+	assert.Equal(t, "backup.registry:5000/old/app:v1", spec.Containers[0].Image)
+	assert.Nil(t, annotations)
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RepositoryTemplateEnvVar is the environment variable setting the repository
+	// of the migration registry the images of an ImageStream are copied to
+	RepositoryTemplateEnvVar  = "IMAGE_COPY_REPOSITORY_TEMPLATE"
+	defaultRepositoryTemplate = "${namespace}/${name}"
+)
+
+var repositoryTemplateVariable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// RepositoryVariables are the values substituted in a repository template
+type RepositoryVariables struct {
+	// The namespace of the backed-up ImageStream
+	Namespace string
+	// The namespace the ImageStream is restored to; the namespace at backup time
+	MappedNamespace string
+	// The name of the ImageStream
+	Name string
+	// The name of the backup
+	Backup string
+}
+
+// RepositoryTemplate returns the migration registry repository template,
+// configured by the IMAGE_COPY_REPOSITORY_TEMPLATE environment variable
+func RepositoryTemplate() string {
+	template := os.Getenv(RepositoryTemplateEnvVar)
+	if len(template) == 0 {
+		return defaultRepositoryTemplate
+	}
+	return template
+}
+
+// ValidateRepositoryTemplate returns an error if the template uses unknown variables
+func ValidateRepositoryTemplate(template string) error {
+	for _, match := range repositoryTemplateVariable.FindAllStringSubmatch(template, -1) {
+		if _, found := (RepositoryVariables{}).values()[match[1]]; !found {
+			return fmt.Errorf("unknown variable %s in %s %q", match[0], RepositoryTemplateEnvVar, template)
+		}
+	}
+	if strings.HasPrefix(template, "/") || strings.HasSuffix(template, "/") {
+		return fmt.Errorf("%s %q must not start or end with /", RepositoryTemplateEnvVar, template)
+	}
+	return nil
+}
+
+// ExpandRepositoryTemplate substitutes variables in the repository template
+func ExpandRepositoryTemplate(template string, variables RepositoryVariables) string {
+	values := variables.values()
+	return repositoryTemplateVariable.ReplaceAllStringFunc(template, func(variable string) string {
+		return values[repositoryTemplateVariable.FindStringSubmatch(variable)[1]]
+	})
+}
+
+func (v RepositoryVariables) values() map[string]string {
+	return map[string]string{
+		"namespace":       v.Namespace,
+		"mappedNamespace": v.MappedNamespace,
+		"name":            v.Name,
+		"backup":          v.Backup,
+	}
+}
+
+// MigrationRegistryImage returns a function swapping image references to the
+// backup internal registry to the migration registry repository the images of
+// their imagestream were copied to by the backup
+func MigrationRegistryImage(backupRegistry, migrationRegistry, backup string, namespaceMapping map[string]string) func(string) string {
+	return func(image string) string {
+		ref, err := ParseImageReference(image)
+		if err != nil || len(backupRegistry) == 0 || ref.Registry != backupRegistry {
+			return image
+		}
+		pathSplit := strings.SplitN(ref.Repository, "/", 2)
+		if len(pathSplit) != 2 {
+			return image
+		}
+		mappedNamespace := pathSplit[0]
+		if newNamespace := namespaceMapping[pathSplit[0]]; len(newNamespace) > 0 {
+			mappedNamespace = newNamespace
+		}
+		ref.Registry = migrationRegistry
+		ref.Repository = ExpandRepositoryTemplate(RepositoryTemplate(), RepositoryVariables{
+			Namespace:       pathSplit[0],
+			MappedNamespace: mappedNamespace,
+			Name:            pathSplit[1],
+			Backup:          backup,
+		})
+		return ref.String()
+	}
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepositoryTemplate(t *testing.T) {
+	variables := RepositoryVariables{Namespace: "ns-a", MappedNamespace: "ns-b", Name: "app", Backup: "nightly"}
+	assert.Equal(t, "ns-a/app", ExpandRepositoryTemplate(defaultRepositoryTemplate, variables))
+	assert.Equal(t, "migration-prod/ns-a-app", ExpandRepositoryTemplate("migration-prod/${namespace}-${name}", variables))
+	assert.Equal(t, "nightly-ns-b-app", ExpandRepositoryTemplate("${backup}-${mappedNamespace}-${name}", variables))
+
+	assert.NoError(t, ValidateRepositoryTemplate("migration-prod/${namespace}-${name}"))
+	assert.Error(t, ValidateRepositoryTemplate("${namespace}/${imagestream}"))
+	assert.Error(t, ValidateRepositoryTemplate("/${namespace}/${name}"))
+}
+
+func TestMigrationRegistryImage(t *testing.T) {
+	swapImage := MigrationRegistryImage("docker-registry.default.svc:5000", "migration.example.com", "backup", map[string]string{"ns": "new-ns"})
+	assert.Equal(t, "migration.example.com/ns/app@sha256:1", swapImage("docker-registry.default.svc:5000/ns/app@sha256:1"))
+	assert.Equal(t, "quay.io/ns/app:latest", swapImage("quay.io/ns/app:latest"))
+
+	os.Setenv(RepositoryTemplateEnvVar, "${backup}/${mappedNamespace}/${name}")
+	defer os.Unsetenv(RepositoryTemplateEnvVar)
+	assert.Equal(t, "migration.example.com/backup/new-ns/app:latest", swapImage("docker-registry.default.svc:5000/ns/app:latest"))
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
 	"github.com/openshift/client-go/route/clientset/versioned/scheme"
 	routev1client "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
-	"github.com/openshift/library-go/pkg/image/reference"
 	"github.com/sirupsen/logrus"
 	velero "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -30,7 +29,7 @@ func GetRegistryInfo(major, minor int, log logrus.FieldLogger) (string, error) {
 	imageStreams, err := imageClient.ImageStreams("openshift").List(metav1.ListOptions{})
 	if err == nil && len(imageStreams.Items) > 0 {
 		if value := imageStreams.Items[0].Status.DockerImageRepository; len(value) > 0 {
-			ref, err := reference.Parse(value)
+			ref, err := ParseImageReference(value)
 			if err == nil {
 				log.Info("[GetRegistryInfo] value from imagestream")
 				return ref.Registry, nil
@@ -54,7 +53,7 @@ func GetRegistryInfo(major, minor int, log logrus.FieldLogger) (string, error) {
 			// Return empty registry host but no error; registry not found
 			return "", nil
 		}
-		internalRegistry := registrySvc.Spec.ClusterIP + ":" + strconv.Itoa(int(registrySvc.Spec.Ports[0].Port))
+		internalRegistry := RegistryHostPort(registrySvc.Spec.ClusterIP, int(registrySvc.Spec.Ports[0].Port))
 		log.Info("[GetRegistryInfo] value from clusterIP")
 		return internalRegistry, nil
 	} else {
@@ -76,6 +75,29 @@ func GetRegistryInfo(major, minor int, log logrus.FieldLogger) (string, error) {
 	}
 }
 
+// GetRoutingSubdomain returns the default subdomain of the hosts generated
+// for routes, from the openshift-apiserver config of 4.x clusters, or "" for
+// 3.x clusters, whose master config isn't readable through the API
+func GetRoutingSubdomain(major, minor int) (string, error) {
+	if major != 1 || minor <= 11 {
+		return "", nil
+	}
+	cClient, err := clients.CoreClient()
+	if err != nil {
+		return "", err
+	}
+	config, err := cClient.ConfigMaps("openshift-apiserver").Get("config", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	serverConfig := APIServerConfig{}
+	err = json.Unmarshal([]byte(config.Data["config.yaml"]), &serverConfig)
+	if err != nil {
+		return "", err
+	}
+	return serverConfig.RoutingConfig.Subdomain, nil
+}
+
 func getMetadataAndAnnotations(item runtime.Unstructured) (metav1.Object, map[string]string, error) {
 	metadata, err := meta.Accessor(item)
 	if err != nil {
@@ -27,6 +27,154 @@ const (
 
 const SkipImages string = "openshift.io/skip-images"
 
+// Set to "true" on an ImageStream to also copy images that reference external registries
+const CopyExternalImagesAnnotation string = "openshift.io/copy-external-images"
+
+// Comma-separated tag names or glob patterns limiting which ImageStream tags have their images copied
+const BackupIncludeTagsAnnotation string = "openshift.io/backup-include-tags"
+
+// Set on imagestreamtags which a BuildConfig of their namespace pushes its output to
+const BuildOutputTagAnnotation string = "openshift.io/build-output-tag"
+
+// Restore annotation to also restore imagestreamtags which builds push to
+const RestoreBuildOutputTagsAnnotation string = "openshift.io/restore-build-output-tags"
+
+// Set to "true" on the Restore to restore Builds, which are skipped by default
+const RestoreBuildsAnnotation string = "openshift.io/restore-builds"
+
+// Set to "true" on the Restore to remove the ImageChange triggers of restored BuildConfigs until they are re-enabled
+const PauseBuildTriggersAnnotation string = "openshift.io/pause-build-triggers"
+
+// JSON of the triggers of a restored BuildConfig before its ImageChange triggers were removed
+const OriginalBuildTriggersAnnotation string = "openshift.io/original-build-triggers"
+
+// Set to "true" on the Restore to give restored BuildConfigs new webhook trigger secrets
+const RegenerateWebhookSecretsAnnotation string = "openshift.io/regenerate-webhook-secrets"
+
+// Set on the Restore to the number of most recent Builds restored per BuildConfig (0 restores all of them)
+const RestoreBuildsPerBuildConfigAnnotation string = "openshift.io/restore-builds-per-buildconfig"
+
+// The status.lastVersion a restored BuildConfig had at backup time
+const BackupLastBuildVersionAnnotation string = "openshift.io/backup-last-build-version"
+
+// Set to "true" on the Restore to restore JenkinsPipeline strategy BuildConfigs to clusters which don't support them
+const RestoreJenkinsPipelinesAnnotation string = "openshift.io/restore-jenkins-pipelines"
+
+// Set to "true" on the Restore to restore DeploymentConfigs scaled to zero and paused, until data is verified
+const MigrateQuiesceAnnotation string = "openshift.io/migrate-quiesce"
+
+// The spec.replicas of a DeploymentConfig restored scaled to zero
+const OriginalReplicasAnnotation string = "openshift.io/original-replicas"
+
+// The spec.paused of a DeploymentConfig restored paused
+const OriginalPausedAnnotation string = "openshift.io/original-paused"
+
+// Set to "true" or "false" on the Restore to remove the ImageChange triggers of restored DeploymentConfigs, done by default for migrations
+const DisableImageTriggersAnnotation string = "openshift.io/disable-image-triggers"
+
+// JSON of the triggers of a restored DeploymentConfig before its ImageChange triggers were removed
+const OriginalTriggersAnnotation string = "openshift.io/original-triggers"
+
+// Set to "true" on the Restore to also restore DeploymentConfigs created by TemplateInstances or managed by operators
+const RestoreOwnedDeploymentConfigsAnnotation string = "openshift.io/restore-owned-deploymentconfigs"
+
+// Set to "true" on the Restore to restore DeploymentConfigs and Deployments paused
+const RestorePausedAnnotation string = "openshift.io/restore-paused"
+
+// Set to "true" on DeploymentConfigs and Deployments the restore paused, which were not paused at backup time
+const PausedByRestoreAnnotation string = "openshift.io/paused-by-restore"
+
+// Set on Deployments, StatefulSets and DaemonSets to update their container images from imagestream tags
+const ImageTriggersAnnotation string = "image.openshift.io/triggers"
+
+// Restore annotation to also restore pods controlled by e.g. a ReplicaSet, which recreates them
+const RestoreControlledPodsAnnotation string = "openshift.io/restore-controlled-pods"
+
+// Restore annotation to only clear the node names, and selectors of host names, zones and regions, of pods, keeping other node selectors
+const ClearNodeSelectionAnnotation string = "openshift.io/clear-node-selection"
+
+// Restore annotation to also restore pods which had succeeded or failed at backup time
+const RestoreFinishedPodsAnnotation string = "openshift.io/restore-finished-pods"
+
+// Set on backed up pods to the required ConfigMaps their volumes mount which the backup includes, separated by commas
+const BackupConfigMapsAnnotation string = "openshift.io/backup-configmaps"
+
+// Set on backed up pods to the UID range and supplemental groups of their namespace
+const BackupUIDRangeAnnotation string = "openshift.io/backup-uid-range"
+const BackupSupplementalGroupsAnnotation string = "openshift.io/backup-supplemental-groups"
+
+// Restore annotation to remove the SCC and seccomp annotations of pods, and their user and fs group IDs of the UID range of their namespace
+const ResetPodSecurityAnnotation string = "openshift.io/reset-pod-security"
+
+// Restore annotation naming a ConfigMap in the velero namespace which maps priority class names of the backup cluster to the ones of the restore cluster
+const PriorityClassMappingAnnotation string = "openshift.io/priorityclass-mapping"
+
+// Pod annotation recording the registry the internal registry images of a restored pod were pointed at, the migration registry for stage migrations
+const RestoredImageRegistryAnnotation string = "openshift.io/restored-image-registry"
+
+// Route annotation recording the default routing subdomain of the backup cluster
+const BackupRoutingSubdomainAnnotation string = "openshift.io/backup-routing-subdomain"
+
+// Backup annotation setting the default routing subdomain of the backup cluster, for clusters whose subdomain can't be looked up
+const RoutingSubdomainAnnotation string = "openshift.io/routing-subdomain"
+
+// Restore annotation to keep the hosts of Routes in the default routing subdomain of the backup cluster, e.g. restoring to the same cluster
+const PreserveRouteHostsAnnotation string = "openshift.io/preserve-route-hosts"
+
+// Restore annotation to only check registry access and image presence instead of copying images
+const ImageCopyDryRunAnnotation string = "openshift.io/image-copy-dry-run"
+
+// Restore annotation making any tag image copy failure fail the restore of the ImageStream
+const StrictImageCopyAnnotation string = "openshift.io/strict-image-copy"
+
+// The migration registry repository the images of an ImageStream were copied to at backup time
+const BackupRepositoryAnnotation string = "openshift.io/backup-repository"
+
+// Prefix of the per-tag annotations recording the digest copied to the migration registry, suffixed with the tag name
+const BackupImageDigestAnnotationPrefix string = "openshift.io/backup-image-digest."
+
+// Comma-separated tag names or glob patterns set on the Restore limiting which ImageStream tags are restored
+const RestoreIncludeTagsAnnotation string = "openshift.io/restore-include-tags"
+
+// Set on the Backup to the number of most recent images copied per ImageStream tag (0 copies the whole history)
+const HistoryDepthAnnotation string = "openshift.io/image-copy-history-depth"
+
+// Set to "true" on the Backup to only copy the current image of each ImageStream tag
+const LatestOnlyAnnotation string = "openshift.io/image-copy-latest-only"
+
+// Comma-separated tag@image entries of ImageStream tag items whose image was missing from the internal registry at backup time
+const BackupSkippedTagsAnnotation string = "openshift.io/backup-skipped-tags"
+
+// Comma-separated source=pushed digest pairs of ImageStream images whose manifest had to be converted at backup time
+const BackupConvertedDigestsAnnotation string = "openshift.io/backup-converted-digests"
+
+// Path of the OCI layout the images of the ImageStream were copied to at backup time, relative to IMAGE_COPY_OCI_LAYOUT_DIR
+const BackupOCILayoutAnnotation string = "openshift.io/backup-oci-layout"
+
+// Set to "true" on the Backup to copy the images of samples operator ImageStreams
+const CopySamplesImagesAnnotation string = "openshift.io/copy-samples-images"
+
+// Blob bytes transferred to the migration registry while backing up an ImageStream
+const BackupCopiedBytesAnnotation string = "openshift.io/backup-copied-bytes"
+
+// Blob bytes of an ImageStream not transferred because they already existed in the migration registry
+const BackupExistingBytesAnnotation string = "openshift.io/backup-existing-bytes"
+
+// Set to "true" on the Restore to point ImageStream tags at the images in the migration registry instead of copying them
+const RestoreFromMigrationRegistryAnnotation string = "openshift.io/restore-images-from-migration-registry"
+
+// Set on the Restore to "true" or a duration (e.g. "10m") to wait for the tags of restored ImageStreams to be resolvable
+const WaitForImageStreamTagsAnnotation string = "openshift.io/wait-for-imagestream-tags"
+
+// Set on the Restore to the namespace/name of a dockerconfigjson Secret holding the credentials to push restored images with
+const RegistrySecretAnnotation string = "openshift.io/registry-secret"
+
+// Set to "true" on an ImageStream to back it up without copying any of its images
+const SkipImageCopyAnnotation string = "openshift.io/skip-image-copy"
+
+// Set to "true" on a backed-up ImageStream whose images were not copied, so the restore skips the copy as well
+const ImageCopySkippedAnnotation string = "openshift.io/image-copy-skipped"
+
 // annotations and labels related to stage vs. initial/final migrations/restores
 const (
 	// Whether the backup/restore is associated with a stage or a final migration
@@ -69,6 +217,7 @@ const (
 	RelatedIsTagAnnotation    string = "migration.openshift.io/related-istag"    // Related istag name
 	PVCSelectedNodeAnnotation string = "volume.kubernetes.io/selected-node"      // kubernetes PVC annotations
 	ResticBackupAnnotation    string = "backup.velero.io/backup-volumes"         // Restic annotations
+	ResticExcludesAnnotation  string = "backup.velero.io/backup-volumes-excludes"
 )
 
 // Configmap Name
@@ -1,11 +1,13 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	velero "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	corev1API "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -15,37 +17,31 @@ import (
 // ReplaceImageRefPrefix replaces an image reference prefix with newPrefix.
 // If the input image reference does not start with oldPrefix, an error is returned
 func ReplaceImageRefPrefix(s, oldPrefix, newPrefix string, namespaceMapping map[string]string) (string, error) {
-	refSplit := strings.SplitN(s, "/", 2)
-	if len(refSplit) != 2 {
+	ref, err := ParseImageReference(s)
+	if err != nil || ref.Registry != oldPrefix {
 		err := fmt.Errorf("image reference [%v] does not have prefix [%v]", s, oldPrefix)
 		return "", err
 	}
-	if refSplit[0] != oldPrefix {
-		err := fmt.Errorf("image reference [%v] does not have prefix [%v]", s, oldPrefix)
-		return "", err
+	namespace := ""
+	namespaceSplit := strings.SplitN(ref.Repository, "/", 2)
+	if len(namespaceSplit) == 2 {
+		namespace = namespaceSplit[0]
 	}
-	outPath := refSplit[1]
-	namespaceSplit := strings.SplitN(refSplit[1], "/", 2)
-	if len(namespaceSplit) == 2 && namespaceMapping[namespaceSplit[0]] != "" { // change namespace if mapping is enabled
-		outPath = strings.Join([]string{namespaceMapping[namespaceSplit[0]], namespaceSplit[1]}, "/")
+	if len(namespace) > 0 && namespaceMapping[namespace] != "" { // change namespace if mapping is enabled
+		ref.Repository = strings.Join([]string{namespaceMapping[namespace], namespaceSplit[1]}, "/")
 	}
-	if len(namespaceSplit) == 2 && namespaceSplit[0] == "openshift" {
-		shaSplit := strings.SplitN(refSplit[1], "@", 2)
-		if len(shaSplit) == 2 {
-			outPath = shaSplit[0]
-		}
+	if namespace == "openshift" {
+		ref.Digest = ""
 	}
-	return fmt.Sprintf("%s/%s", newPrefix, outPath), nil
+	ref.Registry = newPrefix
+	return ref.String(), nil
 }
 
 // HasImageRefPrefix returns true if the input image reference begins with
 // the input prefix followed by "/"
 func HasImageRefPrefix(s, prefix string) bool {
-	refSplit := strings.SplitN(s, "/", 2)
-	if len(refSplit) != 2 {
-		return false
-	}
-	return refSplit[0] == prefix
+	ref, err := ParseImageReference(s)
+	return err == nil && ref.Registry == prefix
 }
 
 // LocalImageReference describes an image in the internal openshift registry
@@ -57,51 +53,191 @@ type LocalImageReference struct {
 	Digest    string
 }
 
-// ParseLocalImageReference
+// ParseLocalImageReference parses a reference to an image of the internal registry prefix
 func ParseLocalImageReference(s, prefix string) (*LocalImageReference, error) {
-	refSplit := strings.Split(s, "/")
-	if refSplit[0] != prefix {
+	ref, err := ParseImageReference(s)
+	if err != nil || ref.Registry != prefix {
 		return nil, fmt.Errorf("image reference is not local")
 	}
-	if len(refSplit) != 3 {
+	repositorySplit := strings.Split(ref.Repository, "/")
+	if len(repositorySplit) != 2 {
 		return nil, fmt.Errorf("Unexpected image reference %s", s)
 	}
-	parsed := LocalImageReference{Registry: prefix, Namespace: refSplit[1]}
-	digestSplit := strings.Split(refSplit[2], "@")
-	if len(digestSplit) > 2 {
-		return nil, fmt.Errorf("Unexpected image reference %s", s)
-	} else if len(digestSplit) == 2 {
-		parsed.Name = digestSplit[0]
-		parsed.Digest = digestSplit[1]
-		return &parsed, nil
+	return &LocalImageReference{
+		Registry:  prefix,
+		Namespace: repositorySplit[0],
+		Name:      repositorySplit[1],
+		Tag:       ref.Tag,
+		Digest:    ref.Digest,
+	}, nil
+}
+
+// SwapPodSpecImages swaps the images of the containers, init containers and
+// ephemeral containers of spec with swapImage, returning how many it changed
+func SwapPodSpecImages(spec *corev1API.PodSpec, swapImage func(string) string, log logrus.FieldLogger) int {
+	swapped := 0
+	for _, containers := range [][]corev1API.Container{spec.Containers, spec.InitContainers} {
+		for n, container := range containers {
+			if newImageRef := swapImage(container.Image); newImageRef != container.Image {
+				log.Infof("[util] replacing container image ref %s with %s", container.Image, newImageRef)
+				containers[n].Image = newImageRef
+				swapped++
+			}
+		}
 	}
-	tagSplit := strings.Split(refSplit[2], ":")
-	if len(tagSplit) > 2 {
-		return nil, fmt.Errorf("Unexpected image reference %s", s)
-	} else if len(tagSplit) == 2 {
-		parsed.Tag = tagSplit[1]
-	}
-	parsed.Name = tagSplit[0]
-	return &parsed, nil
-}
-
-// SwapContainerImageRefs updates internal image references from
-// backup registry to restore registry pathnames
-func SwapContainerImageRefs(containers []corev1API.Container, oldRegistry, newRegistry string, log logrus.FieldLogger, namespaceMapping map[string]string) {
-	if oldRegistry == "" || newRegistry == "" {
-		return
-	}
-	for n, container := range containers {
-		imageRef := container.Image
-		log.Infof("[util] container image ref %s", imageRef)
-		newImageRef, err := ReplaceImageRefPrefix(imageRef, oldRegistry, newRegistry, namespaceMapping)
-		if err == nil {
-			// Replace local image
-			log.Infof("[util] replacing container image ref %s with %s", imageRef, newImageRef)
-			containers[n].Image = newImageRef
+	for n, container := range spec.EphemeralContainers {
+		if newImageRef := swapImage(container.Image); newImageRef != container.Image {
+			log.Infof("[util] replacing ephemeral container image ref %s with %s", container.Image, newImageRef)
+			spec.EphemeralContainers[n].Image = newImageRef
+			swapped++
+		}
+	}
+	return swapped
+}
+
+// RestoreImageSwap returns a function swapping the internal registry image
+// references of a pod, or pod template owner, with annotations restored by
+// restore, and the registry it points them at. Stage migrations, and restores
+// with the restore-images-from-migration-registry annotation, point them at the
+// images the backup copied to the migration registry, so applications run
+// before the final migration. Final migrations and other restores point them at
+// the internal registry of this cluster, as well as the images in the migration
+// registry a previous restore of the item recorded, whose repositories are
+// taken to be namespace/name like by the default repository template.
+func RestoreImageSwap(annotations map[string]string, restore *velero.Restore, backupRegistry, registry string) (func(string) string, string) {
+	namespaceMapping := restore.Spec.NamespaceMapping
+	migrationType := restore.Annotations[StageOrFinalMigrationAnnotation]
+	migrationRegistry := annotations[MigrationRegistry]
+	if len(migrationRegistry) == 0 {
+		migrationRegistry = restore.Annotations[MigrationRegistry]
+	}
+	if len(migrationRegistry) > 0 && migrationType != FinalMigration &&
+		(migrationType == StageMigration || restore.Annotations[RestoreFromMigrationRegistryAnnotation] == "true") {
+		return MigrationRegistryImage(backupRegistry, migrationRegistry, restore.Spec.BackupName, namespaceMapping), migrationRegistry
+	}
+
+	oldRegistries := []string{}
+	if len(backupRegistry) > 0 {
+		oldRegistries = append(oldRegistries, backupRegistry)
+	}
+	if restored := annotations[RestoredImageRegistryAnnotation]; len(restored) > 0 && restored != registry {
+		oldRegistries = append(oldRegistries, restored)
+	}
+	return func(image string) string {
+		if len(registry) == 0 {
+			return image
+		}
+		for _, oldRegistry := range oldRegistries {
+			if newImage, err := ReplaceImageRefPrefix(image, oldRegistry, registry, namespaceMapping); err == nil {
+				return newImage
+			}
+		}
+		return image
+	}, registry
+}
+
+// SwapRestoredImages swaps the internal registry images of spec, the pod spec
+// of an item with annotations, like RestoreImageSwap, and returns annotations
+// recording the registry they point at, if any changed
+func SwapRestoredImages(spec *corev1API.PodSpec, annotations map[string]string, restore *velero.Restore, backupRegistry, registry string, log logrus.FieldLogger) map[string]string {
+	swapImage, imageRegistry := RestoreImageSwap(annotations, restore, backupRegistry, registry)
+	if SwapPodSpecImages(spec, swapImage, log) == 0 {
+		return annotations
+	}
+	log.Infof("[util] pointed the internal registry images at %s", imageRegistry)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[RestoredImageRegistryAnnotation] = imageRegistry
+	return annotations
+}
+
+// imageTrigger is an entry of the image.openshift.io/triggers annotation
+type imageTrigger struct {
+	From      imageTriggerSource `json:"from"`
+	FieldPath string             `json:"fieldPath"`
+	Paused    bool               `json:"paused,omitempty"`
+}
+
+// imageTriggerSource is the image an imageTrigger updates its field with
+type imageTriggerSource struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// SwapImageTriggerRefs swaps the internal registry image references and the
+// imagestream namespaces of the image.openshift.io/triggers annotation, so the
+// trigger controller doesn't put stale images back into the restored containers
+func SwapImageTriggerRefs(annotations map[string]string, oldRegistry, newRegistry string, log logrus.FieldLogger, namespaceMapping map[string]string) error {
+	value, ok := annotations[ImageTriggersAnnotation]
+	if !ok {
+		return nil
+	}
+	var triggers []imageTrigger
+	if err := json.Unmarshal([]byte(value), &triggers); err != nil {
+		return fmt.Errorf("invalid %s annotation: %v", ImageTriggersAnnotation, err)
+	}
+	for i, trigger := range triggers {
+		if trigger.From.Kind == "DockerImage" {
+			if oldRegistry == "" || newRegistry == "" {
+				continue
+			}
+			if newImageRef, err := ReplaceImageRefPrefix(trigger.From.Name, oldRegistry, newRegistry, namespaceMapping); err == nil {
+				log.Infof("[util] replacing image trigger ref %s with %s", trigger.From.Name, newImageRef)
+				triggers[i].From.Name = newImageRef
+			}
+			continue
+		}
+		if newNamespace := namespaceMapping[trigger.From.Namespace]; len(trigger.From.Namespace) > 0 && newNamespace != "" {
+			log.Infof("[util] replacing image trigger namespace %s with %s", trigger.From.Namespace, newNamespace)
+			triggers[i].From.Namespace = newNamespace
+		}
+	}
+	data, err := json.Marshal(triggers)
+	if err != nil {
+		return err
+	}
+	annotations[ImageTriggersAnnotation] = string(data)
+	return nil
+}
+
+// GetRestoreRegistryInfo returns the backup and restore internal registries
+// of item like GetSrcAndDestRegistryInfo, looking up the restore registry if
+// the common plugin has not annotated item with it yet
+func GetRestoreRegistryInfo(item runtime.Unstructured, log logrus.FieldLogger) (string, string, error) {
+	backupRegistry, registry, err := GetSrcAndDestRegistryInfo(item)
+	if err != nil {
+		return "", "", err
+	}
+	if len(registry) == 0 && len(backupRegistry) > 0 {
+		major, minor, err := GetServerVersion()
+		if err != nil {
+			return "", "", err
+		}
+		registry, err = GetRegistryInfo(major, minor, log)
+		if err != nil {
+			return "", "", err
 		}
 	}
+	return backupRegistry, registry, nil
+}
 
+// PauseRestored pauses a restored DeploymentConfig or Deployment, given its
+// annotations and paused field, and records in the
+// openshift.io/paused-by-restore annotation if it was not paused at backup time,
+// so unpausing can leave alone the ones paused on purpose. It returns the
+// updated annotations.
+func PauseRestored(annotations map[string]string, paused *bool) map[string]string {
+	if !*paused {
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[PausedByRestoreAnnotation] = "true"
+		*paused = true
+	}
+	return annotations
 }
 
 // UpdatePullSecret updates registry pull (or push) secret
@@ -118,21 +254,31 @@ func UpdatePullSecret(
 		return secretRef, nil
 	}
 
-	for _, prefix := range []string{"builder-dockercfg-", "default-dockercfg-", "deployer-dockercfg-"} {
-		if strings.HasPrefix(secretRef.Name, prefix) {
-			for _, secret := range secretList.Items {
-				if strings.HasPrefix(secret.Name, prefix) {
-					log.Info(fmt.Sprintf("[util] Found new dockercfg secret: %v", secret))
-					newSecret := corev1API.LocalObjectReference{Name: secret.Name}
-					return &newSecret, nil
-				}
+	if prefix := GeneratedDockercfgSecretPrefix(secretRef.Name); len(prefix) > 0 {
+		for _, secret := range secretList.Items {
+			if strings.HasPrefix(secret.Name, prefix) {
+				log.Info(fmt.Sprintf("[util] Found new dockercfg secret: %s", secret.Name))
+				newSecret := corev1API.LocalObjectReference{Name: secret.Name}
+				return &newSecret, nil
 			}
-			return nil, errors.New("Secret not found")
 		}
+		return nil, errors.New("Secret not found")
 	}
 	return secretRef, nil
 }
 
+// GeneratedDockercfgSecretPrefix returns the name prefix of the dockercfg
+// secrets generated for the builder, default or deployer service account if
+// name is one of them, e.g. "builder-dockercfg-", or "" otherwise
+func GeneratedDockercfgSecretPrefix(name string) string {
+	for _, prefix := range []string{"builder-dockercfg-", "default-dockercfg-", "deployer-dockercfg-"} {
+		if strings.HasPrefix(name, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
 // GetSrcAndDestRegistryInfo returns the Registry hostname for both src and dest clusters
 func GetSrcAndDestRegistryInfo(item runtime.Unstructured) (string, string, error) {
 	_, annotations, err := getMetadataAndAnnotations(item)
@@ -144,6 +290,92 @@ func GetSrcAndDestRegistryInfo(item runtime.Unstructured) (string, string, error
 	return backupRegistry, restoreRegistry, nil
 }
 
+// RestoresNamespace returns true if the namespace filters of restore include namespace
+func RestoresNamespace(restore *velero.Restore, namespace string) bool {
+	return namespaceIncluded(restore.Spec.IncludedNamespaces, restore.Spec.ExcludedNamespaces, namespace)
+}
+
+// MappedNamespace returns the namespace restore restores the items of
+// namespace to. Velero maps the namespaces of items after running the restore
+// item actions, so they still have their backup namespace.
+func MappedNamespace(restore *velero.Restore, namespace string) string {
+	if mapped := restore.Spec.NamespaceMapping[namespace]; len(mapped) > 0 {
+		return mapped
+	}
+	return namespace
+}
+
+// BacksUpNamespace returns true if the namespace filters of backup include namespace
+func BacksUpNamespace(backup *velero.Backup, namespace string) bool {
+	return namespaceIncluded(backup.Spec.IncludedNamespaces, backup.Spec.ExcludedNamespaces, namespace)
+}
+
+func namespaceIncluded(includedNamespaces, excludedNamespaces []string, namespace string) bool {
+	for _, excluded := range excludedNamespaces {
+		if excluded == namespace {
+			return false
+		}
+	}
+	if len(includedNamespaces) == 0 {
+		return true
+	}
+	for _, included := range includedNamespaces {
+		if included == "*" || included == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoresResource returns true if the resource filters of restore include
+// resource, given by its plural name
+func RestoresResource(restore *velero.Restore, resource string) bool {
+	return resourceIncluded(restore.Spec.IncludedResources, restore.Spec.ExcludedResources, resource)
+}
+
+// RestoresClusterResource returns true if restore restores the cluster scoped
+// resource, given by its plural name. Velero restores cluster scoped resources
+// when the restore includes them, or doesn't say and restores all namespaces.
+func RestoresClusterResource(restore *velero.Restore, resource string) bool {
+	if !RestoresResource(restore, resource) {
+		return false
+	}
+	if restore.Spec.IncludeClusterResources != nil {
+		return *restore.Spec.IncludeClusterResources
+	}
+	if len(restore.Spec.ExcludedNamespaces) > 0 {
+		return false
+	}
+	return len(restore.Spec.IncludedNamespaces) == 0 ||
+		len(restore.Spec.IncludedNamespaces) == 1 && restore.Spec.IncludedNamespaces[0] == "*"
+}
+
+// BacksUpResource returns true if the resource filters of backup include
+// resource, given by its plural name
+func BacksUpResource(backup *velero.Backup, resource string) bool {
+	return resourceIncluded(backup.Spec.IncludedResources, backup.Spec.ExcludedResources, resource)
+}
+
+func resourceIncluded(includedResources, excludedResources []string, resource string) bool {
+	matches := func(filter string) bool {
+		return filter == "*" || filter == resource || strings.HasPrefix(filter, resource+".")
+	}
+	for _, excluded := range excludedResources {
+		if matches(excluded) {
+			return false
+		}
+	}
+	if len(includedResources) == 0 {
+		return true
+	}
+	for _, included := range includedResources {
+		if matches(included) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetOwnerReferences returns the array of OwnerReferences associated with the resource
 func GetOwnerReferences(item runtime.Unstructured) ([]metav1.OwnerReference, error) {
 	metadata, err := meta.Accessor(item)
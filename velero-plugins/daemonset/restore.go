@@ -31,12 +31,20 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	json.Unmarshal(itemMarshal, &daemonSet)
 	p.Log.Infof("[daemonset-restore] daemonset: %s", daemonSet.Name)
 
-	backupRegistry, registry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	backupRegistry, registry, err := common.GetRestoreRegistryInfo(input.Item, p.Log)
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(daemonSet.Spec.Template.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(daemonSet.Spec.Template.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
+	daemonSet.Annotations = common.SwapRestoredImages(&daemonSet.Spec.Template.Spec, daemonSet.Annotations, input.Restore, backupRegistry, registry, p.Log)
+	if err := common.SwapImageTriggerRefs(daemonSet.Annotations, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping); err != nil {
+		p.Log.Error("[daemonset-restore] error swapping image trigger refs: ", err)
+		return nil, err
+	}
+
+	if err := common.UpdatePriorityClassName(&daemonSet.Spec.Template.Spec, input.Restore, p.Log); err != nil {
+		p.Log.Error("[daemonset-restore] error updating priority class: ", err)
+		return nil, err
+	}
 
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(daemonSet)
@@ -31,12 +31,25 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	json.Unmarshal(itemMarshal, &deployment)
 	p.Log.Infof("[deployment-restore] deployment: %s", deployment.Name)
 
-	backupRegistry, registry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	backupRegistry, registry, err := common.GetRestoreRegistryInfo(input.Item, p.Log)
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(deployment.Spec.Template.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(deployment.Spec.Template.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
+	deployment.Annotations = common.SwapRestoredImages(&deployment.Spec.Template.Spec, deployment.Annotations, input.Restore, backupRegistry, registry, p.Log)
+	if err := common.SwapImageTriggerRefs(deployment.Annotations, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping); err != nil {
+		p.Log.Error("[deployment-restore] error swapping image trigger refs: ", err)
+		return nil, err
+	}
+
+	if input.Restore.Annotations[common.RestorePausedAnnotation] == "true" {
+		p.Log.Infof("[deployment-restore] restoring deployment %s paused", deployment.Name)
+		deployment.Annotations = common.PauseRestored(deployment.Annotations, &deployment.Spec.Paused)
+	}
+
+	if err := common.UpdatePriorityClassName(&deployment.Spec.Template.Spec, input.Restore, p.Log); err != nil {
+		p.Log.Error("[deployment-restore] error updating priority class: ", err)
+		return nil, err
+	}
 
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(deployment)
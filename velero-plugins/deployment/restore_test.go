@@ -0,0 +1,115 @@
+package deployment
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	appsv1API "k8s.io/api/apps/v1"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"deployments.apps"}}, actual)
+}
+
+func TestRestorePluginRestoresPaused(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.RestorePausedAnnotation: "true"}}}
+	item := deploymentItem(t, appsv1API.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"}})
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := restoredDeployment(t, output)
+	assert.True(t, restored.Spec.Paused)
+	assert.Equal(t, "true", restored.Annotations[common.PausedByRestoreAnnotation])
+}
+
+func TestRestorePluginSwapsInternalRegistry(t *testing.T) {
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"old": "new"}}}
+	deployment := appsv1API.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:      "app",
+		Namespace: "old",
+		Annotations: map[string]string{
+			common.BackupRegistryHostname:  "backup.registry:5000",
+			common.RestoreRegistryHostname: "restore.registry:5000",
+			common.ImageTriggersAnnotation: `[{"from":{"kind":"ImageStreamTag","name":"app:latest","namespace":"old"},"fieldPath":"spec.template.spec.containers[?(@.name==\"app\")].image"}]`,
+		},
+	}}
+	deployment.Spec.Template.Spec.Containers = []corev1API.Container{
+		{Name: "app", Image: "backup.registry:5000/old/app@" + testDigest},
+		{Name: "db", Image: "quay.io/db:v1"},
+	}
+	deployment.Spec.Template.Spec.InitContainers = []corev1API.Container{{Name: "init", Image: "backup.registry:5000/old/init:latest"}}
+	item := deploymentItem(t, deployment)
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := restoredDeployment(t, output)
+	assert.Equal(t, "restore.registry:5000/new/app@"+testDigest, restored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "quay.io/db:v1", restored.Spec.Template.Spec.Containers[1].Image)
+	assert.Equal(t, "restore.registry:5000/new/init:latest", restored.Spec.Template.Spec.InitContainers[0].Image)
+	assert.Equal(t, `[{"from":{"kind":"ImageStreamTag","name":"app:latest","namespace":"new"},"fieldPath":"spec.template.spec.containers[?(@.name==\"app\")].image"}]`,
+		restored.Annotations[common.ImageTriggersAnnotation])
+	assert.False(t, restored.Spec.Paused)
+}
+
+func TestRestorePluginStageMigrationUsesMigrationRegistry(t *testing.T) {
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.StageOrFinalMigrationAnnotation: common.StageMigration}},
+		Spec:       v1.RestoreSpec{BackupName: "backup", NamespaceMapping: map[string]string{"old": "new"}},
+	}
+	deployment := appsv1API.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:      "app",
+		Namespace: "old",
+		Annotations: map[string]string{
+			common.BackupRegistryHostname:  "backup.registry:5000",
+			common.RestoreRegistryHostname: "restore.registry:5000",
+			common.MigrationRegistry:       "migration.example.com",
+		},
+	}}
+	deployment.Spec.Template.Spec.Containers = []corev1API.Container{{Name: "app", Image: "backup.registry:5000/old/app:latest"}}
+	item := deploymentItem(t, deployment)
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := restoredDeployment(t, output)
+	assert.Equal(t, "migration.example.com/old/app:latest", restored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "migration.example.com", restored.Annotations[common.RestoredImageRegistryAnnotation])
+}
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// deploymentItem returns deployment as an item to restore
+func deploymentItem(t *testing.T, deployment appsv1API.Deployment) *unstructured.Unstructured {
+	deployment.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+	data, err := json.Marshal(deployment)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+	return item
+}
+
+// restoredDeployment returns the deployment restored by output
+func restoredDeployment(t *testing.T, output *velero.RestoreItemActionExecuteOutput) appsv1API.Deployment {
+	restored := appsv1API.Deployment{}
+	data, err := json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	return restored
+}
@@ -0,0 +1,137 @@
+package deploymentconfig
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	appsv1API "github.com/openshift/api/apps/v1"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// BackupReferencesEnvVar enables backing up the configmaps and secrets
+// deploymentconfigs reference along with them, which widens the backups
+const BackupReferencesEnvVar = "BACKUP_DEPLOYMENTCONFIG_REFERENCES"
+
+// tokenSecretName matches the names of the token secrets generated for
+// service accounts, e.g. default-token-x7k2p
+var tokenSecretName = regexp.MustCompile(`-token-[a-z0-9]{5}$`)
+
+// BackupPlugin is a backup item action plugin for Velero
+type BackupPlugin struct {
+	Log logrus.FieldLogger
+}
+
+// AppliesTo returns a velero.ResourceSelector that applies to deploymentconfigs
+func (p *BackupPlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"deploymentconfigs"},
+	}, nil
+}
+
+// Execute adds the configmaps and secrets the pod template of the
+// deploymentconfig references as additional items, so they are backed up even
+// if the backup filters don't include them, when BackupReferencesEnvVar is set
+func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.Log.Info("[deploymentconfig-backup] Entering deploymentconfig backup plugin")
+	if enabled, _ := strconv.ParseBool(os.Getenv(BackupReferencesEnvVar)); !enabled {
+		return item, nil, nil
+	}
+
+	deploymentConfig := appsv1API.DeploymentConfig{}
+	itemMarshal, _ := json.Marshal(item)
+	json.Unmarshal(itemMarshal, &deploymentConfig)
+	if deploymentConfig.Spec.Template == nil {
+		return item, nil, nil
+	}
+
+	configMaps, secrets := referencedConfigMapsAndSecrets(deploymentConfig.Spec.Template.Spec)
+	var additionalItems []velero.ResourceIdentifier
+	for _, name := range configMaps {
+		p.Log.Infof("[deploymentconfig-backup] Adding configmap %s as additional item for deploymentconfig %s/%s", name, deploymentConfig.Namespace, deploymentConfig.Name)
+		additionalItems = append(additionalItems, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{Resource: "configmaps"},
+			Namespace:     deploymentConfig.Namespace,
+			Name:          name,
+		})
+	}
+	for _, name := range secrets {
+		p.Log.Infof("[deploymentconfig-backup] Adding secret %s as additional item for deploymentconfig %s/%s", name, deploymentConfig.Namespace, deploymentConfig.Name)
+		additionalItems = append(additionalItems, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{Resource: "secrets"},
+			Namespace:     deploymentConfig.Namespace,
+			Name:          name,
+		})
+	}
+	return item, additionalItems, nil
+}
+
+// referencedConfigMapsAndSecrets returns the names of the configmaps and
+// secrets the env, envFrom and volumes of spec reference, except the dockercfg
+// and token secrets generated for service accounts, which are generated
+// again on the restore cluster
+func referencedConfigMapsAndSecrets(spec corev1API.PodSpec) ([]string, []string) {
+	var configMaps, secrets []string
+	seenConfigMaps := make(map[string]bool)
+	seenSecrets := make(map[string]bool)
+	addConfigMap := func(name string) {
+		if len(name) > 0 && !seenConfigMaps[name] {
+			seenConfigMaps[name] = true
+			configMaps = append(configMaps, name)
+		}
+	}
+	addSecret := func(name string) {
+		if len(name) > 0 && !seenSecrets[name] && len(common.GeneratedDockercfgSecretPrefix(name)) == 0 && !tokenSecretName.MatchString(name) {
+			seenSecrets[name] = true
+			secrets = append(secrets, name)
+		}
+	}
+
+	for _, container := range append(append([]corev1API.Container{}, spec.InitContainers...), spec.Containers...) {
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				addConfigMap(env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				addSecret(env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				addConfigMap(envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				addSecret(envFrom.SecretRef.Name)
+			}
+		}
+	}
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			addConfigMap(volume.ConfigMap.Name)
+		}
+		if volume.Secret != nil {
+			addSecret(volume.Secret.SecretName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					addConfigMap(source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					addSecret(source.Secret.Name)
+				}
+			}
+		}
+	}
+	return configMaps, secrets
+}
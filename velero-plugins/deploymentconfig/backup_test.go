@@ -0,0 +1,97 @@
+package deploymentconfig
+
+import (
+	"os"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	appsv1API "github.com/openshift/api/apps/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestBackupPluginAppliesTo(t *testing.T) {
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+	actual, err := backupPlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"deploymentconfigs"}}, actual)
+}
+
+func TestReferencedConfigMapsAndSecrets(t *testing.T) {
+	spec := corev1API.PodSpec{
+		InitContainers: []corev1API.Container{{
+			Name: "init",
+			EnvFrom: []corev1API.EnvFromSource{
+				{ConfigMapRef: &corev1API.ConfigMapEnvSource{LocalObjectReference: corev1API.LocalObjectReference{Name: "init-settings"}}},
+			},
+		}},
+		Containers: []corev1API.Container{{
+			Name: "app",
+			Env: []corev1API.EnvVar{
+				{Name: "PLAIN", Value: "value"},
+				{Name: "LEVEL", ValueFrom: &corev1API.EnvVarSource{ConfigMapKeyRef: &corev1API.ConfigMapKeySelector{
+					LocalObjectReference: corev1API.LocalObjectReference{Name: "settings"}, Key: "level"}}},
+				{Name: "PASSWORD", ValueFrom: &corev1API.EnvVarSource{SecretKeyRef: &corev1API.SecretKeySelector{
+					LocalObjectReference: corev1API.LocalObjectReference{Name: "db"}, Key: "password"}}},
+				{Name: "POD", ValueFrom: &corev1API.EnvVarSource{FieldRef: &corev1API.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			},
+			EnvFrom: []corev1API.EnvFromSource{
+				{SecretRef: &corev1API.SecretEnvSource{LocalObjectReference: corev1API.LocalObjectReference{Name: "db"}}},
+			},
+		}},
+		Volumes: []corev1API.Volume{
+			{Name: "config", VolumeSource: corev1API.VolumeSource{ConfigMap: &corev1API.ConfigMapVolumeSource{
+				LocalObjectReference: corev1API.LocalObjectReference{Name: "settings"}}}},
+			{Name: "certs", VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: "certs"}}},
+			{Name: "token", VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: "default-token-x7k2p"}}},
+			{Name: "pull", VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: "deployer-dockercfg-abc12"}}},
+			{Name: "projected", VolumeSource: corev1API.VolumeSource{Projected: &corev1API.ProjectedVolumeSource{Sources: []corev1API.VolumeProjection{
+				{ConfigMap: &corev1API.ConfigMapProjection{LocalObjectReference: corev1API.LocalObjectReference{Name: "ca-bundle"}}},
+				{Secret: &corev1API.SecretProjection{LocalObjectReference: corev1API.LocalObjectReference{Name: "api-key"}}},
+			}}}},
+			{Name: "scratch", VolumeSource: corev1API.VolumeSource{EmptyDir: &corev1API.EmptyDirVolumeSource{}}},
+		},
+	}
+	configMaps, secrets := referencedConfigMapsAndSecrets(spec)
+	assert.Equal(t, []string{"init-settings", "settings", "ca-bundle"}, configMaps)
+	assert.Equal(t, []string{"db", "certs", "api-key"}, secrets)
+}
+
+func TestBackupPluginAddsReferences(t *testing.T) {
+	deploymentConfig := appsv1API.DeploymentConfig{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec: appsv1API.DeploymentConfigSpec{Template: &corev1API.PodTemplateSpec{Spec: corev1API.PodSpec{
+			Volumes: []corev1API.Volume{
+				{Name: "config", VolumeSource: corev1API.VolumeSource{ConfigMap: &corev1API.ConfigMapVolumeSource{
+					LocalObjectReference: corev1API.LocalObjectReference{Name: "settings"}}}},
+				{Name: "certs", VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: "certs"}}},
+			},
+		}}},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&deploymentConfig)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{Object: content}
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+
+	// not enabled by default
+	_, additionalItems, err := backupPlugin.Execute(item, &v1.Backup{})
+	require.NoError(t, err)
+	assert.Empty(t, additionalItems)
+
+	os.Setenv(BackupReferencesEnvVar, "true")
+	defer os.Unsetenv(BackupReferencesEnvVar)
+	_, additionalItems, err = backupPlugin.Execute(item, &v1.Backup{})
+	require.NoError(t, err)
+	assert.Equal(t, []velero.ResourceIdentifier{
+		{GroupResource: schema.GroupResource{Resource: "configmaps"}, Namespace: "ns", Name: "settings"},
+		{GroupResource: schema.GroupResource{Resource: "secrets"}, Namespace: "ns", Name: "certs"},
+	}, additionalItems)
+}
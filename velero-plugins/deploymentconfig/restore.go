@@ -2,11 +2,15 @@ package deploymentconfig
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	appsv1API "github.com/openshift/api/apps/v1"
 	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
@@ -31,26 +35,56 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	json.Unmarshal(itemMarshal, &deploymentConfig)
 	p.Log.Infof("[deploymentconfig-restore] deploymentConfig: %s", deploymentConfig.Name)
 
-	backupRegistry, registry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	// velero drops the owner references of the item it restores
+	backupDeploymentConfig := appsv1API.DeploymentConfig{}
+	itemMarshal, _ = json.Marshal(input.ItemFromBackup)
+	json.Unmarshal(itemMarshal, &backupDeploymentConfig)
+	if reason := managedBy(backupDeploymentConfig); len(reason) > 0 && input.Restore.Annotations[common.RestoreOwnedDeploymentConfigsAnnotation] != "true" {
+		p.Log.Warnf("[deploymentconfig-restore] Skipping restore of deploymentConfig %s, %s recreates it; set the %s annotation on the restore to restore it anyway",
+			deploymentConfig.Name, reason, common.RestoreOwnedDeploymentConfigsAnnotation)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	backupRegistry, registry, err := common.GetRestoreRegistryInfo(input.Item, p.Log)
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(deploymentConfig.Spec.Template.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(deploymentConfig.Spec.Template.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-
 	namespaceMapping := input.Restore.Spec.NamespaceMapping
-	newNamespace := namespaceMapping[deploymentConfig.Namespace]
-	if len(input.Restore.Spec.NamespaceMapping) > 0 {
-		for i := range deploymentConfig.Spec.Triggers {
-			if deploymentConfig.Spec.Triggers[i].ImageChangeParams == nil {
-				continue
-			}
+	swapImage, _ := common.RestoreImageSwap(deploymentConfig.Annotations, input.Restore, backupRegistry, registry)
+	if deploymentConfig.Spec.Template != nil {
+		deploymentConfig.Annotations = common.SwapRestoredImages(&deploymentConfig.Spec.Template.Spec, deploymentConfig.Annotations, input.Restore, backupRegistry, registry, p.Log)
+	}
+	swapStrategyImages(&deploymentConfig.Spec.Strategy, swapImage, namespaceMapping, p.Log)
 
-			// if trigger namespace is mapped to new one, swap it
-			triggerNamespace := deploymentConfig.Spec.Triggers[i].ImageChangeParams.From.Namespace
-			if namespaceMapping[triggerNamespace] != "" {
-				deploymentConfig.Spec.Triggers[i].ImageChangeParams.From.Namespace = newNamespace
-			}
+	mapTriggerNamespaces(&deploymentConfig, input.Restore, p.Log)
+
+	if disableImageTriggers(input.Restore) {
+		if err := pauseImageChangeTriggers(&deploymentConfig, swapImage); err != nil {
+			p.Log.Error("[deploymentconfig-restore] error removing deploymentConfig image change triggers: ", err)
+			return nil, err
+		}
+		if _, paused := deploymentConfig.Annotations[common.OriginalTriggersAnnotation]; paused {
+			p.Log.Infof("[deploymentconfig-restore] removed the ImageChange triggers of deploymentConfig %s, kept in the %s annotation",
+				deploymentConfig.Name, common.OriginalTriggersAnnotation)
+		}
+	}
+
+	// quiesce first, so it records the paused state at backup time rather than
+	// the one of the restore
+	if input.Restore.Annotations[common.MigrateQuiesceAnnotation] == "true" {
+		p.Log.Infof("[deploymentconfig-restore] scaling deploymentConfig %s to zero from %d replicas", deploymentConfig.Name, deploymentConfig.Spec.Replicas)
+		quiesce(&deploymentConfig)
+	}
+
+	if input.Restore.Annotations[common.RestorePausedAnnotation] == "true" {
+		p.Log.Infof("[deploymentconfig-restore] restoring deploymentConfig %s paused", deploymentConfig.Name)
+		deploymentConfig.Annotations = common.PauseRestored(deploymentConfig.Annotations, &deploymentConfig.Spec.Paused)
+	}
+
+	if deploymentConfig.Spec.Template != nil {
+		if err := common.UpdatePriorityClassName(&deploymentConfig.Spec.Template.Spec, input.Restore, p.Log); err != nil {
+			p.Log.Error("[deploymentconfig-restore] error updating priority class: ", err)
+			return nil, err
 		}
 	}
 
@@ -60,3 +94,167 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 
 	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: out}), nil
 }
+
+// managedByLabel is set on resources managed by an operator or other tool
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+// managedBy returns what manages deploymentConfig and recreates it on the
+// restore cluster, e.g. the TemplateInstance or operator which created it, or
+// "" if nothing does. Helm releases don't recreate what they manage.
+func managedBy(deploymentConfig appsv1API.DeploymentConfig) string {
+	for _, owner := range deploymentConfig.OwnerReferences {
+		if owner.Kind == "TemplateInstance" {
+			return fmt.Sprintf("its TemplateInstance %s", owner.Name)
+		}
+	}
+	for _, owner := range deploymentConfig.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			return fmt.Sprintf("its owner %s %s", owner.Kind, owner.Name)
+		}
+	}
+	if manager := deploymentConfig.Labels[managedByLabel]; len(manager) > 0 && manager != "Helm" {
+		return fmt.Sprintf("%s, which manages it,", manager)
+	}
+	return ""
+}
+
+// sharedImageStreamsNamespace holds the imagestreams every cluster provides
+const sharedImageStreamsNamespace = "openshift"
+
+// mapTriggerNamespaces maps the namespaces the ImageChange triggers of
+// deploymentConfig reference by the namespace mapping of the restore. Triggers
+// without a namespace reference the namespace of deploymentConfig, so they get
+// its mapped namespace. A warning is logged for the namespaces the restore
+// doesn't include, since their imagestreams may not exist on this cluster.
+func mapTriggerNamespaces(deploymentConfig *appsv1API.DeploymentConfig, restore *v1.Restore, log logrus.FieldLogger) {
+	namespaceMapping := restore.Spec.NamespaceMapping
+	for _, trigger := range deploymentConfig.Spec.Triggers {
+		if trigger.ImageChangeParams == nil {
+			continue
+		}
+		from := &trigger.ImageChangeParams.From
+		if len(from.Namespace) == 0 {
+			from.Namespace = namespaceMapping[deploymentConfig.Namespace]
+			continue
+		}
+		if from.Namespace != sharedImageStreamsNamespace && !common.RestoresNamespace(restore, from.Namespace) {
+			log.Warnf("[deploymentconfig-restore] deploymentConfig %s has an ImageChange trigger on %s %s/%s, whose namespace is not restored",
+				deploymentConfig.Name, from.Kind, from.Namespace, from.Name)
+		}
+		if newNamespace := namespaceMapping[from.Namespace]; len(newNamespace) > 0 {
+			from.Namespace = newNamespace
+		}
+	}
+}
+
+// swapStrategyImages swaps the image of the custom deployer of strategy and
+// the DockerImage references the tagImages lifecycle hooks tag with swapImage,
+// and maps the namespaces of the imagestream tags they tag. The execNewPod
+// hooks run the images of the pod template containers, which are swapped
+// already.
+func swapStrategyImages(strategy *appsv1API.DeploymentStrategy, swapImage func(string) string, namespaceMapping map[string]string, log logrus.FieldLogger) {
+	if strategy.CustomParams != nil && len(strategy.CustomParams.Image) > 0 {
+		if newImage := swapImage(strategy.CustomParams.Image); newImage != strategy.CustomParams.Image {
+			log.Infof("[deploymentconfig-restore] replacing custom deployer image ref %s with %s", strategy.CustomParams.Image, newImage)
+			strategy.CustomParams.Image = newImage
+		}
+	}
+	var hooks []*appsv1API.LifecycleHook
+	if strategy.RecreateParams != nil {
+		hooks = append(hooks, strategy.RecreateParams.Pre, strategy.RecreateParams.Mid, strategy.RecreateParams.Post)
+	}
+	if strategy.RollingParams != nil {
+		hooks = append(hooks, strategy.RollingParams.Pre, strategy.RollingParams.Post)
+	}
+	for _, hook := range hooks {
+		if hook == nil {
+			continue
+		}
+		for i, tagImage := range hook.TagImages {
+			to := &hook.TagImages[i].To
+			if tagImage.To.Kind == "DockerImage" {
+				to.Name = swapImage(tagImage.To.Name)
+			} else if newNamespace := namespaceMapping[tagImage.To.Namespace]; len(tagImage.To.Namespace) > 0 && len(newNamespace) > 0 {
+				to.Namespace = newNamespace
+			}
+			if *to != tagImage.To {
+				log.Infof("[deploymentconfig-restore] replacing tagImages hook ref %s %s/%s with %s/%s",
+					tagImage.To.Kind, tagImage.To.Namespace, tagImage.To.Name, to.Namespace, to.Name)
+			}
+		}
+	}
+}
+
+// disableImageTriggers returns whether the ImageChange triggers of restored
+// deploymentconfigs are removed. The restore annotation takes precedence, and
+// they are removed by default for migrations.
+func disableImageTriggers(restore *v1.Restore) bool {
+	if disable, err := strconv.ParseBool(restore.Annotations[common.DisableImageTriggersAnnotation]); err == nil {
+		return disable
+	}
+	return restore.Labels[common.MigrationApplicationLabelKey] == common.MigrationApplicationLabelValue
+}
+
+// pauseImageChangeTriggers removes the ImageChange triggers of
+// deploymentConfig, so it doesn't roll out as soon as the restored imagestreams
+// get their tags, and records its original triggers in the
+// openshift.io/original-triggers annotation. The containers the triggers
+// updated are set to the image last deployed, swapped to the registry of this
+// cluster, so it can be rolled out by hand.
+func pauseImageChangeTriggers(deploymentConfig *appsv1API.DeploymentConfig, swapImage func(string) string) error {
+	// an empty list rather than nil, which defaults to a ConfigChange trigger
+	triggers := appsv1API.DeploymentTriggerPolicies{}
+	for _, trigger := range deploymentConfig.Spec.Triggers {
+		if trigger.Type != appsv1API.DeploymentTriggerOnImageChange {
+			triggers = append(triggers, trigger)
+			continue
+		}
+		params := trigger.ImageChangeParams
+		if params == nil || len(params.LastTriggeredImage) == 0 || deploymentConfig.Spec.Template == nil {
+			continue
+		}
+		image := swapImage(params.LastTriggeredImage)
+		setContainerImages(deploymentConfig.Spec.Template.Spec.Containers, params.ContainerNames, image)
+		setContainerImages(deploymentConfig.Spec.Template.Spec.InitContainers, params.ContainerNames, image)
+	}
+	if len(triggers) == len(deploymentConfig.Spec.Triggers) {
+		return nil
+	}
+	original, err := json.Marshal(deploymentConfig.Spec.Triggers)
+	if err != nil {
+		return err
+	}
+	if deploymentConfig.Annotations == nil {
+		deploymentConfig.Annotations = make(map[string]string)
+	}
+	deploymentConfig.Annotations[common.OriginalTriggersAnnotation] = string(original)
+	deploymentConfig.Spec.Triggers = triggers
+	return nil
+}
+
+// setContainerImages sets the image of the named containers
+func setContainerImages(containers []corev1API.Container, names []string, image string) {
+	for i := range containers {
+		for _, name := range names {
+			if containers[i].Name == name {
+				containers[i].Image = image
+			}
+		}
+	}
+}
+
+// quiesce scales deploymentConfig to zero and pauses it, so restored workloads
+// don't start until their data is verified, and records the original replicas
+// and paused state in the openshift.io/original-replicas and
+// openshift.io/original-paused annotations
+func quiesce(deploymentConfig *appsv1API.DeploymentConfig) {
+	if deploymentConfig.Annotations == nil {
+		deploymentConfig.Annotations = make(map[string]string)
+	}
+	if _, found := deploymentConfig.Annotations[common.OriginalReplicasAnnotation]; !found {
+		deploymentConfig.Annotations[common.OriginalReplicasAnnotation] = strconv.Itoa(int(deploymentConfig.Spec.Replicas))
+		deploymentConfig.Annotations[common.OriginalPausedAnnotation] = strconv.FormatBool(deploymentConfig.Spec.Paused)
+	}
+	deploymentConfig.Spec.Replicas = 0
+	deploymentConfig.Spec.Paused = true
+}
@@ -0,0 +1,355 @@
+package deploymentconfig
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	appsv1API "github.com/openshift/api/apps/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"deploymentconfigs"}}, actual)
+}
+
+func TestQuiesce(t *testing.T) {
+	deploymentConfig := appsv1API.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec:       appsv1API.DeploymentConfigSpec{Replicas: 3},
+	}
+
+	quiesce(&deploymentConfig)
+	assert.Equal(t, int32(0), deploymentConfig.Spec.Replicas)
+	assert.True(t, deploymentConfig.Spec.Paused)
+	assert.Equal(t, "3", deploymentConfig.Annotations[common.OriginalReplicasAnnotation])
+	assert.Equal(t, "false", deploymentConfig.Annotations[common.OriginalPausedAnnotation])
+
+	// quiescing again keeps the original record
+	quiesce(&deploymentConfig)
+	assert.Equal(t, "3", deploymentConfig.Annotations[common.OriginalReplicasAnnotation])
+
+	// the scale-up script patches the annotations in as JSON values
+	var replicas int32
+	var paused bool
+	require.NoError(t, json.Unmarshal([]byte(deploymentConfig.Annotations[common.OriginalReplicasAnnotation]), &replicas))
+	require.NoError(t, json.Unmarshal([]byte(deploymentConfig.Annotations[common.OriginalPausedAnnotation]), &paused))
+	assert.Equal(t, int32(3), replicas)
+	assert.False(t, paused)
+}
+
+func TestDisableImageTriggers(t *testing.T) {
+	assert.False(t, disableImageTriggers(&v1.Restore{}))
+	migration := &v1.Restore{ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{common.MigrationApplicationLabelKey: common.MigrationApplicationLabelValue},
+	}}
+	assert.True(t, disableImageTriggers(migration))
+	migration.Annotations = map[string]string{common.DisableImageTriggersAnnotation: "false"}
+	assert.False(t, disableImageTriggers(migration))
+	assert.True(t, disableImageTriggers(&v1.Restore{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{common.DisableImageTriggersAnnotation: "true"},
+	}}))
+}
+
+func TestPauseImageChangeTriggers(t *testing.T) {
+	triggers := appsv1API.DeploymentTriggerPolicies{
+		{Type: appsv1API.DeploymentTriggerOnConfigChange},
+		{
+			Type: appsv1API.DeploymentTriggerOnImageChange,
+			ImageChangeParams: &appsv1API.DeploymentTriggerImageChangeParams{
+				Automatic:          true,
+				ContainerNames:     []string{"app"},
+				From:               corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:latest"},
+				LastTriggeredImage: "docker-registry.default.svc:5000/ns/app@sha256:1",
+			},
+		},
+	}
+	deploymentConfig := appsv1API.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "new-ns"},
+		Spec: appsv1API.DeploymentConfigSpec{
+			Triggers: triggers,
+			Template: &corev1API.PodTemplateSpec{Spec: corev1API.PodSpec{Containers: []corev1API.Container{
+				{Name: "app", Image: " "},
+				{Name: "sidecar", Image: "quay.io/org/sidecar:1"},
+			}}},
+		},
+	}
+
+	err := pauseImageChangeTriggers(&deploymentConfig, restoreImageSwap("docker-registry.default.svc:5000",
+		"image-registry.openshift-image-registry.svc:5000", map[string]string{"ns": "new-ns"}))
+	require.NoError(t, err)
+	assert.Equal(t, appsv1API.DeploymentTriggerPolicies{triggers[0]}, deploymentConfig.Spec.Triggers)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/new-ns/app@sha256:1", deploymentConfig.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "quay.io/org/sidecar:1", deploymentConfig.Spec.Template.Spec.Containers[1].Image)
+
+	// the resume script puts the annotation back as the triggers value
+	original := appsv1API.DeploymentTriggerPolicies{}
+	require.NoError(t, json.Unmarshal([]byte(deploymentConfig.Annotations[common.OriginalTriggersAnnotation]), &original))
+	assert.Equal(t, triggers, original)
+}
+
+func TestRestorePluginRecordsOriginalTriggers(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.DisableImageTriggersAnnotation: "true"}}}
+	triggers := appsv1API.DeploymentTriggerPolicies{
+		{Type: appsv1API.DeploymentTriggerOnConfigChange},
+		{
+			Type: appsv1API.DeploymentTriggerOnImageChange,
+			ImageChangeParams: &appsv1API.DeploymentTriggerImageChangeParams{
+				Automatic:      true,
+				ContainerNames: []string{"app"},
+				From:           corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:latest", Namespace: "ns"},
+			},
+		},
+	}
+	deploymentConfig := appsv1API.DeploymentConfig{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec: appsv1API.DeploymentConfigSpec{
+			Triggers: triggers,
+			Template: &corev1API.PodTemplateSpec{Spec: corev1API.PodSpec{Containers: []corev1API.Container{{Name: "app", Image: "quay.io/org/app:1"}}}},
+		},
+	}
+	data, err := json.Marshal(deploymentConfig)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := appsv1API.DeploymentConfig{}
+	data, err = json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, appsv1API.DeploymentTriggerPolicies{triggers[0]}, restored.Spec.Triggers)
+	// the resume script replaces the triggers with the annotation as is
+	original := appsv1API.DeploymentTriggerPolicies{}
+	require.NoError(t, json.Unmarshal([]byte(restored.Annotations[common.OriginalTriggersAnnotation]), &original))
+	assert.Equal(t, triggers, original)
+}
+
+func TestPauseOnlyImageChangeTriggers(t *testing.T) {
+	deploymentConfig := appsv1API.DeploymentConfig{Spec: appsv1API.DeploymentConfigSpec{
+		Triggers: appsv1API.DeploymentTriggerPolicies{
+			{
+				Type:              appsv1API.DeploymentTriggerOnImageChange,
+				ImageChangeParams: &appsv1API.DeploymentTriggerImageChangeParams{ContainerNames: []string{"app"}},
+			},
+		},
+	}}
+
+	require.NoError(t, pauseImageChangeTriggers(&deploymentConfig, restoreImageSwap("", "", nil)))
+	// not nil, which would default to a ConfigChange trigger
+	assert.NotNil(t, deploymentConfig.Spec.Triggers)
+	assert.Empty(t, deploymentConfig.Spec.Triggers)
+}
+
+func TestMapTriggerNamespaces(t *testing.T) {
+	imageChange := func(namespace, name string) appsv1API.DeploymentTriggerPolicy {
+		return appsv1API.DeploymentTriggerPolicy{
+			Type:              appsv1API.DeploymentTriggerOnImageChange,
+			ImageChangeParams: &appsv1API.DeploymentTriggerImageChangeParams{From: corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: namespace, Name: name}},
+		}
+	}
+	deploymentConfig := appsv1API.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "old"},
+		Spec: appsv1API.DeploymentConfigSpec{Triggers: appsv1API.DeploymentTriggerPolicies{
+			{Type: appsv1API.DeploymentTriggerOnConfigChange},
+			imageChange("", "app:latest"),
+			imageChange("old", "app:v1"),
+			imageChange("shared", "base:latest"),
+			imageChange("other", "base:latest"),
+			imageChange("openshift", "nodejs:latest"),
+		}},
+	}
+	restore := &v1.Restore{Spec: v1.RestoreSpec{
+		IncludedNamespaces: []string{"old", "shared"},
+		NamespaceMapping:   map[string]string{"old": "new", "shared": "shared-new"},
+	}}
+
+	mapTriggerNamespaces(&deploymentConfig, restore, test.NewLogger())
+	var namespaces []string
+	for _, trigger := range deploymentConfig.Spec.Triggers[1:] {
+		namespaces = append(namespaces, trigger.ImageChangeParams.From.Namespace)
+	}
+	assert.Equal(t, []string{"new", "new", "shared-new", "other", "openshift"}, namespaces)
+
+	// without a mapping, triggers without a namespace keep referencing their own
+	deploymentConfig.Spec.Triggers = appsv1API.DeploymentTriggerPolicies{imageChange("", "app:latest")}
+	mapTriggerNamespaces(&deploymentConfig, &v1.Restore{}, test.NewLogger())
+	assert.Empty(t, deploymentConfig.Spec.Triggers[0].ImageChangeParams.From.Namespace)
+}
+
+func TestSwapStrategyImages(t *testing.T) {
+	swapImage := restoreImageSwap("backup.registry:5000", "restore.registry:5000", map[string]string{"old": "new"})
+	tagImages := func() []appsv1API.TagImageHook {
+		return []appsv1API.TagImageHook{
+			{ContainerName: "app", To: corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "old", Name: "app:pre"}},
+			{ContainerName: "app", To: corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:post"}},
+			{ContainerName: "app", To: corev1API.ObjectReference{Kind: "DockerImage", Name: "backup.registry:5000/old/app:hook"}},
+		}
+	}
+	strategy := appsv1API.DeploymentStrategy{
+		Type:         appsv1API.DeploymentStrategyTypeCustom,
+		CustomParams: &appsv1API.CustomDeploymentStrategyParams{Image: "backup.registry:5000/old/deployer:latest"},
+		RecreateParams: &appsv1API.RecreateDeploymentStrategyParams{
+			Pre:  &appsv1API.LifecycleHook{ExecNewPod: &appsv1API.ExecNewPodHook{ContainerName: "app"}},
+			Post: &appsv1API.LifecycleHook{TagImages: tagImages()},
+		},
+		RollingParams: &appsv1API.RollingDeploymentStrategyParams{
+			Pre: &appsv1API.LifecycleHook{TagImages: tagImages()},
+		},
+	}
+
+	swapStrategyImages(&strategy, swapImage, map[string]string{"old": "new"}, test.NewLogger())
+	assert.Equal(t, "restore.registry:5000/new/deployer:latest", strategy.CustomParams.Image)
+	expected := []appsv1API.TagImageHook{
+		{ContainerName: "app", To: corev1API.ObjectReference{Kind: "ImageStreamTag", Namespace: "new", Name: "app:pre"}},
+		{ContainerName: "app", To: corev1API.ObjectReference{Kind: "ImageStreamTag", Name: "app:post"}},
+		{ContainerName: "app", To: corev1API.ObjectReference{Kind: "DockerImage", Name: "restore.registry:5000/new/app:hook"}},
+	}
+	assert.Equal(t, expected, strategy.RecreateParams.Post.TagImages)
+	assert.Equal(t, expected, strategy.RollingParams.Pre.TagImages)
+	assert.Equal(t, &appsv1API.ExecNewPodHook{ContainerName: "app"}, strategy.RecreateParams.Pre.ExecNewPod)
+
+	// images of other registries are left as they are
+	strategy = appsv1API.DeploymentStrategy{CustomParams: &appsv1API.CustomDeploymentStrategyParams{Image: "quay.io/deployer:v1"}}
+	swapStrategyImages(&strategy, swapImage, nil, test.NewLogger())
+	assert.Equal(t, "quay.io/deployer:v1", strategy.CustomParams.Image)
+}
+
+// restoreImageSwap returns the image swap of a restore from backupRegistry to
+// registry with namespaceMapping
+func restoreImageSwap(backupRegistry, registry string, namespaceMapping map[string]string) func(string) string {
+	swapImage, _ := common.RestoreImageSwap(nil, &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: namespaceMapping}}, backupRegistry, registry)
+	return swapImage
+}
+
+func TestRestorePluginRestoresPausedAndQuiesced(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		common.RestorePausedAnnotation:  "true",
+		common.MigrateQuiesceAnnotation: "true",
+	}}}
+	deploymentConfig := appsv1API.DeploymentConfig{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec:       appsv1API.DeploymentConfigSpec{Replicas: 3, Template: &corev1API.PodTemplateSpec{}},
+	}
+	data, err := json.Marshal(deploymentConfig)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := appsv1API.DeploymentConfig{}
+	data, err = json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.True(t, restored.Spec.Paused)
+	assert.Equal(t, int32(0), restored.Spec.Replicas)
+	// scaling back up unpauses it, as it wasn't paused at backup time
+	assert.Equal(t, "3", restored.Annotations[common.OriginalReplicasAnnotation])
+	assert.Equal(t, "false", restored.Annotations[common.OriginalPausedAnnotation])
+	assert.NotContains(t, restored.Annotations, common.PausedByRestoreAnnotation)
+}
+
+func TestRestorePluginStageMigrationUsesMigrationRegistry(t *testing.T) {
+	restore := &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.StageOrFinalMigrationAnnotation: common.StageMigration}},
+		Spec:       v1.RestoreSpec{BackupName: "backup"},
+	}
+	deploymentConfig := appsv1API.DeploymentConfig{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns", Annotations: map[string]string{
+			common.BackupRegistryHostname:  "docker-registry.default.svc:5000",
+			common.RestoreRegistryHostname: "image-registry.openshift-image-registry.svc:5000",
+			common.MigrationRegistry:       "migration.example.com",
+		}},
+		Spec: appsv1API.DeploymentConfigSpec{Template: &corev1API.PodTemplateSpec{Spec: corev1API.PodSpec{
+			Containers: []corev1API.Container{{Name: "app", Image: "docker-registry.default.svc:5000/ns/app@sha256:1"}},
+		}}},
+	}
+	data, err := json.Marshal(deploymentConfig)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+	require.NoError(t, err)
+
+	restored := appsv1API.DeploymentConfig{}
+	data, err = json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, "migration.example.com/ns/app@sha256:1", restored.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "migration.example.com", restored.Annotations[common.RestoredImageRegistryAnnotation])
+}
+
+func TestManagedBy(t *testing.T) {
+	controller := true
+	deploymentConfigs := map[string]appsv1API.DeploymentConfig{
+		"": {},
+		"its TemplateInstance app": {ObjectMeta: metav1.ObjectMeta{
+			OwnerReferences: []metav1.OwnerReference{{Kind: "TemplateInstance", Name: "app"}},
+		}},
+		"its owner Database db": {ObjectMeta: metav1.ObjectMeta{
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Database", Name: "db", Controller: &controller}},
+		}},
+		"example-operator, which manages it,": {ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{managedByLabel: "example-operator"},
+		}},
+	}
+	for expected, deploymentConfig := range deploymentConfigs {
+		assert.Equal(t, expected, managedBy(deploymentConfig))
+	}
+	assert.Equal(t, "", managedBy(appsv1API.DeploymentConfig{ObjectMeta: metav1.ObjectMeta{
+		Labels:          map[string]string{managedByLabel: "Helm"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ConfigMap", Name: "settings"}},
+	}}))
+}
+
+func TestRestorePluginRestoresPaused(t *testing.T) {
+	restore := &v1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.RestorePausedAnnotation: "true"}}}
+	for _, paused := range []bool{false, true} {
+		deploymentConfig := appsv1API.DeploymentConfig{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig"},
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+			Spec: appsv1API.DeploymentConfigSpec{
+				Paused:   paused,
+				Template: &corev1API.PodTemplateSpec{},
+			},
+		}
+		data, err := json.Marshal(deploymentConfig)
+		require.NoError(t, err)
+		item := &unstructured.Unstructured{}
+		require.NoError(t, item.UnmarshalJSON(data))
+
+		restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: restore})
+		require.NoError(t, err)
+
+		restored := appsv1API.DeploymentConfig{}
+		data, err = json.Marshal(output.UpdatedItem)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &restored))
+		assert.True(t, restored.Spec.Paused)
+		// only the ones the restore paused are marked
+		_, marked := restored.Annotations[common.PausedByRestoreAnnotation]
+		assert.Equal(t, !paused, marked)
+	}
+}
@@ -0,0 +1,76 @@
+package imagecopy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bombsimon/logrusr"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/types"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCopyCancelled cancels the copy of an image from a registry serving its
+// layer slowly, checking the copy stops promptly instead of running to the end
+func TestCopyCancelled(t *testing.T) {
+	registry := newStreamTestRegistry(t, 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/src/app/blobs/"+registry.layerDigest {
+			registry.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(registry.layerSize, 10))
+		w.WriteHeader(http.StatusOK)
+		chunk := make([]byte, 1024)
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	cacheDir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	sys := &types.SystemContext{
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		BlobInfoCacheDir:            cacheDir,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = copyImage(ctx, logrusr.NewLogger(test.NewLogger()), fmt.Sprintf("docker://%s/src/app:latest", host),
+		fmt.Sprintf("docker://%s/dest/app:latest", host), &copy.Options{SourceCtx: sys, DestinationCtx: sys},
+		time.Hour, retryPolicy{attempts: 3, interval: time.Second}, tokenFiles{}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cancelled")
+	assert.True(t, time.Since(start) < 10*time.Second, "copy took %v to stop", time.Since(start))
+}
+
+func TestCopyCancelledBeforeFirstAttempt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := copyImage(ctx, logrusr.NewLogger(test.NewLogger()), "docker://registry.example.com/src/app:latest",
+		"docker://registry.example.com/dest/app:latest", &copy.Options{},
+		time.Hour, retryPolicy{attempts: 3, interval: time.Second}, tokenFiles{}, nil)
+	require.Error(t, err)
+	assert.Equal(t, "copy of image docker://registry.example.com/src/app:latest cancelled: context canceled", err.Error())
+}
@@ -0,0 +1,112 @@
+package imagecopy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+)
+
+// CompressionEnvVar is the environment variable setting the compression of the
+// layers pushed by image copies: gzip, zstd or none. Unset, the layers are
+// pushed as they are stored in the source registry.
+const CompressionEnvVar = "IMAGE_COPY_COMPRESSION"
+
+const compressionNone = "none"
+
+// ociManifestMediaType is the MIME type of OCI image manifests
+const ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+// Compression returns the layer compression configured by IMAGE_COPY_COMPRESSION
+func Compression() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv(CompressionEnvVar)))
+}
+
+// ValidateCompression returns an error if the layer compression is unknown, or
+// set while image digests are preserved, since changing the compression of the
+// layers changes the image digests
+func ValidateCompression(name string, preserveDigests bool) error {
+	if len(name) == 0 {
+		return nil
+	}
+	if name != compressionNone {
+		if _, err := compression.AlgorithmByName(name); err != nil {
+			return fmt.Errorf("%s=%s is not one of gzip, zstd or none", CompressionEnvVar, name)
+		}
+	}
+	if preserveDigests {
+		return fmt.Errorf("%s=%s changes image digests, which %s forbids; set %s=false to compress the copied layers",
+			CompressionEnvVar, name, PreserveDigestsEnvVar, PreserveDigestsEnvVar)
+	}
+	return nil
+}
+
+// compressedCopyOptions returns copyOptions set to push the layers with the
+// named compression. zstd layers are only valid in OCI manifests, so the
+// manifests are converted to OCI for zstd.
+func compressedCopyOptions(copyOptions *copy.Options, name string) *copy.Options {
+	algorithm, err := compression.AlgorithmByName(name)
+	if err != nil || copyOptions == nil {
+		return copyOptions
+	}
+	options := *copyOptions
+	destinationCtx := types.SystemContext{}
+	if options.DestinationCtx != nil {
+		destinationCtx = *options.DestinationCtx
+	}
+	destinationCtx.CompressionFormat = &algorithm
+	options.DestinationCtx = &destinationCtx
+	if algorithm.Name() == compression.Zstd.Name() {
+		options.ForceManifestMIMEType = ociManifestMediaType
+	}
+	return &options
+}
+
+// layerCompression returns the layer compression the copies of the copier ask
+// of the destination, or nil to leave it to the destination
+func (c *imageStreamCopier) layerCompression() *types.LayerCompression {
+	var layerCompression types.LayerCompression
+	switch {
+	case c.PreserveDigests:
+		layerCompression = types.PreserveOriginal
+	case c.Compression == compressionNone:
+		layerCompression = types.Decompress
+	case len(c.Compression) > 0:
+		layerCompression = types.Compress
+	default:
+		return nil
+	}
+	return &layerCompression
+}
+
+// layerCompressionReference wraps the reference of a copy destination to override
+// the layer compression it asks for, e.g. to push layers as they are rather than
+// compressing uncompressed layers, which changes the image digest
+type layerCompressionReference struct {
+	types.ImageReference
+	compression types.LayerCompression
+}
+
+// NewImageDestination returns the destination of the wrapped reference
+func (r layerCompressionReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return layerCompressionDestination{dest, r.compression}, nil
+}
+
+// layerCompressionDestination is a copy destination asking for a given layer compression
+type layerCompressionDestination struct {
+	types.ImageDestination
+	compression types.LayerCompression
+}
+
+// DesiredLayerCompression returns the layer compression of the destination
+func (d layerCompressionDestination) DesiredLayerCompression() types.LayerCompression {
+	return d.compression
+}
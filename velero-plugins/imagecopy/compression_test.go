@@ -0,0 +1,63 @@
+package imagecopy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCompression(t *testing.T) {
+	assert.NoError(t, ValidateCompression("", true))
+	assert.NoError(t, ValidateCompression("zstd", false))
+	assert.NoError(t, ValidateCompression("none", false))
+	assert.Error(t, ValidateCompression("zstd", true))
+	assert.Error(t, ValidateCompression("gzip", true))
+	assert.Error(t, ValidateCompression("lz4", false))
+}
+
+func TestCompressedCopyOptions(t *testing.T) {
+	destinationCtx := &types.SystemContext{DockerCertPath: "/certs"}
+	copyOptions := &copy.Options{DestinationCtx: destinationCtx}
+	zstd := compressedCopyOptions(copyOptions, "zstd")
+	assert.Equal(t, compression.Zstd.Name(), zstd.DestinationCtx.CompressionFormat.Name())
+	assert.Equal(t, "/certs", zstd.DestinationCtx.DockerCertPath)
+	assert.Equal(t, ociManifestMediaType, zstd.ForceManifestMIMEType)
+	assert.Nil(t, destinationCtx.CompressionFormat)
+
+	gzip := compressedCopyOptions(copyOptions, "gzip")
+	assert.Equal(t, compression.Gzip.Name(), gzip.DestinationCtx.CompressionFormat.Name())
+	assert.Empty(t, gzip.ForceManifestMIMEType)
+	assert.Equal(t, copyOptions, compressedCopyOptions(copyOptions, "none"))
+}
+
+func TestLayerCompression(t *testing.T) {
+	copier := &imageStreamCopier{ImageStreamCopyOptions: ImageStreamCopyOptions{PreserveDigests: true}}
+	assert.Equal(t, types.PreserveOriginal, *copier.layerCompression())
+	copier.PreserveDigests = false
+	assert.Nil(t, copier.layerCompression())
+	copier.Compression = "none"
+	assert.Equal(t, types.Decompress, *copier.layerCompression())
+	copier.Compression = "zstd"
+	assert.Equal(t, types.Compress, *copier.layerCompression())
+}
+
+func TestLayerCompressionDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dest, err := alltransports.ParseImageName("dir:" + dir)
+	require.NoError(t, err)
+	imageDest, err := layerCompressionReference{dest, types.PreserveOriginal}.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer imageDest.Close()
+	assert.Equal(t, types.PreserveOriginal, imageDest.DesiredLayerCompression())
+	assert.Equal(t, dest.StringWithinTransport(), imageDest.Reference().StringWithinTransport())
+}
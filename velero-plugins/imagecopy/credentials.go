@@ -0,0 +1,72 @@
+package imagecopy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/types"
+)
+
+// tokenFiles are the files holding the bearer tokens used as the password of
+// the source and destination registry credentials, e.g. the service account
+// token, which may be rotated while a long copy is running
+type tokenFiles struct {
+	source      string
+	destination string
+}
+
+// tokenFiles returns the token files of the copier
+func (c *imageStreamCopier) tokenFiles() tokenFiles {
+	return tokenFiles{source: c.SourceTokenFile, destination: c.DestTokenFile}
+}
+
+// refresh returns copyOptions with the credentials of the source and destination
+// contexts re-read from their token files, and the tokens read. Contexts without
+// credentials, e.g. those of external images, are left as they are. Fresh
+// contexts are returned as the ones of copyOptions are shared by concurrent copies.
+func (t tokenFiles) refresh(copyOptions *copy.Options) (*copy.Options, []string, error) {
+	refreshed := *copyOptions
+	var tokens []string
+	var err error
+	if refreshed.SourceCtx, err = refreshToken(copyOptions.SourceCtx, t.source, &tokens); err != nil {
+		return nil, nil, err
+	}
+	if refreshed.DestinationCtx, err = refreshToken(copyOptions.DestinationCtx, t.destination, &tokens); err != nil {
+		return nil, nil, err
+	}
+	return &refreshed, tokens, nil
+}
+
+// refreshToken returns a copy of sys using the token read from tokenFile as
+// password, appending the token to tokens
+func refreshToken(sys *types.SystemContext, tokenFile string, tokens *[]string) (*types.SystemContext, error) {
+	if sys == nil || sys.DockerAuthConfig == nil || len(tokenFile) == 0 {
+		return sys, nil
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read registry token from %s: %v", tokenFile, err)
+	}
+	token := strings.TrimSpace(string(data))
+	*tokens = append(*tokens, token)
+	refreshed := *sys
+	refreshed.DockerAuthConfig = &types.DockerAuthConfig{Username: sys.DockerAuthConfig.Username, Password: token}
+	return &refreshed, nil
+}
+
+// tokensRotated returns true if a token file holds another token than the one
+// used, read by refresh
+func (t tokenFiles) tokensRotated(copyOptions *copy.Options, used []string) bool {
+	_, current, err := t.refresh(copyOptions)
+	if err != nil || len(current) != len(used) {
+		return false
+	}
+	for i := range current {
+		if current[i] != used[i] {
+			return true
+		}
+	}
+	return false
+}
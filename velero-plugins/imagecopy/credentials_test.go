@@ -0,0 +1,44 @@
+package imagecopy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+
+	sourceAuth := &types.DockerAuthConfig{Username: "ignored", Password: "initial"}
+	copyOptions := &copy.Options{
+		SourceCtx:      &types.SystemContext{DockerAuthConfig: sourceAuth},
+		DestinationCtx: &types.SystemContext{},
+	}
+	tokens := tokenFiles{source: tokenFile, destination: tokenFile}
+	refreshed, used, err := tokens.refresh(copyOptions)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first"}, used)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "ignored", Password: "first"}, refreshed.SourceCtx.DockerAuthConfig)
+	assert.Nil(t, refreshed.DestinationCtx.DockerAuthConfig)
+	// the shared contexts are left untouched
+	assert.Equal(t, "initial", sourceAuth.Password)
+	assert.False(t, tokens.tokensRotated(copyOptions, used))
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("second\n"), 0600))
+	assert.True(t, tokens.tokensRotated(copyOptions, used))
+
+	unchanged, used, err := tokenFiles{}.refresh(copyOptions)
+	require.NoError(t, err)
+	assert.Empty(t, used)
+	assert.Equal(t, copyOptions.SourceCtx, unchanged.SourceCtx)
+}
@@ -0,0 +1,38 @@
+package imagecopy
+
+import "sync"
+
+// CopiedImages records the images copied by a single backup or restore, so an
+// image tagged more than once is only copied once to each destination repository
+type CopiedImages struct {
+	mutex  sync.Mutex
+	pushed map[copiedImage]string
+}
+
+// copiedImage is a source image digest copied to a destination repository
+type copiedImage struct {
+	digest      string
+	destination string
+}
+
+// NewCopiedImages returns an empty record of copied images
+func NewCopiedImages() *CopiedImages {
+	return &CopiedImages{pushed: map[copiedImage]string{}}
+}
+
+// lookup returns the digest pushed for the source image digest to the
+// destination repository, if it was copied there already
+func (c *CopiedImages) lookup(digest, destination string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pushed, found := c.pushed[copiedImage{digest: digest, destination: destination}]
+	return pushed, found
+}
+
+// record records the copy of the source image digest to the destination
+// repository, pushed with the pushed digest
+func (c *CopiedImages) record(digest, destination, pushed string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pushed[copiedImage{digest: digest, destination: destination}] = pushed
+}
@@ -0,0 +1,20 @@
+package imagecopy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopiedImages(t *testing.T) {
+	copied := NewCopiedImages()
+	_, found := copied.lookup("sha256:1", "registry:5000/ns/app")
+	assert.False(t, found)
+	copied.record("sha256:1", "registry:5000/ns/app", "sha256:2")
+	pushed, found := copied.lookup("sha256:1", "registry:5000/ns/app")
+	assert.True(t, found)
+	assert.Equal(t, "sha256:2", pushed)
+	// copies to other repositories are not deduplicated
+	_, found = copied.lookup("sha256:1", "registry:5000/other/app")
+	assert.False(t, found)
+}
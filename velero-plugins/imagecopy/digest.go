@@ -0,0 +1,65 @@
+package imagecopy
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+)
+
+// PreserveDigestsEnvVar is the environment variable which, set to "false", lets
+// image copies change the digest of images, e.g. by compressing their layers
+const PreserveDigestsEnvVar = "IMAGE_COPY_PRESERVE_DIGESTS"
+
+// PreserveDigests returns whether image copies must keep the digest of the
+// images, configured by IMAGE_COPY_PRESERVE_DIGESTS (default true)
+func PreserveDigests() bool {
+	preserve, err := strconv.ParseBool(os.Getenv(PreserveDigestsEnvVar))
+	return err != nil || preserve
+}
+
+// referenceDigest returns the digest of an image path pulled by digest, or ""
+func referenceDigest(path string) string {
+	if index := strings.LastIndex(path, "@"); index >= 0 {
+		return path[index+1:]
+	}
+	return ""
+}
+
+// manifestConversionRequired returns true if copying src can't keep its digest:
+// schema1 manifests are converted to schema2, which the registries accept, only
+// one image of a manifest list is copied with IMAGE_COPY_SINGLE_ARCH, and OCI
+// layouts only hold OCI manifests
+func manifestConversionRequired(ctx context.Context, src string, copyOptions *copy.Options, toOCILayout bool) bool {
+	srcRef, err := alltransports.ParseImageName(src)
+	if err != nil {
+		return false
+	}
+	mimeType := sourceManifestMIMEType(ctx, srcRef, copyOptions.SourceCtx)
+	if mimeType == manifest.DockerV2Schema1MediaType || mimeType == manifest.DockerV2Schema1SignedMediaType {
+		return true
+	}
+	if toOCILayout && len(mimeType) > 0 && mimeType != ociManifestMediaType && mimeType != ociIndexMediaType {
+		return true
+	}
+	return manifest.MIMETypeIsMultiImage(mimeType) && copyOptions.ImageListSelection == copy.CopySystemImage
+}
+
+// sourceManifestMIMEType returns the MIME type of the manifest of srcRef, or "" if it can't be read
+func sourceManifestMIMEType(ctx context.Context, srcRef types.ImageReference, sys *types.SystemContext) string {
+	src, err := srcRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return ""
+	}
+	defer src.Close()
+	_, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return ""
+	}
+	return mimeType
+}
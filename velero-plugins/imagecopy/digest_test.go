@@ -0,0 +1,31 @@
+package imagecopy
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreserveDigests(t *testing.T) {
+	defer os.Unsetenv(PreserveDigestsEnvVar)
+	os.Unsetenv(PreserveDigestsEnvVar)
+	assert.True(t, PreserveDigests())
+	os.Setenv(PreserveDigestsEnvVar, "false")
+	assert.False(t, PreserveDigests())
+	os.Setenv(PreserveDigestsEnvVar, "maybe")
+	assert.True(t, PreserveDigests())
+}
+
+func TestReferenceDigest(t *testing.T) {
+	assert.Equal(t, "sha256:abc", referenceDigest("docker://registry:5000/ns/app@sha256:abc"))
+	assert.Empty(t, referenceDigest("docker://registry:5000/ns/app:latest"))
+}
+
+func TestManifestConversionRequired(t *testing.T) {
+	assert.True(t, manifestConversionRequired(context.Background(), "dir:testdata/schema1", &copy.Options{}, false))
+	assert.False(t, manifestConversionRequired(context.Background(), "dir:testdata/missing", &copy.Options{}, false))
+	assert.True(t, manifestConversionRequired(context.Background(), "dir:testdata/schema1", &copy.Options{}, true))
+}
@@ -0,0 +1,128 @@
+package imagecopy
+
+import (
+	"strings"
+)
+
+// isSourceImageNotFoundError returns true if the copy failed because the source
+// registry no longer has the manifest or one of the blobs of the image,
+// e.g. after `oc adm prune images`
+func isSourceImageNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "Error reading manifest") && strings.Contains(msg, "manifest unknown") {
+		return true
+	}
+	return strings.Contains(msg, "Error fetching blob: invalid status code from registry 404")
+}
+
+// isNonRetriableCopyError returns true if retrying the copy can't succeed, because
+// the registry denied access or rejected the manifest
+func isNonRetriableCopyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isManifestInvalidError(err) || isQuotaExceededError(err) {
+		return true
+	}
+	msg := err.Error()
+	for _, denied := range []string{"unauthorized", "authentication required", "denied:", "invalid status code from registry 401", "invalid status code from registry 403"} {
+		if strings.Contains(msg, denied) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnauthorizedError returns true if the registry rejected the credentials of the
+// copy, e.g. because the token they hold expired
+func isUnauthorizedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, unauthorized := range []string{"unauthorized", "authentication required", "invalid status code from registry 401"} {
+		if strings.Contains(msg, unauthorized) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRegistryNotReadyError returns true if the copy failed because the registry is
+// not accepting requests yet, e.g. on a freshly installed cluster
+func isRegistryNotReadyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, notReady := range []string{"connection refused", "502 Bad Gateway", "503 Service Unavailable", "invalid status code from registry 502",
+		"invalid status code from registry 503", "TLS handshake timeout"} {
+		if strings.Contains(msg, notReady) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientCopyError returns true if the copy failed on a registry or network
+// hiccup, which a new attempt may not hit
+func isTransientCopyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isRegistryNotReadyError(err) || isRateLimitedError(err) {
+		return true
+	}
+	msg := err.Error()
+	for _, transient := range []string{"connection reset", "broken pipe", "unexpected EOF", "i/o timeout", "no such host",
+		"invalid status code from registry 500", "invalid status code from registry 504", "500 Internal Server Error", "504 Gateway Timeout",
+		"blob upload unknown", "blob unknown to registry", "use of closed network connection", "http2: "} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRateLimitedError returns true if the registry refused the copy with 429 Too
+// Many Requests, e.g. a rate-limited service such as Quay.io
+func isRateLimitedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, rateLimited := range []string{"too many requests", "toomanyrequests", "invalid status code from registry 429", "429 Too Many Requests"} {
+		if strings.Contains(msg, rateLimited) {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuotaExceededError returns true if the destination registry rejected the push
+// because the image stream quota of the namespace or the registry storage is exhausted
+func isQuotaExceededError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, quota := range []string{"quota", "invalid status code from registry 413", "Request Entity Too Large", "blob upload invalid"} {
+		if strings.Contains(msg, quota) {
+			return true
+		}
+	}
+	return false
+}
+
+// isManifestInvalidError returns true if the destination registry rejected the
+// manifest of the image, e.g. a schema1 manifest pushed to a registry with
+// schema1 support disabled
+func isManifestInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "manifest invalid")
+}
@@ -0,0 +1,40 @@
+package imagecopy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyErrorClassification(t *testing.T) {
+	refused := errors.New("Error initializing destination docker://target/ns/app:latest: pinging docker registry returned: Get https://target/v2/: dial tcp 10.0.0.1:443: connect: connection refused")
+	unauthorized := errors.New("Error writing blob: Error initiating layer upload to /v2/ns/app/blobs/uploads/ in target: unauthorized: authentication required")
+	invalid := errors.New("Error writing manifest: Error uploading manifest latest to target/ns/app: manifest invalid: manifest invalid")
+	quota := errors.New("Error writing blob: Error uploading layer chunked: blob upload invalid: blob upload invalid")
+	tooLarge := errors.New("Error writing blob: Error initiating layer upload to /v2/ns/app/blobs/uploads/ in target, status 413 (Request Entity Too Large)")
+
+	assert.True(t, isRegistryNotReadyError(refused))
+	assert.True(t, isUnauthorizedError(unauthorized))
+	assert.False(t, isUnauthorizedError(invalid))
+	assert.False(t, isNonRetriableCopyError(refused))
+	assert.True(t, isNonRetriableCopyError(unauthorized))
+	assert.True(t, isNonRetriableCopyError(invalid))
+	assert.True(t, isQuotaExceededError(quota))
+	assert.True(t, isQuotaExceededError(tooLarge))
+	assert.False(t, isQuotaExceededError(unauthorized))
+	assert.True(t, isNonRetriableCopyError(quota))
+	assert.False(t, isNonRetriableCopyError(nil))
+
+	reset := errors.New("Error writing blob: Patch https://target/v2/ns/app/blobs/uploads/1: read tcp 10.0.0.2:40000->10.0.0.1:443: read: connection reset by peer")
+	assert.True(t, isTransientCopyError(refused))
+	assert.True(t, isTransientCopyError(reset))
+	assert.False(t, isTransientCopyError(unauthorized))
+	assert.False(t, isTransientCopyError(errors.New("Error parsing image name")))
+
+	rateLimited := errors.New("Error writing blob: Error initiating layer upload to /v2/ns/app/blobs/uploads/ in quay.io: too many requests to registry")
+	assert.True(t, isRateLimitedError(rateLimited))
+	assert.True(t, isTransientCopyError(rateLimited))
+	assert.False(t, isNonRetriableCopyError(rateLimited))
+	assert.False(t, isRateLimitedError(reset))
+}
@@ -4,134 +4,864 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
 	"github.com/go-logr/logr"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	imagev1API "github.com/openshift/api/image/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	//"github.com/sirupsen/logrus"
 )
 
+const (
+	// CopyConcurrencyEnvVar is the environment variable setting the number of tags copied concurrently
+	CopyConcurrencyEnvVar  = "IMAGE_COPY_CONCURRENCY"
+	defaultCopyConcurrency = 4
+)
+
+const (
+	// CopyTimeoutEnvVar is the environment variable setting the maximum time spent copying a single image
+	CopyTimeoutEnvVar  = "IMAGE_COPY_TIMEOUT"
+	defaultCopyTimeout = 30 * time.Minute
+)
+
+const (
+	// CopyRetryAttemptsEnvVar is the environment variable setting how many times each image copy is attempted
+	CopyRetryAttemptsEnvVar  = "IMAGE_COPY_RETRY_ATTEMPTS"
+	defaultCopyRetryAttempts = 7
+	// CopyRetriesEnvVar is the environment variable setting how many times a failed image copy is retried,
+	// used when IMAGE_COPY_RETRY_ATTEMPTS is not set
+	CopyRetriesEnvVar = "IMAGE_COPY_RETRIES"
+	// CopyRetryIntervalEnvVar is the environment variable setting the wait before the first retry, doubled on each retry
+	CopyRetryIntervalEnvVar  = "IMAGE_COPY_RETRY_INTERVAL"
+	defaultCopyRetryInterval = 5 * time.Second
+)
+
+const (
+	// CopyProgressIntervalEnvVar is the environment variable setting how often the progress of an image copy is logged
+	CopyProgressIntervalEnvVar  = "IMAGE_COPY_PROGRESS_INTERVAL"
+	defaultCopyProgressInterval = 30 * time.Second
+)
+
+// SingleArchEnvVar is the environment variable which, set to "true", copies only the
+// image of the plugin platform out of a manifest list instead of the whole list
+const SingleArchEnvVar = "IMAGE_COPY_SINGLE_ARCH"
+
+// ImageStreamCopyOptions configures the copy of the images of an ImageStream
+type ImageStreamCopyOptions struct {
+	// The internal registry path for the cluster in which is comes from, used to determine which images are local
+	InternalRegistryPath string
+	// The registry to copy the images from
+	SrcRegistry string
+	// The registry to copy the images to
+	DestRegistry string
+	// The namespace to copy to
+	DestNamespace string
+	// The repository to copy the images from, instead of the one of their reference
+	SrcRepository string
+	// The repository to copy the images to, instead of DestNamespace/<imagestream name>
+	DestRepository string
+	// The containers/image options used for each image copy
+	CopyOptions *copy.Options
+	// Whether to update the input imageStream if the digest changes on pushing to the new registry
+	UpdateDigest bool
+	// Whether to also copy images that reference registries other than the internal one
+	CopyExternal bool
+	// Tag names or glob patterns to copy; if empty, all tags are copied
+	IncludeTags []string
+	// The maximum number of tags copied at the same time
+	Concurrency int
+	// Whether to copy external images of tags with a Local reference policy through the internal registry
+	PullThroughLocalReferences bool
+	// Digests recorded at backup time for the most recent image of each tag, which
+	// are pulled by digest from the source registry instead of re-resolving the reference
+	TagDigests map[string]string
+	// The maximum time spent copying a single image, including retries; zero means no limit
+	Timeout time.Duration
+	// Whether to skip the copy of images the destination repository already has
+	SkipExistingImages bool
+	// The number of times each image copy is attempted
+	RetryAttempts int
+	// The wait before the first retry of an image copy, doubled on each retry
+	RetryInterval time.Duration
+	// Whether to only check that the source registry has each image instead of copying it
+	DryRun bool
+	// The file of the token used as the password of the source registry credentials,
+	// re-read before each copy attempt as the token may be rotated during long copies
+	SourceTokenFile string
+	// The file of the token used as the password of the destination registry credentials
+	DestTokenFile string
+	// Whether to push the layers as they are and fail the tags whose image digest
+	// changes, unless the manifest had to be converted
+	PreserveDigests bool
+	// The compression of the pushed layers: gzip, zstd or none; empty leaves it to
+	// the destination, unless digests are preserved
+	Compression string
+	// Whether to also copy the sigstore signatures and attachments of each image
+	CopySignatures bool
+	// The registries for which TLS verification is skipped; if set, only these
+	// are insecure among the external registries images are pulled from
+	InsecureRegistries []string
+	// The images already copied by the same backup or restore, which are only
+	// tagged again from the copy in the destination repository; nil copies each image
+	CopiedImages *CopiedImages
+	// Whether to read back the manifest of each pushed image from the destination
+	// and fail the tag if it isn't the one pushed
+	VerifyPushes bool
+	// The OCI layout directory to copy the local images from instead of SrcRegistry,
+	// looking each image up by digest
+	SrcOCILayout string
+	// The OCI layout directory to copy the images to instead of DestRegistry, each
+	// named by its source digest
+	DestOCILayout string
+}
+
+// ImageStreamCopyResult describes the outcome of copying the images of an ImageStream
+type ImageStreamCopyResult struct {
+	// The digest pushed for the most recent image of each copied tag
+	Digests map[string]string
+	// Tag items skipped because their image is missing from the source registry, as tag@image
+	SkippedItems []string
+	// Tags whose most recent image was pushed to the destination by tag
+	CopiedTags []string
+	// Tags with at least one image which failed to copy
+	FailedTags []string
+	// Blob bytes transferred to the destination registry
+	BytesCopied uint64
+	// Blob bytes not transferred because the blobs already existed at the destination
+	BytesExisting uint64
+	// Blobs not transferred because the destination already had them, checked
+	// directly or found through the blob info cache
+	BlobsReused int
+	// The number of copy attempts rate limited by each registry
+	RateLimited map[string]int
+	// Images copied to the destination registry
+	ImagesCopied int
+	// Images not copied because the destination registry already had them
+	ImagesExisting int
+	// The time spent copying the images of the ImageStream
+	Duration time.Duration
+	// The digest pushed for each source image digest which changed because the
+	// manifest of the image had to be converted
+	ConvertedDigests map[string]string
+}
+
 // CopyLocalImageStreamImages copies all local images associated with the ImageStream
-// is: ImageStream resource that images are being copied for
-// internalRegistryPath: The internal registry path for the cluster in which is comes from, used to determine which images are local
-// srcRegistry: the registry to copy the images from
-// destRegistry: the registry to copy the images to
-// destNamespace: the namespace to copy to
+// ctx: cancelling it aborts the copies in progress and fails the tags not copied yet
+// imageStream: ImageStream resource that images are being copied for
+// options: the copy configuration
 // log: the logger to log to
-// updateDigest: whether to update the input imageStream if the digest changes on pushing to the new registry
 func CopyLocalImageStreamImages(
+	ctx context.Context,
 	imageStream imagev1API.ImageStream,
-	internalRegistryPath string,
-	srcRegistry string,
-	destRegistry string,
-	destNamespace string,
-	copyOptions *copy.Options,
-	log logr.Logger,
-	updateDigest bool) error {
+	options ImageStreamCopyOptions,
+	log logr.Logger) (*ImageStreamCopyResult, error) {
+	copier := &imageStreamCopier{
+		ctx:                    ctx,
+		ImageStreamCopyOptions: options,
+		imageStream:            imageStream,
+		log:                    log,
+	}
+	if !options.PreserveDigests && len(options.Compression) > 0 {
+		copier.CopyOptions = compressedCopyOptions(options.CopyOptions, options.Compression)
+	}
+	concurrency := options.Concurrency
+	if concurrency < 1 || len(options.DestOCILayout) > 0 {
+		// each copy to an OCI layout rewrites its index, so they can't run at the same time
+		concurrency = 1
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
 	localImageCopied := false
 	localImageCopiedByTag := false
+	result := &ImageStreamCopyResult{Digests: make(map[string]string), ConvertedDigests: make(map[string]string), RateLimited: make(map[string]int)}
+	copier.throttle = newThrottle(concurrency)
+	start := time.Now()
 	for tagIndex, tag := range imageStream.Status.Tags {
-		log.Info(fmt.Sprintf("[imagecopy] Copying tag: %#v", tag.Tag))
-		specTag := findSpecTag(imageStream.Spec.Tags, tag.Tag)
-		copyToTag := true
-		if specTag != nil && specTag.From != nil {
-			// we have a tag.
-			log.Info(fmt.Sprintf("[imagecopy] image tagged: %s, %s", specTag.From.Kind, specTag.From.Name))
-			// Use the tag if it references an ImageStreamImage in the current namespace
-			if !(specTag.From.Kind == "ImageStreamImage" && (specTag.From.Namespace == "" || specTag.From.Namespace == imageStream.Namespace)) {
-				log.Info(fmt.Sprintf("[imagecopy] not using tag for copy (either out-of-namespace or not an ImageStreamImage tag"))
-				copyToTag = false
-			}
-		}
-		// Iterate over items in reverse order so most recently tagged is copied last
-		for i := len(tag.Items) - 1; i >= 0; i-- {
-			dockerImageReference := tag.Items[i].DockerImageReference
-			if len(internalRegistryPath) > 0 && strings.HasPrefix(dockerImageReference, internalRegistryPath) {
-				if len(srcRegistry) == 0 {
-					return errors.New("copy source registry not found but ImageStream has internal images")
-				}
-				if len(destRegistry) == 0 {
-					return errors.New("copy destination registry not found but ImageStream has internal images")
-				}
-				localImageCopied = true
-				destTag := ""
-				if copyToTag {
-					localImageCopiedByTag = true
-					destTag = ":" + tag.Tag
-				}
-				srcPath := fmt.Sprintf("docker://%s%s", srcRegistry, strings.TrimPrefix(dockerImageReference, internalRegistryPath))
-				destPath := fmt.Sprintf("docker://%s/%s/%s%s", destRegistry, destNamespace, imageStream.Name, destTag)
-				log.Info(fmt.Sprintf("[imagecopy] copying from: %s", srcPath))
-				log.Info(fmt.Sprintf("[imagecopy] copying to: %s", destPath))
-
-				imgManifest, err := copyImage(log, srcPath, destPath, copyOptions)
-				if err != nil {
-					log.Info(fmt.Sprintf("[imagecopy] Error copying image: %v", err))
-					return err
-				}
-				newDigest, err := manifest.Digest(imgManifest)
-				if err != nil {
-					log.Info(fmt.Sprintf("[imagecopy] Error computing image digest for manifest: %v", err))
-					return err
-				}
-				log.V(4).Info(fmt.Sprintf("[imagecopy] src image digest: %s", tag.Items[i].Image))
-				if updateDigest && string(newDigest) != tag.Items[i].Image {
-					log.V(4).Info(fmt.Sprintf("[imagecopy] migration registry image digest: %s", newDigest))
-					imageStream.Status.Tags[tagIndex].Items[i].Image = string(newDigest)
-					digestSplit := strings.Split(dockerImageReference, "@")
-					// update sha in dockerImageRef found
-					if len(digestSplit) == 2 {
-						imageStream.Status.Tags[tagIndex].Items[i].DockerImageReference = digestSplit[0] +
-							"@" + string(newDigest)
-					}
-				}
-				log.V(4).Info(fmt.Sprintf("[imagecopy] manifest of copied image: %s", imgManifest))
-			}
+		if !TagIncluded(options.IncludeTags, tag.Tag) {
+			log.Info(fmt.Sprintf("[imagecopy] tag %s does not match included tags %v, skipping copy", tag.Tag, options.IncludeTags))
+			continue
 		}
+		wg.Add(1)
+		copier.throttle.acquire()
+		go func(tagIndex int, tag imagev1API.NamedTagEventList) {
+			defer wg.Done()
+			defer copier.throttle.release()
+			tagResult, err := copier.copyTag(tagIndex, tag)
+			mutex.Lock()
+			defer mutex.Unlock()
+			localImageCopied = localImageCopied || tagResult.copied
+			localImageCopiedByTag = localImageCopiedByTag || tagResult.copiedByTag
+			if len(tagResult.digest) > 0 {
+				result.Digests[tag.Tag] = tagResult.digest
+			}
+			if tagResult.copiedByTag && len(tagResult.digest) > 0 {
+				result.CopiedTags = append(result.CopiedTags, tag.Tag)
+			}
+			result.SkippedItems = append(result.SkippedItems, tagResult.skippedItems...)
+			for source, pushed := range tagResult.convertedDigests {
+				result.ConvertedDigests[source] = pushed
+			}
+			result.BytesCopied += tagResult.stats.transferred
+			result.BytesExisting += tagResult.stats.existing
+			result.BlobsReused += tagResult.stats.reused
+			result.ImagesCopied += tagResult.stats.images
+			result.ImagesExisting += tagResult.stats.existingImages
+			for registry, count := range tagResult.stats.rateLimited {
+				result.RateLimited[registry] += count
+			}
+			if err != nil {
+				log.Info(fmt.Sprintf("[imagecopy] Error copying tag %s: %v", tag.Tag, err))
+				errs = append(errs, fmt.Errorf("tag %s: %v", tag.Tag, err))
+				result.FailedTags = append(result.FailedTags, tag.Tag)
+			}
+		}(tagIndex, tag)
 	}
+	wg.Wait()
+	result.Duration = time.Since(start)
 	log.Info(fmt.Sprintf("[imagecopy] copied at least one local image: %t", localImageCopied))
 	log.Info(fmt.Sprintf("[imagecopy] copied at least one local image by tag: %t", localImageCopiedByTag))
-	return nil
+	sort.Strings(result.SkippedItems)
+	sort.Strings(result.CopiedTags)
+	sort.Strings(result.FailedTags)
+	return result, utilerrors.NewAggregate(errs)
+}
+
+// imageStreamCopier holds the settings shared by all tag copies of a single ImageStream
+type imageStreamCopier struct {
+	ImageStreamCopyOptions
+	ctx         context.Context
+	imageStream imagev1API.ImageStream
+	log         logr.Logger
+	throttle    *throttle
+}
+
+// tagCopyResult describes the outcome of copying the images of a single tag
+type tagCopyResult struct {
+	copied           bool
+	copiedByTag      bool
+	digest           string
+	skippedItems     []string
+	convertedDigests map[string]string
+	stats            copyStats
+}
+
+// copyStats counts the blobs of image copies
+type copyStats struct {
+	transferred uint64
+	existing    uint64
+	reused      int
+	// the number of copy attempts rate limited by each registry
+	rateLimited map[string]int
+	// the images copied, and those the destination already had
+	images         int
+	existingImages int
+}
+
+// add adds the counts of other to s
+func (s *copyStats) add(other copyStats) {
+	s.transferred += other.transferred
+	s.existing += other.existing
+	s.reused += other.reused
+	s.images += other.images
+	s.existingImages += other.existingImages
+	for registry, count := range other.rateLimited {
+		s.addRateLimited(registry, count)
+	}
+}
+
+// addRateLimited counts rate limited copy attempts of registry
+func (s *copyStats) addRateLimited(registry string, count int) {
+	if s.rateLimited == nil {
+		s.rateLimited = map[string]int{}
+	}
+	s.rateLimited[registry] += count
+}
+
+// slowDownIfRateLimited lowers the number of tags copied at the same time if a
+// registry rate limited the copy
+func (c *imageStreamCopier) slowDownIfRateLimited(stats copyStats) {
+	if len(stats.rateLimited) > 0 && c.throttle != nil {
+		limit := c.throttle.slowDown()
+		c.log.Info(fmt.Sprintf("[imagecopy] rate limited by registry, copying up to %d tags at a time", limit))
+	}
+}
+
+// copyTag copies the images of a single status tag. Only the items of the
+// given tag are updated, so tags can be copied concurrently.
+func (c *imageStreamCopier) copyTag(tagIndex int, tag imagev1API.NamedTagEventList) (tagCopyResult, error) {
+	log := c.log
+	imageStream := c.imageStream
+	result := tagCopyResult{}
+	log.Info(fmt.Sprintf("[imagecopy] Copying tag: %#v", tag.Tag))
+	specTag := findSpecTag(imageStream.Spec.Tags, tag.Tag)
+	copyToTag := true
+	if specTag != nil && specTag.From != nil {
+		// we have a tag.
+		log.Info(fmt.Sprintf("[imagecopy] image tagged: %s, %s", specTag.From.Kind, specTag.From.Name))
+		// Use the tag if it references an ImageStreamImage in the current namespace
+		if !(specTag.From.Kind == "ImageStreamImage" && (specTag.From.Namespace == "" || specTag.From.Namespace == imageStream.Namespace)) {
+			log.Info(fmt.Sprintf("[imagecopy] not using tag for copy (either out-of-namespace or not an ImageStreamImage tag"))
+			copyToTag = false
+		}
+	}
+	// Tags with a Local reference policy are served by the internal registry even
+	// when they point at an external image
+	localReferencePolicy := specTag != nil && specTag.ReferencePolicy.Type == imagev1API.LocalTagReferencePolicy
+	// Iterate over items in reverse order so most recently tagged is copied last
+	for i := len(tag.Items) - 1; i >= 0; i-- {
+		dockerImageReference := tag.Items[i].DockerImageReference
+		localImage := len(c.InternalRegistryPath) > 0 && common.HasImageRefPrefix(dockerImageReference, c.InternalRegistryPath)
+		// Tags pinned to an image of another stream (e.g. by an ImageStreamImage
+		// reference) are copied into the repository of this stream
+		otherStream := false
+		if localImage {
+			localRef, err := common.ParseLocalImageReference(dockerImageReference, c.InternalRegistryPath)
+			otherStream = err == nil && (localRef.Namespace != imageStream.Namespace || localRef.Name != imageStream.Name)
+		}
+		pullThrough := !localImage && localReferencePolicy && c.PullThroughLocalReferences && len(c.InternalRegistryPath) > 0
+		if !localImage && !pullThrough && !c.CopyExternal {
+			log.Info(fmt.Sprintf("[imagecopy] skipping copy of external image: %s", dockerImageReference))
+			continue
+		}
+		if len(c.SrcRegistry) == 0 && len(c.SrcOCILayout) == 0 {
+			return result, errors.New("copy source registry not found but ImageStream has internal images")
+		}
+		if len(c.DestRegistry) == 0 && len(c.DestOCILayout) == 0 {
+			return result, errors.New("copy destination registry not found but ImageStream has internal images")
+		}
+		result.copied = true
+		destTag := ""
+		if copyToTag {
+			result.copiedByTag = true
+			destTag = ":" + tag.Tag
+		}
+		srcPath := fmt.Sprintf("docker://%s%s", c.SrcRegistry, strings.TrimPrefix(dockerImageReference, c.InternalRegistryPath))
+		if len(c.SrcRepository) > 0 {
+			srcPath = fmt.Sprintf("docker://%s/%s@%s", c.SrcRegistry, c.SrcRepository, tag.Items[i].Image)
+		}
+		if recordedDigest := c.TagDigests[tag.Tag]; i == 0 && len(recordedDigest) > 0 {
+			// pull the most recent image by the digest recorded at backup time, in case
+			// the tag was overwritten in the source registry since
+			srcPath = fmt.Sprintf("docker://%s/%s@%s", c.SrcRegistry, c.srcRepository(), recordedDigest)
+		}
+		if len(c.SrcOCILayout) > 0 && localImage {
+			layoutPath, err := ociLayoutSource(c.SrcOCILayout, c.itemDigest(tag, i))
+			if err != nil {
+				return result, fmt.Errorf("imagestream %s/%s image %s: %v", imageStream.Namespace, imageStream.Name, tag.Items[i].Image, err)
+			}
+			srcPath = layoutPath
+		}
+		imageCopyOptions := c.CopyOptions
+		if pullThrough {
+			// pull the image through the internal registry, as clients of the tag do
+			srcPath = fmt.Sprintf("docker://%s/%s/%s@%s", c.SrcRegistry, imageStream.Namespace, imageStream.Name, tag.Items[i].Image)
+		} else if !localImage {
+			// external images are pulled straight from their own registry,
+			// without the internal registry credentials
+			srcPath = fmt.Sprintf("docker://%s", dockerImageReference)
+			imageCopyOptions = externalCopyOptions(c.CopyOptions, registryHost(srcPath), c.InsecureRegistries)
+			if RegistryListed(c.InsecureRegistries, registryHost(srcPath)) {
+				log.Info(fmt.Sprintf("[imagecopy] WARNING: TLS verification is disabled for registry %s", registryHost(srcPath)))
+			}
+		}
+		destPath := fmt.Sprintf("docker://%s/%s%s", c.DestRegistry, c.destRepository(), destTag)
+		if len(c.DestOCILayout) > 0 {
+			destPath = ociLayoutDestination(c.DestOCILayout, tag.Items[i].Image)
+		}
+		if c.SkipExistingImages {
+			digest := c.itemDigest(tag, i)
+			// the most recent image must also be tagged, older ones only need to exist
+			existingPath := fmt.Sprintf("docker://%s/%s@%s", c.DestRegistry, c.destRepository(), digest)
+			if copyToTag && i == 0 {
+				existingPath = destPath
+			}
+			if len(digest) > 0 && destinationHasImage(c.ctx, existingPath, digest, imageCopyOptions.DestinationCtx) {
+				log.Info(fmt.Sprintf("[imagecopy] image %s already present at %s, skipping copy", digest, existingPath))
+				result.stats.existingImages++
+				result.digest = digest
+				continue
+			}
+		}
+		if c.DryRun {
+			log.Info(fmt.Sprintf("[imagecopy] dry run, checking source image: %s", srcPath))
+			if err := checkSourceImage(c.ctx, srcPath, imageCopyOptions.SourceCtx); err != nil {
+				return result, fmt.Errorf("imagestream %s/%s image %s can't be read from %s: %v", imageStream.Namespace, imageStream.Name, tag.Items[i].Image, srcPath, err)
+			}
+			continue
+		}
+		tokens := c.tokenFiles()
+		sourceDigest := c.itemDigest(tag, i)
+		destRepository := fmt.Sprintf("%s/%s", c.DestRegistry, c.destRepository())
+		dedupe := c.CopiedImages != nil && len(c.DestOCILayout) == 0 && len(sourceDigest) > 0
+		deduplicated := false
+		if dedupe {
+			if pushed, found := c.CopiedImages.lookup(sourceDigest, destRepository); found {
+				// only the manifest is pushed again, from the copy already in the destination
+				log.Info(fmt.Sprintf("[imagecopy] image %s already copied to %s, deduplicated", sourceDigest, destRepository))
+				srcPath = fmt.Sprintf("docker://%s@%s", destRepository, pushed)
+				deduplicatedOptions := *imageCopyOptions
+				deduplicatedOptions.SourceCtx = imageCopyOptions.DestinationCtx
+				imageCopyOptions = &deduplicatedOptions
+				tokens.source = tokens.destination
+				deduplicated = true
+			}
+		}
+		log.Info(fmt.Sprintf("[imagecopy] copying from: %s", srcPath))
+		log.Info(fmt.Sprintf("[imagecopy] copying to: %s", destPath))
+
+		imgManifest, stats, err := copyImage(c.ctx, log, srcPath, destPath, imageCopyOptions, c.Timeout, c.retryPolicy(), tokens, c.layerCompression())
+		result.stats.add(stats)
+		c.slowDownIfRateLimited(stats)
+		if isSourceImageNotFoundError(err) {
+			log.Info(fmt.Sprintf("[imagecopy] image %s not found in source registry, skipping: %v", srcPath, err))
+			result.skippedItems = append(result.skippedItems, tag.Tag+"@"+tag.Items[i].Image)
+			continue
+		}
+		if isQuotaExceededError(err) {
+			log.Info(fmt.Sprintf("[imagecopy] Error copying image: %v", err))
+			return result, fmt.Errorf("imagestream %s/%s image %s: the registry rejected the push of about %d bytes to namespace %s, "+
+				"the image stream quota of the namespace or the registry storage is likely exhausted: %v",
+				imageStream.Namespace, imageStream.Name, tag.Items[i].Image, stats.transferred, c.DestNamespace, err)
+		}
+		if err != nil {
+			log.Info(fmt.Sprintf("[imagecopy] Error copying image: %v", err))
+			return result, fmt.Errorf("imagestream %s/%s image %s: %v", imageStream.Namespace, imageStream.Name, tag.Items[i].Image, err)
+		}
+		result.stats.images++
+		newDigest, err := manifest.Digest(imgManifest)
+		if err != nil {
+			log.Info(fmt.Sprintf("[imagecopy] Error computing image digest for manifest: %v", err))
+			return result, err
+		}
+		if c.VerifyPushes {
+			// read the image back by digest, rather than by the tag it may have been pushed to
+			verifyPath := fmt.Sprintf("docker://%s/%s@%s", c.DestRegistry, c.destRepository(), newDigest)
+			if len(c.DestOCILayout) > 0 {
+				verifyPath = destPath
+			}
+			if err := verifyPushedImage(c.ctx, verifyPath, string(newDigest), imageCopyOptions.DestinationCtx); err != nil {
+				log.Info(fmt.Sprintf("[imagecopy] Error verifying pushed image: %v", err))
+				return result, fmt.Errorf("imagestream %s/%s image %s: %v", imageStream.Namespace, imageStream.Name, tag.Items[i].Image, err)
+			}
+		}
+		if expected := referenceDigest(srcPath); c.PreserveDigests && len(expected) > 0 && string(newDigest) != expected {
+			if !manifestConversionRequired(c.ctx, srcPath, imageCopyOptions, len(c.DestOCILayout) > 0) {
+				return result, fmt.Errorf("imagestream %s/%s image %s: digest changed from %s to %s on copy to %s",
+					imageStream.Namespace, imageStream.Name, tag.Items[i].Image, expected, newDigest, destPath)
+			}
+			log.Info(fmt.Sprintf("[imagecopy] manifest of image %s had to be converted, digest changed to %s", srcPath, newDigest))
+			if result.convertedDigests == nil {
+				result.convertedDigests = map[string]string{}
+			}
+			result.convertedDigests[expected] = string(newDigest)
+		}
+		if dedupe && !deduplicated {
+			c.CopiedImages.record(sourceDigest, destRepository, string(newDigest))
+		}
+		if c.CopySignatures && !deduplicated {
+			signatureStats, err := c.copySignatures(srcPath, string(newDigest), imageCopyOptions)
+			result.stats.add(signatureStats)
+			c.slowDownIfRateLimited(signatureStats)
+			if err != nil {
+				return result, fmt.Errorf("imagestream %s/%s image %s: %v", imageStream.Namespace, imageStream.Name, tag.Items[i].Image, err)
+			}
+		}
+		result.digest = string(newDigest)
+		log.V(4).Info(fmt.Sprintf("[imagecopy] src image digest: %s", tag.Items[i].Image))
+		if c.UpdateDigest && (!localImage || otherStream) {
+			// the copied external, pulled-through or other stream image now lives in the
+			// repository of this stream in the migration registry, so record it as a
+			// local image of this stream for the restore plugin to pick up
+			log.V(4).Info(fmt.Sprintf("[imagecopy] migration registry image digest: %s", newDigest))
+			imageStream.Status.Tags[tagIndex].Items[i].Image = string(newDigest)
+			imageStream.Status.Tags[tagIndex].Items[i].DockerImageReference = fmt.Sprintf("%s/%s/%s@%s",
+				c.InternalRegistryPath, imageStream.Namespace, imageStream.Name, newDigest)
+		} else if c.UpdateDigest && string(newDigest) != tag.Items[i].Image {
+			log.V(4).Info(fmt.Sprintf("[imagecopy] migration registry image digest: %s", newDigest))
+			imageStream.Status.Tags[tagIndex].Items[i].Image = string(newDigest)
+			digestSplit := strings.Split(dockerImageReference, "@")
+			// update sha in dockerImageRef found
+			if len(digestSplit) == 2 {
+				imageStream.Status.Tags[tagIndex].Items[i].DockerImageReference = digestSplit[0] +
+					"@" + string(newDigest)
+			}
+		}
+		log.V(4).Info(fmt.Sprintf("[imagecopy] manifest of copied image: %s", imgManifest))
+		log.V(4).Info(fmt.Sprintf("[imagecopy] copied %d bytes, %d bytes of %d blobs already existed", stats.transferred, stats.existing, stats.reused))
+	}
+	return result, nil
+}
+
+// itemDigest returns the digest of the source image of item i of tag, the one
+// recorded at backup time for the most recent image
+func (c *imageStreamCopier) itemDigest(tag imagev1API.NamedTagEventList, i int) string {
+	if recordedDigest := c.TagDigests[tag.Tag]; i == 0 && len(recordedDigest) > 0 {
+		return recordedDigest
+	}
+	return tag.Items[i].Image
+}
+
+// srcRepository returns the repository of the source registry holding the images of the ImageStream
+func (c *imageStreamCopier) srcRepository() string {
+	if len(c.SrcRepository) > 0 {
+		return c.SrcRepository
+	}
+	return c.imageStream.Namespace + "/" + c.imageStream.Name
+}
+
+// destRepository returns the repository of the destination registry the images are copied to
+func (c *imageStreamCopier) destRepository() string {
+	if len(c.DestRepository) > 0 {
+		return c.DestRepository
+	}
+	return c.DestNamespace + "/" + c.imageStream.Name
+}
+
+// CopyConcurrency returns the maximum number of ImageStream tags copied at the
+// same time, configured by the IMAGE_COPY_CONCURRENCY environment variable.
+// containers/image transfers up to 6 layers of each image in parallel between
+// docker registries, so the registries see up to 6 times as many blob transfers.
+func CopyConcurrency() int {
+	concurrency, err := strconv.Atoi(os.Getenv(CopyConcurrencyEnvVar))
+	if err != nil || concurrency < 1 {
+		return defaultCopyConcurrency
+	}
+	return concurrency
+}
+
+// CopyRetryAttempts returns the number of times each image copy is attempted,
+// configured by the IMAGE_COPY_RETRY_ATTEMPTS environment variable, or by
+// IMAGE_COPY_RETRIES as the number of retries after the first attempt
+func CopyRetryAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv(CopyRetryAttemptsEnvVar))
+	if err == nil && attempts >= 1 {
+		return attempts
+	}
+	retries, err := strconv.Atoi(os.Getenv(CopyRetriesEnvVar))
+	if err == nil && retries >= 0 {
+		return retries + 1
+	}
+	return defaultCopyRetryAttempts
+}
+
+// CopyRetryInterval returns the wait before the first retry of an image copy,
+// configured by the IMAGE_COPY_RETRY_INTERVAL environment variable as a duration
+func CopyRetryInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv(CopyRetryIntervalEnvVar))
+	if err != nil || interval <= 0 {
+		return defaultCopyRetryInterval
+	}
+	return interval
+}
+
+// retryPolicy configures the attempts of a single image copy
+type retryPolicy struct {
+	attempts int
+	interval time.Duration
+}
+
+// retryPolicy returns the retry policy of the copier, falling back to the
+// defaults for unset options
+func (c *imageStreamCopier) retryPolicy() retryPolicy {
+	policy := retryPolicy{attempts: c.RetryAttempts, interval: c.RetryInterval}
+	if policy.attempts < 1 {
+		policy.attempts = defaultCopyRetryAttempts
+	}
+	if policy.interval <= 0 {
+		policy.interval = defaultCopyRetryInterval
+	}
+	return policy
+}
+
+// CopyTimeout returns the maximum time spent copying a single image, configured
+// by the IMAGE_COPY_TIMEOUT environment variable as a duration (e.g. "45m")
+func CopyTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv(CopyTimeoutEnvVar))
+	if err != nil || timeout < 0 {
+		return defaultCopyTimeout
+	}
+	return timeout
+}
+
+// ImageListSelection returns which images of a manifest list are copied: all of
+// them, unless IMAGE_COPY_SINGLE_ARCH is "true"
+func ImageListSelection() copy.ImageListSelection {
+	if singleArch, err := strconv.ParseBool(os.Getenv(SingleArchEnvVar)); err == nil && singleArch {
+		return copy.CopySystemImage
+	}
+	return copy.CopyAllImages
 }
 
-func copyImage(log logr.Logger,src, dest string, copyOptions *copy.Options) ([]byte, error) {
+func copyImage(ctx context.Context, log logr.Logger, src, dest string, copyOptions *copy.Options, timeout time.Duration, retry retryPolicy, tokens tokenFiles,
+	layerCompression *types.LayerCompression) ([]byte, copyStats, error) {
+	stats := copyStats{}
 	policyContext, err := getPolicyContext()
 	if err != nil {
-		return []byte{}, fmt.Errorf("Error loading trust policy: %v", err)
+		return []byte{}, stats, fmt.Errorf("Error loading trust policy: %v", err)
 	}
 	defer policyContext.Destroy()
 	srcRef, err := alltransports.ParseImageName(src)
 	if err != nil {
-		return []byte{}, fmt.Errorf("Invalid source name %s: %v", src, err)
+		return []byte{}, stats, fmt.Errorf("Invalid source name %s: %v", src, err)
 	}
 	destRef, err := alltransports.ParseImageName(dest)
 	if err != nil {
-		return []byte{}, fmt.Errorf("Invalid destination name %s: %v", dest, err)
+		return []byte{}, stats, fmt.Errorf("Invalid destination name %s: %v", dest, err)
+	}
+	if layerCompression != nil {
+		destRef = layerCompressionReference{destRef, *layerCompression}
+	}
+	// The timeout bounds all attempts, and cancelling the context, by the timeout
+	// or with the backup or restore, aborts the registry requests of the attempt
+	// in progress
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	// Let's retry the image copy up to 10 times
-	// Each retry will wait 5 seconds longer
+	// Let's retry the image copy, e.g. while the registry is not ready yet
+	// Each retry will wait twice as long as the previous one
 	// Let's log a warning if we encounter `blob unknown to registry`
-	retryWait := 0
-	log.Info(fmt.Sprintf("copying image: %s; will attempt up to 7 times...", src))
-	for i := 0; i < 7; i++ {
-		time.Sleep(time.Duration(retryWait) * time.Second)
-		retryWait += 5
-		var manifest []byte
-		manifest, err = copy.Image(context.Background(), policyContext, destRef, srcRef, copyOptions)
+	retryWait := time.Duration(0)
+	log.Info(fmt.Sprintf("copying image: %s; will attempt up to %v times...", src, retry.attempts))
+	attempts := 0
+	start := time.Now()
+	for i := 0; i < retry.attempts; i++ {
+		if ctx.Err() != nil {
+			return []byte{}, stats, interruptedCopyError(ctx, src, timeout, err)
+		}
+		select {
+		case <-time.After(retryWait):
+		case <-ctx.Done():
+			return []byte{}, stats, interruptedCopyError(ctx, src, timeout, err)
+		}
+		if retryWait == 0 {
+			retryWait = retry.interval
+		} else {
+			retryWait *= 2
+		}
+		var imgManifest []byte
+		attempts++
+		// each attempt uses the current registry tokens, and starts a new upload,
+		// as the registry may not have kept the blobs of an interrupted one
+		attemptOptions, usedTokens, refreshErr := tokens.refresh(copyOptions)
+		if refreshErr != nil {
+			return []byte{}, stats, refreshErr
+		}
+		imgManifest, err = copyImageCountingBytes(ctx, log, src, policyContext, destRef, srcRef, attemptOptions, &stats)
 		if err == nil {
-			return manifest, err
+			log.Info(fmt.Sprintf("copy of image %s complete, %d bytes transferred in %v", src, stats.transferred, time.Since(start).Round(time.Second)))
+		}
+		if err == nil || isSourceImageNotFoundError(err) {
+			return imgManifest, stats, err
+		}
+		if ctx.Err() != nil {
+			return []byte{}, stats, interruptedCopyError(ctx, src, timeout, err)
+		}
+		if isManifestInvalidError(err) && copyOptions.ForceManifestMIMEType == "" && isSchema1Source(ctx, srcRef, attemptOptions.SourceCtx) {
+			// the destination rejects schema1 manifests, so convert the image to schema2
+			log.Info(fmt.Sprintf("destination rejected the schema1 manifest of image %s, converting to schema2", src))
+			imgManifest, err = copyImageCountingBytes(ctx, log, src, policyContext, destRef, srcRef, schema2CopyOptions(attemptOptions), &stats)
+			if err != nil {
+				return []byte{}, stats, fmt.Errorf("image %s has a schema1 manifest which the destination registry rejects, "+
+					"and it could not be converted to schema2; push the image again with a schema2 manifest before migrating: %v", src, err)
+			}
+			return imgManifest, stats, nil
+		}
+		if isUnauthorizedError(err) && tokens.tokensRotated(copyOptions, usedTokens) {
+			// the token expired during the copy, the blobs already pushed are
+			// reused by the next attempt
+			log.Info(fmt.Sprintf("registry token rotated while copying image %s, retrying with the new token", src))
+		} else if isNonRetriableCopyError(err) || !isTransientCopyError(err) {
+			return []byte{}, stats, fmt.Errorf("copy of image %s failed after %d attempts: %v", src, attempts, err)
 		}
 		if strings.Contains(err.Error(), "blob unknown to registry") {
 			log.Info(fmt.Sprintf("encountered `blob unknown to registry error` for image %s", src))
 		}
-		log.Info(fmt.Sprintf("attempt #%v failed, waiting %vs and then retrying", i+1, retryWait))
+		if isRegistryNotReadyError(err) {
+			log.Info(fmt.Sprintf("registry not ready copying image %s: %v", src, err))
+		}
+		if isRateLimitedError(err) {
+			stats.addRateLimited(rateLimitedRegistry(err, src, dest), 1)
+			if retryWait < rateLimitWait {
+				retryWait = rateLimitWait
+			}
+		}
+		if i+1 < retry.attempts {
+			log.Info(fmt.Sprintf("attempt #%v of %v failed, waiting %v and then retrying: %v", i+1, retry.attempts, retryWait, err))
+		}
+	}
+	return []byte{}, stats, fmt.Errorf("copy of image %s failed after %d attempts: %v", src, attempts, err)
+}
+
+// copyImageCountingBytes runs a single image copy, adding the blob bytes it
+// transferred, including those of a failed attempt, and the bytes of blobs
+// which already existed at the destination to stats. The progress of the copy
+// is logged every IMAGE_COPY_PROGRESS_INTERVAL, so copies of small images
+// don't log any.
+func copyImageCountingBytes(ctx context.Context, log logr.Logger, src string, policyContext *signature.PolicyContext,
+	destRef, srcRef types.ImageReference, copyOptions *copy.Options, stats *copyStats) ([]byte, error) {
+	progress := make(chan types.ProgressProperties)
+	done := make(chan struct{})
+	interval := CopyProgressInterval()
+	go func() {
+		defer close(done)
+		start := time.Now()
+		lastLog := start
+		var transferred uint64
+		blobSizes := make(map[string]int64)
+		for event := range progress {
+			switch event.Event {
+			case types.ProgressEventRead, types.ProgressEventDone:
+				stats.transferred += event.OffsetUpdate
+				transferred += event.OffsetUpdate
+				blobSizes[event.Artifact.Digest.String()] = event.Artifact.Size
+			case types.ProgressEventSkipped:
+				stats.reused++
+				if event.Artifact.Size > 0 {
+					stats.existing += uint64(event.Artifact.Size)
+				}
+			}
+			if interval > 0 && time.Since(lastLog) >= interval {
+				lastLog = time.Now()
+				log.Info(fmt.Sprintf("[imagecopy] copying %s: %d bytes transferred%s, %v elapsed", src, transferred,
+					knownSize(blobSizes), lastLog.Sub(start).Round(time.Second)))
+			}
+		}
+	}()
+	options := *copyOptions
+	options.Progress = progress
+	options.ProgressInterval = time.Second
+	manifest, err := copy.Image(ctx, policyContext, destRef, srcRef, &options)
+	close(progress)
+	<-done
+	return manifest, err
+}
+
+// interruptedCopyError describes the copy of src stopped by the end of ctx,
+// after the timeout or by cancellation, with the error of the last attempt, or
+// the one of ctx if none failed yet
+func interruptedCopyError(ctx context.Context, src string, timeout time.Duration, err error) error {
+	if err == nil {
+		err = ctx.Err()
+	}
+	if ctx.Err() == context.Canceled {
+		return fmt.Errorf("copy of image %s cancelled: %v", src, err)
+	}
+	return fmt.Errorf("copy of image %s timed out after %v: %v", src, timeout, err)
+}
+
+// knownSize describes the total size of the blobs being copied, if all are known
+func knownSize(blobSizes map[string]int64) string {
+	var total int64
+	for _, size := range blobSizes {
+		if size <= 0 {
+			return ""
+		}
+		total += size
+	}
+	return fmt.Sprintf(" of %d bytes of the %d blobs started", total, len(blobSizes))
+}
+
+// CopyProgressInterval returns how often the progress of an image copy is logged,
+// configured by the IMAGE_COPY_PROGRESS_INTERVAL environment variable as a
+// duration; zero disables the progress logs
+func CopyProgressInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv(CopyProgressIntervalEnvVar))
+	if err != nil || interval < 0 {
+		return defaultCopyProgressInterval
+	}
+	return interval
+}
+
+// destinationHasImage returns true if dest resolves to the image with the
+// given manifest digest, checked with the same system context as the copy
+func destinationHasImage(ctx context.Context, dest, digest string, sys *types.SystemContext) bool {
+	destRef, err := alltransports.ParseImageName(dest)
+	if err != nil {
+		return false
+	}
+	src, err := destRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	imgManifest, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return false
+	}
+	manifestDigest, err := manifest.Digest(imgManifest)
+	return err == nil && string(manifestDigest) == digest
+}
+
+// checkSourceImage returns an error if the manifest of the src image can't be read
+func checkSourceImage(ctx context.Context, src string, sys *types.SystemContext) error {
+	srcRef, err := alltransports.ParseImageName(src)
+	if err != nil {
+		return err
+	}
+	imgSrc, err := srcRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer imgSrc.Close()
+	_, _, err = imgSrc.GetManifest(ctx, nil)
+	return err
+}
+
+// CheckRegistryAccess returns an error if registry can't be reached or rejects
+// the credentials of sys
+func CheckRegistryAccess(registry string, sys *types.SystemContext) error {
+	username, password := "", ""
+	if sys != nil && sys.DockerAuthConfig != nil {
+		username, password = sys.DockerAuthConfig.Username, sys.DockerAuthConfig.Password
 	}
-	return []byte{}, err
+	return docker.CheckAuth(context.Background(), sys, username, password, registry)
+}
+
+// isSchema1Source returns true if the source image has a Docker schema1 manifest
+func isSchema1Source(ctx context.Context, srcRef types.ImageReference, sys *types.SystemContext) bool {
+	mimeType := sourceManifestMIMEType(ctx, srcRef, sys)
+	return mimeType == manifest.DockerV2Schema1MediaType || mimeType == manifest.DockerV2Schema1SignedMediaType
+}
+
+// schema2CopyOptions returns a copy of copyOptions converting the image to a
+// Docker schema2 manifest
+func schema2CopyOptions(copyOptions *copy.Options) *copy.Options {
+	options := *copyOptions
+	options.ForceManifestMIMEType = manifest.DockerV2Schema2MediaType
+	return &options
+}
+
+// externalCopyOptions returns a copy of copyOptions whose source context
+// does not carry the internal registry credentials. If insecureRegistries are
+// set, TLS verification is only skipped for registry if they list it.
+func externalCopyOptions(copyOptions *copy.Options, registry string, insecureRegistries []string) *copy.Options {
+	options := *copyOptions
+	if options.SourceCtx != nil {
+		sourceCtx := *options.SourceCtx
+		sourceCtx.DockerAuthConfig = nil
+		if len(insecureRegistries) > 0 {
+			sourceCtx.DockerInsecureSkipTLSVerify = types.NewOptionalBool(RegistryListed(insecureRegistries, registry))
+		}
+		options.SourceCtx = &sourceCtx
+	}
+	return &options
 }
 
 func getPolicyContext() (*signature.PolicyContext, error) {
@@ -139,6 +869,32 @@ func getPolicyContext() (*signature.PolicyContext, error) {
 	return signature.NewPolicyContext(policy)
 }
 
+// ParseIncludeTags splits a comma-separated list of tag names or glob patterns
+func ParseIncludeTags(value string) []string {
+	includeTags := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) > 0 {
+			includeTags = append(includeTags, pattern)
+		}
+	}
+	return includeTags
+}
+
+// TagIncluded returns true if the tag matches any of the includeTags patterns,
+// or if no patterns are given
+func TagIncluded(includeTags []string, tag string) bool {
+	if len(includeTags) == 0 {
+		return true
+	}
+	for _, pattern := range includeTags {
+		if matched, err := path.Match(pattern, tag); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
 func findSpecTag(tags []imagev1API.TagReference, name string) *imagev1API.TagReference {
 	for _, tag := range tags {
 		if tag.Name == name {
@@ -0,0 +1,120 @@
+package imagecopy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bombsimon/logrusr"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIncludeTags(t *testing.T) {
+	assert.Equal(t, []string{}, ParseIncludeTags(""))
+	assert.Equal(t, []string{"latest", "v*"}, ParseIncludeTags("latest, v*,"))
+}
+
+func TestTagIncluded(t *testing.T) {
+	tests := []struct {
+		name        string
+		includeTags []string
+		tag         string
+		expected    bool
+	}{
+		{name: "no patterns", includeTags: []string{}, tag: "nightly-2021-01-01", expected: true},
+		{name: "exact match", includeTags: []string{"latest", "stable"}, tag: "stable", expected: true},
+		{name: "glob match", includeTags: []string{"v*"}, tag: "v1.2", expected: true},
+		{name: "no match", includeTags: []string{"latest", "v*"}, tag: "pr-1234", expected: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, TagIncluded(tc.includeTags, tc.tag))
+		})
+	}
+}
+
+func TestCopyTimeout(t *testing.T) {
+	defer os.Unsetenv(CopyTimeoutEnvVar)
+	os.Unsetenv(CopyTimeoutEnvVar)
+	assert.Equal(t, defaultCopyTimeout, CopyTimeout())
+	os.Setenv(CopyTimeoutEnvVar, "45m")
+	assert.Equal(t, 45*time.Minute, CopyTimeout())
+	os.Setenv(CopyTimeoutEnvVar, "0")
+	assert.Equal(t, time.Duration(0), CopyTimeout())
+	os.Setenv(CopyTimeoutEnvVar, "forever")
+	assert.Equal(t, defaultCopyTimeout, CopyTimeout())
+}
+
+func TestCopyRetryAttempts(t *testing.T) {
+	defer os.Unsetenv(CopyRetryAttemptsEnvVar)
+	defer os.Unsetenv(CopyRetriesEnvVar)
+	os.Unsetenv(CopyRetryAttemptsEnvVar)
+	os.Unsetenv(CopyRetriesEnvVar)
+	assert.Equal(t, defaultCopyRetryAttempts, CopyRetryAttempts())
+	os.Setenv(CopyRetriesEnvVar, "2")
+	assert.Equal(t, 3, CopyRetryAttempts())
+	os.Setenv(CopyRetryAttemptsEnvVar, "5")
+	assert.Equal(t, 5, CopyRetryAttempts())
+}
+
+func TestCopyProgressInterval(t *testing.T) {
+	defer os.Unsetenv(CopyProgressIntervalEnvVar)
+	os.Unsetenv(CopyProgressIntervalEnvVar)
+	assert.Equal(t, defaultCopyProgressInterval, CopyProgressInterval())
+	os.Setenv(CopyProgressIntervalEnvVar, "5s")
+	assert.Equal(t, 5*time.Second, CopyProgressInterval())
+	os.Setenv(CopyProgressIntervalEnvVar, "0")
+	assert.Equal(t, time.Duration(0), CopyProgressInterval())
+	os.Setenv(CopyProgressIntervalEnvVar, "often")
+	assert.Equal(t, defaultCopyProgressInterval, CopyProgressInterval())
+}
+
+func TestImageListSelection(t *testing.T) {
+	defer os.Unsetenv(SingleArchEnvVar)
+	os.Unsetenv(SingleArchEnvVar)
+	assert.Equal(t, copy.CopyAllImages, ImageListSelection())
+	os.Setenv(SingleArchEnvVar, "true")
+	assert.Equal(t, copy.CopySystemImage, ImageListSelection())
+}
+
+func TestCopySchema1ImageToSchema2(t *testing.T) {
+	srcRef, err := alltransports.ParseImageName("dir:testdata/schema1")
+	require.NoError(t, err)
+	assert.True(t, isSchema1Source(context.Background(), srcRef, nil))
+
+	dest, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	imgManifest, stats, err := copyImage(context.Background(), logrusr.NewLogger(test.NewLogger()), "dir:testdata/schema1", "dir:"+dest,
+		schema2CopyOptions(&copy.Options{}), time.Minute, retryPolicy{attempts: 1, interval: time.Second}, tokenFiles{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, manifest.GuessMIMEType(imgManifest))
+	assert.NotZero(t, stats.transferred)
+
+	destRef, err := alltransports.ParseImageName("dir:" + dest)
+	require.NoError(t, err)
+	assert.False(t, isSchema1Source(context.Background(), destRef, nil))
+}
+
+func TestDestinationHasImage(t *testing.T) {
+	imgManifest, err := ioutil.ReadFile("testdata/schema1/manifest.json")
+	require.NoError(t, err)
+	digest, err := manifest.Digest(imgManifest)
+	require.NoError(t, err)
+
+	assert.True(t, destinationHasImage(context.Background(), "dir:testdata/schema1", string(digest), nil))
+	assert.False(t, destinationHasImage(context.Background(), "dir:testdata/schema1", "sha256:0000", nil))
+	assert.False(t, destinationHasImage(context.Background(), "dir:testdata/missing", string(digest), nil))
+}
+
+func TestCheckSourceImage(t *testing.T) {
+	assert.NoError(t, checkSourceImage(context.Background(), "dir:testdata/schema1", nil))
+	assert.Error(t, checkSourceImage(context.Background(), "dir:testdata/missing", nil))
+}
@@ -0,0 +1,84 @@
+package imagecopy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// OCILayoutDirEnvVar is the environment variable setting the directory, usually
+// on a volume mounted on the velero deployment, under which backups write the
+// images of each ImageStream to an OCI layout instead of the migration registry,
+// and restores read them from
+const OCILayoutDirEnvVar = "IMAGE_COPY_OCI_LAYOUT_DIR"
+
+const (
+	// ociIndexFile is the file of an OCI layout listing its images
+	ociIndexFile = "index.json"
+	// ociRefNameAnnotation names an image of an OCI layout
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// ociIndexMediaType is the MIME type of OCI image indexes
+	ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+)
+
+// OCILayoutDir returns the directory set by IMAGE_COPY_OCI_LAYOUT_DIR, or "" if
+// images are copied through the migration registry
+func OCILayoutDir() string {
+	return os.Getenv(OCILayoutDirEnvVar)
+}
+
+// OCILayoutPath returns the path of the OCI layout holding the images of an
+// ImageStream backed up by backup, relative to the OCI layout directory
+func OCILayoutPath(backup, namespace, name string) string {
+	return filepath.Join(backup, namespace, name)
+}
+
+// CheckOCILayoutWritable creates the OCI layout directory dir if needed, and
+// checks files can be written to it
+func CheckOCILayoutWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("OCI layout directory %s can't be created, check the volume mounted at %s on the velero deployment is writable: %v",
+			dir, OCILayoutDir(), err)
+	}
+	file, err := ioutil.TempFile(dir, ".write-check")
+	if err != nil {
+		return fmt.Errorf("OCI layout directory %s is not writable, check the volume mounted at %s on the velero deployment is writable: %v",
+			dir, OCILayoutDir(), err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// ociLayoutDestination returns the path an image with the given digest is
+// copied to in the OCI layout dir, named by the digest
+func ociLayoutDestination(dir, digest string) string {
+	return fmt.Sprintf("oci:%s:%s", dir, digest)
+}
+
+// ociLayoutSource returns the path of the image with the given manifest digest
+// in the OCI layout dir. The layout only holds OCI manifests, so images are
+// looked up by the digest of their manifest in the layout rather than by the
+// name they were written with, which is the digest of the source image.
+func ociLayoutSource(dir, digest string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return "", fmt.Errorf("reading OCI layout %s: %v", dir, err)
+	}
+	index := struct {
+		Manifests []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return "", fmt.Errorf("reading OCI layout %s: %v", dir, err)
+	}
+	for _, descriptor := range index.Manifests {
+		if name := descriptor.Annotations[ociRefNameAnnotation]; descriptor.Digest == digest && len(name) > 0 {
+			return fmt.Sprintf("oci:%s:%s", dir, name), nil
+		}
+	}
+	return "", fmt.Errorf("image %s not found in OCI layout %s", digest, dir)
+}
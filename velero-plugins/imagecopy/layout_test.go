@@ -0,0 +1,59 @@
+package imagecopy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bombsimon/logrusr"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCILayoutPath(t *testing.T) {
+	assert.Equal(t, "nightly/ns/app", OCILayoutPath("nightly", "ns", "app"))
+}
+
+func TestCheckOCILayoutWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, CheckOCILayoutWritable(filepath.Join(dir, "nightly", "ns", "app")))
+	files, err := ioutil.ReadDir(filepath.Join(dir, "nightly", "ns", "app"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, []byte{}, 0644))
+	assert.Error(t, CheckOCILayoutWritable(filepath.Join(file, "ns", "app")))
+}
+
+func TestOCILayoutRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	preserve := types.PreserveOriginal
+	sourceDigest := "sha256:16af7b3b80a764bd1c9c897789bb36822aec1e3242020c5d5ba29e2e8054f0a5"
+	pushed, _, err := copyImage(context.Background(), logrusr.NewLogger(test.NewLogger()), "dir:testdata/schema1", ociLayoutDestination(dir, sourceDigest),
+		&copy.Options{}, time.Minute, retryPolicy{attempts: 1, interval: time.Second}, tokenFiles{}, &preserve)
+	require.NoError(t, err)
+	pushedDigest, err := manifest.Digest(pushed)
+	require.NoError(t, err)
+
+	// the image is found by the digest of the manifest written to the layout
+	path, err := ociLayoutSource(dir, string(pushedDigest))
+	require.NoError(t, err)
+	assert.Equal(t, ociLayoutDestination(dir, sourceDigest), path)
+	assert.NoError(t, checkSourceImage(context.Background(), path, nil))
+	_, err = ociLayoutSource(dir, "sha256:missing")
+	assert.Error(t, err)
+	_, err = ociLayoutSource(filepath.Join(dir, "missing"), string(pushedDigest))
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package imagecopy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// clusterNoProxy are the domains of in-cluster services, such as the internal
+// registry service, which are never reached through the proxy
+var clusterNoProxy = []string{".svc", ".cluster.local"}
+
+// ConfigureProxy adds the in-cluster service domains to NO_PROXY when a proxy is
+// set for the plugin, so traffic to the internal registry service isn't proxied,
+// and returns the proxy settings the image copies use. containers/image reads
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY on its first registry request, so this
+// must be called at plugin startup.
+func ConfigureProxy() string {
+	httpProxy := getEnvAny("HTTP_PROXY", "http_proxy")
+	httpsProxy := getEnvAny("HTTPS_PROXY", "https_proxy")
+	noProxy := getEnvAny("NO_PROXY", "no_proxy")
+	if len(httpProxy) == 0 && len(httpsProxy) == 0 {
+		return "no proxy"
+	}
+	entries := []string{}
+	for _, entry := range strings.Split(noProxy, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	for _, domain := range clusterNoProxy {
+		if !containsString(entries, domain) && !containsString(entries, strings.TrimPrefix(domain, ".")) {
+			entries = append(entries, domain)
+		}
+	}
+	noProxy = strings.Join(entries, ",")
+	os.Setenv("NO_PROXY", noProxy)
+	return fmt.Sprintf("HTTP_PROXY=%q HTTPS_PROXY=%q NO_PROXY=%q", httpProxy, httpsProxy, noProxy)
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package imagecopy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureProxy(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+	assert.Equal(t, "no proxy", ConfigureProxy())
+	assert.Empty(t, os.Getenv("NO_PROXY"))
+
+	os.Setenv("https_proxy", "http://proxy.example.com:3128")
+	os.Setenv("no_proxy", "example.com, .cluster.local")
+	assert.Equal(t, `HTTP_PROXY="" HTTPS_PROXY="http://proxy.example.com:3128" NO_PROXY="example.com,.cluster.local,.svc"`, ConfigureProxy())
+	assert.Equal(t, "example.com,.cluster.local,.svc", os.Getenv("NO_PROXY"))
+}
@@ -0,0 +1,73 @@
+package imagecopy
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitWait is the minimum wait before retrying a copy the registry rate
+// limited. containers/image already honours the Retry-After header of the
+// requests it can repeat, so a copy only fails once the registry keeps limiting.
+const rateLimitWait = 30 * time.Second
+
+// throttle limits the number of tags copied at the same time, a limit which is
+// halved each time a registry rate limits the copies
+type throttle struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newThrottle(limit int) *throttle {
+	t := &throttle{limit: limit}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+// acquire waits until fewer copies than the limit are running
+func (t *throttle) acquire() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for t.active >= t.limit {
+		t.cond.Wait()
+	}
+	t.active++
+}
+
+// release ends a copy started by acquire
+func (t *throttle) release() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active--
+	t.cond.Signal()
+}
+
+// slowDown halves the limit, down to a single copy at a time, and returns the new limit
+func (t *throttle) slowDown() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.limit > 1 {
+		t.limit /= 2
+	}
+	return t.limit
+}
+
+// registryHost returns the registry of a docker:// image path
+func registryHost(path string) string {
+	host := strings.TrimPrefix(path, "docker://")
+	if index := strings.Index(host, "/"); index >= 0 {
+		host = host[:index]
+	}
+	return host
+}
+
+// rateLimitedRegistry returns which registry of the copy from src to dest
+// rate limited it, going by the registry named in err, or dest by default
+func rateLimitedRegistry(err error, src, dest string) string {
+	if strings.Contains(err.Error(), registryHost(src)) && !strings.Contains(err.Error(), registryHost(dest)) {
+		return registryHost(src)
+	}
+	return registryHost(dest)
+}
@@ -0,0 +1,40 @@
+package imagecopy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := newThrottle(4)
+	throttle.acquire()
+	throttle.acquire()
+	assert.Equal(t, 2, throttle.slowDown())
+	released := make(chan struct{})
+	go func() {
+		throttle.acquire()
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatal("acquired a copy over the limit")
+	default:
+	}
+	throttle.release()
+	<-released
+	assert.Equal(t, 1, throttle.slowDown())
+	assert.Equal(t, 1, throttle.slowDown())
+}
+
+func TestRateLimitedRegistry(t *testing.T) {
+	src := "docker://image-registry.openshift-image-registry.svc:5000/ns/app@sha256:abc"
+	dest := "docker://quay.io/migration/app:latest"
+	assert.Equal(t, "quay.io", registryHost(dest))
+	pull := errors.New("Error reading manifest sha256:abc in image-registry.openshift-image-registry.svc:5000/ns/app: too many requests to registry")
+	push := errors.New("Error writing blob: Error initiating layer upload to /v2/migration/app/blobs/uploads/ in quay.io: too many requests to registry")
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000", rateLimitedRegistry(pull, src, dest))
+	assert.Equal(t, "quay.io", rateLimitedRegistry(push, src, dest))
+	assert.Equal(t, "quay.io", rateLimitedRegistry(errors.New("too many requests to registry"), src, dest))
+}
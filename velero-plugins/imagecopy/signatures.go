@@ -0,0 +1,66 @@
+package imagecopy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+)
+
+// CopySignaturesEnvVar is the environment variable which, set to "false", stops
+// copying the sigstore signatures and attachments of images, e.g. for registries
+// which reject their artifact types
+const CopySignaturesEnvVar = "IMAGE_COPY_SIGNATURES"
+
+// sigstoreTagSuffixes are the suffixes of the tags cosign stores the signatures,
+// attestations and SBOMs of an image under, in the repository of the image
+var sigstoreTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// CopySignatures returns whether the sigstore signatures and attachments of the
+// images are copied along with them, configured by IMAGE_COPY_SIGNATURES (default true)
+func CopySignatures() bool {
+	copySignatures, err := strconv.ParseBool(os.Getenv(CopySignaturesEnvVar))
+	return err != nil || copySignatures
+}
+
+// sigstoreTag returns the tag of a sigstore attachment of the image digest, e.g.
+// sha256-<hex>.sig for its cosign signature
+func sigstoreTag(digest, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + suffix
+}
+
+// copySignatures copies the sigstore signatures and attachments of the image
+// pulled from srcPath to the destination repository, if the source has any.
+// They are keyed on the image digest, so they are only copied if the copy kept it.
+func (c *imageStreamCopier) copySignatures(srcPath, pushedDigest string, copyOptions *copy.Options) (copyStats, error) {
+	log := c.log
+	stats := copyStats{}
+	if len(c.SrcOCILayout) > 0 || len(c.DestOCILayout) > 0 {
+		log.V(4).Info(fmt.Sprintf("[imagecopy] not copying signatures of %s, which are not kept in OCI layouts", srcPath))
+		return stats, nil
+	}
+	digest := referenceDigest(srcPath)
+	if len(digest) == 0 || digest != pushedDigest {
+		log.V(4).Info(fmt.Sprintf("[imagecopy] not copying signatures of %s, its digest was not kept", srcPath))
+		return stats, nil
+	}
+	srcRepository := strings.TrimSuffix(srcPath, "@"+digest)
+	for _, suffix := range sigstoreTagSuffixes {
+		tag := sigstoreTag(digest, suffix)
+		srcTag := fmt.Sprintf("%s:%s", srcRepository, tag)
+		destTag := fmt.Sprintf("docker://%s/%s:%s", c.DestRegistry, c.destRepository(), tag)
+		_, tagStats, err := copyImage(c.ctx, log, srcTag, destTag, copyOptions, c.Timeout, c.retryPolicy(), c.tokenFiles(), c.layerCompression())
+		stats.add(tagStats)
+		if isSourceImageNotFoundError(err) {
+			log.V(4).Info(fmt.Sprintf("[imagecopy] no %s attachment for image %s", tag, srcPath))
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("copying %s attachment of image %s: %v", tag, srcPath, err)
+		}
+		log.Info(fmt.Sprintf("[imagecopy] copied %s attachment of image %s", tag, srcPath))
+	}
+	return stats, nil
+}
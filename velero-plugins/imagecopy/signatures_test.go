@@ -0,0 +1,31 @@
+package imagecopy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bombsimon/logrusr"
+	"github.com/containers/image/v5/copy"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySignatures(t *testing.T) {
+	defer os.Unsetenv(CopySignaturesEnvVar)
+	os.Unsetenv(CopySignaturesEnvVar)
+	assert.True(t, CopySignatures())
+	os.Setenv(CopySignaturesEnvVar, "false")
+	assert.False(t, CopySignatures())
+}
+
+func TestSigstoreTag(t *testing.T) {
+	assert.Equal(t, "sha256-abc.sig", sigstoreTag("sha256:abc", ".sig"))
+}
+
+func TestCopySignaturesSkipsChangedDigests(t *testing.T) {
+	copier := &imageStreamCopier{log: logrusr.NewLogger(test.NewLogger())}
+	_, err := copier.copySignatures("docker://registry.invalid/ns/app@sha256:abc", "sha256:def", &copy.Options{})
+	assert.NoError(t, err)
+	_, err = copier.copySignatures("docker://registry.invalid/ns/app:latest", "sha256:def", &copy.Options{})
+	assert.NoError(t, err)
+}
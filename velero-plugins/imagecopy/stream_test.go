@@ -0,0 +1,189 @@
+package imagecopy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bombsimon/logrusr"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// streamTestLayerSizeEnvVar overrides the size of the layer copied by
+	// TestCopyStreamsLayers, e.g. to run it with a multi-GB layer
+	streamTestLayerSizeEnvVar  = "IMAGE_COPY_TEST_LAYER_SIZE"
+	defaultStreamTestLayerSize = 128 << 20
+	// streamTestHeapCeiling is the heap growth allowed while copying the layer
+	streamTestHeapCeiling = 32 << 20
+)
+
+// syntheticLayer returns a reader of size pseudo-random bytes, the same for each call
+func syntheticLayer(size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(1)), size)
+}
+
+// streamTestRegistry is a minimal registry serving a single image with one
+// synthetic layer, and accepting pushes of blobs and manifests, streaming all
+// blobs without keeping them in memory
+type streamTestRegistry struct {
+	layerSize    int64
+	layerDigest  string
+	config       []byte
+	configDigest string
+	manifest     []byte
+	mutex        sync.Mutex
+	uploaded     map[string]int64
+}
+
+func newStreamTestRegistry(t *testing.T, layerSize int64) *streamTestRegistry {
+	hash := sha256.New()
+	_, err := io.Copy(hash, syntheticLayer(layerSize))
+	require.NoError(t, err)
+	r := &streamTestRegistry{
+		layerSize:   layerSize,
+		layerDigest: fmt.Sprintf("sha256:%x", hash.Sum(nil)),
+		config:      []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`),
+		uploaded:    map[string]int64{},
+	}
+	r.configDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(r.config))
+	r.manifest, err = json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifest.DockerV2Schema2MediaType,
+		"config":        map[string]interface{}{"mediaType": manifest.DockerV2Schema2ConfigMediaType, "size": len(r.config), "digest": r.configDigest},
+		"layers": []interface{}{
+			map[string]interface{}{"mediaType": manifest.DockerV2SchemaLayerMediaTypeUncompressed, "size": layerSize, "digest": r.layerDigest},
+		},
+	})
+	require.NoError(t, err)
+	return r
+}
+
+func (r *streamTestRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(path, "/v2/src/app/manifests/"):
+		w.Header().Set("Content-Type", manifest.DockerV2Schema2MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.manifest)))
+		w.Write(r.manifest)
+	case path == "/v2/src/app/blobs/"+r.configDigest:
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.config)))
+		w.Write(r.config)
+	case path == "/v2/src/app/blobs/"+r.layerDigest:
+		w.Header().Set("Content-Length", strconv.FormatInt(r.layerSize, 10))
+		io.Copy(w, syntheticLayer(r.layerSize))
+	case strings.HasPrefix(path, "/v2/dest/app/blobs/sha256:"):
+		// no blob exists at the destination before it is pushed
+		w.WriteHeader(http.StatusNotFound)
+	case path == "/v2/dest/app/blobs/uploads/" && req.Method == http.MethodPost:
+		w.Header().Set("Location", "/v2/dest/app/blobs/uploads/1")
+		w.WriteHeader(http.StatusAccepted)
+	case path == "/v2/dest/app/blobs/uploads/1" && req.Method == http.MethodPatch:
+		size, _ := io.Copy(ioutil.Discard, req.Body)
+		r.mutex.Lock()
+		r.uploaded["pending"] += size
+		r.mutex.Unlock()
+		w.Header().Set("Location", "/v2/dest/app/blobs/uploads/1")
+		w.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
+		w.WriteHeader(http.StatusAccepted)
+	case path == "/v2/dest/app/blobs/uploads/1" && req.Method == http.MethodPut:
+		digest := req.URL.Query().Get("digest")
+		r.mutex.Lock()
+		r.uploaded[digest] = r.uploaded["pending"]
+		delete(r.uploaded, "pending")
+		r.mutex.Unlock()
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "/v2/dest/app/manifests/") && req.Method == http.MethodPut:
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// peakHeap samples the heap in use until stop is closed, and returns the highest value seen
+func peakHeap(stop <-chan struct{}) <-chan uint64 {
+	peak := make(chan uint64, 1)
+	go func() {
+		var max uint64
+		var stats runtime.MemStats
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > max {
+				max = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return peak
+}
+
+// TestCopyStreamsLayers copies an image with a large layer between two registries,
+// checking the layer is streamed rather than buffered in memory
+func TestCopyStreamsLayers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("copies a large layer")
+	}
+	layerSize := int64(defaultStreamTestLayerSize)
+	if size, err := strconv.ParseInt(os.Getenv(streamTestLayerSizeEnvVar), 10, 64); err == nil && size > 0 {
+		layerSize = size
+	}
+	registry := newStreamTestRegistry(t, layerSize)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	cacheDir, err := ioutil.TempDir("", "imagecopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	sys := &types.SystemContext{
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		BlobInfoCacheDir:            cacheDir,
+	}
+	preserve := types.PreserveOriginal
+
+	runtime.GC()
+	var baseline runtime.MemStats
+	runtime.ReadMemStats(&baseline)
+	stop := make(chan struct{})
+	peak := peakHeap(stop)
+	_, stats, err := copyImage(context.Background(), logrusr.NewLogger(test.NewLogger()), fmt.Sprintf("docker://%s/src/app:latest", host),
+		fmt.Sprintf("docker://%s/dest/app:latest", host), &copy.Options{SourceCtx: sys, DestinationCtx: sys},
+		time.Minute, retryPolicy{attempts: 1, interval: time.Second}, tokenFiles{}, &preserve)
+	close(stop)
+	require.NoError(t, err)
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	assert.Equal(t, layerSize, registry.uploaded[registry.layerDigest])
+	assert.True(t, stats.transferred >= uint64(layerSize))
+	growth := int64(<-peak) - int64(baseline.HeapAlloc)
+	assert.Truef(t, growth < streamTestHeapCeiling, "heap grew by %d bytes copying a %d bytes layer", growth, layerSize)
+}
@@ -0,0 +1,33 @@
+package imagecopy
+
+import (
+	"os"
+	"strings"
+)
+
+// InsecureRegistriesEnvVar is the environment variable listing, comma-separated,
+// the registries for which TLS verification is skipped. When it is set, the
+// registries it doesn't list are verified.
+const InsecureRegistriesEnvVar = "INSECURE_REGISTRIES"
+
+// InsecureRegistries returns the registries set by INSECURE_REGISTRIES
+func InsecureRegistries() []string {
+	registries := []string{}
+	for _, registry := range strings.Split(os.Getenv(InsecureRegistriesEnvVar), ",") {
+		if registry = strings.TrimSpace(registry); len(registry) > 0 {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+// RegistryListed returns true if registries has registry, compared exactly,
+// including any port
+func RegistryListed(registries []string, registry string) bool {
+	for _, listed := range registries {
+		if listed == registry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package imagecopy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsecureRegistries(t *testing.T) {
+	defer os.Unsetenv(InsecureRegistriesEnvVar)
+	os.Unsetenv(InsecureRegistriesEnvVar)
+	assert.Empty(t, InsecureRegistries())
+	os.Setenv(InsecureRegistriesEnvVar, "legacy.example.com:5000, ,other.example.com")
+	registries := InsecureRegistries()
+	assert.Equal(t, []string{"legacy.example.com:5000", "other.example.com"}, registries)
+	assert.True(t, RegistryListed(registries, "legacy.example.com:5000"))
+	assert.False(t, RegistryListed(registries, "legacy.example.com"))
+	assert.False(t, RegistryListed(registries, "example.com"))
+}
+
+func TestExternalCopyOptionsInsecureRegistries(t *testing.T) {
+	copyOptions := &copy.Options{SourceCtx: &types.SystemContext{
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		DockerAuthConfig:            &types.DockerAuthConfig{Username: "ignored", Password: "token"},
+	}}
+	options := externalCopyOptions(copyOptions, "quay.io", nil)
+	assert.Nil(t, options.SourceCtx.DockerAuthConfig)
+	assert.Equal(t, types.OptionalBoolTrue, options.SourceCtx.DockerInsecureSkipTLSVerify)
+
+	options = externalCopyOptions(copyOptions, "quay.io", []string{"legacy.example.com"})
+	assert.Equal(t, types.OptionalBoolFalse, options.SourceCtx.DockerInsecureSkipTLSVerify)
+	options = externalCopyOptions(copyOptions, "legacy.example.com", []string{"legacy.example.com"})
+	assert.Equal(t, types.OptionalBoolTrue, options.SourceCtx.DockerInsecureSkipTLSVerify)
+	assert.NotNil(t, copyOptions.SourceCtx.DockerAuthConfig)
+}
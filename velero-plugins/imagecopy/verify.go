@@ -0,0 +1,51 @@
+package imagecopy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+)
+
+// VerifyPushesEnvVar is the environment variable which, set to "false", skips
+// reading back the manifest of each pushed image, e.g. for registries that are
+// slow to serve what was just pushed
+const VerifyPushesEnvVar = "IMAGE_COPY_VERIFY_PUSHES"
+
+// VerifyPushes returns whether the manifest of each pushed image is read back
+// from the destination, configured by IMAGE_COPY_VERIFY_PUSHES (default true)
+func VerifyPushes() bool {
+	verify, err := strconv.ParseBool(os.Getenv(VerifyPushesEnvVar))
+	return err != nil || verify
+}
+
+// verifyPushedImage returns an error unless the destination serves the manifest
+// with the pushed digest at dest, catching registries which accept a manifest
+// but serve another one, e.g. misconfigured pull-through caches
+func verifyPushedImage(ctx context.Context, dest, pushedDigest string, sys *types.SystemContext) error {
+	destRef, err := alltransports.ParseImageName(dest)
+	if err != nil {
+		return fmt.Errorf("Invalid destination name %s: %v", dest, err)
+	}
+	src, err := destRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return fmt.Errorf("pushed image %s can't be read back: %v", dest, err)
+	}
+	defer src.Close()
+	served, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("pushed image %s can't be read back: %v", dest, err)
+	}
+	servedDigest, err := manifest.Digest(served)
+	if err != nil {
+		return fmt.Errorf("computing the digest of the manifest served for %s: %v", dest, err)
+	}
+	if string(servedDigest) != pushedDigest {
+		return fmt.Errorf("destination served manifest %s for %s instead of the pushed manifest %s", servedDigest, dest, pushedDigest)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package imagecopy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPushes(t *testing.T) {
+	defer os.Unsetenv(VerifyPushesEnvVar)
+	os.Unsetenv(VerifyPushesEnvVar)
+	assert.True(t, VerifyPushes())
+	os.Setenv(VerifyPushesEnvVar, "false")
+	assert.False(t, VerifyPushes())
+	os.Setenv(VerifyPushesEnvVar, "maybe")
+	assert.True(t, VerifyPushes())
+}
+
+func TestVerifyPushedImage(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/schema1/manifest.json")
+	require.NoError(t, err)
+	digest, err := manifest.Digest(content)
+	require.NoError(t, err)
+	assert.NoError(t, verifyPushedImage(context.Background(), "dir:testdata/schema1", string(digest), nil))
+	assert.Error(t, verifyPushedImage(context.Background(), "dir:testdata/schema1", "sha256:other", nil))
+	assert.Error(t, verifyPushedImage(context.Background(), "dir:testdata/missing", string(digest), nil))
+}
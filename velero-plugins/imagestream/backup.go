@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/bombsimon/logrusr"
 	"github.com/containers/image/v5/copy"
@@ -19,6 +22,8 @@ import (
 // BackupPlugin is a backup item action plugin for Heptio Ark.
 type BackupPlugin struct {
 	Log logrus.FieldLogger
+	// the images copied by each backup, by backup name
+	CopiedImages map[string]*imagecopy.CopiedImages
 }
 
 // AppliesTo returns a velero.ResourceSelector that applies to imagestreams.
@@ -41,6 +46,25 @@ func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (ru
 		annotations = make(map[string]string)
 	}
 
+	delete(annotations, common.ImageCopySkippedAnnotation)
+	skipImageCopy := annotations[common.SkipImageCopyAnnotation] == "true"
+	if skipImageCopy {
+		p.Log.Info("[is-backup] ImageStream has skip-image-copy annotation, backing up without copying images")
+	} else if isSamplesImageStream(imageStream) && !copySamplesImages(backup) {
+		// the samples operator of the target cluster recreates these
+		p.Log.Info("[is-backup] ImageStream is managed by the samples operator, backing up without copying images")
+		skipImageCopy = true
+	}
+	if skipImageCopy {
+		annotations[common.ImageCopySkippedAnnotation] = "true"
+		imageStream.Annotations = annotations
+		var out map[string]interface{}
+		objrec, _ := json.Marshal(imageStream)
+		json.Unmarshal(objrec, &out)
+		item.SetUnstructuredContent(out)
+		return item, nil, nil
+	}
+
 	skipImages := annotations[common.SkipImages]
 	if len(skipImages) != 0 {
 		p.Log.Info("Not running in OADP/CAM context, skipping copy of image.")
@@ -49,39 +73,139 @@ func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (ru
 
 	internalRegistry := annotations[common.BackupRegistryHostname]
 	migrationRegistry := annotations[common.MigrationRegistry]
-	if len(migrationRegistry) == 0 {
+	// images are written to an OCI layout on disk instead of the migration
+	// registry when no registry is reachable from both clusters
+	layoutPath := ""
+	layoutDir := ""
+	if root := imagecopy.OCILayoutDir(); len(root) > 0 {
+		layoutPath = imagecopy.OCILayoutPath(backup.Name, imageStream.Namespace, imageStream.Name)
+		layoutDir = filepath.Join(root, layoutPath)
+		if err := imagecopy.CheckOCILayoutWritable(layoutDir); err != nil {
+			return nil, nil, err
+		}
+		p.Log.Info(fmt.Sprintf("[is-backup] copying images to OCI layout %s", layoutDir))
+		migrationRegistry = ""
+	} else if len(migrationRegistry) == 0 {
 		return nil, nil, errors.New("migration registry not found for annotation \"openshift.io/migration\"")
 	}
 	p.Log.Info(fmt.Sprintf("[is-backup] internal registry: %#v", internalRegistry))
 
-	sourceCtx, err := internalRegistrySystemContext()
+	trimTagHistory(&imageStream, historyDepth(backup), p.Log)
+
+	insecureSource := insecureRegistry(InsecureSourceRegistryEnvVar, internalRegistry)
+	insecureDestination := insecureRegistry(InsecureDestinationRegistryEnvVar, migrationRegistry)
+	warnInsecureRegistry(internalRegistry, insecureSource, "[is-backup]", p.Log)
+	if len(layoutDir) == 0 {
+		warnInsecureRegistry(migrationRegistry, insecureDestination, "[is-backup]", p.Log)
+	}
+	sourceCtx, tokenFile, err := internalRegistrySystemContext(insecureSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	destinationCtx, err := migrationRegistrySystemContext(insecureDestination)
 	if err != nil {
 		return nil, nil, err
 	}
-	destinationCtx, err := migrationRegistrySystemContext()
+	tokenFile, err = useInternalRegistryAuthFile(sourceCtx, SourceRegistryAuthFileEnvVar, internalRegistry, tokenFile, "[is-backup]", p.Log)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = imagecopy.CopyLocalImageStreamImages(
+	if len(layoutDir) == 0 {
+		if _, err := useRegistryAuthFile(destinationCtx, DestinationRegistryAuthFileEnvVar, migrationRegistry); err != nil {
+			return nil, nil, err
+		}
+	}
+	repository := common.ExpandRepositoryTemplate(common.RepositoryTemplate(), common.RepositoryVariables{
+		Namespace:       imageStream.Namespace,
+		MappedNamespace: imageStream.Namespace,
+		Name:            imageStream.Name,
+		Backup:          backup.Name,
+	})
+	ctx, cancel := operationContext("backups", backup.Namespace, backup.Name, "[is-backup]", p.Log)
+	defer cancel()
+	result, err := imagecopy.CopyLocalImageStreamImages(
+		ctx,
 		imageStream,
-		internalRegistry,
-		internalRegistry,
-		migrationRegistry,
-		imageStream.Namespace,
-		&copy.Options{
-			SourceCtx:      sourceCtx,
-			DestinationCtx: destinationCtx,
+		imagecopy.ImageStreamCopyOptions{
+			InternalRegistryPath: internalRegistry,
+			SrcRegistry:          internalRegistry,
+			DestRegistry:         migrationRegistry,
+			DestNamespace:        imageStream.Namespace,
+			DestRepository:       repository,
+			CopyOptions: &copy.Options{
+				SourceCtx:          sourceCtx,
+				DestinationCtx:     destinationCtx,
+				ImageListSelection: imagecopy.ImageListSelection(),
+			},
+			UpdateDigest:               true,
+			CopyExternal:               annotations[common.CopyExternalImagesAnnotation] == "true",
+			IncludeTags:                imagecopy.ParseIncludeTags(annotations[common.BackupIncludeTagsAnnotation]),
+			Concurrency:                imagecopy.CopyConcurrency(),
+			PullThroughLocalReferences: true,
+			Timeout:                    imagecopy.CopyTimeout(),
+			RetryAttempts:              imagecopy.CopyRetryAttempts(),
+			RetryInterval:              imagecopy.CopyRetryInterval(),
+			SourceTokenFile:            tokenFile,
+			PreserveDigests:            imagecopy.PreserveDigests(),
+			Compression:                imagecopy.Compression(),
+			CopySignatures:             imagecopy.CopySignatures(),
+			InsecureRegistries:         imagecopy.InsecureRegistries(),
+			DestOCILayout:              layoutDir,
+			CopiedImages:               copiedImages(p.CopiedImages, backup.Name),
+			VerifyPushes:               imagecopy.VerifyPushes(),
 		},
-		logrusr.NewLogger(p.Log),
-		true)
+		logrusr.NewLogger(p.Log))
+	if result != nil {
+		warnRateLimited(result.RateLimited, "[is-backup]", p.Log)
+		recordCopyMetrics("Backup", backup.ObjectMeta, result, "[is-backup]", p.Log)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	setTagDigestAnnotations(annotations, result.Digests)
+	if len(layoutPath) > 0 {
+		annotations[common.BackupOCILayoutAnnotation] = layoutPath
+		delete(annotations, common.BackupRepositoryAnnotation)
+	} else {
+		annotations[common.BackupRepositoryAnnotation] = repository
+		delete(annotations, common.BackupOCILayoutAnnotation)
+	}
+	p.Log.Info(fmt.Sprintf("[is-backup] copied %d bytes to the migration registry for imagestream %s/%s, %d bytes of %d blobs already existed",
+		result.BytesCopied, imageStream.Namespace, imageStream.Name, result.BytesExisting, result.BlobsReused))
+	annotations[common.BackupCopiedBytesAnnotation] = strconv.FormatUint(result.BytesCopied, 10)
+	annotations[common.BackupExistingBytesAnnotation] = strconv.FormatUint(result.BytesExisting, 10)
+	if len(result.SkippedItems) > 0 {
+		p.Log.Warnf("[is-backup] images missing from the internal registry were not copied: %v", result.SkippedItems)
+		annotations[common.BackupSkippedTagsAnnotation] = strings.Join(result.SkippedItems, ",")
+	} else {
+		delete(annotations, common.BackupSkippedTagsAnnotation)
+	}
+	if len(result.ConvertedDigests) > 0 {
+		p.Log.Warnf("[is-backup] manifests of imagestream %s/%s images had to be converted, changing their digests: %v",
+			imageStream.Namespace, imageStream.Name, convertedDigestPairs(result.ConvertedDigests))
+		annotations[common.BackupConvertedDigestsAnnotation] = strings.Join(convertedDigestPairs(result.ConvertedDigests), ",")
+	} else {
+		delete(annotations, common.BackupConvertedDigestsAnnotation)
+	}
+	imageStream.Annotations = annotations
+
+	// back up the streams pinned by ImageStreamImage tags or referenced from
+	// other namespaces, so the references resolve once restored
+	var additionalItems []velero.ResourceIdentifier
+	for _, reference := range referencedImageStreams(imageStream) {
+		if !common.BacksUpNamespace(backup, reference.Namespace) {
+			p.Log.Warnf("[is-backup] imagestream %s/%s references imagestream %s/%s, which is not backed up since its namespace is excluded",
+				imageStream.Namespace, imageStream.Name, reference.Namespace, reference.Name)
+			continue
+		}
+		p.Log.Info(fmt.Sprintf("[is-backup] Adding referenced imagestream %s/%s as additional item", reference.Namespace, reference.Name))
+		additionalItems = append(additionalItems, reference)
+	}
 
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(imageStream)
 	json.Unmarshal(objrec, &out)
 	item.SetUnstructuredContent(out)
-	return item, nil, nil
+	return item, additionalItems, nil
 
 }
\ No newline at end of file
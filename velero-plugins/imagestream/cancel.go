@@ -0,0 +1,107 @@
+package imagestream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// copyWatchInterval is how often running image copies check whether their
+// backup or restore is still going on
+const copyWatchInterval = 10 * time.Second
+
+// operationWatch checks whether the image copies of a backup or restore should stop
+type operationWatch struct {
+	// e.g. "backup nightly" in logs
+	description string
+	// the process id of the velero server, which started the plugin process
+	server int
+	// the current process id of the parent of the plugin process
+	parent func() int
+	// returns the phase of the backup or restore, and false if it was deleted
+	phase func() (string, bool, error)
+}
+
+// stopReason returns why the image copies should stop, or ""
+func (w operationWatch) stopReason() string {
+	if w.parent() != w.server {
+		return "the velero server exited"
+	}
+	phase, found, err := w.phase()
+	if err != nil {
+		// e.g. the API server can't be reached for a moment
+		return ""
+	}
+	if !found {
+		return fmt.Sprintf("%s was deleted", w.description)
+	}
+	if len(phase) > 0 && phase != "InProgress" {
+		return fmt.Sprintf("%s is %s", w.description, phase)
+	}
+	return ""
+}
+
+// operationContext returns the context of the image copies of the backup or
+// restore, given by the resource and namespace and name of the velero object.
+// Velero doesn't pass a context to item actions, so the context is cancelled
+// if the velero server exits or the backup or restore is deleted or no longer
+// in progress, checked every copyWatchInterval.
+func operationContext(resource, namespace, name, prefix string, log logrus.FieldLogger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := operationWatch{
+		description: fmt.Sprintf("%s %s/%s", resource, namespace, name),
+		server:      os.Getppid(),
+		parent:      os.Getppid,
+		phase: func() (string, bool, error) {
+			return veleroPhase(resource, namespace, name)
+		},
+	}
+	go func() {
+		ticker := time.NewTicker(copyWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if reason := watch.stopReason(); len(reason) > 0 {
+				log.Warnf("%s cancelling image copies, %s", prefix, reason)
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// veleroPhase returns the phase of the velero object of the resource, e.g.
+// backups, and false if it doesn't exist
+func veleroPhase(resource, namespace, name string) (string, bool, error) {
+	client, err := clients.DiscoveryClient()
+	if err != nil {
+		return "", true, err
+	}
+	data, err := client.RESTClient().Get().AbsPath("/apis/velero.io/v1/namespaces", namespace, resource, name).DoRaw()
+	if k8serrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+	object := struct {
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	}{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return "", true, err
+	}
+	return object.Status.Phase, true, nil
+}
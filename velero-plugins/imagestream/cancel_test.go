@@ -0,0 +1,24 @@
+package imagestream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationWatchStopReason(t *testing.T) {
+	watch := func(parent int, phase string, found bool, err error) operationWatch {
+		return operationWatch{
+			description: "backups velero/nightly",
+			server:      10,
+			parent:      func() int { return parent },
+			phase:       func() (string, bool, error) { return phase, found, err },
+		}
+	}
+	assert.Empty(t, watch(10, "InProgress", true, nil).stopReason())
+	assert.Empty(t, watch(10, "", true, errors.New("unreachable")).stopReason())
+	assert.Equal(t, "the velero server exited", watch(1, "InProgress", true, nil).stopReason())
+	assert.Equal(t, "backups velero/nightly was deleted", watch(10, "", false, nil).stopReason())
+	assert.Equal(t, "backups velero/nightly is Failed", watch(10, "Failed", true, nil).stopReason())
+}
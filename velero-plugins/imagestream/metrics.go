@@ -0,0 +1,116 @@
+package imagestream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
+	"github.com/sirupsen/logrus"
+	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// copyMetricsLabel labels the ConfigMaps holding the image copy counters of a
+	// Backup or Restore with the kind of the object
+	copyMetricsLabel = "openshift.io/image-copy-metrics"
+	// the keys of the image copy counters
+	metricsImagesCopied   = "imagesCopied"
+	metricsImagesExisting = "imagesExisting"
+	metricsBytesCopied    = "bytesCopied"
+	metricsFailedTags     = "failedTags"
+	metricsCopySeconds    = "copySeconds"
+	// conflicting updates of the counters are retried this many times
+	copyMetricsUpdateAttempts = 3
+)
+
+// copyMetricsKeys are the image copy counters, in the order they are logged
+var copyMetricsKeys = []string{metricsImagesCopied, metricsImagesExisting, metricsBytesCopied, metricsFailedTags, metricsCopySeconds}
+
+// addCopyMetrics adds the counts of result to the image copy counters in data
+func addCopyMetrics(data map[string]string, result *imagecopy.ImageStreamCopyResult) map[string]string {
+	if data == nil {
+		data = map[string]string{}
+	}
+	add := func(key string, value int64) {
+		current, _ := strconv.ParseInt(data[key], 10, 64)
+		data[key] = strconv.FormatInt(current+value, 10)
+	}
+	add(metricsImagesCopied, int64(result.ImagesCopied))
+	add(metricsImagesExisting, int64(result.ImagesExisting))
+	add(metricsBytesCopied, int64(result.BytesCopied))
+	add(metricsFailedTags, int64(len(result.FailedTags)))
+	add(metricsCopySeconds, int64(result.Duration.Round(time.Second)/time.Second))
+	return data
+}
+
+// copyMetricsSummary describes the image copy counters in data
+func copyMetricsSummary(data map[string]string) string {
+	summary := ""
+	for i, key := range copyMetricsKeys {
+		if i > 0 {
+			summary += " "
+		}
+		summary += fmt.Sprintf("%s=%s", key, data[key])
+	}
+	return summary
+}
+
+// copyMetricsConfigMapName returns the name of the ConfigMap holding the image
+// copy counters of the Backup or Restore named name
+func copyMetricsConfigMapName(ownerKind, name string) string {
+	return fmt.Sprintf("image-copy-%s-%s", strings.ToLower(ownerKind), name)
+}
+
+// recordCopyMetrics adds the counts of an ImageStream copy to the image copy
+// counters of the Backup or Restore owner, kept in a ConfigMap of its namespace
+// which is deleted along with it, and logs the totals so far. Plugins can't
+// annotate the Backup or Restore they run for, and counting in the ConfigMap
+// keeps the totals across plugin processes. Failures are only logged.
+func recordCopyMetrics(ownerKind string, owner metav1.ObjectMeta, result *imagecopy.ImageStreamCopyResult, prefix string, log logrus.FieldLogger) {
+	client, err := clients.CoreClient()
+	if err != nil {
+		log.Warnf("%s can't record image copy metrics: %v", prefix, err)
+		return
+	}
+	kind := strings.ToLower(ownerKind)
+	name := copyMetricsConfigMapName(ownerKind, owner.Name)
+	for attempt := 0; attempt < copyMetricsUpdateAttempts; attempt++ {
+		configMap, err := client.ConfigMaps(owner.Namespace).Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			configMap = &corev1API.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: owner.Namespace,
+					Labels:    map[string]string{copyMetricsLabel: kind},
+					OwnerReferences: []metav1.OwnerReference{{
+						APIVersion: "velero.io/v1",
+						Kind:       ownerKind,
+						Name:       owner.Name,
+						UID:        types.UID(owner.UID),
+					}},
+				},
+			}
+			configMap.Data = addCopyMetrics(nil, result)
+			_, err = client.ConfigMaps(owner.Namespace).Create(configMap)
+		} else if err == nil {
+			configMap.Data = addCopyMetrics(configMap.Data, result)
+			_, err = client.ConfigMaps(owner.Namespace).Update(configMap)
+		}
+		if k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("%s can't record image copy metrics in configmap %s/%s: %v", prefix, owner.Namespace, name, err)
+			return
+		}
+		log.Info(fmt.Sprintf("%s image copy totals of %s %s so far: %s", prefix, kind, owner.Name, copyMetricsSummary(configMap.Data)))
+		return
+	}
+	log.Warnf("%s can't record image copy metrics in configmap %s/%s: too many conflicting updates", prefix, owner.Namespace, name)
+}
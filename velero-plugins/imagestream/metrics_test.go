@@ -0,0 +1,33 @@
+package imagestream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddCopyMetrics(t *testing.T) {
+	data := addCopyMetrics(nil, &imagecopy.ImageStreamCopyResult{
+		ImagesCopied:   2,
+		ImagesExisting: 1,
+		BytesCopied:    1024,
+		FailedTags:     []string{"broken"},
+		Duration:       1500 * time.Millisecond,
+	})
+	data = addCopyMetrics(data, &imagecopy.ImageStreamCopyResult{
+		ImagesCopied: 3,
+		BytesCopied:  512,
+		Duration:     10 * time.Second,
+	})
+	assert.Equal(t, map[string]string{
+		metricsImagesCopied:   "5",
+		metricsImagesExisting: "1",
+		metricsBytesCopied:    "1536",
+		metricsFailedTags:     "1",
+		metricsCopySeconds:    "12",
+	}, data)
+	assert.Equal(t, "imagesCopied=5 imagesExisting=1 bytesCopied=1536 failedTags=1 copySeconds=12", copyMetricsSummary(data))
+	assert.Equal(t, "image-copy-restore-nightly", copyMetricsConfigMapName("Restore", "nightly"))
+}
@@ -0,0 +1,96 @@
+package imagestream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	imagev1API "github.com/openshift/api/image/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	imageDigestMirrorSetsPath      = "/apis/config.openshift.io/v1/imagedigestmirrorsets"
+	imageContentSourcePoliciesPath = "/apis/operator.openshift.io/v1alpha1/imagecontentsourcepolicies"
+)
+
+// MirrorRule redirects pulls of images from Source to one of Mirrors
+type MirrorRule struct {
+	Source  string   `json:"source"`
+	Mirrors []string `json:"mirrors"`
+}
+
+// mirrorRuleList holds the rules of an ImageDigestMirrorSet or
+// ImageContentSourcePolicy list
+type mirrorRuleList struct {
+	Items []struct {
+		Spec struct {
+			ImageDigestMirrors      []MirrorRule `json:"imageDigestMirrors"`
+			RepositoryDigestMirrors []MirrorRule `json:"repositoryDigestMirrors"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// updateMirrorRules looks up the ImageDigestMirrorSet and ImageContentSourcePolicy
+// rules of the restore cluster. Clusters without these APIs have no rules.
+func (p *RestorePlugin) updateMirrorRules() error {
+	client, err := clients.DiscoveryClient()
+	if err != nil {
+		return err
+	}
+	rules := []MirrorRule{}
+	for _, path := range []string{imageDigestMirrorSetsPath, imageContentSourcePoliciesPath} {
+		data, err := client.RESTClient().Get().AbsPath(path).DoRaw()
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error listing %s: %v", path, err)
+		}
+		list := mirrorRuleList{}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		for _, item := range list.Items {
+			rules = append(rules, item.Spec.ImageDigestMirrors...)
+			rules = append(rules, item.Spec.RepositoryDigestMirrors...)
+		}
+	}
+	p.MirrorRules = rules
+	return nil
+}
+
+// matchMirrorRule returns the rule whose source covers the image reference, if any
+func matchMirrorRule(rules []MirrorRule, ref string) *MirrorRule {
+	for i, rule := range rules {
+		if len(rule.Source) == 0 || !strings.HasPrefix(ref, rule.Source) {
+			continue
+		}
+		rest := strings.TrimPrefix(ref, rule.Source)
+		if len(rest) == 0 || strings.ContainsAny(rest[:1], "/@:") {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// logMirroredReferences logs the external image references of imageStream which
+// a mirror rule redirects. They are left as-is, as the runtime pulls them from
+// the mirror, rather than copied from a registry that may be unreachable.
+func (p *RestorePlugin) logMirroredReferences(imageStream imagev1API.ImageStream, backupInternalRegistries []string) {
+	if len(p.MirrorRules) == 0 {
+		return
+	}
+	for _, tag := range imageStream.Status.Tags {
+		for _, item := range tag.Items {
+			if isInternalReference(item.DockerImageReference, backupInternalRegistries) {
+				continue
+			}
+			if rule := matchMirrorRule(p.MirrorRules, item.DockerImageReference); rule != nil {
+				p.Log.Info(fmt.Sprintf("[is-restore] tag %s image %s matches mirror rule %s -> %v, leaving reference as-is",
+					tag.Tag, item.DockerImageReference, rule.Source, rule.Mirrors))
+			}
+		}
+	}
+}
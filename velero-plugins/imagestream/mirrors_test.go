@@ -0,0 +1,25 @@
+package imagestream
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchMirrorRule(t *testing.T) {
+	list := mirrorRuleList{}
+	require.NoError(t, json.Unmarshal([]byte(`{"items":[
+		{"spec":{"imageDigestMirrors":[{"source":"quay.io/org","mirrors":["mirror.local/org"]}]}},
+		{"spec":{"repositoryDigestMirrors":[{"source":"registry.redhat.io","mirrors":["mirror.local/redhat"]}]}}
+	]}`), &list))
+	rules := append(list.Items[0].Spec.ImageDigestMirrors, list.Items[1].Spec.RepositoryDigestMirrors...)
+
+	rule := matchMirrorRule(rules, "quay.io/org/app@sha256:1")
+	require.NotNil(t, rule)
+	assert.Equal(t, []string{"mirror.local/org"}, rule.Mirrors)
+	assert.NotNil(t, matchMirrorRule(rules, "registry.redhat.io/ubi8/ubi@sha256:2"))
+	assert.Nil(t, matchMirrorRule(rules, "quay.io/organization/app@sha256:3"))
+	assert.Nil(t, matchMirrorRule(rules, "docker.io/library/busybox@sha256:4"))
+}
@@ -4,19 +4,32 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/bombsimon/logrusr"
 	"github.com/containers/image/v5/copy"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
 	imagev1API "github.com/openshift/api/image/v1"
 	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
+const defaultTagWaitTimeout = 5 * time.Minute
+
 // MyRestorePlugin is a restore item action plugin for Velero
 type RestorePlugin struct {
-	Log logrus.FieldLogger
+	Log               logrus.FieldLogger
+	MirrorRules       []MirrorRule
+	UpdatedForRestore map[string]bool
+	// the images copied by each restore, by restore name
+	CopiedImages map[string]*imagecopy.CopiedImages
 }
 
 // AppliesTo returns a velero.ResourceSelector that applies to imagestreams
@@ -43,17 +56,82 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	itemMarshal, _ = json.Marshal(input.ItemFromBackup)
 	json.Unmarshal(itemMarshal, &imageStreamUnmodified)
 
+	backupInternalRegistry, internalRegistry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if len(internalRegistry) == 0 {
+		// the backup hostname may not be valid on this cluster, so look it up
+		major, minor, err := common.GetServerVersion()
+		if err != nil {
+			return nil, err
+		}
+		internalRegistry, err = common.GetRegistryInfo(major, minor, p.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !p.UpdatedForRestore[input.Restore.Name] {
+		if err := p.updateMirrorRules(); err != nil {
+			p.Log.Warnf("[is-restore] error looking up image mirror rules: %v", err)
+		}
+		p.UpdatedForRestore[input.Restore.Name] = true
+	}
+	backupRegistries := backupInternalRegistries(backupInternalRegistry, imageStreamUnmodified)
+	p.logMirroredReferences(imageStreamUnmodified, backupRegistries)
+	namespaceMapping := input.Restore.Spec.NamespaceMapping
+	rewriteImageStreamReferences(&imageStream, backupRegistries, internalRegistry, namespaceMapping)
+	additionalItems := p.crossNamespaceItems(input.Restore, imageStreamUnmodified)
+	if restoreIncludeTags := imagecopy.ParseIncludeTags(input.Restore.Annotations[common.RestoreIncludeTagsAnnotation]); len(restoreIncludeTags) > 0 {
+		filterTags(&imageStream, restoreIncludeTags, p.Log)
+		filterTags(&imageStreamUnmodified, restoreIncludeTags, p.Log)
+	}
+
+	if annotations[common.ImageCopySkippedAnnotation] == "true" {
+		p.Log.Info("[is-restore] Images were not copied at backup time, restoring ImageStream without copying images")
+		// no spec tag restored may point at the migration registry, or at a
+		// backup registry hostname which could not be rewritten. Velero clears
+		// the status of the item, so the status tags need no pruning.
+		staleRegistries := []string{annotations[common.MigrationRegistry]}
+		for _, registry := range backupRegistries {
+			if registry != internalRegistry {
+				staleRegistries = append(staleRegistries, registry)
+			}
+		}
+		pruneRegistryReferences(&imageStream, staleRegistries, p.Log)
+		var out map[string]interface{}
+		objrec, _ := json.Marshal(imageStream)
+		json.Unmarshal(objrec, &out)
+		input.Item.SetUnstructuredContent(out)
+		return &velero.RestoreItemActionExecuteOutput{
+			UpdatedItem:     input.Item,
+			AdditionalItems: additionalItems,
+		}, nil
+	}
+
 	skipImages := annotations[common.SkipImages]
 	if len(skipImages) != 0 {
 		p.Log.Info("Not running in OADP/CAM context, skipping copy of image.")
 		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
 	}
-	backupInternalRegistry, internalRegistry, err := common.GetSrcAndDestRegistryInfo(input.Item)
-	if err != nil {
-		return nil, err
-	}
 	migrationRegistry := annotations[common.MigrationRegistry]
-	if len(migrationRegistry) == 0 {
+	// images written to an OCI layout at backup time are read from the same
+	// layout, on a volume mounted on the velero deployment of this cluster
+	layoutDir := ""
+	if layoutPath := annotations[common.BackupOCILayoutAnnotation]; len(layoutPath) > 0 {
+		root := imagecopy.OCILayoutDir()
+		if len(root) == 0 {
+			return nil, fmt.Errorf("images of imagestream %s/%s were backed up to OCI layout %s but %s is not set",
+				imageStreamUnmodified.Namespace, imageStreamUnmodified.Name, layoutPath, imagecopy.OCILayoutDirEnvVar)
+		}
+		layoutDir = filepath.Join(root, layoutPath)
+		if _, err := os.Stat(layoutDir); err != nil {
+			return nil, fmt.Errorf("OCI layout of imagestream %s/%s can't be read, check the volume mounted at %s on the velero deployment: %v",
+				imageStreamUnmodified.Namespace, imageStreamUnmodified.Name, root, err)
+		}
+		p.Log.Info(fmt.Sprintf("[is-restore] copying images from OCI layout %s", layoutDir))
+		migrationRegistry = ""
+	} else if len(migrationRegistry) == 0 {
 		return nil, errors.New("migration registry not found for annotation \"openshift.io/migration\"")
 	}
 	p.Log.Info(fmt.Sprintf("[is-restore] backup internal registry: %#v", backupInternalRegistry))
@@ -61,38 +139,231 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 
 	destNamespace := imageStreamUnmodified.Namespace
 	// if destination namespace is mapped to new one, swap it
-	namespaceMapping := input.Restore.Spec.NamespaceMapping
 	if namespaceMapping[destNamespace] != "" {
 		destNamespace = namespaceMapping[imageStreamUnmodified.Namespace]
 	}
 
-	sourceCtx, err := migrationRegistrySystemContext()
+	includeTags := imagecopy.ParseIncludeTags(annotations[common.BackupIncludeTagsAnnotation])
+	for _, tag := range imageStreamUnmodified.Status.Tags {
+		if !imagecopy.TagIncluded(includeTags, tag.Tag) {
+			p.Log.Warnf("[is-restore] tag %s was not copied during backup, skipping image copy", tag.Tag)
+		}
+	}
+
+	// images were copied to the repository recorded at backup time, or by older
+	// backups to the one the template gives
+	repository := annotations[common.BackupRepositoryAnnotation]
+	if len(repository) == 0 {
+		repository = common.ExpandRepositoryTemplate(common.RepositoryTemplate(), common.RepositoryVariables{
+			Namespace:       imageStreamUnmodified.Namespace,
+			MappedNamespace: destNamespace,
+			Name:            imageStreamUnmodified.Name,
+			Backup:          input.Restore.Spec.BackupName,
+		})
+	}
+
+	dropSkippedTagItems(&imageStreamUnmodified, annotations[common.BackupSkippedTagsAnnotation], p.Log)
+
+	if input.Restore.Annotations[common.RestoreFromMigrationRegistryAnnotation] == "true" && len(layoutDir) > 0 {
+		p.Log.Warnf("[is-restore] images of imagestream %s/%s were backed up to an OCI layout, copying them instead of pointing tags at the migration registry",
+			imageStreamUnmodified.Namespace, imageStreamUnmodified.Name)
+	} else if input.Restore.Annotations[common.RestoreFromMigrationRegistryAnnotation] == "true" {
+		p.Log.Info("[is-restore] Pointing tags at the migration registry instead of copying images")
+		pointTagsAtMigrationRegistry(&imageStream, imageStreamUnmodified, backupInternalRegistry, migrationRegistry, repository,
+			includeTags, insecureRegistry(InsecureSourceRegistryEnvVar, migrationRegistry), p.Log)
+		var out map[string]interface{}
+		objrec, _ := json.Marshal(imageStream)
+		json.Unmarshal(objrec, &out)
+		input.Item.SetUnstructuredContent(out)
+		return &velero.RestoreItemActionExecuteOutput{
+			UpdatedItem:     input.Item,
+			AdditionalItems: additionalItems,
+		}, nil
+	}
+
+	insecureSource := insecureRegistry(InsecureSourceRegistryEnvVar, migrationRegistry)
+	insecureDestination := insecureRegistry(InsecureDestinationRegistryEnvVar, internalRegistry)
+	if len(layoutDir) == 0 {
+		warnInsecureRegistry(migrationRegistry, insecureSource, "[is-restore]", p.Log)
+	}
+	warnInsecureRegistry(internalRegistry, insecureDestination, "[is-restore]", p.Log)
+	sourceCtx, err := migrationRegistrySystemContext(insecureSource)
+	if err != nil {
+		return nil, err
+	}
+	destinationCtx, tokenFile, err := internalRegistrySystemContext(insecureDestination)
 	if err != nil {
 		return nil, err
 	}
-	destinationCtx, err := internalRegistrySystemContext()
+	if len(layoutDir) == 0 {
+		if _, err := useRegistryAuthFile(sourceCtx, SourceRegistryAuthFileEnvVar, migrationRegistry); err != nil {
+			return nil, err
+		}
+	}
+	tokenFile, err = useInternalRegistryAuthFile(destinationCtx, DestinationRegistryAuthFileEnvVar, internalRegistry, tokenFile, "[is-restore]", p.Log)
 	if err != nil {
 		return nil, err
 	}
-	err = imagecopy.CopyLocalImageStreamImages(
+	if secretRef := input.Restore.Annotations[common.RegistrySecretAnnotation]; len(secretRef) > 0 {
+		p.Log.Info(fmt.Sprintf("[is-restore] using credentials from secret %s to push images", secretRef))
+		tokenFile = ""
+		destinationCtx.DockerAuthConfig, err = registrySecretAuthConfig(secretRef, internalRegistry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dryRun := input.Restore.Annotations[common.ImageCopyDryRunAnnotation] == "true"
+	if dryRun {
+		p.Log.Info(fmt.Sprintf("[is-restore] dry run, checking images of imagestream %s/%s without copying", imageStreamUnmodified.Namespace, imageStreamUnmodified.Name))
+		if len(layoutDir) == 0 {
+			if err := imagecopy.CheckRegistryAccess(migrationRegistry, sourceCtx); err != nil {
+				p.Log.Warnf("[is-restore] dry run: can't access migration registry %s: %v", migrationRegistry, err)
+			}
+		}
+		if err := imagecopy.CheckRegistryAccess(internalRegistry, destinationCtx); err != nil {
+			p.Log.Warnf("[is-restore] dry run: can't access internal registry %s: %v", internalRegistry, err)
+		}
+	}
+	ctx, cancel := operationContext("restores", input.Restore.Namespace, input.Restore.Name, "[is-restore]", p.Log)
+	defer cancel()
+	result, err := imagecopy.CopyLocalImageStreamImages(
+		ctx,
 		imageStreamUnmodified,
-		backupInternalRegistry,
-		migrationRegistry,
-		internalRegistry,
-		destNamespace,
-		&copy.Options{
-			SourceCtx:      sourceCtx,
-			DestinationCtx: destinationCtx,
+		imagecopy.ImageStreamCopyOptions{
+			InternalRegistryPath: backupInternalRegistry,
+			SrcRegistry:          migrationRegistry,
+			DestRegistry:         internalRegistry,
+			DestNamespace:        destNamespace,
+			SrcRepository:        repository,
+			CopyOptions: &copy.Options{
+				SourceCtx:          sourceCtx,
+				DestinationCtx:     destinationCtx,
+				ImageListSelection: imagecopy.ImageListSelection(),
+			},
+			IncludeTags:        includeTags,
+			Concurrency:        imagecopy.CopyConcurrency(),
+			TagDigests:         tagDigestAnnotations(annotations),
+			Timeout:            imagecopy.CopyTimeout(),
+			SkipExistingImages: true,
+			RetryAttempts:      imagecopy.CopyRetryAttempts(),
+			RetryInterval:      imagecopy.CopyRetryInterval(),
+			DryRun:             dryRun,
+			DestTokenFile:      tokenFile,
+			PreserveDigests:    imagecopy.PreserveDigests(),
+			Compression:        imagecopy.Compression(),
+			CopySignatures:     imagecopy.CopySignatures(),
+			InsecureRegistries: imagecopy.InsecureRegistries(),
+			SrcOCILayout:       layoutDir,
+			CopiedImages:       copiedImages(p.CopiedImages, input.Restore.Name),
+			VerifyPushes:       imagecopy.VerifyPushes(),
 		},
-		logrusr.NewLogger(p.Log),
-		false)
-	if err != nil {
+		logrusr.NewLogger(p.Log))
+	if result != nil {
+		warnRateLimited(result.RateLimited, "[is-restore]", p.Log)
+		recordCopyMetrics("Restore", input.Restore.ObjectMeta, result, "[is-restore]", p.Log)
+	}
+	if dryRun {
+		if aggregate, ok := err.(utilerrors.Aggregate); ok {
+			for _, tagErr := range aggregate.Errors() {
+				p.Log.Warnf("[is-restore] dry run: %v", tagErr)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		p.Log.Info(fmt.Sprintf("[is-restore] dry run of imagestream %s/%s done, restoring it unmodified", imageStreamUnmodified.Namespace, imageStreamUnmodified.Name))
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	// the copy of the other tags went ahead, so surface tag failures as warnings
+	// rather than failing the restore of the whole imagestream, unless the
+	// restore asks for a strict copy. The imagestream is created by the pushes,
+	// so the failed tags are missing from it.
+	if aggregate, ok := err.(utilerrors.Aggregate); ok && input.Restore.Annotations[common.StrictImageCopyAnnotation] != "true" {
+		for _, tagErr := range aggregate.Errors() {
+			p.Log.Warnf("[is-restore] failed to copy images of imagestream %s/%s: %v", imageStreamUnmodified.Namespace, imageStreamUnmodified.Name, tagErr)
+		}
+		for _, tag := range result.FailedTags {
+			p.Log.Warnf("[is-restore] tag %s (image %s) of imagestream %s/%s is not restored", tag,
+				tagImage(imageStreamUnmodified, tag, annotations), imageStreamUnmodified.Namespace, imageStreamUnmodified.Name)
+		}
+	} else if err != nil {
 		return nil, err
 	}
 
-	var out map[string]interface{}
-	objrec, _ := json.Marshal(imageStream)
-	json.Unmarshal(objrec, &out)
-	input.Item.SetUnstructuredContent(out)
+	if result != nil {
+		p.Log.Info(fmt.Sprintf("[is-restore] copied %d bytes to the internal registry for imagestream %s/%s, %d bytes of %d blobs already existed",
+			result.BytesCopied, imageStreamUnmodified.Namespace, imageStreamUnmodified.Name, result.BytesExisting, result.BlobsReused))
+	}
+	if result != nil && len(result.ConvertedDigests) > 0 {
+		p.Log.Warnf("[is-restore] manifests of imagestream %s/%s images had to be converted, changing their digests: %v",
+			imageStreamUnmodified.Namespace, imageStreamUnmodified.Name, convertedDigestPairs(result.ConvertedDigests))
+	}
+	if value, found := input.Restore.Annotations[common.WaitForImageStreamTagsAnnotation]; found && result != nil {
+		timeout := defaultTagWaitTimeout
+		if duration, err := time.ParseDuration(value); err == nil {
+			timeout = duration
+		}
+		p.waitForTags(destNamespace, imageStreamUnmodified.Name, result.CopiedTags, timeout)
+	}
+
 	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
 }
+
+// crossNamespaceItems returns the imagestreams of other namespaces the spec tags
+// of imageStream reference, so they are restored first, and warns about those
+// neither part of the restore nor present on this cluster
+func (p *RestorePlugin) crossNamespaceItems(restore *v1.Restore, imageStream imagev1API.ImageStream) []velero.ResourceIdentifier {
+	var additionalItems []velero.ResourceIdentifier
+	for _, reference := range crossNamespaceReferences(imageStream) {
+		if common.RestoresNamespace(restore, reference.Namespace) {
+			additionalItems = append(additionalItems, reference)
+			continue
+		}
+		namespace := reference.Namespace
+		if mapped := restore.Spec.NamespaceMapping[namespace]; len(mapped) > 0 {
+			namespace = mapped
+		}
+		client, err := clients.ImageClient()
+		if err == nil {
+			_, err = client.ImageStreams(namespace).Get(reference.Name, metav1.GetOptions{})
+		}
+		if err != nil {
+			p.Log.Warnf("[is-restore] imagestream %s/%s references imagestream %s/%s, which is not part of the restore and can't be found: %v",
+				imageStream.Namespace, imageStream.Name, namespace, reference.Name, err)
+		}
+	}
+	return additionalItems
+}
+
+// waitForTags polls the ImageStream restored by the image pushes until the
+// status of every tag holds an image, so that items restored later, such as
+// deploymentconfigs with image change triggers, can resolve them. Velero can't
+// run the wait asynchronously, so it blocks the restore for at most timeout,
+// after which a warning is logged and the restore goes on.
+func (p *RestorePlugin) waitForTags(namespace, name string, tags []string, timeout time.Duration) {
+	if len(tags) == 0 {
+		return
+	}
+	client, err := clients.ImageClient()
+	if err != nil {
+		p.Log.Warnf("[is-restore] not waiting for tags of imagestream %s/%s: %v", namespace, name, err)
+		return
+	}
+	p.Log.Info(fmt.Sprintf("[is-restore] waiting up to %v for tags %v of imagestream %s/%s", timeout, tags, namespace, name))
+	deadline := time.Now().Add(timeout)
+	for {
+		missing := tags
+		imageStream, err := client.ImageStreams(namespace).Get(name, metav1.GetOptions{})
+		if err == nil {
+			missing = missingStatusTags(*imageStream, tags)
+		}
+		if len(missing) == 0 {
+			p.Log.Info(fmt.Sprintf("[is-restore] tags of imagestream %s/%s are resolvable", namespace, name))
+			return
+		}
+		if time.Now().After(deadline) {
+			p.Log.Warnf("[is-restore] timed out after %v waiting for tags %v of imagestream %s/%s", timeout, missing, namespace, name)
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -1,38 +1,718 @@
 package imagestream
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
 	"github.com/containers/image/v5/types"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
+	imagev1API "github.com/openshift/api/image/v1"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
 )
 
+const (
+	// InsecureSourceRegistryEnvVar is the environment variable controlling TLS verification of the registry images are copied from
+	InsecureSourceRegistryEnvVar = "INSECURE_SOURCE_REGISTRY"
+	// InsecureDestinationRegistryEnvVar is the environment variable controlling TLS verification of the registry images are copied to
+	InsecureDestinationRegistryEnvVar = "INSECURE_DESTINATION_REGISTRY"
+)
+
+// RegistryCABundleEnvVar is the environment variable setting the path of a CA
+// bundle file, or of a directory of *.crt files, trusted for registry connections
+// in addition to the system CAs
+const RegistryCABundleEnvVar = "REGISTRY_CA_BUNDLE"
+
+const (
+	// RegistryAuthFileEnvVar is the environment variable setting the path of a
+	// containers-auth.json or dockerconfigjson file holding registry credentials
+	// for both sides of the image copies
+	RegistryAuthFileEnvVar = "REGISTRY_AUTH_FILE"
+	// SourceRegistryAuthFileEnvVar sets the auth file of the registry images are copied from, instead of REGISTRY_AUTH_FILE
+	SourceRegistryAuthFileEnvVar = "SOURCE_REGISTRY_AUTH_FILE"
+	// DestinationRegistryAuthFileEnvVar sets the auth file of the registry images are copied to, instead of REGISTRY_AUTH_FILE
+	DestinationRegistryAuthFileEnvVar = "DESTINATION_REGISTRY_AUTH_FILE"
+)
+
+// BlobInfoCacheDirEnvVar is the environment variable setting the directory of the
+// blob info cache, which records the blobs known to each registry across image
+// copies and plugin invocations
+const BlobInfoCacheDirEnvVar = "IMAGE_COPY_BLOB_CACHE_DIR"
+
+var (
+	registryCertDirOnce sync.Once
+	registryCertDirPath string
+	registryCertDirErr  error
+)
+
+const (
+	// CopySamplesImagesEnvVar is the environment variable which, set to "true",
+	// copies the images of samples operator ImageStreams at backup time
+	CopySamplesImagesEnvVar = "COPY_SAMPLES_IMAGES"
+	samplesNamespace        = "openshift"
+	samplesManagedLabel     = "samples.operator.openshift.io/managed"
+)
+
+const (
+	// HistoryDepthEnvVar is the environment variable setting how many of the most
+	// recent images of each tag are copied at backup time
+	HistoryDepthEnvVar  = "IMAGE_COPY_HISTORY_DEPTH"
+	defaultHistoryDepth = 3
+)
+
+// isSamplesImageStream returns whether imageStream is managed by the samples operator
+func isSamplesImageStream(imageStream imagev1API.ImageStream) bool {
+	return imageStream.Namespace == samplesNamespace || imageStream.Labels[samplesManagedLabel] == "true"
+}
+
+// copySamplesImages returns whether the images of samples operator ImageStreams
+// are copied, e.g. for disconnected targets where the samples operator can't import
+func copySamplesImages(backup *v1.Backup) bool {
+	if value, found := backup.Annotations[common.CopySamplesImagesAnnotation]; found {
+		return value == "true"
+	}
+	return os.Getenv(CopySamplesImagesEnvVar) == "true"
+}
 
-func internalRegistrySystemContext() (*types.SystemContext, error) {
+// internalRegistrySystemContext returns the system context used for the internal
+// registry, and the file of the service account token it authenticates with.
+// An insecure context skips TLS verification and falls back to HTTP for
+// registries which are not TLS-terminated.
+func internalRegistrySystemContext(insecure bool) (*types.SystemContext, string, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if config.BearerToken == "" {
-		return nil, errors.New("BearerToken not found, can't authenticate with registry")
+		return nil, "", errors.New("BearerToken not found, can't authenticate with registry")
+	}
+	certDir, err := registryCertDir()
+	if err != nil {
+		return nil, "", err
 	}
 	ctx := &types.SystemContext{
+		DockerCertPath:                    certDir,
+		BlobInfoCacheDir:                  blobInfoCacheDir(),
 		DockerDaemonInsecureSkipTLSVerify: true,
-		DockerInsecureSkipTLSVerify:       types.OptionalBoolTrue,
+		DockerInsecureSkipTLSVerify:       types.NewOptionalBool(insecure),
 		DockerDisableDestSchema1MIMETypes: true,
 		DockerAuthConfig: &types.DockerAuthConfig{
 			Username: "ignored",
 			Password: config.BearerToken,
 		},
 	}
-	return ctx, nil
+	return ctx, config.BearerTokenFile, nil
 }
 
-func migrationRegistrySystemContext() (*types.SystemContext, error) {
+// migrationRegistrySystemContext returns the system context used for the migration registry
+func migrationRegistrySystemContext(insecure bool) (*types.SystemContext, error) {
+	certDir, err := registryCertDir()
+	if err != nil {
+		return nil, err
+	}
 	ctx := &types.SystemContext{
+		DockerCertPath:                    certDir,
+		BlobInfoCacheDir:                  blobInfoCacheDir(),
 		DockerDaemonInsecureSkipTLSVerify: true,
-		DockerInsecureSkipTLSVerify:       types.OptionalBoolTrue,
+		DockerInsecureSkipTLSVerify:       types.NewOptionalBool(insecure),
 		DockerDisableDestSchema1MIMETypes: true,
 	}
 	return ctx, nil
 }
 
+// blobInfoCacheDir returns the directory of the blob info cache set by
+// IMAGE_COPY_BLOB_CACHE_DIR, by default under the temporary directory, as the
+// default location of containers/image isn't writable in the Velero pod. The
+// cache is kept in memory for a single copy if the directory can't be created.
+func blobInfoCacheDir() string {
+	if dir := os.Getenv(BlobInfoCacheDirEnvVar); len(dir) > 0 {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "openshift-velero-plugin", "blob-info-cache")
+}
+
+// registryCertDir returns the directory of the CA bundle set by REGISTRY_CA_BUNDLE,
+// or "" to only trust the system CAs. The bundle is read once per plugin process.
+func registryCertDir() (string, error) {
+	registryCertDirOnce.Do(func() {
+		if bundle := os.Getenv(RegistryCABundleEnvVar); len(bundle) > 0 {
+			registryCertDirPath, registryCertDirErr = certDirForBundle(bundle)
+		}
+	})
+	return registryCertDirPath, registryCertDirErr
+}
+
+// certDirForBundle returns a directory containers/image reads the CAs of bundle
+// from: bundle itself if a directory, or a directory holding a copy of the file
+func certDirForBundle(bundle string) (string, error) {
+	info, err := os.Stat(bundle)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s %s: %v", RegistryCABundleEnvVar, bundle, err)
+	}
+	if info.IsDir() {
+		return bundle, nil
+	}
+	data, err := ioutil.ReadFile(bundle)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s %s: %v", RegistryCABundleEnvVar, bundle, err)
+	}
+	certDir, err := ioutil.TempDir("", "registry-ca")
+	if err != nil {
+		return "", err
+	}
+	// only *.crt files are read as CAs
+	if err := ioutil.WriteFile(filepath.Join(certDir, "ca.crt"), data, 0644); err != nil {
+		return "", err
+	}
+	return certDir, nil
+}
+
+// insecureRegistry returns whether TLS verification is skipped for registry, on
+// the side of the copy configured by envVar. Registries are insecure unless set
+// to "false", or, if INSECURE_REGISTRIES is set, unless it lists them.
+func insecureRegistry(envVar, registry string) bool {
+	insecure, err := strconv.ParseBool(os.Getenv(envVar))
+	if err == nil {
+		return insecure
+	}
+	if insecureRegistries := imagecopy.InsecureRegistries(); len(insecureRegistries) > 0 {
+		return imagecopy.RegistryListed(insecureRegistries, registry)
+	}
+	return true
+}
+
+// warnInsecureRegistry logs a warning if TLS verification is skipped for registry
+func warnInsecureRegistry(registry string, insecure bool, prefix string, log logrus.FieldLogger) {
+	if insecure {
+		log.Warnf("%s TLS verification is disabled for registry %s", prefix, registry)
+	}
+}
+
+// setTagDigestAnnotations replaces any per-tag digest annotations with the
+// digests pushed for each tag
+func setTagDigestAnnotations(annotations map[string]string, digests map[string]string) {
+	for key := range annotations {
+		if strings.HasPrefix(key, common.BackupImageDigestAnnotationPrefix) {
+			delete(annotations, key)
+		}
+	}
+	for tag, digest := range digests {
+		annotations[common.BackupImageDigestAnnotationPrefix+tag] = digest
+	}
+}
+
+// copiedImages returns the record of the images copied by the backup or restore
+// named name, shared by all its ImageStreams, or nil without records
+func copiedImages(records map[string]*imagecopy.CopiedImages, name string) *imagecopy.CopiedImages {
+	if records == nil {
+		return nil
+	}
+	if records[name] == nil {
+		records[name] = imagecopy.NewCopiedImages()
+	}
+	return records[name]
+}
+
+// warnRateLimited logs a single warning per registry which rate limited the image copies
+func warnRateLimited(rateLimited map[string]int, prefix string, log logrus.FieldLogger) {
+	var registries []string
+	for registry := range rateLimited {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	for _, registry := range registries {
+		log.Warnf("%s rate limited %d times by registry %s", prefix, rateLimited[registry], registry)
+	}
+}
+
+// convertedDigestPairs returns the converted digests as sorted source=pushed pairs
+func convertedDigestPairs(digests map[string]string) []string {
+	var pairs []string
+	for source, pushed := range digests {
+		pairs = append(pairs, source+"="+pushed)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// tagDigestAnnotations returns the per-tag digests recorded at backup time
+func tagDigestAnnotations(annotations map[string]string) map[string]string {
+	digests := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, common.BackupImageDigestAnnotationPrefix) {
+			digests[strings.TrimPrefix(key, common.BackupImageDigestAnnotationPrefix)] = value
+		}
+	}
+	return digests
+}
+
+// historyDepth returns the number of most recent images copied per tag. The
+// backup annotations take precedence over the environment variable, and a
+// value of 0 copies the whole tag history.
+func historyDepth(backup *v1.Backup) int {
+	if backup.Annotations[common.LatestOnlyAnnotation] == "true" {
+		return 1
+	}
+	value, found := backup.Annotations[common.HistoryDepthAnnotation]
+	if !found {
+		value = os.Getenv(HistoryDepthEnvVar)
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 0 {
+		return defaultHistoryDepth
+	}
+	return depth
+}
+
+// trimTagHistory drops all but the most recent depth items of each status tag
+func trimTagHistory(imageStream *imagev1API.ImageStream, depth int, log logrus.FieldLogger) {
+	if depth == 0 {
+		return
+	}
+	for i, tag := range imageStream.Status.Tags {
+		if len(tag.Items) > depth {
+			log.Info(fmt.Sprintf("[is-backup] tag %s: skipping %v historical items beyond depth %v", tag.Tag, len(tag.Items)-depth, depth))
+			imageStream.Status.Tags[i].Items = tag.Items[:depth]
+		}
+	}
+}
+
+// dropSkippedTagItems removes the tag items whose image was not copied at backup
+// time, listed as comma-separated tag@image entries
+func dropSkippedTagItems(imageStream *imagev1API.ImageStream, skippedItems string, log logrus.FieldLogger) {
+	if len(skippedItems) == 0 {
+		return
+	}
+	skipped := make(map[string]bool)
+	for _, item := range strings.Split(skippedItems, ",") {
+		skipped[item] = true
+	}
+	for i, tag := range imageStream.Status.Tags {
+		items := []imagev1API.TagEvent{}
+		for _, item := range tag.Items {
+			if skipped[tag.Tag+"@"+item.Image] {
+				log.Warnf("[is-restore] image %s of tag %s was missing at backup time, not restoring it", item.Image, tag.Tag)
+				continue
+			}
+			items = append(items, item)
+		}
+		imageStream.Status.Tags[i].Items = items
+	}
+}
+
+// imageStreamImageReferences returns the ImageStreams, other than imageStream
+// itself, that the ImageStreamImage spec tags of imageStream are pinned to
+func imageStreamImageReferences(imageStream imagev1API.ImageStream) []velero.ResourceIdentifier {
+	var references []velero.ResourceIdentifier
+	seen := make(map[string]bool)
+	for _, tag := range imageStream.Spec.Tags {
+		if tag.From == nil || tag.From.Kind != "ImageStreamImage" {
+			continue
+		}
+		nameSplit := strings.Split(tag.From.Name, "@")
+		if len(nameSplit) != 2 || len(nameSplit[0]) == 0 {
+			continue
+		}
+		namespace := tag.From.Namespace
+		if namespace == "" {
+			namespace = imageStream.Namespace
+		}
+		if namespace == imageStream.Namespace && nameSplit[0] == imageStream.Name {
+			continue
+		}
+		if seen[namespace+"/"+nameSplit[0]] {
+			continue
+		}
+		seen[namespace+"/"+nameSplit[0]] = true
+		references = append(references, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{
+				Group:    "image.openshift.io",
+				Resource: "imagestreams",
+			},
+			Namespace: namespace,
+			Name:      nameSplit[0],
+		})
+	}
+	return references
+}
+
+// backupInternalRegistries returns the hostnames the backup cluster internal
+// registry was known by: the recorded one, which may be the registry service
+// cluster IP on 3.x clusters, and the one the ImageStream repository uses
+func backupInternalRegistries(backupInternalRegistry string, backupImageStream imagev1API.ImageStream) []string {
+	registries := []string{backupInternalRegistry}
+	repository := backupImageStream.Status.DockerImageRepository
+	if repositorySplit := strings.SplitN(repository, "/", 2); len(repositorySplit) == 2 && repositorySplit[0] != backupInternalRegistry {
+		registries = append(registries, repositorySplit[0])
+	}
+	return registries
+}
+
+// isInternalReference returns whether ref points at any of the internal registries
+func isInternalReference(ref string, internalRegistries []string) bool {
+	for _, registry := range internalRegistries {
+		if len(registry) > 0 && common.HasImageRefPrefix(ref, registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossNamespaceReferences returns the imagestreams of other namespaces which
+// spec tags of imageStream reference by an ImageStreamTag or ImageStreamImage
+func crossNamespaceReferences(imageStream imagev1API.ImageStream) []velero.ResourceIdentifier {
+	var references []velero.ResourceIdentifier
+	seen := make(map[string]bool)
+	for _, tag := range imageStream.Spec.Tags {
+		if tag.From == nil || len(tag.From.Namespace) == 0 || tag.From.Namespace == imageStream.Namespace {
+			continue
+		}
+		var name string
+		switch tag.From.Kind {
+		case "ImageStreamTag":
+			name = strings.Split(tag.From.Name, ":")[0]
+		case "ImageStreamImage":
+			name = strings.Split(tag.From.Name, "@")[0]
+		}
+		if len(name) == 0 || seen[tag.From.Namespace+"/"+name] {
+			continue
+		}
+		seen[tag.From.Namespace+"/"+name] = true
+		references = append(references, velero.ResourceIdentifier{
+			GroupResource: schema.GroupResource{
+				Group:    "image.openshift.io",
+				Resource: "imagestreams",
+			},
+			Namespace: tag.From.Namespace,
+			Name:      name,
+		})
+	}
+	return references
+}
+
+// referencedImageStreams returns the imagestreams pinned by ImageStreamImage tags
+// of imageStream, along with those of other namespaces its tags reference
+func referencedImageStreams(imageStream imagev1API.ImageStream) []velero.ResourceIdentifier {
+	references := imageStreamImageReferences(imageStream)
+	seen := make(map[string]bool)
+	for _, reference := range references {
+		seen[reference.Namespace+"/"+reference.Name] = true
+	}
+	for _, reference := range crossNamespaceReferences(imageStream) {
+		if !seen[reference.Namespace+"/"+reference.Name] {
+			references = append(references, reference)
+		}
+	}
+	return references
+}
+
+// pointTagsAtMigrationRegistry points the tags of imageStream whose images were
+// copied at backup time at the migration registry location they were copied to,
+// as DockerImage references, instead of copying the images again. The other
+// fields of existing spec tags are kept, except that the import is made insecure
+// for an insecure migration registry.
+func pointTagsAtMigrationRegistry(
+	imageStream *imagev1API.ImageStream,
+	backupImageStream imagev1API.ImageStream,
+	backupInternalRegistry, migrationRegistry, repository string,
+	includeTags []string,
+	insecure bool,
+	log logrus.FieldLogger) {
+	digests := tagDigestAnnotations(backupImageStream.Annotations)
+	for _, tag := range backupImageStream.Status.Tags {
+		if len(tag.Items) == 0 || !imagecopy.TagIncluded(includeTags, tag.Tag) {
+			continue
+		}
+		if !common.HasImageRefPrefix(tag.Items[0].DockerImageReference, backupInternalRegistry) {
+			continue
+		}
+		digest := digests[tag.Tag]
+		if len(digest) == 0 {
+			digest = tag.Items[0].Image
+		}
+		migrationRef := fmt.Sprintf("%s/%s@%s", migrationRegistry, repository, digest)
+		log.Info(fmt.Sprintf("[is-restore] pointing tag %s at %s", tag.Tag, migrationRef))
+		tagRef := imagev1API.TagReference{
+			Name:            tag.Tag,
+			ReferencePolicy: imagev1API.TagReferencePolicy{Type: imagev1API.SourceTagReferencePolicy},
+		}
+		index := -1
+		for i, specTag := range imageStream.Spec.Tags {
+			if specTag.Name == tag.Tag {
+				tagRef = specTag
+				index = i
+			}
+		}
+		tagRef.From = &corev1.ObjectReference{Kind: "DockerImage", Name: migrationRef}
+		tagRef.ImportPolicy.Insecure = tagRef.ImportPolicy.Insecure || insecure
+		if index >= 0 {
+			imageStream.Spec.Tags[index] = tagRef
+		} else {
+			imageStream.Spec.Tags = append(imageStream.Spec.Tags, tagRef)
+		}
+	}
+}
+
+// rewriteImageStreamReferences rewrites the image references of imageStream to
+// any of the backup internal registry hostnames to the restore internal registry,
+// and the namespaces they and the ImageStreamTag and ImageStreamImage tags refer
+// to following namespaceMapping
+func rewriteImageStreamReferences(imageStream *imagev1API.ImageStream, backupInternalRegistries []string, internalRegistry string, namespaceMapping map[string]string) {
+	rewrite := func(ref string) string {
+		for _, backupInternalRegistry := range backupInternalRegistries {
+			if len(backupInternalRegistry) == 0 {
+				continue
+			}
+			newRegistry := internalRegistry
+			if len(newRegistry) == 0 {
+				newRegistry = backupInternalRegistry
+			}
+			newRef, err := common.ReplaceImageRefPrefix(ref, backupInternalRegistry, newRegistry, namespaceMapping)
+			if err == nil {
+				return newRef
+			}
+		}
+		return ref
+	}
+	for _, tag := range imageStream.Spec.Tags {
+		if tag.From == nil {
+			continue
+		}
+		switch tag.From.Kind {
+		case "DockerImage":
+			tag.From.Name = rewrite(tag.From.Name)
+		case "ImageStreamTag", "ImageStreamImage":
+			if mapped := namespaceMapping[tag.From.Namespace]; len(tag.From.Namespace) > 0 && len(mapped) > 0 {
+				tag.From.Namespace = mapped
+			}
+		}
+	}
+	for i, tag := range imageStream.Status.Tags {
+		for j, item := range tag.Items {
+			imageStream.Status.Tags[i].Items[j].DockerImageReference = rewrite(item.DockerImageReference)
+		}
+	}
+	imageStream.Status.DockerImageRepository = rewrite(imageStream.Status.DockerImageRepository)
+}
+
+// pruneRegistryReferences removes the spec tags of imageStream still
+// referencing one of registries, e.g. the migration registry, which is not
+// reachable once the restore is done, with a warning for each
+func pruneRegistryReferences(imageStream *imagev1API.ImageStream, registries []string, log logrus.FieldLogger) {
+	stale := func(ref string) bool {
+		for _, registry := range registries {
+			if len(registry) > 0 && common.HasImageRefPrefix(ref, registry) {
+				return true
+			}
+		}
+		return false
+	}
+	specTags := []imagev1API.TagReference{}
+	for _, tag := range imageStream.Spec.Tags {
+		if tag.From != nil && tag.From.Kind == "DockerImage" && stale(tag.From.Name) {
+			log.Warnf("[is-restore] not restoring spec tag %s of imagestream %s/%s, it references %s, which is not reachable after the restore",
+				tag.Name, imageStream.Namespace, imageStream.Name, tag.From.Name)
+			continue
+		}
+		specTags = append(specTags, tag)
+	}
+	imageStream.Spec.Tags = specTags
+}
+
+// missingStatusTags returns the tags which don't have an image in the status of imageStream yet
+func missingStatusTags(imageStream imagev1API.ImageStream, tags []string) []string {
+	resolved := make(map[string]bool)
+	for _, tag := range imageStream.Status.Tags {
+		if len(tag.Items) > 0 {
+			resolved[tag.Tag] = true
+		}
+	}
+	missing := []string{}
+	for _, tag := range tags {
+		if !resolved[tag] {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// filterTags removes the spec and status tags of imageStream which don't match
+// includeTags, so that the restored ImageStream doesn't import them again
+func filterTags(imageStream *imagev1API.ImageStream, includeTags []string, log logrus.FieldLogger) {
+	specTags := []imagev1API.TagReference{}
+	for _, tag := range imageStream.Spec.Tags {
+		if imagecopy.TagIncluded(includeTags, tag.Name) {
+			specTags = append(specTags, tag)
+		}
+	}
+	statusTags := []imagev1API.NamedTagEventList{}
+	for _, tag := range imageStream.Status.Tags {
+		if imagecopy.TagIncluded(includeTags, tag.Tag) {
+			statusTags = append(statusTags, tag)
+		} else {
+			log.Info(fmt.Sprintf("[is-restore] tag %s does not match restore included tags %v, not restoring it", tag.Tag, includeTags))
+		}
+	}
+	imageStream.Spec.Tags = specTags
+	imageStream.Status.Tags = statusTags
+}
+
+// tagImage returns the digest recorded at backup time for the most recent
+// image of tag, or the image of its first status item
+func tagImage(imageStream imagev1API.ImageStream, tag string, annotations map[string]string) string {
+	if digest := annotations[common.BackupImageDigestAnnotationPrefix+tag]; len(digest) > 0 {
+		return digest
+	}
+	for _, statusTag := range imageStream.Status.Tags {
+		if statusTag.Tag == tag && len(statusTag.Items) > 0 {
+			return statusTag.Items[0].Image
+		}
+	}
+	return ""
+}
+
+// registrySecretAuthConfig returns the credentials for registry held by the
+// dockerconfigjson (or dockercfg) Secret named by secretRef, as namespace/name
+func registrySecretAuthConfig(secretRef, registry string) (*types.DockerAuthConfig, error) {
+	refSplit := strings.SplitN(secretRef, "/", 2)
+	if len(refSplit) != 2 || len(refSplit[0]) == 0 || len(refSplit[1]) == 0 {
+		return nil, fmt.Errorf("registry secret %q must be given as namespace/name", secretRef)
+	}
+	client, err := clients.CoreClient()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Secrets(refSplit[0]).Get(refSplit[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading registry secret %s: %v", secretRef, err)
+	}
+	var authConfig *types.DockerAuthConfig
+	if data, found := secret.Data[corev1.DockerConfigJsonKey]; found {
+		authConfig, err = dockerConfigAuth(data, registry, true)
+	} else if data, found := secret.Data[corev1.DockerConfigKey]; found {
+		authConfig, err = dockerConfigAuth(data, registry, false)
+	} else {
+		err = fmt.Errorf("no %s or %s key", corev1.DockerConfigJsonKey, corev1.DockerConfigKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing registry secret %s: %v", secretRef, err)
+	}
+	return authConfig, nil
+}
+
+// dockerConfigEntry is a registry entry of a docker config file
+type dockerConfigEntry struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// dockerConfigAuth returns the credentials for registry in a dockerconfigjson
+// document, or in a legacy dockercfg one if wrapped is false
+func dockerConfigAuth(data []byte, registry string, wrapped bool) (*types.DockerAuthConfig, error) {
+	authConfig, found, err := findDockerConfigAuth(data, registry, wrapped)
+	if err == nil && !found {
+		err = fmt.Errorf("no credentials for registry %s", registry)
+	}
+	return authConfig, err
+}
+
+// findDockerConfigAuth returns the credentials for registry in a docker config
+// document, and whether it has any
+func findDockerConfigAuth(data []byte, registry string, wrapped bool) (*types.DockerAuthConfig, bool, error) {
+	auths := map[string]dockerConfigEntry{}
+	if wrapped {
+		config := struct {
+			Auths map[string]dockerConfigEntry `json:"auths"`
+		}{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, false, err
+		}
+		auths = config.Auths
+	} else if err := json.Unmarshal(data, &auths); err != nil {
+		return nil, false, err
+	}
+	for host, entry := range auths {
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		if strings.SplitN(host, "/", 2)[0] != registry {
+			continue
+		}
+		if len(entry.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid auth for registry %s: %v", registry, err)
+			}
+			authSplit := strings.SplitN(string(decoded), ":", 2)
+			if len(authSplit) != 2 {
+				return nil, false, fmt.Errorf("invalid auth for registry %s", registry)
+			}
+			return &types.DockerAuthConfig{Username: authSplit[0], Password: authSplit[1]}, true, nil
+		}
+		return &types.DockerAuthConfig{Username: entry.Username, Password: entry.Password}, true, nil
+	}
+	return nil, false, nil
+}
+
+// registryAuthFile returns the auth file of one side of the image copies, set by
+// its own environment variable or by REGISTRY_AUTH_FILE
+func registryAuthFile(sideEnvVar string) string {
+	if file := os.Getenv(sideEnvVar); len(file) > 0 {
+		return file
+	}
+	return os.Getenv(RegistryAuthFileEnvVar)
+}
+
+// useRegistryAuthFile points ctx at the auth file of one side of the image
+// copies, replacing the credentials of ctx with those the file holds for
+// registry. It returns whether the file has credentials for registry.
+func useRegistryAuthFile(ctx *types.SystemContext, sideEnvVar, registry string) (bool, error) {
+	file := registryAuthFile(sideEnvVar)
+	if len(file) == 0 {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, fmt.Errorf("error reading registry auth file %s: %v", file, err)
+	}
+	authConfig, found, err := findDockerConfigAuth(data, registry, true)
+	if err != nil {
+		return false, fmt.Errorf("error parsing registry auth file %s: %v", file, err)
+	}
+	ctx.AuthFilePath = file
+	if found {
+		ctx.DockerAuthConfig = authConfig
+	}
+	return found, nil
+}
+
+// useInternalRegistryAuthFile prefers the credentials of the auth file of the
+// internal registry side of the copies over the service account token, and
+// returns the token file still used, if any
+func useInternalRegistryAuthFile(ctx *types.SystemContext, sideEnvVar, registry, tokenFile, prefix string, log logrus.FieldLogger) (string, error) {
+	found, err := useRegistryAuthFile(ctx, sideEnvVar, registry)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		log.Info(fmt.Sprintf("%s using credentials for internal registry %s from auth file %s", prefix, registry, ctx.AuthFilePath))
+		return "", nil
+	}
+	log.Info(fmt.Sprintf("%s using the service account token for internal registry %s", prefix, registry))
+	return tokenFile, nil
+}
@@ -0,0 +1,402 @@
+package imagestream
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	imagev1API "github.com/openshift/api/image/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHistoryDepth(t *testing.T) {
+	backup := &v1.Backup{}
+	assert.Equal(t, defaultHistoryDepth, historyDepth(backup))
+
+	backup.Annotations = map[string]string{common.HistoryDepthAnnotation: "0"}
+	assert.Equal(t, 0, historyDepth(backup))
+
+	backup.Annotations[common.LatestOnlyAnnotation] = "true"
+	assert.Equal(t, 1, historyDepth(backup))
+}
+
+func TestTrimTagHistoryLatestOnly(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{
+				{
+					Tag: "latest",
+					Items: []imagev1API.TagEvent{
+						{Image: "sha256:3"},
+						{Image: "sha256:2"},
+						{Image: "sha256:1"},
+					},
+				},
+				{
+					Tag:   "v1",
+					Items: []imagev1API.TagEvent{{Image: "sha256:1"}},
+				},
+			},
+		},
+	}
+	backup := &v1.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{common.LatestOnlyAnnotation: "true"},
+		},
+	}
+
+	trimTagHistory(&imageStream, historyDepth(backup), test.NewLogger())
+
+	for _, tag := range imageStream.Status.Tags {
+		assert.Len(t, tag.Items, 1)
+	}
+	assert.Equal(t, "sha256:3", imageStream.Status.Tags[0].Items[0].Image)
+}
+
+func TestImageStreamImageReferences(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{
+				{Name: "self", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Name: "app@sha256:1"}},
+				{Name: "base", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Name: "base@sha256:2"}},
+				{Name: "shared", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Namespace: "openshift", Name: "base@sha256:3"}},
+				{Name: "shared-again", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Namespace: "openshift", Name: "base@sha256:4"}},
+				{Name: "latest", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Name: "base:latest"}},
+			},
+		},
+	}
+	references := imageStreamImageReferences(imageStream)
+	assert.Len(t, references, 2)
+	assert.Equal(t, "ns", references[0].Namespace)
+	assert.Equal(t, "base", references[0].Name)
+	assert.Equal(t, "openshift", references[1].Namespace)
+	assert.Equal(t, "base", references[1].Name)
+	assert.Equal(t, "imagestreams", references[1].GroupResource.Resource)
+}
+
+func TestCrossNamespaceReferences(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{
+				{Name: "base", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Namespace: "shared-images", Name: "ubi:8"}},
+				{Name: "base-9", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Namespace: "shared-images", Name: "ubi:9"}},
+				{Name: "pinned", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Namespace: "other", Name: "tools@sha256:1"}},
+				{Name: "local", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Name: "app:latest"}},
+				{Name: "external", From: &corev1.ObjectReference{Kind: "DockerImage", Namespace: "shared-images", Name: "quay.io/ubi:8"}},
+			},
+		},
+	}
+	references := crossNamespaceReferences(imageStream)
+	require.Len(t, references, 2)
+	assert.Equal(t, "shared-images/ubi", references[0].Namespace+"/"+references[0].Name)
+	assert.Equal(t, "other/tools", references[1].Namespace+"/"+references[1].Name)
+	assert.Len(t, referencedImageStreams(imageStream), 2)
+	assert.True(t, common.RestoresNamespace(&v1.Restore{}, "shared-images"))
+	assert.False(t, common.RestoresNamespace(&v1.Restore{Spec: v1.RestoreSpec{IncludedNamespaces: []string{"ns"}}}, "shared-images"))
+	assert.False(t, common.RestoresNamespace(&v1.Restore{Spec: v1.RestoreSpec{ExcludedNamespaces: []string{"shared-images"}}}, "shared-images"))
+}
+
+func TestIsSamplesImageStream(t *testing.T) {
+	assert.True(t, isSamplesImageStream(imagev1API.ImageStream{ObjectMeta: metav1.ObjectMeta{Name: "ruby", Namespace: "openshift"}}))
+	assert.True(t, isSamplesImageStream(imagev1API.ImageStream{ObjectMeta: metav1.ObjectMeta{
+		Name: "ruby", Namespace: "ns", Labels: map[string]string{samplesManagedLabel: "true"}}}))
+	assert.False(t, isSamplesImageStream(imagev1API.ImageStream{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"}}))
+}
+
+func TestPointTagsAtMigrationRegistry(t *testing.T) {
+	backupImageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "ns",
+			Annotations: map[string]string{common.BackupImageDigestAnnotationPrefix + "latest": "sha256:2"},
+		},
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "latest", Items: []imagev1API.TagEvent{{DockerImageReference: "internal/ns/app@sha256:1", Image: "sha256:1"}}},
+				{Tag: "v1", Items: []imagev1API.TagEvent{{DockerImageReference: "internal/ns/app@sha256:3", Image: "sha256:3"}}},
+				{Tag: "external", Items: []imagev1API.TagEvent{{DockerImageReference: "quay.io/org/app@sha256:4", Image: "sha256:4"}}},
+			},
+		},
+	}
+	imageStream := imagev1API.ImageStream{
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{
+				{Name: "v1", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Name: "app@sha256:3"}},
+				{Name: "external", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "quay.io/org/app:latest"}},
+			},
+		},
+	}
+	pointTagsAtMigrationRegistry(&imageStream, backupImageStream, "internal", "migration", "ns/app", []string{}, true, test.NewLogger())
+
+	assert.Len(t, imageStream.Spec.Tags, 3)
+	assert.Equal(t, "migration/ns/app@sha256:3", imageStream.Spec.Tags[0].From.Name)
+	assert.Equal(t, "DockerImage", imageStream.Spec.Tags[0].From.Kind)
+	assert.True(t, imageStream.Spec.Tags[0].ImportPolicy.Insecure)
+	assert.Equal(t, "quay.io/org/app:latest", imageStream.Spec.Tags[1].From.Name)
+	assert.Equal(t, "latest", imageStream.Spec.Tags[2].Name)
+	assert.Equal(t, "migration/ns/app@sha256:2", imageStream.Spec.Tags[2].From.Name)
+}
+
+func TestRewriteImageStreamReferences(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns-a"},
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{
+				{Name: "pinned", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "internal:5000/ns-a/app@sha256:1"}},
+				{Name: "unmapped", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "internal:5000/ns-c/base:latest"}},
+				{Name: "istag", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Namespace: "ns-a", Name: "base:latest"}},
+				{Name: "isimage", From: &corev1.ObjectReference{Kind: "ImageStreamImage", Namespace: "ns-c", Name: "base@sha256:2"}},
+				{Name: "external", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "quay.io/ns-a/app:latest"}},
+			},
+		},
+		Status: imagev1API.ImageStreamStatus{
+			DockerImageRepository: "internal:5000/ns-a/app",
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "pinned", Items: []imagev1API.TagEvent{{DockerImageReference: "internal:5000/ns-a/app@sha256:1"}}},
+			},
+		},
+	}
+	rewriteImageStreamReferences(&imageStream, []string{"internal:5000"}, "target:5000", map[string]string{"ns-a": "ns-b"})
+
+	assert.Equal(t, "target:5000/ns-b/app@sha256:1", imageStream.Spec.Tags[0].From.Name)
+	assert.Equal(t, "target:5000/ns-c/base:latest", imageStream.Spec.Tags[1].From.Name)
+	assert.Equal(t, "ns-b", imageStream.Spec.Tags[2].From.Namespace)
+	assert.Equal(t, "ns-c", imageStream.Spec.Tags[3].From.Namespace)
+	assert.Equal(t, "quay.io/ns-a/app:latest", imageStream.Spec.Tags[4].From.Name)
+	assert.Equal(t, "target:5000/ns-b/app", imageStream.Status.DockerImageRepository)
+	assert.Equal(t, "target:5000/ns-b/app@sha256:1", imageStream.Status.Tags[0].Items[0].DockerImageReference)
+}
+
+func TestRewriteImageStreamReferencesRegistryHostnames(t *testing.T) {
+	backupImageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Status: imagev1API.ImageStreamStatus{
+			DockerImageRepository: "docker-registry.default.svc:5000/ns/app",
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "latest", Items: []imagev1API.TagEvent{
+					{DockerImageReference: "docker-registry.default.svc:5000/ns/app@sha256:1"},
+					{DockerImageReference: "172.30.1.1:5000/ns/app@sha256:2"},
+				}},
+			},
+		},
+	}
+	registries := backupInternalRegistries("172.30.1.1:5000", backupImageStream)
+	assert.Equal(t, []string{"172.30.1.1:5000", "docker-registry.default.svc:5000"}, registries)
+
+	rewriteImageStreamReferences(&backupImageStream, registries, "image-registry.openshift-image-registry.svc:5000", nil)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/ns/app", backupImageStream.Status.DockerImageRepository)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/ns/app@sha256:1", backupImageStream.Status.Tags[0].Items[0].DockerImageReference)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/ns/app@sha256:2", backupImageStream.Status.Tags[0].Items[1].DockerImageReference)
+}
+
+func TestMissingStatusTags(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "latest", Items: []imagev1API.TagEvent{{Image: "sha256:1"}}},
+				{Tag: "v1"},
+			},
+		},
+	}
+	assert.Equal(t, []string{"v1", "v2"}, missingStatusTags(imageStream, []string{"latest", "v1", "v2"}))
+	assert.Empty(t, missingStatusTags(imageStream, []string{"latest"}))
+}
+
+func TestFilterTags(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{{Name: "latest"}, {Name: "pr-1"}},
+		},
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{{Tag: "latest"}, {Tag: "v1"}, {Tag: "pr-1"}},
+		},
+	}
+	filterTags(&imageStream, []string{"latest", "v*"}, test.NewLogger())
+	assert.Equal(t, []imagev1API.TagReference{{Name: "latest"}}, imageStream.Spec.Tags)
+	assert.Equal(t, []imagev1API.NamedTagEventList{{Tag: "latest"}, {Tag: "v1"}}, imageStream.Status.Tags)
+}
+
+func TestTagImage(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{{Name: "latest"}, {Name: "old"}},
+		},
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "latest"},
+				{Tag: "old", Items: []imagev1API.TagEvent{{Image: "sha256:1"}}},
+			},
+		},
+	}
+	assert.Equal(t, "sha256:1", tagImage(imageStream, "old", map[string]string{}))
+	assert.Equal(t, "sha256:2", tagImage(imageStream, "old", map[string]string{"openshift.io/backup-image-digest.old": "sha256:2"}))
+}
+
+func TestPruneRegistryReferences(t *testing.T) {
+	imageStream := imagev1API.ImageStream{
+		Spec: imagev1API.ImageStreamSpec{
+			Tags: []imagev1API.TagReference{
+				{Name: "latest", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "target/ns/app@sha256:1"}},
+				{Name: "old", From: &corev1.ObjectReference{Kind: "DockerImage", Name: "migration/ns/app@sha256:2"}},
+				{Name: "base", From: &corev1.ObjectReference{Kind: "ImageStreamTag", Name: "base:latest"}},
+			},
+		},
+	}
+	pruneRegistryReferences(&imageStream, []string{"migration", ""}, test.NewLogger())
+	require.Len(t, imageStream.Spec.Tags, 2)
+	assert.Equal(t, "latest", imageStream.Spec.Tags[0].Name)
+	assert.Equal(t, "base", imageStream.Spec.Tags[1].Name)
+}
+
+func TestRestoreKeepsTagFields(t *testing.T) {
+	tagRef := func(from string) imagev1API.TagReference {
+		return imagev1API.TagReference{
+			Name:        "latest",
+			Annotations: map[string]string{"ci.example.com/version": "1.2.3"},
+			From:        &corev1.ObjectReference{Kind: "DockerImage", Name: from},
+			Reference:   true,
+			ImportPolicy: imagev1API.TagImportPolicy{
+				Scheduled: true,
+				Insecure:  true,
+			},
+			ReferencePolicy: imagev1API.TagReferencePolicy{Type: imagev1API.LocalTagReferencePolicy},
+		}
+	}
+	imageStream := imagev1API.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		Spec:       imagev1API.ImageStreamSpec{Tags: []imagev1API.TagReference{tagRef("internal/ns/app@sha256:1")}},
+		Status: imagev1API.ImageStreamStatus{
+			Tags: []imagev1API.NamedTagEventList{
+				{Tag: "latest", Items: []imagev1API.TagEvent{{DockerImageReference: "internal/ns/app@sha256:1", Image: "sha256:1"}}},
+			},
+		},
+	}
+
+	rewritten := *imageStream.DeepCopy()
+	rewriteImageStreamReferences(&rewritten, []string{"internal"}, "target", nil)
+	assert.Equal(t, tagRef("target/ns/app@sha256:1"), rewritten.Spec.Tags[0])
+
+	pointed := *imageStream.DeepCopy()
+	pointTagsAtMigrationRegistry(&pointed, imageStream, "internal", "migration", "ns/app", []string{}, false, test.NewLogger())
+	assert.Equal(t, tagRef("migration/ns/app@sha256:1"), pointed.Spec.Tags[0])
+}
+
+func TestCertDirForBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "corporate.pem")
+	require.NoError(t, ioutil.WriteFile(bundle, []byte("-----BEGIN CERTIFICATE-----\n"), 0644))
+
+	certDir, err := certDirForBundle(bundle)
+	require.NoError(t, err)
+	defer os.RemoveAll(certDir)
+	data, err := ioutil.ReadFile(filepath.Join(certDir, "ca.crt"))
+	require.NoError(t, err)
+	assert.Equal(t, "-----BEGIN CERTIFICATE-----\n", string(data))
+
+	certDir, err = certDirForBundle(dir)
+	require.NoError(t, err)
+	assert.Equal(t, dir, certDir)
+
+	_, err = certDirForBundle(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestDockerConfigAuth(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("builder:s3cr3t:x"))
+	data := []byte(`{"auths":{"https://quay.io/v1/":{"auth":"` + auth + `"},"registry.example.com:5000":{"username":"pusher","password":"p"}}}`)
+
+	authConfig, err := dockerConfigAuth(data, "quay.io", true)
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "builder", Password: "s3cr3t:x"}, authConfig)
+
+	authConfig, err = dockerConfigAuth(data, "registry.example.com:5000", true)
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "pusher", Password: "p"}, authConfig)
+
+	_, err = dockerConfigAuth(data, "image-registry.openshift-image-registry.svc:5000", true)
+	assert.Error(t, err)
+
+	authConfig, err = dockerConfigAuth([]byte(`{"quay.io":{"auth":"`+auth+`"}}`), "quay.io", false)
+	require.NoError(t, err)
+	assert.Equal(t, "builder", authConfig.Username)
+}
+
+func TestBlobInfoCacheDir(t *testing.T) {
+	defer os.Unsetenv(BlobInfoCacheDirEnvVar)
+	os.Unsetenv(BlobInfoCacheDirEnvVar)
+	assert.Equal(t, filepath.Join(os.TempDir(), "openshift-velero-plugin", "blob-info-cache"), blobInfoCacheDir())
+	os.Setenv(BlobInfoCacheDirEnvVar, "/cache")
+	assert.Equal(t, "/cache", blobInfoCacheDir())
+}
+
+func TestUseRegistryAuthFile(t *testing.T) {
+	defer os.Unsetenv(RegistryAuthFileEnvVar)
+	defer os.Unsetenv(SourceRegistryAuthFileEnvVar)
+	os.Unsetenv(SourceRegistryAuthFileEnvVar)
+	os.Unsetenv(RegistryAuthFileEnvVar)
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	authFile := filepath.Join(dir, "auth.json")
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`{"auths":{"quay.io":{"username":"pusher","password":"p"}}}`), 0600))
+
+	ctx := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "ignored", Password: "token"}}
+	found, err := useRegistryAuthFile(ctx, SourceRegistryAuthFileEnvVar, "quay.io")
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Empty(t, ctx.AuthFilePath)
+
+	os.Setenv(RegistryAuthFileEnvVar, authFile)
+	tokenFile, err := useInternalRegistryAuthFile(ctx, SourceRegistryAuthFileEnvVar, "image-registry.openshift-image-registry.svc:5000",
+		"/token", "[test]", test.NewLogger())
+	require.NoError(t, err)
+	assert.Equal(t, "/token", tokenFile)
+	assert.Equal(t, "token", ctx.DockerAuthConfig.Password)
+	assert.Equal(t, authFile, ctx.AuthFilePath)
+
+	tokenFile, err = useInternalRegistryAuthFile(ctx, SourceRegistryAuthFileEnvVar, "quay.io", "/token", "[test]", test.NewLogger())
+	require.NoError(t, err)
+	assert.Empty(t, tokenFile)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "pusher", Password: "p"}, ctx.DockerAuthConfig)
+
+	os.Setenv(SourceRegistryAuthFileEnvVar, filepath.Join(dir, "missing.json"))
+	_, err = useRegistryAuthFile(ctx, SourceRegistryAuthFileEnvVar, "quay.io")
+	assert.Error(t, err)
+}
+
+func TestInsecureRegistry(t *testing.T) {
+	defer os.Unsetenv(InsecureSourceRegistryEnvVar)
+	defer os.Unsetenv(imagecopy.InsecureRegistriesEnvVar)
+	os.Unsetenv(InsecureSourceRegistryEnvVar)
+	os.Unsetenv(imagecopy.InsecureRegistriesEnvVar)
+	assert.True(t, insecureRegistry(InsecureSourceRegistryEnvVar, "registry.example.com"))
+	os.Setenv(imagecopy.InsecureRegistriesEnvVar, "legacy.example.com")
+	assert.False(t, insecureRegistry(InsecureSourceRegistryEnvVar, "registry.example.com"))
+	assert.True(t, insecureRegistry(InsecureSourceRegistryEnvVar, "legacy.example.com"))
+	os.Setenv(InsecureSourceRegistryEnvVar, "true")
+	assert.True(t, insecureRegistry(InsecureSourceRegistryEnvVar, "registry.example.com"))
+}
+
+func TestCopiedImages(t *testing.T) {
+	assert.Nil(t, copiedImages(nil, "backup"))
+	records := map[string]*imagecopy.CopiedImages{}
+	copied := copiedImages(records, "backup")
+	assert.NotNil(t, copied)
+	assert.True(t, copied == copiedImages(records, "backup"))
+	assert.False(t, copied == copiedImages(records, "other"))
+}
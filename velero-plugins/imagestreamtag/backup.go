@@ -13,6 +13,7 @@ import (
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 )
 
@@ -46,6 +47,7 @@ func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (ru
 	if _, found := annotations[common.RelatedIsTagNsAnnotation]; found {
 		delete(annotations, common.RelatedIsTagNsAnnotation)
 	}
+	delete(annotations, common.BuildOutputTagAnnotation)
 	p.Log.Info(fmt.Sprintf("[istag-backup] Backing up imagestreamtag %s", imageStreamTag.Name))
 
 	referenceTag := imageStreamTag.Tag != nil && imageStreamTag.Tag.From != nil
@@ -83,10 +85,68 @@ func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (ru
 			}
 		}
 	}
+	if p.isBuildOutput(imageStreamTag) {
+		p.Log.Info(fmt.Sprintf("[istag-backup] imagestreamtag %s is the output of a buildconfig", imageStreamTag.Name))
+		annotations[common.BuildOutputTagAnnotation] = "true"
+	}
+
+	// back up the imagestream referenced in another namespace, so the reference
+	// resolves once restored
+	var additionalItems []velero.ResourceIdentifier
+	if referenceTag && len(imageStreamTag.Tag.From.Namespace) > 0 && imageStreamTag.Tag.From.Namespace != imageStreamTag.Namespace {
+		var streamName string
+		switch imageStreamTag.Tag.From.Kind {
+		case "ImageStreamTag":
+			streamName = strings.Split(imageStreamTag.Tag.From.Name, ":")[0]
+		case "ImageStreamImage":
+			streamName = strings.Split(imageStreamTag.Tag.From.Name, "@")[0]
+		}
+		if len(streamName) > 0 && common.BacksUpNamespace(backup, imageStreamTag.Tag.From.Namespace) {
+			p.Log.Info(fmt.Sprintf("[istag-backup] Adding referenced imagestream %s/%s as additional item", imageStreamTag.Tag.From.Namespace, streamName))
+			additionalItems = append(additionalItems, velero.ResourceIdentifier{
+				GroupResource: schema.GroupResource{
+					Group:    "image.openshift.io",
+					Resource: "imagestreams",
+				},
+				Namespace: imageStreamTag.Tag.From.Namespace,
+				Name:      streamName,
+			})
+		} else if len(streamName) > 0 {
+			p.Log.Warnf("[istag-backup] imagestreamtag %s references imagestream %s/%s, which is not backed up since its namespace is excluded",
+				imageStreamTag.Name, imageStreamTag.Tag.From.Namespace, streamName)
+		}
+	}
+
 	imageStreamTag.Annotations = annotations
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(imageStreamTag)
 	json.Unmarshal(objrec, &out)
 	item.SetUnstructuredContent(out)
-	return item, nil, nil
+	return item, additionalItems, nil
+}
+
+// isBuildOutput returns true if a BuildConfig of the namespace pushes its output
+// to the tag, and the tag doesn't reference another imagestream
+func (p *BackupPlugin) isBuildOutput(imageStreamTag imagev1API.ImageStreamTag) bool {
+	if imageStreamTag.Tag != nil && imageStreamTag.Tag.From != nil && imageStreamTag.Tag.From.Kind != "DockerImage" {
+		return false
+	}
+	client, err := clients.BuildClient()
+	if err != nil {
+		p.Log.Warnf("[istag-backup] can't look up buildconfigs: %v", err)
+		return false
+	}
+	buildConfigs, err := client.BuildConfigs(imageStreamTag.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		p.Log.Warnf("[istag-backup] can't look up buildconfigs of namespace %s: %v", imageStreamTag.Namespace, err)
+		return false
+	}
+	for _, buildConfig := range buildConfigs.Items {
+		to := buildConfig.Spec.Output.To
+		if to != nil && to.Kind == "ImageStreamTag" && to.Name == imageStreamTag.Name &&
+			(to.Namespace == "" || to.Namespace == imageStreamTag.Namespace) {
+			return true
+		}
+	}
+	return false
 }
@@ -3,15 +3,24 @@ package imagestreamtag
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
 	imagev1API "github.com/openshift/api/image/v1"
+	imagev1client "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+const parentStreamWaitTimeout = 30 * time.Second
+
 // RestorePlugin is a restore item action plugin for Velero
 type RestorePlugin struct {
 	Log logrus.FieldLogger
@@ -36,6 +45,17 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 
 	p.Log.Info(fmt.Sprintf("[istag-restore] Restoring imagestreamtag %s", imageStreamTag.Name))
 
+	if nameSplit := strings.SplitN(imageStreamTag.Name, ":", 2); len(nameSplit) == 2 &&
+		!imagecopy.TagIncluded(imagecopy.ParseIncludeTags(input.Restore.Annotations[common.RestoreIncludeTagsAnnotation]), nameSplit[1]) {
+		p.Log.Info(fmt.Sprintf("[istag-restore] Tag does not match restore included tags, not restoring imagestreamtag %s", imageStreamTag.Name))
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	if annotations[common.BuildOutputTagAnnotation] == "true" && input.Restore.Annotations[common.RestoreBuildOutputTagsAnnotation] != "true" {
+		p.Log.Info(fmt.Sprintf("[istag-restore] imagestreamtag %s is the output of a buildconfig, leaving it to the first build", imageStreamTag.Name))
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
 	backupInternalRegistry := annotations[common.BackupRegistryHostname]
 	p.Log.Info(fmt.Sprintf("[istag-restore] backup internal registry: %#v", backupInternalRegistry))
 	dockerImageReference := imageStreamTag.Image.DockerImageReference
@@ -43,6 +63,12 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	if localImage {
 		p.Log.Info(fmt.Sprintf("[istag-restore] Local image: %v", dockerImageReference))
 	}
+	if imageStreamTag.Tag == nil {
+		// status-only tags, from pushes or imported history, can't be created
+		// without a spec tag, and come back with the images of their imagestream
+		p.Log.Info(fmt.Sprintf("[istag-restore] imagestreamtag %s has no spec tag, restored with its imagestream", imageStreamTag.Name))
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
 	var additionalItems []velero.ResourceIdentifier
 	if len(annotations[common.RelatedIsTagAnnotation]) > 0 && len(annotations[common.RelatedIsTagNsAnnotation]) > 0 {
 		p.Log.Info(fmt.Sprintf("[istag-restore] Setting additionalItems: %v/%v", annotations[common.RelatedIsTagNsAnnotation], annotations[common.RelatedIsTagAnnotation]))
@@ -61,16 +87,48 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	if referenceTag {
 		p.Log.Info(fmt.Sprintf("[istag-restore] Reference tag: %v, tag: %v", imageStreamTag.Tag.From.Kind, imageStreamTag.Tag.From.Name))
 
-		// Removing annotations from the tag, to prevent mismatch
+		// Removing annotations from the tag, to prevent mismatch. The tag
+		// annotations are kept on the object, from which the tag gets them.
+		for key, value := range imageStreamTag.Tag.Annotations {
+			if _, found := annotations[key]; !found {
+				annotations[key] = value
+			}
+		}
+		imageStreamTag.Annotations = annotations
 		imageStreamTag.Tag.Annotations = nil
 		namespaceMapping := input.Restore.Spec.NamespaceMapping
+		p.checkCrossNamespaceReference(input, imageStreamTag)
 		if imageStreamTag.Tag.From.Kind == "ImageStreamTag" {
 			p.Log.Info("[istag-restore] ImageStreamTag reference")
 			if imageStreamTag.Tag.From.Namespace != "" && namespaceMapping[imageStreamTag.Tag.From.Namespace] != "" {
 				imageStreamTag.Tag.From.Namespace = namespaceMapping[imageStreamTag.Tag.From.Namespace]
 			}
+		} else if imageStreamTag.Tag.From.Kind == "DockerImage" {
+			p.Log.Info("[istag-restore] DockerImage reference")
+			internalRegistry, err := p.restoreRegistry(input)
+			if err != nil {
+				return nil, err
+			}
+			// references to the backup cluster registry, or to the migration registry
+			// during a staged migration, point at the registry of this cluster instead
+			for _, registry := range []string{backupInternalRegistry, annotations[common.MigrationRegistry]} {
+				if len(registry) > 0 && common.HasImageRefPrefix(imageStreamTag.Tag.From.Name, registry) {
+					newRef, err := common.ReplaceImageRefPrefix(imageStreamTag.Tag.From.Name, registry, internalRegistry, namespaceMapping)
+					if err != nil {
+						return nil, err
+					}
+					p.Log.Info(fmt.Sprintf("[istag-restore] rewriting %s to %s", imageStreamTag.Tag.From.Name, newRef))
+					imageStreamTag.Tag.From.Name = newRef
+					break
+				}
+			}
 		} else if imageStreamTag.Tag.From.Kind == "ImageStreamImage" {
-			if imageStreamTag.Tag.From.Namespace == "" || imageStreamTag.Tag.From.Namespace == imageStreamTag.Namespace {
+			// Images of the same stream are recreated by the image import, but a tag
+			// pinned to another stream must be restored to keep pointing at it
+			streamName := strings.Split(imageStreamTag.Name, ":")[0]
+			fromStreamName := strings.Split(imageStreamTag.Tag.From.Name, "@")[0]
+			if (imageStreamTag.Tag.From.Namespace == "" || imageStreamTag.Tag.From.Namespace == imageStreamTag.Namespace) &&
+				fromStreamName == streamName {
 				referenceTag = false
 			}
 			if imageStreamTag.Tag.From.Namespace != "" && namespaceMapping[imageStreamTag.Tag.From.Namespace] != "" {
@@ -82,6 +140,11 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	// Restore the tag if this is a reference tag *or* an external image. Otherwise,
 	// image import will create the imagestreamtag automatically.
 	if referenceTag || !localImage {
+		namespace := common.MappedNamespace(input.Restore, imageStreamTag.Namespace)
+		if client, err := clients.ImageClient(); err == nil && p.updateExistingTag(client, namespace, imageStreamTag) {
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		p.waitForParentStream(namespace, strings.Split(imageStreamTag.Name, ":")[0], parentStreamWaitTimeout)
 		var out map[string]interface{}
 		objrec, _ := json.Marshal(imageStreamTag)
 		json.Unmarshal(objrec, &out)
@@ -96,3 +159,98 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	p.Log.Info("[istag-restore] Not restoring local imagestreamtag")
 	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
 }
+
+// restoreRegistry returns the internal registry hostname of this cluster
+func (p *RestorePlugin) restoreRegistry(input *velero.RestoreItemActionExecuteInput) (string, error) {
+	_, internalRegistry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	if err != nil || len(internalRegistry) > 0 {
+		return internalRegistry, err
+	}
+	major, minor, err := common.GetServerVersion()
+	if err != nil {
+		return "", err
+	}
+	return common.GetRegistryInfo(major, minor, p.Log)
+}
+
+// updateExistingTag returns true if the imagestreamtag is already present in
+// namespace, the namespace it is restored to, e.g. created by the restore of an
+// imagestream carrying the tag in its spec or by an earlier restore, after
+// updating its reference to the restored one
+func (p *RestorePlugin) updateExistingTag(client imagev1client.ImageStreamTagsGetter, namespace string, imageStreamTag imagev1API.ImageStreamTag) bool {
+	existing, err := client.ImageStreamTags(namespace).Get(imageStreamTag.Name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	if imageStreamTag.Tag == nil || existing.Tag != nil && reflect.DeepEqual(existing.Tag.From, imageStreamTag.Tag.From) &&
+		existing.Tag.ReferencePolicy == imageStreamTag.Tag.ReferencePolicy && existing.Tag.ImportPolicy == imageStreamTag.Tag.ImportPolicy {
+		p.Log.Info(fmt.Sprintf("[istag-restore] imagestreamtag %s already exists, skipping", imageStreamTag.Name))
+		return true
+	}
+	if existing.Tag == nil {
+		existing.Tag = &imagev1API.TagReference{Name: imageStreamTag.Tag.Name}
+	}
+	existing.Tag.From = imageStreamTag.Tag.From
+	existing.Tag.ReferencePolicy = imageStreamTag.Tag.ReferencePolicy
+	existing.Tag.ImportPolicy = imageStreamTag.Tag.ImportPolicy
+	if _, err := client.ImageStreamTags(namespace).Update(existing); err != nil {
+		p.Log.Warnf("[istag-restore] imagestreamtag %s already exists and can't be updated: %v", imageStreamTag.Name, err)
+		return true
+	}
+	p.Log.Info(fmt.Sprintf("[istag-restore] updated the reference and policies of existing imagestreamtag %s", imageStreamTag.Name))
+	return true
+}
+
+// waitForParentStream polls until the imagestream of the tag exists in
+// namespace, the namespace it is restored to, since creating the tag fails with
+// NotFound otherwise. On timeout a warning is logged and the tag restored
+// anyway, as the imagestream may still be created later.
+func (p *RestorePlugin) waitForParentStream(namespace, name string, timeout time.Duration) {
+	client, err := clients.ImageClient()
+	if err != nil {
+		p.Log.Warnf("[istag-restore] not waiting for imagestream %s/%s: %v", namespace, name, err)
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := client.ImageStreams(namespace).Get(name, metav1.GetOptions{})
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			p.Log.Warnf("[istag-restore] timed out after %v waiting for imagestream %s/%s: %v", timeout, namespace, name, err)
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// checkCrossNamespaceReference warns if the reference tag points at an imagestream
+// of another namespace, which is neither part of the restore nor present on this cluster
+func (p *RestorePlugin) checkCrossNamespaceReference(input *velero.RestoreItemActionExecuteInput, imageStreamTag imagev1API.ImageStreamTag) {
+	from := imageStreamTag.Tag.From
+	if len(from.Namespace) == 0 || from.Namespace == imageStreamTag.Namespace || common.RestoresNamespace(input.Restore, from.Namespace) {
+		return
+	}
+	var streamName string
+	switch from.Kind {
+	case "ImageStreamTag":
+		streamName = strings.Split(from.Name, ":")[0]
+	case "ImageStreamImage":
+		streamName = strings.Split(from.Name, "@")[0]
+	default:
+		return
+	}
+	namespace := from.Namespace
+	if mapped := input.Restore.Spec.NamespaceMapping[namespace]; len(mapped) > 0 {
+		namespace = mapped
+	}
+	client, err := clients.ImageClient()
+	if err == nil {
+		_, err = client.ImageStreams(namespace).Get(streamName, metav1.GetOptions{})
+	}
+	if err != nil {
+		p.Log.Warnf("[istag-restore] imagestreamtag %s references %s %s/%s, which is not part of the restore and can't be found: %v",
+			imageStreamTag.Name, from.Kind, namespace, from.Name, err)
+	}
+}
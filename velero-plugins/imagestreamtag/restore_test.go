@@ -0,0 +1,127 @@
+package imagestreamtag
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	imagev1API "github.com/openshift/api/image/v1"
+	imagev1client "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"imagestreamtags"}}, actual)
+}
+
+func TestRestorePluginStatusOnlyTag(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/status-only-istag.json")
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+}
+
+func TestRestorePluginKeepsTagPolicies(t *testing.T) {
+	imageStreamTag := imagev1API.ImageStreamTag{
+		TypeMeta: metav1.TypeMeta{APIVersion: "image.openshift.io/v1", Kind: "ImageStreamTag"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app:latest",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				common.BackupRegistryHostname:  "docker-registry.default.svc:5000",
+				common.RestoreRegistryHostname: "image-registry.openshift-image-registry.svc:5000",
+			},
+		},
+		Tag: &imagev1API.TagReference{
+			Name: "latest",
+			From: &corev1API.ObjectReference{Kind: "DockerImage", Name: "docker-registry.default.svc:5000/ns/app@sha256:1"},
+			ImportPolicy: imagev1API.TagImportPolicy{
+				Insecure:  true,
+				Scheduled: true,
+			},
+			ReferencePolicy: imagev1API.TagReferencePolicy{Type: imagev1API.LocalTagReferencePolicy},
+		},
+	}
+	data, err := json.Marshal(imageStreamTag)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+	require.NoError(t, err)
+	require.False(t, output.SkipRestore)
+
+	restored := imagev1API.ImageStreamTag{}
+	data, err = json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/ns/app@sha256:1", restored.Tag.From.Name)
+	assert.Equal(t, imageStreamTag.Tag.ImportPolicy, restored.Tag.ImportPolicy)
+	assert.Equal(t, imageStreamTag.Tag.ReferencePolicy, restored.Tag.ReferencePolicy)
+}
+
+// fakeImageStreamTags serves the imagestreamtags of namespaces
+type fakeImageStreamTags struct {
+	imagev1client.ImageStreamTagInterface
+	namespace string
+	tags      map[string]map[string]*imagev1API.ImageStreamTag
+}
+
+func (f *fakeImageStreamTags) ImageStreamTags(namespace string) imagev1client.ImageStreamTagInterface {
+	return &fakeImageStreamTags{ImageStreamTagInterface: f.ImageStreamTagInterface, namespace: namespace, tags: f.tags}
+}
+
+func (f *fakeImageStreamTags) Get(name string, options metav1.GetOptions) (*imagev1API.ImageStreamTag, error) {
+	if tag, found := f.tags[f.namespace][name]; found {
+		return tag.DeepCopy(), nil
+	}
+	return nil, k8serrors.NewNotFound(imagev1API.Resource("imagestreamtags"), name)
+}
+
+func (f *fakeImageStreamTags) Update(tag *imagev1API.ImageStreamTag) (*imagev1API.ImageStreamTag, error) {
+	f.tags[f.namespace][tag.Name] = tag
+	return tag, nil
+}
+
+func TestUpdateExistingTagMappedNamespace(t *testing.T) {
+	existing := func(namespace, from string) *imagev1API.ImageStreamTag {
+		return &imagev1API.ImageStreamTag{
+			ObjectMeta: metav1.ObjectMeta{Name: "app:latest", Namespace: namespace},
+			Tag:        &imagev1API.TagReference{Name: "latest", From: &corev1API.ObjectReference{Kind: "DockerImage", Name: from}},
+		}
+	}
+	client := &fakeImageStreamTags{tags: map[string]map[string]*imagev1API.ImageStreamTag{
+		"ns":     {"app:latest": existing("ns", "quay.io/ns/app:v1")},
+		"new-ns": {},
+	}}
+	restored := *existing("ns", "quay.io/ns/app:v2")
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}}}
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+
+	// the tag of the backup namespace is left alone, the one of the mapped namespace is restored
+	assert.False(t, restorePlugin.updateExistingTag(client, common.MappedNamespace(restore, restored.Namespace), restored))
+	assert.Equal(t, "quay.io/ns/app:v1", client.tags["ns"]["app:latest"].Tag.From.Name)
+
+	client.tags["new-ns"]["app:latest"] = existing("new-ns", "quay.io/ns/app:v1")
+	assert.True(t, restorePlugin.updateExistingTag(client, common.MappedNamespace(restore, restored.Namespace), restored))
+	assert.Equal(t, "quay.io/ns/app:v2", client.tags["new-ns"]["app:latest"].Tag.From.Name)
+	assert.Equal(t, "quay.io/ns/app:v1", client.tags["ns"]["app:latest"].Tag.From.Name)
+}
@@ -0,0 +1,68 @@
+package imagetag
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	imagev1API "github.com/openshift/api/image/v1"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// BackupPlugin is a backup item action plugin for Velero
+type BackupPlugin struct {
+	Log logrus.FieldLogger
+}
+
+// AppliesTo returns a velero.ResourceSelector that applies to imagetags
+func (p *BackupPlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"imagetags"},
+	}, nil
+}
+
+// Execute backs up the imagestream an imagetag references in another
+// namespace, so the reference resolves once restored
+func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.Log.Info("[imagetag-backup] Entering ImageTag backup plugin")
+	imageTag := imagev1API.ImageTag{}
+	itemMarshal, _ := json.Marshal(item)
+	json.Unmarshal(itemMarshal, &imageTag)
+
+	if imageTag.Spec == nil || imageTag.Spec.From == nil {
+		return item, nil, nil
+	}
+	from := imageTag.Spec.From
+	if len(from.Namespace) == 0 || from.Namespace == imageTag.Namespace {
+		return item, nil, nil
+	}
+	var streamName string
+	switch from.Kind {
+	case "ImageStreamTag":
+		streamName = strings.Split(from.Name, ":")[0]
+	case "ImageStreamImage":
+		streamName = strings.Split(from.Name, "@")[0]
+	}
+	if len(streamName) == 0 {
+		return item, nil, nil
+	}
+	if !common.BacksUpNamespace(backup, from.Namespace) {
+		p.Log.Warnf("[imagetag-backup] imagetag %s references imagestream %s/%s, which is not backed up since its namespace is excluded",
+			imageTag.Name, from.Namespace, streamName)
+		return item, nil, nil
+	}
+	p.Log.Info(fmt.Sprintf("[imagetag-backup] Adding referenced imagestream %s/%s as additional item", from.Namespace, streamName))
+	return item, []velero.ResourceIdentifier{{
+		GroupResource: schema.GroupResource{
+			Group:    "image.openshift.io",
+			Resource: "imagestreams",
+		},
+		Namespace: from.Namespace,
+		Name:      streamName,
+	}}, nil
+}
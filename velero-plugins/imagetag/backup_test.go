@@ -0,0 +1,39 @@
+package imagetag
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestBackupPluginAddsReferencedImageStream(t *testing.T) {
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+	item := imageTagItem(map[string]interface{}{"kind": "ImageStreamTag", "name": "base:latest", "namespace": "shared"})
+	_, additionalItems, err := backupPlugin.Execute(item, &v1.Backup{})
+	require.NoError(t, err)
+	assert.Equal(t, []velero.ResourceIdentifier{{
+		GroupResource: schema.GroupResource{Group: "image.openshift.io", Resource: "imagestreams"},
+		Namespace:     "shared",
+		Name:          "base",
+	}}, additionalItems)
+
+	// the imagestream of an excluded namespace isn't backed up
+	_, additionalItems, err = backupPlugin.Execute(item, &v1.Backup{Spec: v1.BackupSpec{ExcludedNamespaces: []string{"shared"}}})
+	require.NoError(t, err)
+	assert.Empty(t, additionalItems)
+
+	// nor is the one of its own namespace or a registry image
+	for _, from := range []map[string]interface{}{
+		{"kind": "ImageStreamImage", "name": "base@sha256:" + digest, "namespace": "ns"},
+		{"kind": "DockerImage", "name": "quay.io/shared/base:latest"},
+	} {
+		_, additionalItems, err = backupPlugin.Execute(imageTagItem(from), &v1.Backup{})
+		require.NoError(t, err)
+		assert.Empty(t, additionalItems)
+	}
+}
@@ -1,8 +1,15 @@
 package imagetag
 
 import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	imagev1API "github.com/openshift/api/image/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // RestorePlugin is a restore item action plugin for Velero
@@ -10,16 +17,86 @@ type RestorePlugin struct {
 	Log logrus.FieldLogger
 }
 
-// AppliesTo returns a velero.ResourceSelector that applies to secrets
+// AppliesTo returns a velero.ResourceSelector that applies to imagetags
 func (p *RestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 	return velero.ResourceSelector{
 		IncludedResources: []string{"imagetags"},
 	}, nil
 }
 
-// Execute action for the restore plugin for the secret resource
+// Execute action for the restore plugin for the imagetag resource
 func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	p.Log.Info("[imagetag-restore] Entering ImageTag restore plugin")
+	imageTag := imagev1API.ImageTag{}
+	itemMarshal, _ := json.Marshal(input.Item)
+	json.Unmarshal(itemMarshal, &imageTag)
+
+	// ImageTags are a view of the tags of an imagestream, which the imagestream
+	// and imagestreamtag plugins restore
+	if common.RestoresResource(input.Restore, "imagestreams") || common.RestoresResource(input.Restore, "imagestreamtags") {
+		p.Log.Infof("[imagetag-restore] skipping restore of imagetag %s, restored with its imagestream", imageTag.Name)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+	if imageTag.Spec == nil {
+		p.Log.Infof("[imagetag-restore] skipping restore of imagetag %s without spec tag", imageTag.Name)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+	namespace := common.MappedNamespace(input.Restore, imageTag.Namespace)
+	if p.tagExists(namespace, imageTag.Name) {
+		p.Log.Infof("[imagetag-restore] imagetag %s already exists in namespace %s, skipping", imageTag.Name, namespace)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	backupInternalRegistry, internalRegistry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if len(internalRegistry) == 0 {
+		major, minor, err := common.GetServerVersion()
+		if err != nil {
+			return nil, err
+		}
+		internalRegistry, err = common.GetRegistryInfo(major, minor, p.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	namespaceMapping := input.Restore.Spec.NamespaceMapping
+	if from := imageTag.Spec.From; from != nil {
+		switch from.Kind {
+		case "DockerImage":
+			if len(backupInternalRegistry) > 0 && common.HasImageRefPrefix(from.Name, backupInternalRegistry) {
+				newRef, err := common.ReplaceImageRefPrefix(from.Name, backupInternalRegistry, internalRegistry, namespaceMapping)
+				if err != nil {
+					return nil, err
+				}
+				p.Log.Info(fmt.Sprintf("[imagetag-restore] rewriting %s to %s", from.Name, newRef))
+				from.Name = newRef
+			}
+		case "ImageStreamTag", "ImageStreamImage":
+			if mapped := namespaceMapping[from.Namespace]; len(from.Namespace) > 0 && len(mapped) > 0 {
+				from.Namespace = mapped
+			}
+		}
+	}
+	// only the spec can be set on create, the status follows from the import
+	imageTag.Status = nil
+	imageTag.Image = nil
 
-	p.Log.Infof("[imagetag-restore] skipping restore of imagetag")
-	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
-}
\ No newline at end of file
+	var out map[string]interface{}
+	objrec, _ := json.Marshal(imageTag)
+	json.Unmarshal(objrec, &out)
+	input.Item.SetUnstructuredContent(out)
+	p.Log.Infof("[imagetag-restore] Restoring imagetag %s", imageTag.Name)
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
+
+// tagExists returns true if the imagetag is already present on this cluster
+func (p *RestorePlugin) tagExists(namespace, name string) bool {
+	client, err := clients.ImageClient()
+	if err != nil {
+		return false
+	}
+	_, err = client.ImageTags(namespace).Get(name, metav1.GetOptions{})
+	return err == nil
+}
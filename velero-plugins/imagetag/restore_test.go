@@ -0,0 +1,108 @@
+package imagetag
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const digest = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"imagetags"}}, actual)
+}
+
+func TestRestorePluginSkipsImageTagsOfRestoredStreams(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "image.openshift.io/v1",
+		"kind":       "ImageTag",
+		"metadata":   map[string]interface{}{"name": "app:latest", "namespace": "ns"},
+		"spec":       map[string]interface{}{"name": "latest"},
+	}}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+
+	// imagetags without spec tag are restored by the image copy of their imagestream
+	delete(item.Object, "spec")
+	imageTagsOnly := &v1.Restore{Spec: v1.RestoreSpec{IncludedResources: []string{"imagetags.image.openshift.io"}}}
+	output, err = restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: imageTagsOnly})
+	require.NoError(t, err)
+	assert.True(t, output.SkipRestore)
+}
+
+// imageTagOnlyRestore returns an imagetags only restore mapping namespace ns to new-ns
+func imageTagOnlyRestore() *v1.Restore {
+	return &v1.Restore{Spec: v1.RestoreSpec{
+		IncludedResources: []string{"imagetags.image.openshift.io"},
+		NamespaceMapping:  map[string]string{"ns": "new-ns"},
+	}}
+}
+
+// imageTagItem returns an imagetag of namespace ns tagging from
+func imageTagItem(from map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "image.openshift.io/v1",
+		"kind":       "ImageTag",
+		"metadata": map[string]interface{}{
+			"name":      "app:latest",
+			"namespace": "ns",
+			"annotations": map[string]interface{}{
+				common.BackupRegistryHostname:  "image-registry.old.svc:5000",
+				common.RestoreRegistryHostname: "image-registry.new.svc:5000",
+			},
+		},
+		"spec":   map[string]interface{}{"name": "latest", "from": from},
+		"status": map[string]interface{}{"name": "latest"},
+	}}
+}
+
+func TestRestorePluginRewritesInternalRegistryReference(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	item := imageTagItem(map[string]interface{}{"kind": "DockerImage", "name": "image-registry.old.svc:5000/ns/base@sha256:" + digest})
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: imageTagOnlyRestore()})
+	require.NoError(t, err)
+	assert.False(t, output.SkipRestore)
+	name, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "from", "name")
+	assert.Equal(t, "image-registry.new.svc:5000/new-ns/base@sha256:"+digest, name)
+	_, found, _ := unstructured.NestedMap(output.UpdatedItem.UnstructuredContent(), "status")
+	assert.False(t, found)
+
+	// references to other registries are kept
+	item = imageTagItem(map[string]interface{}{"kind": "DockerImage", "name": "quay.io/ns/base:latest"})
+	output, err = restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: imageTagOnlyRestore()})
+	require.NoError(t, err)
+	name, _, _ = unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "from", "name")
+	assert.Equal(t, "quay.io/ns/base:latest", name)
+}
+
+func TestRestorePluginMapsReferenceNamespace(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	for _, from := range []map[string]interface{}{
+		{"kind": "ImageStreamTag", "name": "base:latest", "namespace": "ns"},
+		{"kind": "ImageStreamImage", "name": "base@sha256:" + digest, "namespace": "ns"},
+	} {
+		item := imageTagItem(from)
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: imageTagOnlyRestore()})
+		require.NoError(t, err)
+		namespace, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "from", "namespace")
+		assert.Equal(t, "new-ns", namespace, from["kind"])
+	}
+
+	// unmapped namespaces are kept
+	item := imageTagItem(map[string]interface{}{"kind": "ImageStreamTag", "name": "base:latest", "namespace": "openshift"})
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: imageTagOnlyRestore()})
+	require.NoError(t, err)
+	namespace, _, _ := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "from", "namespace")
+	assert.Equal(t, "openshift", namespace)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/daemonset"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/deployment"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/deploymentconfig"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagecopy"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagestream"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagestreamtag"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/imagetag"
@@ -41,9 +42,12 @@ func main() {
 		RegisterRestoreItemAction("openshift.io/04-pvc-restore-plugin", newPVCRestorePlugin).
 		RegisterBackupItemAction("openshift.io/04-imagestreamtag-backup-plugin", newImageStreamTagBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/04-imagestreamtag-restore-plugin", newImageStreamTagRestorePlugin).
+		RegisterBackupItemAction("openshift.io/05-route-backup-plugin", newRouteBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/05-route-restore-plugin", newRouteRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/06-build-restore-plugin", newBuildRestorePlugin).
+		RegisterBackupItemAction("openshift.io/07-pod-backup-plugin", newPodBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/07-pod-restore-plugin", newPodRestorePlugin).
+		RegisterBackupItemAction("openshift.io/08-deploymentconfig-backup-plugin", newDeploymentConfigBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/08-deploymentconfig-restore-plugin", newDeploymentConfigRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/09-replicationcontroller-restore-plugin", newReplicationControllerRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/10-job-restore-plugin", newJobRestorePlugin).
@@ -53,6 +57,7 @@ func main() {
 		RegisterRestoreItemAction("openshift.io/14-statefulset-restore-plugin", newStatefulSetRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/15-service-restore-plugin", newServiceRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/16-cronjob-restore-plugin", newCronJobRestorePlugin).
+		RegisterBackupItemAction("openshift.io/17-buildconfig-backup-plugin", newBuildConfigBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/17-buildconfig-restore-plugin", newBuildConfigRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/18-secret-restore-plugin", newSecretRestorePlugin).
 		RegisterBackupItemAction("openshift.io/19-is-backup-plugin", newImageStreamBackupPlugin).
@@ -60,6 +65,7 @@ func main() {
 		RegisterRestoreItemAction("openshift.io/20-SCC-restore-plugin", newSCCRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/21-role-bindings-restore-plugin", newRoleBindingRestorePlugin).
 		RegisterRestoreItemAction("openshift.io/22-cluster-role-bindings-restore-plugin", newClusterRoleBindingRestorePlugin).
+		RegisterBackupItemAction("openshift.io/23-imagetag-backup-plugin", newImageTagBackupPlugin).
 		RegisterRestoreItemAction("openshift.io/23-imagetag-restore-plugin", newImageTagRestorePlugin).
 		Serve()
 }
@@ -76,6 +82,10 @@ func newBuildRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &build.RestorePlugin{Log: logger}, nil
 }
 
+func newBuildConfigBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &buildconfig.BackupPlugin{Log: logger}, nil
+}
+
 func newBuildConfigRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &buildconfig.RestorePlugin{Log: logger}, nil
 }
@@ -88,6 +98,10 @@ func newDeploymentRestorePlugin(logger logrus.FieldLogger) (interface{}, error)
 	return &deployment.RestorePlugin{Log: logger}, nil
 }
 
+func newDeploymentConfigBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &deploymentconfig.BackupPlugin{Log: logger}, nil
+}
+
 func newDeploymentConfigRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &deploymentconfig.RestorePlugin{Log: logger}, nil
 }
@@ -100,6 +114,10 @@ func newCronJobRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &cronjob.RestorePlugin{Log: logger}, nil
 }
 
+func newPodBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &pod.BackupPlugin{Log: logger}, nil
+}
+
 func newPodRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &pod.RestorePlugin{Log: logger}, nil
 }
@@ -112,6 +130,10 @@ func newReplicationControllerRestorePlugin(logger logrus.FieldLogger) (interface
 	return &replicationcontroller.RestorePlugin{Log: logger}, nil
 }
 
+func newRouteBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &route.BackupPlugin{Log: logger, Subdomains: make(map[string]string)}, nil
+}
+
 func newRouteRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &route.RestorePlugin{Log: logger}, nil
 }
@@ -165,11 +187,26 @@ func newPVRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 }
 
 func newImageStreamBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
-	return &imagestream.BackupPlugin{Log: logger}, nil
+	if err := common.ValidateRepositoryTemplate(common.RepositoryTemplate()); err != nil {
+		return nil, err
+	}
+	if err := imagecopy.ValidateCompression(imagecopy.Compression(), imagecopy.PreserveDigests()); err != nil {
+		return nil, err
+	}
+	logger.Infof("[is-backup] image copy proxy settings: %s", imagecopy.ConfigureProxy())
+	return &imagestream.BackupPlugin{Log: logger, CopiedImages: make(map[string]*imagecopy.CopiedImages)}, nil
 }
 
 func newImageStreamRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
-	return &imagestream.RestorePlugin{Log: logger}, nil
+	if err := common.ValidateRepositoryTemplate(common.RepositoryTemplate()); err != nil {
+		return nil, err
+	}
+	if err := imagecopy.ValidateCompression(imagecopy.Compression(), imagecopy.PreserveDigests()); err != nil {
+		return nil, err
+	}
+	logger.Infof("[is-restore] image copy proxy settings: %s", imagecopy.ConfigureProxy())
+	return &imagestream.RestorePlugin{Log: logger, UpdatedForRestore: make(map[string]bool),
+		CopiedImages: make(map[string]*imagecopy.CopiedImages)}, nil
 }
 
 func newImageStreamTagBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
@@ -180,6 +217,10 @@ func newImageStreamTagRestorePlugin(logger logrus.FieldLogger) (interface{}, err
 	return &imagestreamtag.RestorePlugin{Log: logger}, nil
 }
 
+func newImageTagBackupPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &imagetag.BackupPlugin{Log: logger}, nil
+}
+
 func newImageTagRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &imagetag.RestorePlugin{Log: logger}, nil
 }
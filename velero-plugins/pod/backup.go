@@ -0,0 +1,231 @@
+package pod
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// ResticStorageClassesEnvVar lists the storage classes, separated by commas,
+// whose PVC volumes are backed up with restic
+const ResticStorageClassesEnvVar = "RESTIC_STORAGECLASSES"
+
+// ResticVolumeTypesEnvVar lists the types of volumes not backed by PVCs,
+// e.g. emptyDir, separated by commas, which are backed up with restic
+const ResticVolumeTypesEnvVar = "RESTIC_VOLUME_TYPES"
+
+// BackupPlugin is a backup item action plugin for Velero
+type BackupPlugin struct {
+	Log logrus.FieldLogger
+}
+
+// AppliesTo returns a velero.ResourceSelector that applies to pods
+func (p *BackupPlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"pods"},
+	}, nil
+}
+
+// Execute records the UID and supplemental group ranges of the namespace of
+// the pod, for restores resetting its security context, and the ConfigMaps
+// its volumes need which are backed up, and adds its volumes which the restic
+// policy selects to its restic backup annotation
+func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.Log.Info("[pod-backup] Entering Pod backup plugin")
+
+	pod := corev1API.Pod{}
+	itemMarshal, _ := json.Marshal(item)
+	json.Unmarshal(itemMarshal, &pod)
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+
+	client, err := clients.CoreClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	namespace, err := client.Namespaces().Get(pod.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	recordNamespaceRanges(pod.Annotations, namespace.Annotations)
+
+	if err := recordBackedUpConfigMaps(client, &pod, backup); err != nil {
+		return nil, nil, err
+	}
+
+	if err := p.addResticVolumes(client, &pod); err != nil {
+		return nil, nil, err
+	}
+
+	var out map[string]interface{}
+	objrec, _ := json.Marshal(pod)
+	json.Unmarshal(objrec, &out)
+	item.SetUnstructuredContent(out)
+	return item, nil, nil
+}
+
+// recordBackedUpConfigMaps records the required ConfigMaps the volumes of pod
+// mount which backup includes in its backed up ConfigMaps annotation, so the
+// restore plugin knows which ones are restored along with it
+func recordBackedUpConfigMaps(client corev1.CoreV1Interface, pod *corev1API.Pod, backup *v1.Backup) error {
+	delete(pod.Annotations, common.BackupConfigMapsAnnotation)
+	if len(requiredConfigMapVolumes(pod.Spec)) == 0 {
+		return nil
+	}
+	configMapList, err := client.ConfigMaps(pod.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	configMaps := make(map[string]bool)
+	for _, configMap := range configMapList.Items {
+		configMaps[configMap.Name] = true
+	}
+	if backedUp := backedUpConfigMaps(pod.Spec, configMaps, backup); len(backedUp) > 0 {
+		pod.Annotations[common.BackupConfigMapsAnnotation] = strings.Join(backedUp, ",")
+	}
+	return nil
+}
+
+// addResticVolumes adds the volumes of pod which the restic policy of
+// ResticStorageClassesEnvVar and ResticVolumeTypesEnvVar selects to its
+// restic backup annotation, on pod and the pod of the cluster. Velero picks
+// the restic volumes of a pod before running item actions, so they are
+// backed up with restic from the next backup on.
+func (p *BackupPlugin) addResticVolumes(client corev1.CoreV1Interface, pod *corev1API.Pod) error {
+	storageClasses := envList(ResticStorageClassesEnvVar)
+	volumeTypes := envList(ResticVolumeTypesEnvVar)
+	if len(storageClasses) == 0 && len(volumeTypes) == 0 {
+		return nil
+	}
+	if _, excluded := pod.Annotations[common.ResticExcludesAnnotation]; excluded {
+		p.Log.Infof("[pod-backup] pod %s/%s has the %s annotation, leaving its restic volumes as they are", pod.Namespace, pod.Name, common.ResticExcludesAnnotation)
+		return nil
+	}
+
+	volumes, err := resticVolumes(pod.Spec, storageClasses, volumeTypes, func(claim string) (string, error) {
+		pvc, err := client.PersistentVolumeClaims(pod.Namespace).Get(claim, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return storageClassName(*pvc), nil
+	})
+	if err != nil {
+		return err
+	}
+	value, added := mergeResticVolumes(pod.Annotations[common.ResticBackupAnnotation], volumes)
+	if len(added) == 0 {
+		return nil
+	}
+	p.Log.Infof("[pod-backup] adding volumes %v of pod %s/%s to its %s annotation", added, pod.Namespace, pod.Name, common.ResticBackupAnnotation)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{common.ResticBackupAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := client.Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch); err != nil {
+		return err
+	}
+	pod.Annotations[common.ResticBackupAnnotation] = value
+	return nil
+}
+
+// envList returns the values of the environment variable separated by commas
+func envList(name string) map[string]bool {
+	values := make(map[string]bool)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values[value] = true
+		}
+	}
+	return values
+}
+
+// storageClassName returns the storage class of pvc, also given by the
+// annotation it replaced
+func storageClassName(pvc corev1API.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName
+	}
+	return pvc.Annotations[corev1API.BetaStorageClassAnnotation]
+}
+
+// volumeType returns the type of the volumes not backed by PVCs which
+// ResticVolumeTypesEnvVar can list, or ""
+func volumeType(volume corev1API.Volume) string {
+	switch {
+	case volume.EmptyDir != nil:
+		return "emptyDir"
+	case volume.Secret != nil:
+		return "secret"
+	case volume.ConfigMap != nil:
+		return "configMap"
+	case volume.DownwardAPI != nil:
+		return "downwardAPI"
+	case volume.Projected != nil:
+		return "projected"
+	}
+	return ""
+}
+
+// resticVolumes returns the names of the volumes of spec backed by PVCs of
+// storageClasses, given by storageClassOf, and of the volumeTypes
+func resticVolumes(spec corev1API.PodSpec, storageClasses, volumeTypes map[string]bool, storageClassOf func(claim string) (string, error)) ([]string, error) {
+	var volumes []string
+	for _, volume := range spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			if len(storageClasses) == 0 {
+				continue
+			}
+			storageClass, err := storageClassOf(volume.PersistentVolumeClaim.ClaimName)
+			if err != nil {
+				return nil, err
+			}
+			if storageClasses[storageClass] {
+				volumes = append(volumes, volume.Name)
+			}
+			continue
+		}
+		if kind := volumeType(volume); len(kind) > 0 && volumeTypes[kind] {
+			volumes = append(volumes, volume.Name)
+		}
+	}
+	return volumes, nil
+}
+
+// mergeResticVolumes returns the restic backup annotation value listing the
+// volumes of value and volumes, and the volumes it didn't list yet
+func mergeResticVolumes(value string, volumes []string) (string, []string) {
+	var names []string
+	listed := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 && !listed[name] {
+			listed[name] = true
+			names = append(names, name)
+		}
+	}
+	var added []string
+	for _, name := range volumes {
+		if !listed[name] {
+			listed[name] = true
+			names = append(names, name)
+			added = append(added, name)
+		}
+	}
+	return strings.Join(names, ","), added
+}
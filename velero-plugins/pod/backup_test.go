@@ -0,0 +1,92 @@
+package pod
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackupPluginAppliesTo(t *testing.T) {
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+	actual, err := backupPlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"pods"}}, actual)
+}
+
+func TestAddResticVolumesWithoutPolicy(t *testing.T) {
+	pod := corev1API.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{}},
+		Spec: corev1API.PodSpec{Volumes: []corev1API.Volume{
+			{Name: "scratch", VolumeSource: corev1API.VolumeSource{EmptyDir: &corev1API.EmptyDirVolumeSource{}}},
+		}},
+	}
+	backupPlugin := &BackupPlugin{Log: test.NewLogger()}
+	// the cluster isn't reached without a policy
+	require.NoError(t, backupPlugin.addResticVolumes(nil, &pod))
+	assert.Empty(t, pod.Annotations)
+}
+
+func TestResticVolumes(t *testing.T) {
+	claim := func(name, claim string) corev1API.Volume {
+		return corev1API.Volume{Name: name, VolumeSource: corev1API.VolumeSource{PersistentVolumeClaim: &corev1API.PersistentVolumeClaimVolumeSource{ClaimName: claim}}}
+	}
+	spec := corev1API.PodSpec{Volumes: []corev1API.Volume{
+		claim("data", "data-claim"),
+		claim("logs", "logs-claim"),
+		{Name: "scratch", VolumeSource: corev1API.VolumeSource{EmptyDir: &corev1API.EmptyDirVolumeSource{}}},
+		{Name: "certs", VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: "certs"}}},
+		{Name: "config", VolumeSource: corev1API.VolumeSource{ConfigMap: &corev1API.ConfigMapVolumeSource{}}},
+		{Name: "info", VolumeSource: corev1API.VolumeSource{DownwardAPI: &corev1API.DownwardAPIVolumeSource{}}},
+		{Name: "host", VolumeSource: corev1API.VolumeSource{HostPath: &corev1API.HostPathVolumeSource{Path: "/var/log"}}},
+	}}
+	storageClassOf := func(claim string) (string, error) {
+		return map[string]string{"data-claim": "gp2", "logs-claim": "standard"}[claim], nil
+	}
+
+	volumes, err := resticVolumes(spec, map[string]bool{"gp2": true}, map[string]bool{}, storageClassOf)
+	require.NoError(t, err)
+	// secret, configMap, downwardAPI and emptyDir volumes only if configured
+	assert.Equal(t, []string{"data"}, volumes)
+
+	volumes, err = resticVolumes(spec, map[string]bool{"gp2": true, "standard": true}, map[string]bool{"emptyDir": true}, storageClassOf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data", "logs", "scratch"}, volumes)
+
+	// PVCs aren't looked up without storage classes
+	volumes, err = resticVolumes(spec, map[string]bool{}, map[string]bool{"configMap": true}, func(string) (string, error) {
+		return "", errors.New("looked up")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config"}, volumes)
+
+	_, err = resticVolumes(spec, map[string]bool{"gp2": true}, nil, func(string) (string, error) {
+		return "", errors.New("not found")
+	})
+	assert.Error(t, err)
+}
+
+func TestMergeResticVolumes(t *testing.T) {
+	value, added := mergeResticVolumes("", []string{"data"})
+	assert.Equal(t, "data", value)
+	assert.Equal(t, []string{"data"}, added)
+
+	value, added = mergeResticVolumes("logs, data", []string{"data", "scratch"})
+	assert.Equal(t, "logs,data,scratch", value)
+	assert.Equal(t, []string{"scratch"}, added)
+
+	_, added = mergeResticVolumes("data", []string{"data"})
+	assert.Empty(t, added)
+}
+
+func TestStorageClassName(t *testing.T) {
+	gp2 := "gp2"
+	assert.Equal(t, "gp2", storageClassName(corev1API.PersistentVolumeClaim{Spec: corev1API.PersistentVolumeClaimSpec{StorageClassName: &gp2}}))
+	assert.Equal(t, "standard", storageClassName(corev1API.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{"volume.beta.kubernetes.io/storage-class": "standard"}}}))
+}
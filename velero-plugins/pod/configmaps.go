@@ -0,0 +1,84 @@
+package pod
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1API "k8s.io/api/core/v1"
+)
+
+// configMapVolume is a required ConfigMap a volume of a pod mounts
+type configMapVolume struct {
+	volume    string
+	configMap string
+}
+
+// requiredConfigMapVolumes returns the required ConfigMaps the configMap and
+// projected volumes of spec mount. Pods missing one are created but never start.
+func requiredConfigMapVolumes(spec corev1API.PodSpec) []configMapVolume {
+	var required []configMapVolume
+	add := func(volume string, source corev1API.LocalObjectReference, optional *bool) {
+		if optional == nil || !*optional {
+			required = append(required, configMapVolume{volume: volume, configMap: source.Name})
+		}
+	}
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			add(volume.Name, volume.ConfigMap.LocalObjectReference, volume.ConfigMap.Optional)
+		}
+		if volume.Projected == nil {
+			continue
+		}
+		for _, source := range volume.Projected.Sources {
+			if source.ConfigMap != nil {
+				add(volume.Name, source.ConfigMap.LocalObjectReference, source.ConfigMap.Optional)
+			}
+		}
+	}
+	return required
+}
+
+// backedUpConfigMaps returns the required ConfigMaps the volumes of spec mount
+// which exist, given by configMaps, and backup includes, each once
+func backedUpConfigMaps(spec corev1API.PodSpec, configMaps map[string]bool, backup *v1.Backup) []string {
+	if !common.BacksUpResource(backup, "configmaps") {
+		return nil
+	}
+	var backedUp []string
+	seen := make(map[string]bool)
+	for _, required := range requiredConfigMapVolumes(spec) {
+		if configMaps[required.configMap] && !seen[required.configMap] {
+			seen[required.configMap] = true
+			backedUp = append(backedUp, required.configMap)
+		}
+	}
+	return backedUp
+}
+
+// restoredConfigMaps returns the ConfigMaps of the backup annotation of a pod
+// which restore restores along with it
+func restoredConfigMaps(annotations map[string]string, restore *v1.Restore) map[string]bool {
+	configMaps := make(map[string]bool)
+	if len(annotations[common.BackupConfigMapsAnnotation]) == 0 || !common.RestoresResource(restore, "configmaps") {
+		return configMaps
+	}
+	for _, name := range strings.Split(annotations[common.BackupConfigMapsAnnotation], ",") {
+		configMaps[name] = true
+	}
+	return configMaps
+}
+
+// missingConfigMapVolumes returns the required ConfigMaps the configMap and
+// projected volumes of spec mount which configMaps doesn't have, each with the
+// volume mounting it
+func missingConfigMapVolumes(spec corev1API.PodSpec, configMaps map[string]bool) []string {
+	var missing []string
+	for _, required := range requiredConfigMapVolumes(spec) {
+		if !configMaps[required.configMap] {
+			missing = append(missing, fmt.Sprintf("ConfigMap %s of volume %s", required.configMap, required.volume))
+		}
+	}
+	return missing
+}
@@ -0,0 +1,71 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/stretchr/testify/assert"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1API "k8s.io/api/core/v1"
+)
+
+// configMapVolumesSpec returns a pod spec mounting the required ConfigMaps
+// app-config, restored-config, required-config and ca-bundle and optional ones
+func configMapVolumesSpec() corev1API.PodSpec {
+	optional := true
+	required := false
+	configMapVolume := func(volume, name string, optional *bool) corev1API.Volume {
+		return corev1API.Volume{Name: volume, VolumeSource: corev1API.VolumeSource{ConfigMap: &corev1API.ConfigMapVolumeSource{
+			LocalObjectReference: corev1API.LocalObjectReference{Name: name},
+			Optional:             optional,
+		}}}
+	}
+	return corev1API.PodSpec{
+		Volumes: []corev1API.Volume{
+			configMapVolume("config", "app-config", nil),
+			configMapVolume("restored", "restored-config", nil),
+			configMapVolume("required", "required-config", &required),
+			configMapVolume("optional", "optional-config", &optional),
+			{Name: "projected", VolumeSource: corev1API.VolumeSource{Projected: &corev1API.ProjectedVolumeSource{
+				Sources: []corev1API.VolumeProjection{
+					{ConfigMap: &corev1API.ConfigMapProjection{LocalObjectReference: corev1API.LocalObjectReference{Name: "ca-bundle"}}},
+					{ConfigMap: &corev1API.ConfigMapProjection{LocalObjectReference: corev1API.LocalObjectReference{Name: "optional-bundle"}, Optional: &optional}},
+					{Secret: &corev1API.SecretProjection{LocalObjectReference: corev1API.LocalObjectReference{Name: "tls"}}},
+				},
+			}}},
+			{Name: "data", VolumeSource: corev1API.VolumeSource{EmptyDir: &corev1API.EmptyDirVolumeSource{}}},
+		},
+	}
+}
+
+func TestMissingConfigMapVolumes(t *testing.T) {
+	spec := configMapVolumesSpec()
+	assert.Equal(t, []string{
+		"ConfigMap app-config of volume config",
+		"ConfigMap required-config of volume required",
+		"ConfigMap ca-bundle of volume projected",
+	}, missingConfigMapVolumes(spec, map[string]bool{"restored-config": true}))
+	assert.Empty(t, missingConfigMapVolumes(spec, map[string]bool{"app-config": true, "restored-config": true, "required-config": true, "ca-bundle": true}))
+}
+
+func TestBackedUpConfigMaps(t *testing.T) {
+	spec := configMapVolumesSpec()
+	spec.Volumes = append(spec.Volumes, spec.Volumes[0])
+	existing := map[string]bool{"app-config": true, "ca-bundle": true, "optional-config": true}
+	assert.Equal(t, []string{"app-config", "ca-bundle"}, backedUpConfigMaps(spec, existing, &v1.Backup{}))
+	assert.Empty(t, backedUpConfigMaps(spec, existing, &v1.Backup{Spec: v1.BackupSpec{ExcludedResources: []string{"configmaps"}}}))
+}
+
+func TestRestoredConfigMaps(t *testing.T) {
+	annotations := map[string]string{common.BackupConfigMapsAnnotation: "app-config,ca-bundle"}
+	assert.Equal(t, map[string]bool{"app-config": true, "ca-bundle": true}, restoredConfigMaps(annotations, &v1.Restore{}))
+	assert.Empty(t, restoredConfigMaps(annotations, &v1.Restore{Spec: v1.RestoreSpec{ExcludedResources: []string{"configmaps"}}}))
+	assert.Empty(t, restoredConfigMaps(nil, &v1.Restore{}))
+
+	// the restored ones aren't reported missing
+	missing := missingConfigMapVolumes(configMapVolumesSpec(), restoredConfigMaps(annotations, &v1.Restore{}))
+	assert.Equal(t, []string{
+		"ConfigMap restored-config of volume restored",
+		"ConfigMap required-config of volume required",
+	}, missing)
+}
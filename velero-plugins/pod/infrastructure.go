@@ -0,0 +1,52 @@
+package pod
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreInfrastructurePodsEnvVar restores the build, deployer, pruner and
+// operator pods the restore plugin skips otherwise when set to true
+const RestoreInfrastructurePodsEnvVar = "RESTORE_INFRASTRUCTURE_PODS"
+
+// jobNameLabel is set on the pods of jobs to the name of their job
+const jobNameLabel = "job-name"
+
+// prunerJobName matches the names of the jobs cronjobs such as the image
+// pruner create, e.g. image-pruner-27167520, which end in their schedule time
+var prunerJobName = regexp.MustCompile(`^(.+-)?pruner-[0-9]+$`)
+
+// openshiftNamespacePrefix is the prefix of the namespaces of the openshift
+// operators and their operands
+const openshiftNamespacePrefix = "openshift-"
+
+// infrastructurePodReason returns why pod, in namespace at backup time and
+// with ownerRefs, is run by openshift on the backup cluster and not restored,
+// or "" if it is not an infrastructure pod. The build, deployer and hook pods
+// ran to completion, the pruner jobs run again as scheduled and the operators
+// of the restore cluster create the pods of their openshift namespaces, e.g.
+// the installer and revision pruner pods.
+func infrastructurePodReason(pod corev1API.Pod, namespace string, ownerRefs []metav1.OwnerReference) string {
+	if kind := generatedPodKind(pod); len(kind) > 0 {
+		return fmt.Sprintf("it is a %s pod", kind)
+	}
+	jobs := []string{pod.Labels[jobNameLabel]}
+	for _, owner := range ownerRefs {
+		if owner.Kind == "Job" {
+			jobs = append(jobs, owner.Name)
+		}
+	}
+	for _, job := range jobs {
+		if prunerJobName.MatchString(job) {
+			return fmt.Sprintf("it is run by the pruner job %s", job)
+		}
+	}
+	if strings.HasPrefix(namespace, openshiftNamespacePrefix) && len(ownerRefs) > 0 {
+		return fmt.Sprintf("it is owned by %s %s in the openshift namespace %s", ownerRefs[0].Kind, ownerRefs[0].Name, namespace)
+	}
+	return ""
+}
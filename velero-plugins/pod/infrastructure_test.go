@@ -0,0 +1,70 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInfrastructurePodReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		pod       corev1API.Pod
+		namespace string
+		ownerRefs []metav1.OwnerReference
+		expected  string
+	}{
+		{
+			name: "deployer pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:   "app-1-deploy",
+				Labels: map[string]string{"openshift.io/deployer-pod-for.name": "app-1"},
+			}},
+			namespace: "ns",
+			expected:  "it is a deployer pod",
+		},
+		{
+			name: "image pruner pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:   "image-pruner-27167520-x7k2p",
+				Labels: map[string]string{"job-name": "image-pruner-27167520"},
+			}},
+			namespace: "openshift-image-registry",
+			expected:  "it is run by the pruner job image-pruner-27167520",
+		},
+		{
+			name:      "pruner pod without the job-name label",
+			pod:       corev1API.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pruner-27167520-x7k2p"}},
+			namespace: "ns",
+			ownerRefs: []metav1.OwnerReference{{Kind: "Job", Name: "pruner-27167520"}},
+			expected:  "it is run by the pruner job pruner-27167520",
+		},
+		{
+			name:      "installer pod of an operator",
+			pod:       corev1API.Pod{ObjectMeta: metav1.ObjectMeta{Name: "installer-5-master-0", Labels: map[string]string{"app": "installer"}}},
+			namespace: "openshift-kube-apiserver",
+			ownerRefs: []metav1.OwnerReference{{Kind: "ConfigMap", Name: "revision-status-5"}},
+			expected:  "it is owned by ConfigMap revision-status-5 in the openshift namespace openshift-kube-apiserver",
+		},
+		{
+			name:      "standalone pod in an openshift namespace",
+			pod:       corev1API.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug"}},
+			namespace: "openshift-monitoring",
+			expected:  "",
+		},
+		{
+			name:      "job pod of an application",
+			pod:       corev1API.Pod{ObjectMeta: metav1.ObjectMeta{Name: "report-27167520-x7k2p", Labels: map[string]string{"job-name": "report-27167520"}}},
+			namespace: "ns",
+			ownerRefs: []metav1.OwnerReference{{Kind: "Job", Name: "report-27167520"}},
+			expected:  "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, infrastructurePodReason(test.pod, test.namespace, test.ownerRefs))
+		})
+	}
+}
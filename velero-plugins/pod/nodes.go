@@ -0,0 +1,102 @@
+package pod
+
+import (
+	"fmt"
+
+	corev1API "k8s.io/api/core/v1"
+)
+
+// nodeSpecificLabels are the node labels selecting nodes, or the zones or
+// regions of nodes, of a single cluster
+var nodeSpecificLabels = map[string]bool{
+	"kubernetes.io/hostname":                   true,
+	"topology.kubernetes.io/zone":              true,
+	"topology.kubernetes.io/region":            true,
+	"failure-domain.beta.kubernetes.io/zone":   true,
+	"failure-domain.beta.kubernetes.io/region": true,
+}
+
+// nodeNameField is the node field selecting nodes by name in node affinity terms
+const nodeNameField = "metadata.name"
+
+// clearNodeSelection removes what pins spec to nodes of the backup cluster:
+// its node name, the node selector entries and node affinity requirements on
+// node specific labels, and the node affinity requirements on node names.
+// Selectors on other labels, e.g. node roles, are kept. It returns the
+// removed fields.
+func clearNodeSelection(spec *corev1API.PodSpec) []string {
+	var removed []string
+	if len(spec.NodeName) > 0 {
+		removed = append(removed, fmt.Sprintf("spec.nodeName=%s", spec.NodeName))
+		spec.NodeName = ""
+	}
+	for key, value := range spec.NodeSelector {
+		if nodeSpecificLabels[key] {
+			removed = append(removed, fmt.Sprintf("spec.nodeSelector[%s]=%s", key, value))
+			delete(spec.NodeSelector, key)
+		}
+	}
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil {
+		return removed
+	}
+
+	nodeAffinity := spec.Affinity.NodeAffinity
+	if required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+		var terms []corev1API.NodeSelectorTerm
+		for i, term := range required.NodeSelectorTerms {
+			path := fmt.Sprintf("spec.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[%d]", i)
+			term, termRemoved := clearNodeSelectorTerm(term, path)
+			removed = append(removed, termRemoved...)
+			if len(term.MatchExpressions) > 0 || len(term.MatchFields) > 0 || len(termRemoved) == 0 {
+				terms = append(terms, term)
+			}
+		}
+		// no terms match no nodes
+		if len(terms) == 0 {
+			nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+		} else {
+			required.NodeSelectorTerms = terms
+		}
+	}
+	var preferred []corev1API.PreferredSchedulingTerm
+	for i, term := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		path := fmt.Sprintf("spec.affinity.nodeAffinity.preferredDuringSchedulingIgnoredDuringExecution[%d].preference", i)
+		preference, termRemoved := clearNodeSelectorTerm(term.Preference, path)
+		removed = append(removed, termRemoved...)
+		if len(preference.MatchExpressions) > 0 || len(preference.MatchFields) > 0 || len(termRemoved) == 0 {
+			term.Preference = preference
+			preferred = append(preferred, term)
+		}
+	}
+	nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil && len(preferred) == 0 {
+		spec.Affinity.NodeAffinity = nil
+	}
+	return removed
+}
+
+// clearNodeSelectorTerm removes the requirements of term on node specific
+// labels and node names, and returns the removed requirements, described by
+// their path
+func clearNodeSelectorTerm(term corev1API.NodeSelectorTerm, path string) (corev1API.NodeSelectorTerm, []string) {
+	var removed []string
+	var expressions []corev1API.NodeSelectorRequirement
+	for i, requirement := range term.MatchExpressions {
+		if nodeSpecificLabels[requirement.Key] {
+			removed = append(removed, fmt.Sprintf("%s.matchExpressions[%d]: %s %s %v", path, i, requirement.Key, requirement.Operator, requirement.Values))
+			continue
+		}
+		expressions = append(expressions, requirement)
+	}
+	var fields []corev1API.NodeSelectorRequirement
+	for i, requirement := range term.MatchFields {
+		if requirement.Key == nodeNameField {
+			removed = append(removed, fmt.Sprintf("%s.matchFields[%d]: %s %s %v", path, i, requirement.Key, requirement.Operator, requirement.Values))
+			continue
+		}
+		fields = append(fields, requirement)
+	}
+	term.MatchExpressions = expressions
+	term.MatchFields = fields
+	return term, removed
+}
@@ -0,0 +1,73 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1API "k8s.io/api/core/v1"
+)
+
+func TestClearNodeSelection(t *testing.T) {
+	hostname := corev1API.NodeSelectorRequirement{Key: "kubernetes.io/hostname", Operator: corev1API.NodeSelectorOpIn, Values: []string{"node5.old-cluster"}}
+	zone := corev1API.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: corev1API.NodeSelectorOpIn, Values: []string{"us-east-1a"}}
+	role := corev1API.NodeSelectorRequirement{Key: "node-role.kubernetes.io/worker", Operator: corev1API.NodeSelectorOpExists}
+	name := corev1API.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1API.NodeSelectorOpIn, Values: []string{"node5"}}
+	spec := corev1API.PodSpec{
+		NodeName: "node5",
+		NodeSelector: map[string]string{
+			"kubernetes.io/hostname":         "node5.old-cluster",
+			"node-role.kubernetes.io/worker": "",
+		},
+		Affinity: &corev1API.Affinity{NodeAffinity: &corev1API.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1API.NodeSelector{NodeSelectorTerms: []corev1API.NodeSelectorTerm{
+				{MatchExpressions: []corev1API.NodeSelectorRequirement{hostname, role}},
+				{MatchFields: []corev1API.NodeSelectorRequirement{name}},
+			}},
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1API.PreferredSchedulingTerm{
+				{Weight: 10, Preference: corev1API.NodeSelectorTerm{MatchExpressions: []corev1API.NodeSelectorRequirement{zone}}},
+				{Weight: 5, Preference: corev1API.NodeSelectorTerm{MatchExpressions: []corev1API.NodeSelectorRequirement{role}}},
+			},
+		}},
+	}
+
+	removed := clearNodeSelection(&spec)
+	assert.Equal(t, []string{
+		"spec.nodeName=node5",
+		"spec.nodeSelector[kubernetes.io/hostname]=node5.old-cluster",
+		"spec.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0]: kubernetes.io/hostname In [node5.old-cluster]",
+		"spec.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[1].matchFields[0]: metadata.name In [node5]",
+		"spec.affinity.nodeAffinity.preferredDuringSchedulingIgnoredDuringExecution[0].preference.matchExpressions[0]: topology.kubernetes.io/zone In [us-east-1a]",
+	}, removed)
+	assert.Empty(t, spec.NodeName)
+	assert.Equal(t, map[string]string{"node-role.kubernetes.io/worker": ""}, spec.NodeSelector)
+	assert.Equal(t, &corev1API.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1API.NodeSelector{NodeSelectorTerms: []corev1API.NodeSelectorTerm{
+			{MatchExpressions: []corev1API.NodeSelectorRequirement{role}},
+		}},
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1API.PreferredSchedulingTerm{
+			{Weight: 5, Preference: corev1API.NodeSelectorTerm{MatchExpressions: []corev1API.NodeSelectorRequirement{role}}},
+		},
+	}, spec.Affinity.NodeAffinity)
+}
+
+func TestClearNodeSelectionRemovesEmptyNodeAffinity(t *testing.T) {
+	hostname := corev1API.NodeSelectorRequirement{Key: "kubernetes.io/hostname", Operator: corev1API.NodeSelectorOpIn, Values: []string{"node5"}}
+	spec := corev1API.PodSpec{
+		Affinity: &corev1API.Affinity{
+			NodeAffinity: &corev1API.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1API.NodeSelector{NodeSelectorTerms: []corev1API.NodeSelectorTerm{
+					{MatchExpressions: []corev1API.NodeSelectorRequirement{hostname}},
+				}},
+			},
+			PodAntiAffinity: &corev1API.PodAntiAffinity{},
+		},
+	}
+	assert.Len(t, clearNodeSelection(&spec), 1)
+	assert.Nil(t, spec.Affinity.NodeAffinity)
+	assert.NotNil(t, spec.Affinity.PodAntiAffinity)
+
+	// nothing pins a pod selecting node roles only
+	spec = corev1API.PodSpec{NodeSelector: map[string]string{"node-role.kubernetes.io/infra": ""}}
+	assert.Empty(t, clearNodeSelection(&spec))
+	assert.Equal(t, map[string]string{"node-role.kubernetes.io/infra": ""}, spec.NodeSelector)
+}
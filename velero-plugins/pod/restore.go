@@ -2,17 +2,24 @@ package pod
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 	"fmt"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/clients"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	appsv1API "github.com/openshift/api/apps/v1"
+	buildv1API "github.com/openshift/api/build/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	corev1API "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 // RestorePlugin is a restore item action plugin for Velero
@@ -36,37 +43,85 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	json.Unmarshal(itemMarshal, &pod)
 	p.Log.Infof("[pod-restore] pod: %s", pod.Name)
 
-	// ISSUE-61 : removing the node selectors from pods
-	// to avoid pod being `unschedulable` on destination
-	pod.Spec.NodeSelector = nil
-
+	// velero drops the status and owner references of the item it restores
+	backupPod := corev1API.Pod{}
+	itemMarshal, _ = json.Marshal(input.ItemFromBackup)
+	json.Unmarshal(itemMarshal, &backupPod)
 	ownerRefs, err := common.GetOwnerReferences(input.ItemFromBackup)
 	if err != nil {
 		return nil, err
 	}
-	// Check if pod has owner Refs
-	if len(ownerRefs) > 0 && pod.Annotations[common.ResticBackupAnnotation] == "" {
-		p.Log.Infof("[pod-restore] skipping restore of pod %s, has owner references and no restic backup", pod.Name)
+
+	// the controllers and operators of the restore cluster run their own
+	// deployments, builds and infrastructure pods
+	if restoreInfrastructure, _ := strconv.ParseBool(os.Getenv(RestoreInfrastructurePodsEnvVar)); !restoreInfrastructure {
+		if reason := infrastructurePodReason(pod, backupPod.Namespace, ownerRefs); len(reason) > 0 {
+			p.Log.Infof("[pod-restore] skipping restore of pod %s, %s", pod.Name, reason)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+	}
+
+	if phase := backupPod.Status.Phase; (phase == corev1API.PodSucceeded || phase == corev1API.PodFailed) &&
+		input.Restore.Annotations[common.RestoreFinishedPodsAnnotation] != "true" {
+		p.Log.Infof("[pod-restore] skipping restore of pod %s, which was %s at backup time", pod.Name, phase)
 		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
 	}
 
+	if input.Restore.Annotations[common.ResetPodSecurityAnnotation] == "true" {
+		removed, err := resetSecurity(pod.Annotations, &pod.Spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) > 0 {
+			p.Log.Infof("[pod-restore] reset the security of pod %s: %s", pod.Name, strings.Join(removed, ", "))
+		}
+	}
+	delete(pod.Annotations, common.BackupUIDRangeAnnotation)
+	delete(pod.Annotations, common.BackupSupplementalGroupsAnnotation)
+
+	if input.Restore.Annotations[common.ClearNodeSelectionAnnotation] == "true" {
+		if removed := clearNodeSelection(&pod.Spec); len(removed) > 0 {
+			p.Log.Infof("[pod-restore] cleared the node selection of pod %s: %s", pod.Name, strings.Join(removed, ", "))
+		}
+	} else {
+		// ISSUE-61 : removing the node selectors from pods
+		// to avoid pod being `unschedulable` on destination
+		pod.Spec.NodeSelector = nil
+		// nor bound to a node of the backup cluster
+		pod.Spec.NodeName = ""
+	}
+
+	for _, name := range removeTokenVolumes(&pod.Spec) {
+		p.Log.Infof("[pod-restore] removing service account token volume %s of pod %s, the kubelet mounts a token", name, pod.Name)
+	}
+
+	// the controller of the pod creates it again, but restic restores volumes
+	// through the pods it backed them up from
+	if owner := controllerOwner(ownerRefs); owner != nil && pod.Annotations[common.ResticBackupAnnotation] == "" {
+		if input.Restore.Annotations[common.RestoreControlledPodsAnnotation] != "true" {
+			p.Log.Infof("[pod-restore] skipping restore of pod %s, controlled by %s %s and has no restic backup", pod.Name, owner.Kind, owner.Name)
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		p.Log.Infof("[pod-restore] restoring pod %s controlled by %s %s, the restore has the %s annotation", pod.Name, owner.Kind, owner.Name, common.RestoreControlledPodsAnnotation)
+	}
+
 	backupRegistry, registry, err := common.GetSrcAndDestRegistryInfo(input.Item)
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(pod.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(pod.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
+	pod.Annotations = common.SwapRestoredImages(&pod.Spec, pod.Annotations, input.Restore, backupRegistry, registry, p.Log)
 
 	// update PullSecrets
 	client, err := clients.CoreClient()
 	if err != nil {
 		return nil, err
 	}
-	secretList, err := client.Secrets(pod.Namespace).List(metav1.ListOptions{})
+	namespace := common.MappedNamespace(input.Restore, pod.Namespace)
+	secretList, err := client.Secrets(namespace).List(metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-	nameSpace, err := client.Namespaces().Get(pod.Namespace, metav1.GetOptions{})
+	nameSpace, err := client.Namespaces().Get(namespace, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -87,17 +142,29 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 			return nil, errors.New("Secret is not getting created")
 		}
 		time.Sleep(time.Second)
-		secretList, err = client.Secrets(pod.Namespace).List(metav1.ListOptions{})
+		secretList, err = client.Secrets(namespace).List(metav1.ListOptions{})
 		if err != nil {
 			return nil, err
 		}
 	}
-	for n, secret := range pod.Spec.ImagePullSecrets {
-		newSecret, err := common.UpdatePullSecret(&secret, secretList, p.Log)
-		if err != nil {
-			return nil, err
+	// the ConfigMaps of the restore are restored before pods, so they exist in
+	// the namespace the pod is restored to unless their restore failed. A pod
+	// missing some is restored anyway, since they may be created later.
+	configMaps := restoredConfigMaps(pod.Annotations, input.Restore)
+	delete(pod.Annotations, common.BackupConfigMapsAnnotation)
+	if configMapList, err := client.ConfigMaps(namespace).List(metav1.ListOptions{}); err != nil {
+		p.Log.Warnf("[pod-restore] error listing the configmaps of namespace %s to check the volumes of pod %s: %v", namespace, pod.Name, err)
+	} else {
+		for _, configMap := range configMapList.Items {
+			configMaps[configMap.Name] = true
 		}
-		pod.Spec.ImagePullSecrets[n] = *newSecret
+	}
+	if missing := missingConfigMapVolumes(pod.Spec, configMaps); len(missing) > 0 {
+		p.Log.Warnf("[pod-restore] pod %s won't start until the missing required volume sources exist: %s", pod.Name, strings.Join(missing, ", "))
+	}
+	pod.Spec.ImagePullSecrets, err = restoredPullSecrets(client, namespace, pod.Spec, p.Log)
+	if err != nil {
+		return nil, err
 	}
 	// if this is a stage pod and there's a stage pod image found
 	destStagePodImage := input.Restore.Annotations[common.StagePodImageAnnotation]
@@ -108,9 +175,182 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 			pod.Spec.Containers[n].Image = destStagePodImage
 		}
 	}
+	if err := common.UpdatePriorityClassName(&pod.Spec, input.Restore, p.Log); err != nil {
+		p.Log.Error("[pod-restore] error updating priority class: ", err)
+		return nil, err
+	}
+
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(pod)
 	json.Unmarshal(objrec, &out)
 
 	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: out}), nil
 }
+
+// controllerOwner returns the owner reference of the controller of a pod,
+// e.g. its ReplicaSet, or nil if it is standalone
+func controllerOwner(ownerRefs []metav1.OwnerReference) *metav1.OwnerReference {
+	for i, owner := range ownerRefs {
+		if owner.Controller != nil && *owner.Controller {
+			return &ownerRefs[i]
+		}
+	}
+	return nil
+}
+
+// tokenSecretSuffix matches the random suffix of the names of the token
+// secrets generated for service accounts, e.g. -x7k2p
+var tokenSecretSuffix = regexp.MustCompile(`^[a-z0-9]{5}$`)
+
+// serviceAccountName returns the name of the service account pods of spec run as
+func serviceAccountName(spec corev1API.PodSpec) string {
+	if len(spec.ServiceAccountName) > 0 {
+		return spec.ServiceAccountName
+	}
+	if len(spec.DeprecatedServiceAccount) > 0 {
+		return spec.DeprecatedServiceAccount
+	}
+	return "default"
+}
+
+// generatedDockercfgPrefix returns the name prefix of the dockercfg secrets
+// generated for the same service account as the secret name, if it is one
+// generated for serviceAccount or the builder, default or deployer service
+// account, or "" otherwise
+func generatedDockercfgPrefix(name, serviceAccount string) string {
+	prefix := serviceAccount + "-dockercfg-"
+	if strings.HasPrefix(name, prefix) && tokenSecretSuffix.MatchString(strings.TrimPrefix(name, prefix)) {
+		return prefix
+	}
+	return common.GeneratedDockercfgSecretPrefix(name)
+}
+
+// restoredPullSecrets returns the pull secrets of spec, with the generated
+// ones replaced by those of the namespace the pod is restored to
+func restoredPullSecrets(client corev1client.SecretsGetter, namespace string, spec corev1API.PodSpec, log logrus.FieldLogger) ([]corev1API.LocalObjectReference, error) {
+	secretList, err := client.Secrets(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return updatePullSecrets(spec.ImagePullSecrets, serviceAccountName(spec), secretList, log), nil
+}
+
+// updatePullSecrets points the references of pullSecrets to dockercfg
+// secrets generated on the backup cluster at the ones generated for the same
+// service accounts in secretList. References without one are dropped, so the
+// pod gets the pull secrets of its service account if none are left.
+// References to other secrets are left as they are.
+func updatePullSecrets(pullSecrets []corev1API.LocalObjectReference, serviceAccount string, secretList *corev1API.SecretList, log logrus.FieldLogger) []corev1API.LocalObjectReference {
+	existing := make(map[string]bool)
+	for _, secret := range secretList.Items {
+		existing[secret.Name] = true
+	}
+	var updated []corev1API.LocalObjectReference
+	seen := make(map[string]bool)
+	for _, ref := range pullSecrets {
+		if prefix := generatedDockercfgPrefix(ref.Name, serviceAccount); len(prefix) > 0 && !existing[ref.Name] {
+			newName := ""
+			for _, secret := range secretList.Items {
+				if strings.HasPrefix(secret.Name, prefix) {
+					newName = secret.Name
+					break
+				}
+			}
+			if len(newName) == 0 {
+				log.Infof("[pod-restore] no secret replaces generated pull secret %s in the target namespace, dropping the reference", ref.Name)
+				continue
+			}
+			log.Infof("[pod-restore] replacing generated pull secret %s with %s", ref.Name, newName)
+			ref.Name = newName
+		}
+		if !seen[ref.Name] {
+			seen[ref.Name] = true
+			updated = append(updated, ref)
+		}
+	}
+	return updated
+}
+
+// removeTokenVolumes removes the volumes of spec mounting the token secret
+// generated for its service account, and their mounts, since the secret isn't
+// generated on clusters with bound service account tokens. It returns the
+// names of the removed volumes.
+func removeTokenVolumes(spec *corev1API.PodSpec) []string {
+	prefix := serviceAccountName(*spec) + "-token-"
+
+	var removed []string
+	var volumes []corev1API.Volume
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil && strings.HasPrefix(volume.Secret.SecretName, prefix) &&
+			tokenSecretSuffix.MatchString(strings.TrimPrefix(volume.Secret.SecretName, prefix)) {
+			removed = append(removed, volume.Name)
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	spec.Volumes = volumes
+
+	isRemoved := func(name string) bool {
+		for _, volume := range removed {
+			if volume == name {
+				return true
+			}
+		}
+		return false
+	}
+	removeMounts := func(mounts []corev1API.VolumeMount) []corev1API.VolumeMount {
+		var kept []corev1API.VolumeMount
+		for _, mount := range mounts {
+			if !isRemoved(mount.Name) {
+				kept = append(kept, mount)
+			}
+		}
+		return kept
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].VolumeMounts = removeMounts(spec.Containers[i].VolumeMounts)
+	}
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].VolumeMounts = removeMounts(spec.InitContainers[i].VolumeMounts)
+	}
+	for i := range spec.EphemeralContainers {
+		spec.EphemeralContainers[i].VolumeMounts = removeMounts(spec.EphemeralContainers[i].VolumeMounts)
+	}
+	return removed
+}
+
+// deployerPodTypeLabel is set on the lifecycle hook pods of deployments to
+// the kind of hook, e.g. hook-pre
+const deployerPodTypeLabel = "openshift.io/deployer-pod.type"
+
+// hookPodSuffixes are the suffixes of the names of the lifecycle hook pods of
+// deployments, after the name of the deployment
+var hookPodSuffixes = []string{"-hook-pre", "-hook-mid", "-hook-post"}
+
+// generatedPodKind returns whether pod is a "build", deployment "hook" or
+// "deployer" pod, which the openshift controllers ran to completion on the
+// backup cluster, or "" if it is not
+func generatedPodKind(pod corev1API.Pod) string {
+	if len(pod.Labels[buildv1API.BuildLabel]) > 0 || len(pod.Annotations[buildv1API.BuildAnnotation]) > 0 {
+		return "build"
+	}
+	deployment := pod.Labels[appsv1API.DeployerPodForDeploymentLabel]
+	if len(deployment) == 0 {
+		deployment = pod.Annotations[appsv1API.DeploymentAnnotation]
+	}
+	if len(deployment) == 0 {
+		return ""
+	}
+	if strings.HasPrefix(pod.Labels[deployerPodTypeLabel], "hook-") {
+		return "hook"
+	}
+	for _, suffix := range hookPodSuffixes {
+		if pod.Name == deployment+suffix {
+			return "hook"
+		}
+	}
+	return "deployer"
+}
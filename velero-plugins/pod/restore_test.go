@@ -0,0 +1,242 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+func TestRestorePluginSkipsFinishedPods(t *testing.T) {
+	for _, phase := range []corev1API.PodPhase{corev1API.PodSucceeded, corev1API.PodFailed} {
+		pod := corev1API.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "job-x7k2p", Namespace: "ns"},
+			Status:     corev1API.PodStatus{Phase: phase},
+		}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pod)
+		require.NoError(t, err)
+		backupItem := &unstructured.Unstructured{Object: content}
+		// velero drops the status of the item it restores
+		item := backupItem.DeepCopy()
+		delete(item.Object, "status")
+
+		restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: backupItem, Restore: &v1.Restore{}})
+		require.NoError(t, err)
+		assert.True(t, output.SkipRestore, string(phase))
+	}
+}
+
+func TestControllerOwner(t *testing.T) {
+	controller := true
+	notController := false
+	assert.Nil(t, controllerOwner(nil))
+	assert.Nil(t, controllerOwner([]metav1.OwnerReference{
+		{Kind: "ConfigMap", Name: "owner"},
+		{Kind: "Job", Name: "not-controller", Controller: &notController},
+	}))
+	assert.Equal(t, &metav1.OwnerReference{Kind: "ReplicaSet", Name: "app-5d9f", Controller: &controller},
+		controllerOwner([]metav1.OwnerReference{
+			{Kind: "ConfigMap", Name: "owner"},
+			{Kind: "ReplicaSet", Name: "app-5d9f", Controller: &controller},
+		}))
+}
+
+func TestGeneratedPodKind(t *testing.T) {
+	tests := []struct {
+		name     string
+		pod      corev1API.Pod
+		expected string
+	}{
+		{
+			name: "deployer pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-1-deploy",
+				Labels:      map[string]string{"openshift.io/deployer-pod-for.name": "app-1"},
+				Annotations: map[string]string{"openshift.io/deployment.name": "app-1"},
+			}},
+			expected: "deployer",
+		},
+		{
+			name: "deployer pod of a custom strategy, with the annotation only",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-2-deployer",
+				Annotations: map[string]string{"openshift.io/deployment.name": "app-2"},
+			}},
+			expected: "deployer",
+		},
+		{
+			name: "pre hook pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name: "app-1-hook-pre",
+				Labels: map[string]string{
+					"openshift.io/deployer-pod-for.name": "app-1",
+					"openshift.io/deployer-pod.type":     "hook-pre",
+				},
+				Annotations: map[string]string{"openshift.io/deployment.name": "app-1"},
+			}},
+			expected: "hook",
+		},
+		{
+			name: "mid hook pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:   "app-1-hook-mid",
+				Labels: map[string]string{"openshift.io/deployer-pod-for.name": "app-1"},
+			}},
+			expected: "hook",
+		},
+		{
+			name: "post hook pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-3-hook-post",
+				Annotations: map[string]string{"openshift.io/deployment.name": "app-3"},
+			}},
+			expected: "hook",
+		},
+		{
+			name: "build pod",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-1-build",
+				Labels:      map[string]string{"openshift.io/build.name": "app-1"},
+				Annotations: map[string]string{"openshift.io/build.name": "app-1"},
+			}},
+			expected: "build",
+		},
+		{
+			name: "pod of a deployment",
+			pod: corev1API.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-1-x7k2p",
+				Labels:      map[string]string{"deployment": "app-1", "deploymentconfig": "app"},
+				Annotations: map[string]string{"openshift.io/deployment-config.name": "app"},
+			}},
+			expected: "",
+		},
+		{
+			name:     "pod named like a deployer pod",
+			pod:      corev1API.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1-deploy"}},
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, generatedPodKind(test.pod))
+		})
+	}
+}
+
+func TestRemoveTokenVolumes(t *testing.T) {
+	tokenVolume := func(name, secret string) corev1API.Volume {
+		return corev1API.Volume{Name: name, VolumeSource: corev1API.VolumeSource{Secret: &corev1API.SecretVolumeSource{SecretName: secret}}}
+	}
+	spec := corev1API.PodSpec{
+		ServiceAccountName: "builder",
+		Volumes: []corev1API.Volume{
+			tokenVolume("builder-token-x7k2p", "builder-token-x7k2p"),
+			tokenVolume("default-token", "default-token-x7k2p"),
+			tokenVolume("certs", "builder-token-certs-secret"),
+			tokenVolume("api", "api-token"),
+			{Name: "data", VolumeSource: corev1API.VolumeSource{EmptyDir: &corev1API.EmptyDirVolumeSource{}}},
+		},
+		Containers: []corev1API.Container{{
+			Name: "app",
+			VolumeMounts: []corev1API.VolumeMount{
+				{Name: "builder-token-x7k2p", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"},
+				{Name: "certs", MountPath: "/certs"},
+				{Name: "data", MountPath: "/data"},
+			},
+		}},
+		InitContainers: []corev1API.Container{{
+			Name:         "init",
+			VolumeMounts: []corev1API.VolumeMount{{Name: "builder-token-x7k2p", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"}},
+		}},
+	}
+	assert.Equal(t, []string{"builder-token-x7k2p"}, removeTokenVolumes(&spec))
+	var volumes []string
+	for _, volume := range spec.Volumes {
+		volumes = append(volumes, volume.Name)
+	}
+	// only the token secret of the service account of the pod is removed
+	assert.Equal(t, []string{"default-token", "certs", "api", "data"}, volumes)
+	assert.Equal(t, []corev1API.VolumeMount{{Name: "certs", MountPath: "/certs"}, {Name: "data", MountPath: "/data"}}, spec.Containers[0].VolumeMounts)
+	assert.Empty(t, spec.InitContainers[0].VolumeMounts)
+
+	// pods without a service account run as the default one
+	spec = corev1API.PodSpec{
+		Volumes:    []corev1API.Volume{tokenVolume("default-token-x7k2p", "default-token-x7k2p")},
+		Containers: []corev1API.Container{{Name: "app", VolumeMounts: []corev1API.VolumeMount{{Name: "default-token-x7k2p"}}}},
+	}
+	assert.Equal(t, []string{"default-token-x7k2p"}, removeTokenVolumes(&spec))
+	assert.Empty(t, spec.Volumes)
+	assert.Empty(t, spec.Containers[0].VolumeMounts)
+
+	spec = corev1API.PodSpec{Volumes: []corev1API.Volume{tokenVolume("certs", "certs")}}
+	assert.Empty(t, removeTokenVolumes(&spec))
+	assert.Len(t, spec.Volumes, 1)
+}
+
+func TestUpdatePullSecrets(t *testing.T) {
+	secretList := &corev1API.SecretList{Items: []corev1API.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default-dockercfg-new01"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "app-dockercfg-new02"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "app-dockercfg-kept3"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "quay-pull"}},
+	}}
+	pullSecrets := []corev1API.LocalObjectReference{
+		{Name: "app-dockercfg-abc12"},
+		{Name: "quay-pull"},
+		{Name: "app-dockercfg-kept3"},
+		{Name: "default-dockercfg-abc12"},
+		{Name: "builder-dockercfg-abc12"},
+		{Name: "app-dockercfg-config"},
+		{Name: "missing-pull"},
+	}
+	assert.Equal(t, []corev1API.LocalObjectReference{
+		{Name: "app-dockercfg-new02"},
+		{Name: "quay-pull"},
+		{Name: "app-dockercfg-kept3"},
+		{Name: "default-dockercfg-new01"},
+		// not generated names are preserved
+		{Name: "app-dockercfg-config"},
+		{Name: "missing-pull"},
+	}, updatePullSecrets(pullSecrets, "app", secretList, test.NewLogger()))
+
+	// the service account pull secrets are used when none are left
+	assert.Empty(t, updatePullSecrets([]corev1API.LocalObjectReference{{Name: "default-dockercfg-abc12"}}, "default", &corev1API.SecretList{}, test.NewLogger()))
+}
+
+// fakeSecrets serves the secrets of namespaces
+type fakeSecrets struct {
+	corev1client.SecretInterface
+	namespace string
+	secrets   map[string][]corev1API.Secret
+}
+
+func (f *fakeSecrets) Secrets(namespace string) corev1client.SecretInterface {
+	return &fakeSecrets{namespace: namespace, secrets: f.secrets}
+}
+
+func (f *fakeSecrets) List(options metav1.ListOptions) (*corev1API.SecretList, error) {
+	return &corev1API.SecretList{Items: f.secrets[f.namespace]}, nil
+}
+
+func TestRestoredPullSecretsMappedNamespace(t *testing.T) {
+	restore := &v1.Restore{Spec: v1.RestoreSpec{NamespaceMapping: map[string]string{"ns": "new-ns"}}}
+	client := &fakeSecrets{secrets: map[string][]corev1API.Secret{
+		"ns":     {{ObjectMeta: metav1.ObjectMeta{Name: "default-dockercfg-other"}}},
+		"new-ns": {{ObjectMeta: metav1.ObjectMeta{Name: "default-dockercfg-new01"}}},
+	}}
+	spec := corev1API.PodSpec{ImagePullSecrets: []corev1API.LocalObjectReference{{Name: "default-dockercfg-abc12"}}}
+	pullSecrets, err := restoredPullSecrets(client, common.MappedNamespace(restore, "ns"), spec, test.NewLogger())
+	require.NoError(t, err)
+	assert.Equal(t, []corev1API.LocalObjectReference{{Name: "default-dockercfg-new01"}}, pullSecrets)
+}
@@ -0,0 +1,144 @@
+package pod
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	securityv1API "github.com/openshift/api/security/v1"
+	corev1API "k8s.io/api/core/v1"
+)
+
+// sccAnnotation is set on pods to the SCC which admitted them
+const sccAnnotation = "openshift.io/scc"
+
+// seccompPodAnnotation and seccompContainerAnnotationPrefix set the seccomp
+// profiles of pods and their containers
+const (
+	seccompPodAnnotation             = "seccomp.security.alpha.kubernetes.io/pod"
+	seccompContainerAnnotationPrefix = "container.seccomp.security.alpha.kubernetes.io/"
+)
+
+// idRange is a range of user or group IDs of a namespace
+type idRange struct {
+	first, last int64
+}
+
+// contains returns whether id is in the range
+func (r idRange) contains(id int64) bool {
+	return r.first <= id && id <= r.last
+}
+
+// parseIDRanges parses the comma separated ranges of the UID range and
+// supplemental groups annotations of namespaces, e.g. 1000620000/10000 (first
+// ID and size) or 1000620000-1000629999 (first and last IDs)
+func parseIDRanges(value string) ([]idRange, error) {
+	var ranges []idRange
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		separator := "/"
+		if !strings.Contains(part, separator) {
+			separator = "-"
+		}
+		bounds := strings.SplitN(part, separator, 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid ID range %q", part)
+		}
+		first, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID range %q: %v", part, err)
+		}
+		second, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID range %q: %v", part, err)
+		}
+		last := second
+		if separator == "/" {
+			last = first + second - 1
+		}
+		ranges = append(ranges, idRange{first: first, last: last})
+	}
+	return ranges, nil
+}
+
+// inRanges returns whether id is set and in ranges
+func inRanges(id *int64, ranges []idRange) bool {
+	if id == nil {
+		return false
+	}
+	for _, r := range ranges {
+		if r.contains(*id) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordNamespaceRanges records the UID and supplemental group ranges of the
+// namespace, given by its annotations, in the pod annotations
+func recordNamespaceRanges(annotations, namespaceAnnotations map[string]string) {
+	if uidRange := namespaceAnnotations[securityv1API.UIDRangeAnnotation]; len(uidRange) > 0 {
+		annotations[common.BackupUIDRangeAnnotation] = uidRange
+	}
+	if groups := namespaceAnnotations[securityv1API.SupplementalGroupsAnnotation]; len(groups) > 0 {
+		annotations[common.BackupSupplementalGroupsAnnotation] = groups
+	}
+}
+
+// resetSecurity removes the SCC and seccomp annotations of a pod, given by
+// its annotations and spec, and the run as user and fs group IDs of its
+// security contexts which are in the ranges of the namespace on the backup
+// cluster, so the SCC admission of the restore cluster assigns them from the
+// ranges of the namespace there. It returns the removed fields.
+func resetSecurity(annotations map[string]string, spec *corev1API.PodSpec) ([]string, error) {
+	var removed []string
+	for key := range annotations {
+		if key == sccAnnotation || key == seccompPodAnnotation || strings.HasPrefix(key, seccompContainerAnnotationPrefix) {
+			removed = append(removed, fmt.Sprintf("metadata.annotations[%s]", key))
+			delete(annotations, key)
+		}
+	}
+
+	uidRanges, err := parseIDRanges(annotations[common.BackupUIDRangeAnnotation])
+	if err != nil {
+		return removed, err
+	}
+	// fs groups are assigned from the supplemental groups, or the UIDs
+	groupRanges := uidRanges
+	if groups := annotations[common.BackupSupplementalGroupsAnnotation]; len(groups) > 0 {
+		if groupRanges, err = parseIDRanges(groups); err != nil {
+			return removed, err
+		}
+	}
+
+	if context := spec.SecurityContext; context != nil {
+		if inRanges(context.RunAsUser, uidRanges) {
+			removed = append(removed, fmt.Sprintf("spec.securityContext.runAsUser=%d", *context.RunAsUser))
+			context.RunAsUser = nil
+		}
+		if inRanges(context.FSGroup, groupRanges) {
+			removed = append(removed, fmt.Sprintf("spec.securityContext.fsGroup=%d", *context.FSGroup))
+			context.FSGroup = nil
+		}
+	}
+	resetRunAsUser := func(field, name string, context *corev1API.SecurityContext) {
+		if context != nil && inRanges(context.RunAsUser, uidRanges) {
+			removed = append(removed, fmt.Sprintf("spec.%s[%s].securityContext.runAsUser=%d", field, name, *context.RunAsUser))
+			context.RunAsUser = nil
+		}
+	}
+	for _, container := range spec.InitContainers {
+		resetRunAsUser("initContainers", container.Name, container.SecurityContext)
+	}
+	for _, container := range spec.Containers {
+		resetRunAsUser("containers", container.Name, container.SecurityContext)
+	}
+	for _, container := range spec.EphemeralContainers {
+		resetRunAsUser("ephemeralContainers", container.Name, container.SecurityContext)
+	}
+	return removed, nil
+}
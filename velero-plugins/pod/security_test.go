@@ -0,0 +1,97 @@
+package pod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1API "k8s.io/api/core/v1"
+)
+
+func TestParseIDRanges(t *testing.T) {
+	ranges, err := parseIDRanges("1000620000/10000")
+	require.NoError(t, err)
+	assert.Equal(t, []idRange{{first: 1000620000, last: 1000629999}}, ranges)
+
+	ranges, err = parseIDRanges("1000620000-1000629999, 5000/10")
+	require.NoError(t, err)
+	assert.Equal(t, []idRange{{first: 1000620000, last: 1000629999}, {first: 5000, last: 5009}}, ranges)
+
+	ranges, err = parseIDRanges("")
+	require.NoError(t, err)
+	assert.Empty(t, ranges)
+
+	_, err = parseIDRanges("1000620000")
+	assert.Error(t, err)
+	_, err = parseIDRanges("first/10000")
+	assert.Error(t, err)
+}
+
+func TestRecordNamespaceRanges(t *testing.T) {
+	annotations := map[string]string{}
+	recordNamespaceRanges(annotations, map[string]string{
+		"openshift.io/sa.scc.uid-range":           "1000620000/10000",
+		"openshift.io/sa.scc.supplemental-groups": "1000620000/10000",
+		"openshift.io/sa.scc.mcs":                 "s0:c25,c10",
+	})
+	assert.Equal(t, map[string]string{
+		"openshift.io/backup-uid-range":           "1000620000/10000",
+		"openshift.io/backup-supplemental-groups": "1000620000/10000",
+	}, annotations)
+}
+
+func TestResetSecurity(t *testing.T) {
+	id := func(value int64) *int64 { return &value }
+	annotations := map[string]string{
+		"openshift.io/scc":                         "restricted",
+		"seccomp.security.alpha.kubernetes.io/pod": "runtime/default",
+		"openshift.io/backup-uid-range":            "1000620000/10000",
+		"openshift.io/backup-supplemental-groups":  "5000/100",
+		"app.kubernetes.io/name":                   "app",
+	}
+	spec := corev1API.PodSpec{
+		SecurityContext: &corev1API.PodSecurityContext{RunAsUser: id(1000620001), FSGroup: id(5000)},
+		InitContainers: []corev1API.Container{
+			{Name: "init", SecurityContext: &corev1API.SecurityContext{RunAsUser: id(1000629999)}},
+		},
+		Containers: []corev1API.Container{
+			{Name: "app", SecurityContext: &corev1API.SecurityContext{RunAsUser: id(1000620001)}},
+			// set on purpose, outside of the range of the namespace
+			{Name: "root", SecurityContext: &corev1API.SecurityContext{RunAsUser: id(0)}},
+			{Name: "plain"},
+		},
+	}
+
+	removed, err := resetSecurity(annotations, &spec)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"metadata.annotations[openshift.io/scc]",
+		"metadata.annotations[seccomp.security.alpha.kubernetes.io/pod]",
+		"spec.securityContext.runAsUser=1000620001",
+		"spec.securityContext.fsGroup=5000",
+		"spec.initContainers[init].securityContext.runAsUser=1000629999",
+		"spec.containers[app].securityContext.runAsUser=1000620001",
+	}, removed)
+	assert.Equal(t, map[string]string{
+		"openshift.io/backup-uid-range":           "1000620000/10000",
+		"openshift.io/backup-supplemental-groups": "5000/100",
+		"app.kubernetes.io/name":                  "app",
+	}, annotations)
+	assert.Equal(t, &corev1API.PodSecurityContext{}, spec.SecurityContext)
+	assert.Nil(t, spec.InitContainers[0].SecurityContext.RunAsUser)
+	assert.Nil(t, spec.Containers[0].SecurityContext.RunAsUser)
+	assert.Equal(t, id(0), spec.Containers[1].SecurityContext.RunAsUser)
+}
+
+func TestResetSecurityWithoutRanges(t *testing.T) {
+	uid := int64(1000620001)
+	annotations := map[string]string{"container.seccomp.security.alpha.kubernetes.io/app": "runtime/default"}
+	spec := corev1API.PodSpec{SecurityContext: &corev1API.PodSecurityContext{RunAsUser: &uid, FSGroup: &uid}}
+
+	removed, err := resetSecurity(annotations, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metadata.annotations[container.seccomp.security.alpha.kubernetes.io/app]"}, removed)
+	// IDs are only reset knowing the ranges of the namespace
+	assert.Equal(t, &uid, spec.SecurityContext.RunAsUser)
+	assert.Equal(t, &uid, spec.SecurityContext.FSGroup)
+}
@@ -4,12 +4,25 @@ import (
 	"encoding/json"
 
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	appsv1API "github.com/openshift/api/apps/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	corev1API "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
+// deployerAnnotations are set by the deployer pod of a DeploymentConfig
+// deployment, and removed from the standalone ReplicationControllers restored
+var deployerAnnotations = []string{
+	appsv1API.DeploymentPodAnnotation,
+	appsv1API.DeploymentStatusAnnotation,
+	appsv1API.DeploymentStatusReasonAnnotation,
+	appsv1API.DeploymentCancelledAnnotation,
+	appsv1API.DeployerPodCreatedAtAnnotation,
+	appsv1API.DeployerPodStartedAtAnnotation,
+	appsv1API.DeployerPodCompletedAtAnnotation,
+}
+
 // RestorePlugin is a restore item action plugin for Velero
 type RestorePlugin struct {
 	Log logrus.FieldLogger
@@ -35,8 +48,9 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(replicationController.Spec.Template.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(replicationController.Spec.Template.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
+	if replicationController.Spec.Template != nil {
+		replicationController.Annotations = common.SwapRestoredImages(&replicationController.Spec.Template.Spec, replicationController.Annotations, input.Restore, backupRegistry, registry, p.Log)
+	}
 
 	ownerRefs, err := common.GetOwnerReferences(input.ItemFromBackup)
 	if err != nil {
@@ -50,6 +64,15 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
 		}
 	}
+	// Deployments of a DeploymentConfig whose owner reference was removed still name it
+	if deploymentConfig := replicationController.Annotations[appsv1API.DeploymentConfigAnnotation]; len(deploymentConfig) > 0 {
+		p.Log.Infof("[replicationcontroller-restore] skipping restore of ReplicationController %s, deployment of DeploymentConfig %s",
+			replicationController.Name, deploymentConfig)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+	for _, annotation := range deployerAnnotations {
+		delete(replicationController.Annotations, annotation)
+	}
 
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(replicationController)
@@ -0,0 +1,74 @@
+package replicationcontroller
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	appsv1API "github.com/openshift/api/apps/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	corev1API "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRestorePluginAppliesTo(t *testing.T) {
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	actual, err := restorePlugin.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"replicationcontrollers"}}, actual)
+}
+
+func TestRestorePluginSkipsDeploymentConfigDeployments(t *testing.T) {
+	owned := corev1API.ReplicationController{ObjectMeta: metav1.ObjectMeta{
+		Name:            "app-1",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps.openshift.io/v1", Kind: "DeploymentConfig", Name: "app"}},
+	}}
+	annotated := corev1API.ReplicationController{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app-2",
+		Annotations: map[string]string{appsv1API.DeploymentConfigAnnotation: "app"},
+	}}
+	for _, replicationController := range []corev1API.ReplicationController{owned, annotated} {
+		item := replicationControllerItem(t, replicationController)
+		restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+		output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+		require.NoError(t, err)
+		assert.True(t, output.SkipRestore, replicationController.Name)
+	}
+}
+
+func TestRestorePluginRemovesDeployerAnnotations(t *testing.T) {
+	item := replicationControllerItem(t, corev1API.ReplicationController{ObjectMeta: metav1.ObjectMeta{
+		Name: "standalone",
+		Annotations: map[string]string{
+			appsv1API.DeploymentPodAnnotation:    "standalone-deploy",
+			appsv1API.DeploymentStatusAnnotation: "Complete",
+			"example.com/owner":                  "team",
+		},
+	}})
+
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item, Restore: &v1.Restore{}})
+	require.NoError(t, err)
+	require.False(t, output.SkipRestore)
+
+	restored := corev1API.ReplicationController{}
+	data, err := json.Marshal(output.UpdatedItem)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, map[string]string{"example.com/owner": "team"}, restored.Annotations)
+}
+
+// replicationControllerItem returns replicationController as an item to restore
+func replicationControllerItem(t *testing.T, replicationController corev1API.ReplicationController) *unstructured.Unstructured {
+	replicationController.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ReplicationController"}
+	replicationController.Spec.Template = &corev1API.PodTemplateSpec{}
+	data, err := json.Marshal(replicationController)
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{}
+	require.NoError(t, item.UnmarshalJSON(data))
+	return item
+}
@@ -0,0 +1,97 @@
+package route
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	routev1API "github.com/openshift/api/route/v1"
+	"github.com/sirupsen/logrus"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// BackupPlugin is a backup item action plugin for Velero
+type BackupPlugin struct {
+	Log logrus.FieldLogger
+	// the default routing subdomain of the cluster looked up for each backup,
+	// by backup name
+	Subdomains map[string]string
+}
+
+// AppliesTo returns a velero.ResourceSelector that applies to routes
+func (p *BackupPlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"routes"},
+	}, nil
+}
+
+// Execute records the default routing subdomain of the cluster on the route,
+// so the restore plugin recognizes hosts generated in it
+func (p *BackupPlugin) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	p.Log.Info("[route-backup] Entering Route backup plugin")
+	route := routev1API.Route{}
+	itemMarshal, _ := json.Marshal(item)
+	json.Unmarshal(itemMarshal, &route)
+
+	subdomain := p.routingSubdomain(backup)
+	if len(subdomain) == 0 {
+		subdomain = generatedHostSubdomain(route)
+	}
+	if len(subdomain) == 0 {
+		p.Log.Infof("[route-backup] default routing subdomain of route %s not known", route.Name)
+		return item, nil, nil
+	}
+	p.Log.Infof("[route-backup] default routing subdomain of route %s is %s", route.Name, subdomain)
+	if route.Annotations == nil {
+		route.Annotations = make(map[string]string)
+	}
+	route.Annotations[common.BackupRoutingSubdomainAnnotation] = subdomain
+
+	var out map[string]interface{}
+	objrec, _ := json.Marshal(route)
+	json.Unmarshal(objrec, &out)
+	item.SetUnstructuredContent(out)
+	return item, nil, nil
+}
+
+// routingSubdomain returns the default routing subdomain of the cluster for
+// backup: the one of its annotation, or else the one looked up once per backup.
+// Lookup errors, e.g. without access to the openshift-apiserver config, are
+// logged and "" returned, so routes fall back to their generated host.
+func (p *BackupPlugin) routingSubdomain(backup *v1.Backup) string {
+	if subdomain := backup.Annotations[common.RoutingSubdomainAnnotation]; len(subdomain) > 0 {
+		return subdomain
+	}
+	if subdomain, found := p.Subdomains[backup.Name]; found {
+		return subdomain
+	}
+	subdomain, err := lookupRoutingSubdomain()
+	if err != nil {
+		p.Log.Warnf("[route-backup] error looking up the default routing subdomain, using the generated hosts of routes: %v", err)
+	}
+	if p.Subdomains != nil {
+		p.Subdomains[backup.Name] = subdomain
+	}
+	return subdomain
+}
+
+// lookupRoutingSubdomain returns the default routing subdomain of the cluster
+func lookupRoutingSubdomain() (string, error) {
+	major, minor, err := common.GetServerVersion()
+	if err != nil {
+		return "", err
+	}
+	return common.GetRoutingSubdomain(major, minor)
+}
+
+// generatedHostSubdomain returns the subdomain of the host generated for
+// route, named <name>-<namespace>.<subdomain>, or "" if it wasn't generated
+func generatedHostSubdomain(route routev1API.Route) string {
+	prefix := route.Name + "-" + route.Namespace + "."
+	if route.Annotations[hostGeneratedAnnotation] != "true" || !strings.HasPrefix(route.Spec.Host, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(route.Spec.Host, prefix)
+}
@@ -0,0 +1,62 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
+	routev1API "github.com/openshift/api/route/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestGeneratedHostSubdomain(t *testing.T) {
+	route := routev1API.Route{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "myns", Annotations: map[string]string{hostGeneratedAnnotation: "true"}},
+		Spec:       routev1API.RouteSpec{Host: "app-myns.apps.old-cluster.example.com"},
+	}
+	assert.Equal(t, "apps.old-cluster.example.com", generatedHostSubdomain(route))
+
+	route.Spec.Host = "www.example.com"
+	assert.Equal(t, "", generatedHostSubdomain(route))
+
+	route.Spec.Host = "app-myns.apps.old-cluster.example.com"
+	delete(route.Annotations, hostGeneratedAnnotation)
+	assert.Equal(t, "", generatedHostSubdomain(route))
+}
+
+func TestRoutingSubdomain(t *testing.T) {
+	backupPlugin := &BackupPlugin{Log: test.NewLogger(), Subdomains: map[string]string{"nightly": "apps.cached.example.com"}}
+	assert.Equal(t, "apps.cached.example.com", backupPlugin.routingSubdomain(&v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly"}}))
+	assert.Equal(t, "apps.annotated.example.com", backupPlugin.routingSubdomain(&v1.Backup{ObjectMeta: metav1.ObjectMeta{
+		Name:        "nightly",
+		Annotations: map[string]string{common.RoutingSubdomainAnnotation: "apps.annotated.example.com"},
+	}}))
+}
+
+func TestBackupPluginFallsBackToGeneratedHost(t *testing.T) {
+	route := routev1API.Route{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "route.openshift.io/v1", Kind: "Route"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "myns", Annotations: map[string]string{hostGeneratedAnnotation: "true"}},
+		Spec:       routev1API.RouteSpec{Host: "app-myns.apps.old-cluster.example.com"},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&route)
+	require.NoError(t, err)
+
+	// the subdomain can't be looked up without a cluster
+	backupPlugin := &BackupPlugin{Log: test.NewLogger(), Subdomains: make(map[string]string)}
+	backup := &v1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly"}}
+	output, _, err := backupPlugin.Execute(&unstructured.Unstructured{Object: content}, backup)
+	require.NoError(t, err)
+	annotations, _, err := unstructured.NestedStringMap(output.UnstructuredContent(), "metadata", "annotations")
+	require.NoError(t, err)
+	assert.Equal(t, "apps.old-cluster.example.com", annotations[common.BackupRoutingSubdomainAnnotation])
+	// the failed lookup isn't repeated for the other routes of the backup
+	subdomain, cached := backupPlugin.Subdomains["nightly"]
+	assert.True(t, cached)
+	assert.Equal(t, "", subdomain)
+}
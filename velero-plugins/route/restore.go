@@ -2,7 +2,9 @@ package route
 
 import (
 	"encoding/json"
+	"strings"
 
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	routev1API "github.com/openshift/api/route/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
@@ -21,16 +23,20 @@ func (p *RestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
 	}, nil
 }
 
-// Execute fixes the route path on restore to use the target cluster's domain name
+// Execute removes the host of routes in the default routing subdomain of the
+// backup cluster on restore, so the target cluster generates one in its domain
 func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
 	p.Log.Info("[route-restore] Entering Route restore plugin")
 	route := routev1API.Route{}
 	itemMarshal, _ := json.Marshal(input.Item)
 	json.Unmarshal(itemMarshal, &route)
 
-	hostGenerated := route.Annotations["openshift.io/host.generated"]
-	if hostGenerated == "true" {
-		p.Log.Info("[route-restore] Stripping src cluster host from Route")
+	if input.Restore.Annotations[common.PreserveRouteHostsAnnotation] == "true" {
+		p.Log.Info("[route-restore] Restore has the preserve-route-hosts annotation so leaving host as-is")
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if defaultHost(route) {
+		p.Log.Infof("[route-restore] Stripping src cluster host %s from Route", route.Spec.Host)
 		route.Spec.Host = ""
 
 		var out map[string]interface{}
@@ -43,3 +49,17 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 
 	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
 }
+
+// hostGeneratedAnnotation is set to "true" on routes whose host the router generated
+const hostGeneratedAnnotation = "openshift.io/host.generated"
+
+// defaultHost returns whether the host of route was generated on the backup
+// cluster or is in its default routing subdomain, and only routes there.
+// Hosts of other domains, e.g. vanity domains, are kept.
+func defaultHost(route routev1API.Route) bool {
+	if route.Annotations[hostGeneratedAnnotation] == "true" {
+		return true
+	}
+	subdomain := route.Annotations[common.BackupRoutingSubdomainAnnotation]
+	return len(subdomain) > 0 && strings.HasSuffix(route.Spec.Host, "."+subdomain)
+}
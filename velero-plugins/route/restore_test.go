@@ -3,10 +3,14 @@ package route
 import (
 	"testing"
 
+	"github.com/konveyor/openshift-velero-plugin/velero-plugins/common"
 	"github.com/konveyor/openshift-velero-plugin/velero-plugins/util/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 func TestRestorePluginAppliesTo(t *testing.T) {
@@ -15,3 +19,58 @@ func TestRestorePluginAppliesTo(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, velero.ResourceSelector{IncludedResources: []string{"routes"}}, actual)
 }
+
+func TestRestorePluginExecute(t *testing.T) {
+	route := func(host string, annotations map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "route.openshift.io/v1",
+			"kind":       "Route",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "myns", "annotations": annotations},
+			"spec":       map[string]interface{}{"host": host},
+		}}
+	}
+	subdomain := map[string]interface{}{common.BackupRoutingSubdomainAnnotation: "apps.old-cluster.example.com"}
+	tests := []struct {
+		name     string
+		item     *unstructured.Unstructured
+		restore  *v1.Restore
+		expected string
+	}{
+		{
+			name:     "generated host",
+			item:     route("app-myns.apps.old-cluster.example.com", map[string]interface{}{hostGeneratedAnnotation: "true"}),
+			restore:  &v1.Restore{},
+			expected: "",
+		},
+		{
+			name:     "host in the default subdomain",
+			item:     route("shop.apps.old-cluster.example.com", subdomain),
+			restore:  &v1.Restore{},
+			expected: "",
+		},
+		{
+			name:     "vanity host",
+			item:     route("www.example.com", subdomain),
+			restore:  &v1.Restore{},
+			expected: "www.example.com",
+		},
+		{
+			name: "preserved host",
+			item: route("shop.apps.old-cluster.example.com", subdomain),
+			restore: &v1.Restore{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{common.PreserveRouteHostsAnnotation: "true"},
+			}},
+			expected: "shop.apps.old-cluster.example.com",
+		},
+	}
+	restorePlugin := &RestorePlugin{Log: test.NewLogger()}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := restorePlugin.Execute(&velero.RestoreItemActionExecuteInput{Item: test.item, ItemFromBackup: test.item, Restore: test.restore})
+			require.NoError(t, err)
+			host, _, err := unstructured.NestedString(output.UpdatedItem.UnstructuredContent(), "spec", "host")
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, host)
+		})
+	}
+}
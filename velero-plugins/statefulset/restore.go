@@ -31,12 +31,20 @@ func (p *RestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*v
 	json.Unmarshal(itemMarshal, &statefulSet)
 	p.Log.Infof("[statefulset-restore] statefulset: %s", statefulSet.Name)
 
-	backupRegistry, registry, err := common.GetSrcAndDestRegistryInfo(input.Item)
+	backupRegistry, registry, err := common.GetRestoreRegistryInfo(input.Item, p.Log)
 	if err != nil {
 		return nil, err
 	}
-	common.SwapContainerImageRefs(statefulSet.Spec.Template.Spec.Containers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
-	common.SwapContainerImageRefs(statefulSet.Spec.Template.Spec.InitContainers, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping)
+	statefulSet.Annotations = common.SwapRestoredImages(&statefulSet.Spec.Template.Spec, statefulSet.Annotations, input.Restore, backupRegistry, registry, p.Log)
+	if err := common.SwapImageTriggerRefs(statefulSet.Annotations, backupRegistry, registry, p.Log, input.Restore.Spec.NamespaceMapping); err != nil {
+		p.Log.Error("[statefulset-restore] error swapping image trigger refs: ", err)
+		return nil, err
+	}
+
+	if err := common.UpdatePriorityClassName(&statefulSet.Spec.Template.Spec, input.Restore, p.Log); err != nil {
+		p.Log.Error("[statefulset-restore] error updating priority class: ", err)
+		return nil, err
+	}
 
 	var out map[string]interface{}
 	objrec, _ := json.Marshal(statefulSet)